@@ -0,0 +1,138 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/dist/servergroup"
+	"github.com/dv343/treeless/hlc"
+)
+
+/*
+	Server-side atomic operations
+
+	Incr, Append, SetIfAbsent and SetIfTimestamp are executed by one of the chunk holders (the key master)
+	under the chunk lock, the master replicates the result to the other holders and waits until one of
+	them stores it before responding. If no holder acknowledges the result the operation returns an error,
+	but the key master keeps the result: as with timeouts, the operation may be applied anyway.
+	The key master is the holder with the highest hash(key+address) rank, every client with the same
+	server group view will choose the same master.
+
+	These operations are atomic with each other as long as clients agree on the key master,
+	using them concurrently with Set or CAS is a race condition.
+*/
+
+//SetIfAbsent sets a key-value pair only if the pair doesn't exist, it can be used for idempotent inserts
+//written is set to true if the pair was written, errs will explain why it wasn't
+func (c *DBClient) SetIfAbsent(key, value []byte) (written bool, errs error) {
+	key = c.qualify(key)
+	valueWithTime := make([]byte, 8+len(value))
+	binary.LittleEndian.PutUint64(valueWithTime, hlc.Now())
+	copy(valueWithTime[8:], value)
+	return c.setOnMaster(key, func(s *servergroup.VirtualServer) (com.SetOperation, error) {
+		return s.SetIfAbsent(key, valueWithTime, c.SetTimeout)
+	})
+}
+
+//SetIfTimestamp sets a key-value pair only if its last modification time matches timestamp (as returned by Get)
+//A zero Unix timestamp (time.Unix(0, 0)) or the zero time.Time matches a non-existent pair
+//written is set to true if the pair was written, errs will explain why it wasn't
+func (c *DBClient) SetIfTimestamp(key, value []byte, timestamp time.Time) (written bool, errs error) {
+	var expected uint64
+	if !timestamp.IsZero() {
+		if timestamp.Before(time.Unix(0, 0)) || timestamp.After(time.Unix(0, math.MaxInt64)) {
+			return false, errors.New("SetIfTimestamp failed: timestamp out of range")
+		}
+		expected = uint64(timestamp.UnixNano())
+	}
+	key = c.qualify(key)
+	msg := make([]byte, 16+len(value))
+	binary.LittleEndian.PutUint64(msg, expected)
+	//The new timestamp should be newer than the expected one, the clock isn't updated with the
+	//caller value: a wrong timestamp would move it forward
+	t := hlc.Now()
+	if t <= expected {
+		t = expected + 1
+	}
+	binary.LittleEndian.PutUint64(msg[8:], t)
+	copy(msg[16:], value)
+	return c.setOnMaster(key, func(s *servergroup.VirtualServer) (com.SetOperation, error) {
+		return s.SetIfTimestamp(key, msg, c.SetTimeout)
+	})
+}
+
+//setOnMaster sends a conditional set to the key master, or to the next holder if the master is unreachable
+func (c *DBClient) setOnMaster(key []byte, send func(s *servergroup.VirtualServer) (com.SetOperation, error)) (written bool, errs error) {
+	for _, s := range c.keyMasters(key) {
+		op, err := send(s)
+		if err != nil {
+			//The request wasn't sent, try the next one
+			errs = err
+			continue
+		}
+		err = op.Wait()
+		return err == nil, err
+	}
+	if errs == nil {
+		errs = errors.New("No servers")
+	}
+	return false, errs
+}
+
+//Incr adds delta to the value of the pair and returns the new value
+//The value is stored as an int64 (8 bytes, little endian), a non-existent pair is considered 0
+//If the request times out the increment may be applied anyway
+func (c *DBClient) Incr(key []byte, delta int64) (value int64, errs error) {
+	key = c.qualify(key)
+	for _, s := range c.keyMasters(key) {
+		op, err := s.Incr(key, delta, c.SetTimeout)
+		if err != nil {
+			//The request wasn't sent, try the next one
+			errs = err
+			continue
+		}
+		r := op.Wait()
+		if r.Err != nil {
+			return 0, r.Err
+		}
+		if len(r.Value) != 8 {
+			return 0, errors.New("Invalid Incr response")
+		}
+		return int64(binary.LittleEndian.Uint64(r.Value)), nil
+	}
+	if errs == nil {
+		errs = errors.New("No servers")
+	}
+	return 0, errs
+}
+
+//Append appends data to the value of the pair, a non-existent pair is considered empty
+//If the request times out (errs != nil and written == false) data may be appended anyway
+func (c *DBClient) Append(key, data []byte) (written bool, errs error) {
+	key = c.qualify(key)
+	for _, s := range c.keyMasters(key) {
+		op, err := s.Append(key, data, c.SetTimeout)
+		if err != nil {
+			//The request wasn't sent, try the next one
+			errs = err
+			continue
+		}
+		err = op.Wait()
+		return err == nil, err
+	}
+	if errs == nil {
+		errs = errors.New("No servers")
+	}
+	return false, errs
+}
+
+//keyMasters returns the chunk holders of key sorted by their master rank, highest first
+//key should be qualified
+func (c *DBClient) keyMasters(key []byte) []*servergroup.VirtualServer {
+	if _, err := c.chunkID(key); err != nil {
+		return nil
+	}
+	return c.sg.KeyMasters(key)
+}
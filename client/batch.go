@@ -0,0 +1,101 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/hlc"
+)
+
+/*
+	Atomic batches
+
+	A batch groups set and delete operations that are applied atomically by each chunk holder,
+	every key of a batch should belong to the same chunk.
+	Keys with the same hash tag belong to the same chunk in keyspaces with hash tags enabled
+	(see protocol.Keyspace.HashTags and hashing.ColocatedKey).
+*/
+
+//Batch is a list of set and delete operations, the zero value is an empty batch
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	del        bool
+	key, value []byte
+}
+
+//Set adds a set operation to the batch
+func (b *Batch) Set(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+//Del adds a delete operation to the batch
+func (b *Batch) Del(key []byte) {
+	b.ops = append(b.ops, batchOp{del: true, key: key})
+}
+
+//Len returns the number of operations of the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+//WriteBatch applies all the operations of the batch atomically, in order
+//written is set to true if at least one server respond without errors
+func (c *DBClient) WriteBatch(b *Batch) (written bool, errs error) {
+	if len(b.ops) == 0 {
+		return false, errors.New("Empty batch")
+	}
+	chunkID, err := c.chunkID(c.qualify(b.ops[0].key))
+	if err != nil {
+		return false, err
+	}
+	batch := make(protocol.Batch, len(b.ops))
+	for i, op := range b.ops {
+		key := c.qualify(op.key)
+		if id, _ := c.chunkID(key); id != chunkID {
+			return false, errors.New("Batch keys belong to different chunks, use a keyspace with hash tags to colocate them")
+		}
+		//Timestamps are increasing, later operations on the same key win
+		value := make([]byte, 8+len(op.value))
+		binary.LittleEndian.PutUint64(value, hlc.Now())
+		copy(value[8:], op.value)
+		batch[i].Key = key
+		if op.del {
+			batch[i].Type = protocol.OpDel
+			batch[i].Value = value[:8]
+		} else {
+			batch[i].Type = protocol.OpSet
+			batch[i].Value = value
+		}
+	}
+	msg := batch.Marshal()
+	servers := c.sg.GetChunkHolders(chunkID)
+	var charray [8]com.SetOperation
+	var chvalidarray [8]bool
+	for i, s := range servers {
+		if s == nil {
+			continue
+		}
+		c, err := s.Batch(msg, c.SetTimeout)
+		if err != nil {
+			errs = err //TODO return all errors
+		} else {
+			charray[i] = c
+			chvalidarray[i] = true
+		}
+	}
+	for i := range servers {
+		if chvalidarray[i] {
+			err := charray[i].Wait()
+			if err != nil {
+				errs = err //TODO return all errors
+			} else {
+				written = true
+			}
+		}
+	}
+	return written, errs
+}
@@ -1,13 +1,18 @@
 package client
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"math/rand"
 	"time"
 	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/protocol"
 	"github.com/dv343/treeless/dist/heartbeat"
 	"github.com/dv343/treeless/dist/servergroup"
 	"github.com/dv343/treeless/hashing"
+	"github.com/dv343/treeless/hlc"
+	"github.com/dv343/treeless/vclock"
 )
 
 const defaultGetTimeout = time.Millisecond * 500
@@ -23,30 +28,67 @@ type DBClient struct {
 	SetTimeout time.Duration
 	DelTimeout time.Duration
 	CASTimeout time.Duration
+	actor      uint64 //Version vector actor ID, used by SetWithContext
+	keyspace   string //Keyspace name, "" is the default keyspace, see Keyspace
 }
 
 //Connect creates a new DBClient and connects it to a Treeless server group by using addr as the entry point
+//addr can be a Unix domain socket address (unix:///path) of a server running on the same host (see com.SetUnixSocket),
+//the client will use the socket to reach that server and it will prefer it for the chunks it holds,
+//other servers are reached over TCP
 func Connect(addr string) (*DBClient, error) {
+	return ConnectWithToken(addr, "")
+}
+
+//ConnectWithToken is like Connect, but the connections of the client are authenticated with token
+//instead of the token set by com.SetToken, "" uses the com.SetToken token
+func ConnectWithToken(addr string, token string) (*DBClient, error) {
+	return ConnectWithConfig(addr, token, nil)
+}
+
+//ConnectWithConfig is like ConnectWithToken, but the client heartbeater uses hbConfig, nil uses heartbeat.DefaultConfig()
+func ConnectWithConfig(addr string, token string, hbConfig *heartbeat.Config) (*DBClient, error) {
 	c := new(DBClient)
-	sg, err := servergroup.Assoc(addr, "")
+	sg, err := servergroup.AssocWithToken(addr, "", token)
 	if err != nil {
 		return nil, err
 	}
+	if com.IsUnixAddr(addr) {
+		if sg.Origin() == "" {
+			return nil, errors.New("The server didn't send its address, it doesn't support Unix domain socket clients")
+		}
+		if err := sg.SetLocalServer(sg.Origin(), addr); err != nil {
+			return nil, err
+		}
+	}
 	c.sg = sg
-	c.hb = heartbeat.Start(sg)
+	c.hb = heartbeat.Start(sg, hbConfig)
 	c.GetTimeout = defaultGetTimeout
 	c.SetTimeout = defaultSetTimeout
 	c.DelTimeout = defaultDelTimeout
 	c.CASTimeout = defaultCASTimeout
+	c.actor = uint64(rand.Int63())
 	return c, nil
 }
 
 //Get return the value associated to a given key
 //lastTime is the last modification time of the pair
 //read will be true if at least one server respond
+//If the pair has siblings (see GetSiblings) the newest one is returned
 func (c *DBClient) Get(key []byte) (value []byte, lastTime time.Time, read bool) {
+	value, lastTime, _, read = c.GetWithServerTime(key)
+	return value, lastTime, read
+}
+
+//GetWithServerTime is Get, it also returns the lowest clock of the servers that responded
+//Conditions based on the pair timestamp (like TTLs) should be checked with serverTime instead of the local clock
+func (c *DBClient) GetWithServerTime(key []byte) (value []byte, lastTime, serverTime time.Time, read bool) {
 	//Last write wins policy
-	chunkID := hashing.GetChunkID(key, c.sg.NumChunks())
+	key = c.qualify(key)
+	chunkID, err := c.chunkID(key)
+	if err != nil {
+		return nil, lastTime, serverTime, false
+	}
 	servers := c.sg.GetChunkHolders(chunkID)
 	var charray [8]com.GetOperation
 	var chvalidarray [8]bool
@@ -69,10 +111,13 @@ func (c *DBClient) Get(key []byte) (value []byte, lastTime time.Time, read bool)
 		if r.Err != nil {
 			continue
 		}
+		if t := hlc.Time(r.Time); r.Time != 0 && (serverTime.IsZero() || t.Before(serverTime)) {
+			serverTime = t
+		}
 		v := r.Value
 		read = true
 		if len(v) >= 8 {
-			t := time.Unix(0, int64(binary.LittleEndian.Uint64(v[:8])))
+			t := hlc.Time(vclock.Timestamp(v))
 			times[i] = t
 			if lastTime.Before(t) {
 				lastTime = t
@@ -81,7 +126,7 @@ func (c *DBClient) Get(key []byte) (value []byte, lastTime time.Time, read bool)
 		}
 	}
 	if value == nil {
-		return nil, lastTime, read
+		return nil, lastTime, serverTime, read
 	}
 	//Read-repair
 	for i, s := range servers {
@@ -91,7 +136,15 @@ func (c *DBClient) Get(key []byte) (value []byte, lastTime time.Time, read bool)
 			s.Set(key, value, 0)
 		}
 	}
-	return value[8:], lastTime, read
+	if vclock.IsMultiValue(value) {
+		siblings, err := vclock.Unmarshal(value)
+		if err != nil || len(siblings) == 0 {
+			return nil, lastTime, serverTime, read
+		}
+		//Siblings are sorted by timestamp
+		return siblings[len(siblings)-1].Value, lastTime, serverTime, read
+	}
+	return value[8:], lastTime, serverTime, read
 }
 
 //Set sets a key-value pair by creating a new one or by overwriting a previous value
@@ -108,12 +161,30 @@ func (c *DBClient) AsyncSet(key, value []byte) (errs error) {
 	return errs
 }
 
+//SetWithTime is Set, it also returns the timestamp of the written pair (as returned by Get)
+func (c *DBClient) SetWithTime(key, value []byte) (lastTime time.Time, written bool, errs error) {
+	valueWithTime := make([]byte, 8+len(value))
+	t := hlc.Now()
+	binary.LittleEndian.PutUint64(valueWithTime, t)
+	copy(valueWithTime[8:], value)
+	written, errs = c.setRecord(c.qualify(key), valueWithTime, c.SetTimeout)
+	return hlc.Time(t), written, errs
+}
+
 func (c *DBClient) set(key, value []byte, timeout time.Duration) (written bool, errs error) {
-	chunkID := hashing.GetChunkID(key, c.sg.NumChunks())
-	servers := c.sg.GetChunkHolders(chunkID)
 	valueWithTime := make([]byte, 8+len(value))
-	binary.LittleEndian.PutUint64(valueWithTime, uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint64(valueWithTime, hlc.Now())
 	copy(valueWithTime[8:], value)
+	return c.setRecord(c.qualify(key), valueWithTime, timeout)
+}
+
+//setRecord sends a record (value with timestamp header) to every chunk holder, key should be qualified
+func (c *DBClient) setRecord(key, valueWithTime []byte, timeout time.Duration) (written bool, errs error) {
+	chunkID, err := c.chunkID(key)
+	if err != nil {
+		return false, err
+	}
+	servers := c.sg.GetChunkHolders(chunkID)
 	var charray [8]com.SetOperation
 	var chvalidarray [8]bool
 	for i, s := range servers {
@@ -144,74 +215,313 @@ func (c *DBClient) set(key, value []byte, timeout time.Duration) (written bool,
 }
 
 //CAS (Compare And Swap) modifies the value of a pair if the provided timestamp and old value match the stored value
-//This is an atomic operation, but it doesn't tolerate network partitions (permanent node failures are ok)
-//It can be used with Get to achieve synchronization when there are no network partitions
-//Using it concurrently with Set is a race condition
+//CAS is linearizable, it runs a single-decree Paxos instance across the chunk holders, so it tolerates
+//network partitions and node failures as long as a majority of the holders is reachable
+//CAS operations are only linearizable with other CAS operations, using it concurrently with Set is a race condition
+//If the chosen value is committed by a majority, written will be true even if some commits fail (errs != nil)
+//If it is chosen but committed by less than a majority, CAS returns an unknown result error, see core/paxos.go
+//CAS retries conflicting Paxos rounds until CASTimeout expires, if it expires after proposing the value
+//written will be false but the value may be written anyway
+//If a chunk holder doesn't support Paxos (older servers) CAS falls back to masterCAS, which isn't linearizable
 func (c *DBClient) CAS(key, value []byte, timestamp time.Time, oldValue []byte) (written bool, errs error) {
-	chunkID := hashing.GetChunkID(key, c.sg.NumChunks())
+	_, written, errs = c.CASWithTime(key, value, timestamp, oldValue)
+	return written, errs
+}
+
+//CASWithTime is CAS, it also returns the timestamp of the written pair (as returned by Get)
+func (c *DBClient) CASWithTime(key, value []byte, timestamp time.Time, oldValue []byte) (lastTime time.Time, written bool, errs error) {
+	ks, err := c.settings()
+	if err != nil {
+		return lastTime, false, err
+	}
+	key = c.qualify(key)
+	chunkID, err := c.chunkID(key)
+	if err != nil {
+		return lastTime, false, err
+	}
 	servers := c.sg.GetChunkHolders(chunkID)
+	n := 0
+	for _, s := range servers {
+		if s != nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return lastTime, false, errors.New("No servers")
+	}
+	if !paxosHolders(servers) {
+		return c.masterCAS(key, value, timestamp, oldValue, servers)
+	}
+	//The quorum is based on the target redundancy, holders declared dead still count
+	if r := ks.Redundancy; r > n {
+		n = r
+	}
+	quorum := n/2 + 1
+	//valueWithTime is our proposal, once proposed it may be chosen even if it isn't accepted by a majority
+	//on the first try, following rounds check if it was chosen
+	var valueWithTime []byte
+	deadline := time.Now().Add(c.CASTimeout)
+	for attempt := 0; attempt == 0 || time.Now().Before(deadline); attempt++ {
+		if attempt > 0 {
+			//Randomized exponential backoff, avoids dueling proposers
+			shift := uint(attempt)
+			if shift > maxPaxosBackoffShift {
+				shift = maxPaxosBackoffShift
+			}
+			time.Sleep(time.Duration(rand.Int63n(int64(paxosBackoff) << shift)))
+		}
+		ballot := protocol.Ballot{Time: hlc.Now(), Proposer: c.actor}
+		promises, promisers, rejected, chosen := c.paxosPrepare(key, ballot, valueWithTime, servers)
+		if chosen {
+			//Our proposal was chosen and committed by another proposer
+			return hlc.Time(vclock.Timestamp(valueWithTime)), true, nil
+		}
+		if len(promisers) < quorum {
+			if len(promisers)+rejected >= quorum {
+				//Contention, retry with a higher ballot
+				continue
+			}
+			break
+		}
+		var committed, accepted protocol.Ballot
+		var acceptedValue, current []byte
+		for _, p := range promises {
+			if committed.Less(p.Committed) {
+				committed = p.Committed
+			}
+			if accepted.Less(p.Accepted) {
+				accepted = p.Accepted
+				acceptedValue = p.AcceptedValue
+			}
+			if p.Value != nil && (current == nil || vclock.Timestamp(current) < vclock.Timestamp(p.Value)) {
+				current = p.Value
+			}
+		}
+		if valueWithTime != nil && bytes.Equal(current, valueWithTime) {
+			return hlc.Time(vclock.Timestamp(valueWithTime)), true, nil
+		}
+		if committed.Less(accepted) {
+			//Finish the in progress proposal, it may be ours
+			if c.paxosPropose(key, ballot, acceptedValue, promisers) >= quorum {
+				var committed int
+				committed, errs = c.paxosCommit(key, ballot, acceptedValue, servers)
+				if valueWithTime != nil && bytes.Equal(acceptedValue, valueWithTime) {
+					if committed < quorum {
+						break
+					}
+					return hlc.Time(vclock.Timestamp(valueWithTime)), true, errs
+				}
+			}
+			continue
+		}
+		//Test
+		if current == nil {
+			if timestamp.UnixNano() != 0 && len(oldValue) > 0 {
+				return lastTime, false, errors.New("CAS failed: empty pair: non-zero timestamp")
+			}
+		} else {
+			if vclock.Timestamp(current) != uint64(timestamp.UnixNano()) {
+				return lastTime, false, errors.New("CAS failed: timestamp mismatch")
+			}
+			if !bytes.Equal(current[8:], oldValue) {
+				return lastTime, false, errors.New("CAS failed: value mismatch")
+			}
+		}
+		if valueWithTime == nil {
+			//The new value timestamp should be newer than the current one
+			valueWithTime = make([]byte, 8+len(value))
+			if current != nil {
+				binary.LittleEndian.PutUint64(valueWithTime, hlc.Update(vclock.Timestamp(current)))
+			} else {
+				binary.LittleEndian.PutUint64(valueWithTime, hlc.Now())
+			}
+			copy(valueWithTime[8:], value)
+		}
+		//Propose and commit the new value
+		if c.paxosPropose(key, ballot, valueWithTime, promisers) >= quorum {
+			committed, errs := c.paxosCommit(key, ballot, valueWithTime, servers)
+			if committed < quorum {
+				//The value is chosen but it could be lost if the acceptors restart
+				break
+			}
+			return hlc.Time(vclock.Timestamp(valueWithTime)), true, errs
+		}
+	}
+	if valueWithTime != nil {
+		return lastTime, false, errors.New("CAS failed: unknown result, the proposal may be chosen later")
+	}
+	return lastTime, false, errors.New("CAS failed: not enough servers or too many concurrent proposals")
+}
+
+//paxosBackoff is the initial maximum backoff between Paxos rounds, it is doubled on each round
+//up to paxosBackoff<<maxPaxosBackoffShift
+const paxosBackoff = time.Millisecond
+const maxPaxosBackoffShift = 5
+
+//paxosHolders returns false if a reachable chunk holder doesn't support Paxos (protocol.FeaturePaxos)
+func paxosHolders(servers [8]*servergroup.VirtualServer) bool {
+	for _, s := range servers {
+		if s == nil {
+			continue
+		}
+		if ok, err := s.Supports(protocol.FeaturePaxos); err == nil && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//masterCAS runs a CAS with servers that don't support Paxos (OpCAS), the holder with the highest rank
+//runs the CAS, then the new value is set on the other holders
+//It isn't linearizable: it doesn't tolerate network partitions nor the failure of the master
+func (c *DBClient) masterCAS(key, value []byte, timestamp time.Time, oldValue []byte, servers [8]*servergroup.VirtualServer) (lastTime time.Time, written bool, errs error) {
 	valueWithTime := make([]byte, 24+len(value))
-	casTime := time.Now()
 	binary.LittleEndian.PutUint64(valueWithTime[0:8], uint64(timestamp.UnixNano()))
 	binary.LittleEndian.PutUint64(valueWithTime[8:16], hashing.FNV1a64(oldValue))
-	binary.LittleEndian.PutUint64(valueWithTime[16:24], uint64(casTime.UnixNano()))
+	binary.LittleEndian.PutUint64(valueWithTime[16:24], hlc.Now())
 	copy(valueWithTime[24:], value)
-	//Master CAS
-	var rank [8]uint64
-	for i, s := range servers {
-		//Calc rank as hash(key+serverIpPort)
-		if s != nil {
-			b := make([]byte, len(s.Phy)+len(key))
-			copy(b, key)
-			copy(b[len(key):], s.Phy)
-			rank[i] = hashing.FNV1a64(b)
-			//fmt.Println(s.Phy, rank[i], key)
+	//The master is the holder with the highest rank (see servergroup.KeyMasters)
+	master := -1
+	for _, m := range c.sg.KeyMasters(key) {
+		for i, s := range servers {
+			if s != nil && s.Phy == m.Phy {
+				master = i
+				break
+			}
 		}
-	}
-	master := 0
-	masterRank := uint64(0)
-	//Select master server
-	for i := range servers {
-		if rank[i] > masterRank {
-			master = i
-			masterRank = rank[i]
+		if master != -1 {
+			break
 		}
 	}
-	//Send CAS
-	if servers[master] == nil {
-		return false, errors.New("No servers")
+	if master == -1 {
+		return lastTime, false, errors.New("No servers")
 	}
-	//fmt.Println(servers[master].Phy)
 	op, err := servers[master].CAS(key, valueWithTime, c.CASTimeout)
 	if err != nil {
-		return false, err
+		return lastTime, false, err
 	}
-	//If CAS won=>set broadcast, else => fail
-	err = op.Wait()
-	if err != nil {
-		return false, err
+	if err := op.Wait(); err != nil {
+		return lastTime, false, err
 	}
-	//Slave SETs
 	for i, s := range servers {
 		if s == nil || i == master {
 			continue
 		}
-		_, err := s.Set(key, valueWithTime[16:], 0)
+		if _, err := s.Set(key, valueWithTime[16:], 0); err != nil {
+			errs = err
+		}
+	}
+	return hlc.Time(vclock.Timestamp(valueWithTime[16:])), true, errs
+}
+
+//paxosPrepare sends prepare requests and returns the promises, the servers that promised the ballot
+//and the number of servers that rejected it
+//If proposal is not nil, chosen will be true if any server reports that it was committed
+func (c *DBClient) paxosPrepare(key []byte, ballot protocol.Ballot, proposal []byte, servers [8]*servergroup.VirtualServer) (promises []*protocol.PaxosPromise, promisers []*servergroup.VirtualServer, rejected int, chosen bool) {
+	var ops [8]com.PaxosOperation
+	var valid [8]bool
+	msg := ballot.Marshal()
+	if proposal != nil {
+		h := make([]byte, 8)
+		binary.LittleEndian.PutUint64(h, hashing.FNV1a64(proposal))
+		msg = append(msg, h...)
+	}
+	for i, s := range servers {
+		if s == nil {
+			continue
+		}
+		op, err := s.Paxos(protocol.OpPaxosPrepare, key, msg, c.CASTimeout)
+		if err == nil {
+			ops[i] = op
+			valid[i] = true
+		}
+	}
+	for i, s := range servers {
+		if !valid[i] {
+			continue
+		}
+		r := ops[i].Wait()
+		if r.Err != nil {
+			continue
+		}
+		p, err := protocol.PaxosPromiseUnMarshal(r.Value)
 		if err != nil {
-			errs = err //TODO return only written
+			continue
+		}
+		chosen = chosen || p.Chosen
+		if !p.Promised {
+			//Make sure our next ballot will be higher
+			hlc.Update(p.Ballot.Time)
+			rejected++
+			continue
+		}
+		promises = append(promises, p)
+		promisers = append(promisers, s)
+	}
+	return promises, promisers, rejected, chosen
+}
+
+//paxosPropose sends propose requests and returns the number of acceptors that accepted the proposal
+func (c *DBClient) paxosPropose(key []byte, ballot protocol.Ballot, value []byte, servers []*servergroup.VirtualServer) (accepted int) {
+	ops := make([]com.PaxosOperation, len(servers))
+	valid := make([]bool, len(servers))
+	msg := append(ballot.Marshal(), value...)
+	for i, s := range servers {
+		op, err := s.Paxos(protocol.OpPaxosPropose, key, msg, c.CASTimeout)
+		if err == nil {
+			ops[i] = op
+			valid[i] = true
 		}
 	}
-	return true, errs
+	for i := range servers {
+		if valid[i] && ops[i].Wait().Err == nil {
+			accepted++
+		}
+	}
+	return accepted
+}
+
+//paxosCommit sends commit requests to every holder and returns the number of holders that stored the value
+func (c *DBClient) paxosCommit(key []byte, ballot protocol.Ballot, value []byte, servers [8]*servergroup.VirtualServer) (committed int, errs error) {
+	var ops [8]com.PaxosOperation
+	var valid [8]bool
+	msg := append(ballot.Marshal(), value...)
+	for i, s := range servers {
+		if s == nil {
+			continue
+		}
+		op, err := s.Paxos(protocol.OpPaxosCommit, key, msg, c.CASTimeout)
+		if err != nil {
+			errs = err
+		} else {
+			ops[i] = op
+			valid[i] = true
+		}
+	}
+	for i := range servers {
+		if valid[i] {
+			if err := ops[i].Wait().Err; err != nil {
+				errs = err //TODO return all errors
+			} else {
+				committed++
+			}
+		}
+	}
+	return committed, errs
 }
 
 //Del deletes a key-value pair from the DB
 //However, if there is a network partition the deleted pair can reappear after the network partition heals
 //Setting the value to nil is more safe, but that won't free all memory
 func (c *DBClient) Del(key []byte) (errs error) {
-	chunkID := hashing.GetChunkID(key, c.sg.NumChunks())
+	key = c.qualify(key)
+	chunkID, err := c.chunkID(key)
+	if err != nil {
+		return err
+	}
 	servers := c.sg.GetChunkHolders(chunkID)
 	t := make([]byte, 8)
-	binary.LittleEndian.PutUint64(t, uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint64(t, hlc.Now())
 	var charray [8]*com.DelOperation
 	for i, s := range servers {
 		if s == nil {
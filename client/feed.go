@@ -0,0 +1,325 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/dist/servergroup"
+	"github.com/dv343/treeless/vclock"
+)
+
+/*
+	Change data capture
+
+	Each chunk holder exposes a change feed of every chunk it holds (see protocol.ChangePage).
+	A Feed streams the feeds of every holder of every chunk of the keyspace, merges them and removes
+	the changes already reported by another holder:
+		A set is reported if its timestamp is newer than the last change reported for the key
+		A deletion is reported if the set it deletes is the last change reported for the key
+	Each feed is streamed by its own goroutine, servers hold its requests until new changes are written.
+	Changes of a key are reported in timestamp order, changes of different keys aren't ordered.
+	The filter remembers the last changes of up to feedFilterSize keys, changes of forgotten keys could be
+	reported again or out of order.
+	Delivery is at-least-once: a new Feed (even if it resumes from a position) reports again the changes
+	stored after the position, and defrags or new holders of a chunk replay their stored pairs.
+	A position that can't be resumed by its holder (see protocol.ErrInvalidCursor) stops the Feed with an error,
+	a holder that released its chunk copy is resumed at the beginning if it gets a new copy.
+*/
+
+const (
+	feedPageSize      = 256                    //Number of changes requested by each subscribe request
+	feedWait          = time.Second * 10       //Time the servers wait for new changes before responding an empty page
+	feedPollInterval  = time.Millisecond * 100 //Time to wait between requests to servers that don't wait for new changes
+	feedRetryInterval = time.Second            //Time between checks of the chunk holders, failed feeds are retried after it
+	feedBufferSize    = 1024                   //Number of changes fetched but not yet returned by Next
+	feedFilterSize    = 64 * 1024              //Number of keys remembered by a change filter (and by each of its sources)
+)
+
+//FeedSource identifies the change feed of a chunk on one of its holders
+type FeedSource struct {
+	ChunkID int
+	Server  string
+}
+
+//FeedPosition stores the position of each change feed, it can be used to resume a Feed
+type FeedPosition map[FeedSource]protocol.ScanCursor
+
+//Change is a modification of a pair
+type Change struct {
+	Key     []byte
+	Value   []byte    //New value, nil if the pair was deleted
+	Time    time.Time //Modification time of the pair, zero for deletions
+	Deleted bool
+}
+
+//Feed is an iterator over the changes of a keyspace, it isn't safe for concurrent use (except Close)
+type Feed struct {
+	c        *DBClient
+	changes  chan sourcedChange
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error //Error returned by Next after stop is closed
+	position FeedPosition
+	filter   *changeFilter
+	cursors  FeedPosition        //Cursor of the last page fetched from each feed
+	running  map[FeedSource]bool //Feeds being streamed
+	mutex    sync.Mutex          //Protects cursors and running
+}
+
+type sourcedChange struct {
+	source    FeedSource
+	next      protocol.ScanCursor
+	key       []byte
+	record    []byte
+	timestamp uint64
+}
+
+//changeFilter removes the changes already reported by another source (feed or watched server)
+type changeFilter struct {
+	keys     map[string]keyChange               //Last change reported for each key
+	lastSets map[interface{}]map[string]uint64 //Timestamp of the last set of each key on each source
+}
+
+type keyChange struct {
+	timestamp uint64
+	deleted   bool
+}
+
+func newChangeFilter() *changeFilter {
+	return &changeFilter{keys: make(map[string]keyChange), lastSets: make(map[interface{}]map[string]uint64)}
+}
+
+//Subscribe returns a Feed of the changes of the keyspace of c
+//from is the position to start at, nil starts at the beginning of each chunk feed
+func (c *DBClient) Subscribe(from FeedPosition) (*Feed, error) {
+	if _, err := c.settings(); err != nil {
+		return nil, err
+	}
+	f := new(Feed)
+	f.c = c
+	f.changes = make(chan sourcedChange, feedBufferSize)
+	f.stop = make(chan struct{})
+	f.position = make(FeedPosition)
+	f.filter = newChangeFilter()
+	f.cursors = make(FeedPosition)
+	f.running = make(map[FeedSource]bool)
+	for s, cursor := range from {
+		f.position[s] = cursor
+		f.cursors[s] = cursor
+	}
+	go f.run()
+	return f, nil
+}
+
+//Next returns the next change, it blocks until there is a new change or the Feed is stopped
+//It returns an error if the Feed was closed or if a feed position couldn't be resumed
+func (f *Feed) Next() (Change, error) {
+	for {
+		var sc sourcedChange
+		select {
+		case sc = <-f.changes:
+		case <-f.stop:
+			return Change{}, f.err
+		}
+		f.position[sc.source] = sc.next
+		if f.filter.duplicated(sc.source, sc.key, sc.record, sc.timestamp) {
+			continue
+		}
+		if change, ok := recordChange(sc.key, sc.record); ok {
+			return change, nil
+		}
+	}
+}
+
+//recordChange returns the change that stored a record, an empty record is a deletion
+func recordChange(key, record []byte) (Change, bool) {
+	if len(record) == 0 {
+		return Change{Key: key, Deleted: true}, true
+	}
+	v, t, ok := recordValue(record)
+	if !ok {
+		return Change{}, false
+	}
+	return Change{Key: key, Value: v, Time: t}, true
+}
+
+//Position returns the position after the last change returned by Next
+func (f *Feed) Position() FeedPosition {
+	p := make(FeedPosition, len(f.position))
+	for s, cursor := range f.position {
+		p[s] = cursor
+	}
+	return p
+}
+
+//Close stops the Feed, pending and future calls to Next will fail
+func (f *Feed) Close() {
+	f.fail(errors.New("Feed closed"))
+}
+
+//fail stops the Feed, Next will return err
+func (f *Feed) fail(err error) {
+	f.stopOnce.Do(func() {
+		f.err = err
+		close(f.stop)
+	})
+}
+
+//duplicated returns true if the change was already reported by another source, or if it is older than
+//the last reported change of the key
+//record is the stored record of the change, empty for deletions, timestamp is its timestamp
+func (f *changeFilter) duplicated(source interface{}, k, record []byte, timestamp uint64) bool {
+	lastSets := f.lastSets[source]
+	if lastSets == nil {
+		lastSets = make(map[string]uint64)
+		f.lastSets[source] = lastSets
+	}
+	key := string(k)
+	last := f.keys[key]
+	if len(record) == 0 {
+		deleted := lastSets[key]
+		delete(lastSets, key)
+		if last.deleted || last.timestamp > deleted {
+			return true
+		}
+		f.keys[key] = keyChange{timestamp: last.timestamp, deleted: true}
+		return false
+	}
+	lastSets[key] = timestamp
+	forget(lastSets)
+	if timestamp <= last.timestamp {
+		return true
+	}
+	f.keys[key] = keyChange{timestamp: timestamp}
+	if len(f.keys) > feedFilterSize {
+		//Forget random keys, like forget
+		for k := range f.keys {
+			delete(f.keys, k)
+			if len(f.keys) <= feedFilterSize/2 {
+				break
+			}
+		}
+	}
+	return false
+}
+
+//forget removes random keys of a source map if it stores more than feedFilterSize keys
+func forget(lastSets map[string]uint64) {
+	if len(lastSets) <= feedFilterSize {
+		return
+	}
+	for k := range lastSets {
+		delete(lastSets, k)
+		if len(lastSets) <= feedFilterSize/2 {
+			return
+		}
+	}
+}
+
+//run streams the feed of each chunk holder until the Feed is stopped
+func (f *Feed) run() {
+	ticker := time.NewTicker(feedRetryInterval)
+	defer ticker.Stop()
+	for {
+		if ks, err := f.c.settings(); err == nil {
+			for chunkID := ks.FirstChunk; chunkID < ks.FirstChunk+ks.NumChunks; chunkID++ {
+				for _, s := range f.c.sg.GetChunkHolders(chunkID) {
+					if s == nil {
+						continue
+					}
+					source := FeedSource{chunkID, s.Phy}
+					f.mutex.Lock()
+					if !f.running[source] {
+						f.running[source] = true
+						go f.stream(source, s)
+					}
+					f.mutex.Unlock()
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+//stream fetches the changes of a feed until the Feed is stopped, the request fails or the server
+//doesn't hold the chunk anymore, run starts it again if it is needed
+func (f *Feed) stream(source FeedSource, s *servergroup.VirtualServer) {
+	defer func() {
+		f.mutex.Lock()
+		delete(f.running, source)
+		f.mutex.Unlock()
+	}()
+	for f.holds(source) {
+		f.mutex.Lock()
+		request := &protocol.SubscribeRequest{Cursor: f.cursors[source], Limit: feedPageSize, Wait: feedWait}
+		f.mutex.Unlock()
+		sent := time.Now()
+		op, err := s.Subscribe(source.ChunkID, request, f.c.GetTimeout+feedWait)
+		var page *protocol.ChangePage
+		if err == nil {
+			page, err = op.Wait()
+		}
+		if err != nil && strings.Contains(err.Error(), protocol.ErrInvalidCursor) {
+			f.fail(errors.New("Feed position of chunk " + fmt.Sprint(source.ChunkID) + " on " + source.Server +
+				" can't be resumed: " + err.Error()))
+			return
+		}
+		if err != nil && strings.Contains(err.Error(), "ChunkNotPresent") {
+			//The holder deleted its copy, the feed of a new copy starts at the beginning
+			f.mutex.Lock()
+			delete(f.cursors, source)
+			f.mutex.Unlock()
+		}
+		if err != nil || !f.push(source, page) {
+			return
+		}
+		f.mutex.Lock()
+		f.cursors[source] = page.Next
+		f.mutex.Unlock()
+		if len(page.Keys) == 0 && time.Since(sent) < feedWait {
+			//The server doesn't wait for new changes (see protocol.FeatureFeedWait)
+			select {
+			case <-time.After(feedPollInterval):
+			case <-f.stop:
+				return
+			}
+		}
+	}
+}
+
+//holds returns true if the source server holds the source chunk
+func (f *Feed) holds(source FeedSource) bool {
+	for _, s := range f.c.sg.GetChunkHolders(source.ChunkID) {
+		if s != nil && s.Phy == source.Server {
+			return true
+		}
+	}
+	return false
+}
+
+//push sends the changes of a page to Next, it returns false if the Feed was closed
+func (f *Feed) push(source FeedSource, page *protocol.ChangePage) bool {
+	for i := range page.Keys {
+		sc := sourcedChange{source: source, key: f.c.unqualify(page.Keys[i]), record: page.Values[i]}
+		if len(sc.record) >= 8 {
+			sc.timestamp = vclock.Timestamp(sc.record)
+		}
+		sc.next = page.Next
+		if i+1 < len(page.Offsets) {
+			sc.next.Offset = page.Offsets[i+1]
+		}
+		select {
+		case f.changes <- sc:
+		case <-f.stop:
+			return false
+		}
+	}
+	return true
+}
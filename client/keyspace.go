@@ -0,0 +1,116 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/hashing"
+)
+
+/*
+	Keyspaces
+
+	A keyspace is a named set of pairs with its own settings (number of chunks, redundancy, chunk size,
+	TTL and conflict policy), see protocol.Keyspace.
+	Keyspace handles share the connections of the DBClient that created them, operations made through
+	a handle only see the pairs of its keyspace.
+
+	The conflict policy selects which writes are accepted: last-writer-wins keyspaces reject SetWithContext,
+	siblings keyspaces accept both Set and SetWithContext like the default keyspace.
+*/
+
+//Time to wait for the chunks of a new keyspace to be reported by the heartbeat
+const keyspaceCreationTimeout = time.Second * 5
+
+//CreateKeyspace creates a named keyspace, settings are validated by the server
+//k.FirstChunk is ignored, chunk IDs are assigned by the key master of hashing.KeyspacesKey
+//It returns when every chunk of the keyspace has a holder
+func (c *DBClient) CreateKeyspace(k protocol.Keyspace) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(keyspaceCreationTimeout)
+	//The key master of the reserved keyspaces key assigns the chunk IDs, see DBServer.createKeyspace
+	for masters := c.sg.KeyMasters(hashing.KeyspacesKey); len(masters) > 0; masters = c.sg.KeyMasters(hashing.KeyspacesKey) {
+		s := masters[0]
+		err := s.CreateKeyspace(&k)
+		if err != nil && strings.HasSuffix(err.Error(), protocol.ErrNotKeyspacesMaster) && time.Now().Before(deadline) {
+			//The server group views differ, wait until they converge
+			if serialization := s.GetAccessInfo(); serialization != nil {
+				c.sg.AdoptConfiguration(serialization)
+			}
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		//Adopt the new configuration now instead of waiting for the heartbeat
+		if serialization := s.GetAccessInfo(); serialization != nil {
+			c.sg.AdoptConfiguration(serialization)
+		}
+		deadline = time.Now().Add(keyspaceCreationTimeout)
+		for time.Now().Before(deadline) {
+			if ks, ok := c.sg.Keyspace(k.Name); ok && c.holdersReady(ks) {
+				return nil
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		return errors.New("Keyspace created but its chunks were not reported in time")
+	}
+	return errors.New("No servers")
+}
+
+//holdersReady returns true if every chunk of the keyspace has at least one holder
+func (c *DBClient) holdersReady(k protocol.Keyspace) bool {
+	for i := k.FirstChunk; i < k.FirstChunk+k.NumChunks; i++ {
+		if c.sg.NumHolders(i) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//Keyspace returns a handle to access the keyspace name, name "" is the default keyspace
+//The handle shares the connections of c, only c should be closed
+func (c *DBClient) Keyspace(name string) (*DBClient, error) {
+	if _, ok := c.sg.Keyspace(name); !ok {
+		return nil, errors.New("Unknown keyspace " + name)
+	}
+	h := new(DBClient)
+	*h = *c
+	h.keyspace = name
+	return h, nil
+}
+
+//settings returns the settings of the keyspace of c
+func (c *DBClient) settings() (protocol.Keyspace, error) {
+	k, ok := c.sg.Keyspace(c.keyspace)
+	if !ok {
+		return k, errors.New("Unknown keyspace " + c.keyspace)
+	}
+	return k, nil
+}
+
+//qualify returns the stored key of key, see hashing.KeyspaceKey
+func (c *DBClient) qualify(key []byte) []byte {
+	return hashing.KeyspaceKey(c.keyspace, key)
+}
+
+//unqualify returns the key of a stored key of the keyspace of c
+func (c *DBClient) unqualify(storedKey []byte) []byte {
+	if c.keyspace == "" {
+		return storedKey
+	}
+	_, key := hashing.SplitKeyspace(storedKey)
+	return key
+}
+
+//chunkID returns the chunk ID of a stored key
+func (c *DBClient) chunkID(storedKey []byte) (int, error) {
+	if c.keyspace == "" && hashing.HasKeyspacePrefix(storedKey) {
+		return 0, errors.New("Reserved key: keys of the default keyspace can't start with the keyspace prefix")
+	}
+	return c.sg.ChunkID(storedKey)
+}
@@ -0,0 +1,216 @@
+/*
+Package lock provides distributed locks (leases) built on top of client CAS operations.
+
+A lock is stored as a regular pair, its value stores the owner ID and the lease TTL.
+Locks are acquired, refreshed and released with CAS, so they are linearizable (see client.DBClient.CAS).
+A lease expires if it isn't refreshed before its TTL elapses since its last write,
+expiration is checked with the pair timestamp and the clock of the servers (see client.DBClient.GetWithServerTime),
+so clients with skewed clocks don't break leases early.
+
+Fencing tokens are the timestamps of the writes that acquired each lease, the tokens of
+consecutive holders are increasing. Resources protected by a lock should reject requests with
+tokens older than the last one they have seen, a holder could be paused until its lease expires.
+*/
+package lock
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+	"github.com/dv343/treeless/client"
+)
+
+const defaultRetryInterval = time.Millisecond * 50
+const defaultTimeout = time.Second * 30
+
+//ErrLocked is returned by TryLock if the lock is held by another owner
+var ErrLocked = errors.New("Lock is held by another owner")
+
+//ErrNotHeld is returned by lease operations after the lease is lost or released
+var ErrNotHeld = errors.New("Lock lease not held")
+
+//ErrTimeout is returned by Lock if the lock wasn't acquired before the Locker timeout
+var ErrTimeout = errors.New("Lock timeout: the lock wasn't acquired")
+
+//Locker acquires locks by using a DB client
+type Locker struct {
+	c *client.DBClient
+	//AutoRenew enables the automatic renewal of the acquired leases, it is enabled by default
+	AutoRenew bool
+	//RetryInterval is the maximum time between Lock tries
+	RetryInterval time.Duration
+	//Timeout is the maximum time Lock waits for the lock, 0 means no limit
+	Timeout time.Duration
+}
+
+//Lease is an acquired lock
+type Lease struct {
+	c         *client.DBClient
+	key       []byte
+	value     []byte //Stored value: owner ID and TTL
+	ttl       time.Duration
+	token     uint64
+	timestamp time.Time //Timestamp of the last write
+	held      bool
+	stop      chan struct{}
+	lost      chan struct{}
+	m         sync.Mutex
+}
+
+//New returns a new Locker that will use c
+func New(c *client.DBClient) *Locker {
+	return &Locker{c: c, AutoRenew: true, RetryInterval: defaultRetryInterval, Timeout: defaultTimeout}
+}
+
+//Lock acquires the lock stored on key, it blocks until the lock is acquired or the Locker timeout expires
+//ttl is the lease duration, the lease will be renewed automatically if AutoRenew is set
+//It returns ErrTimeout if the lock was held by another owner until the timeout, or the last error otherwise
+func (l *Locker) Lock(key []byte, ttl time.Duration) (*Lease, error) {
+	deadline := time.Now().Add(l.Timeout)
+	for {
+		lease, err := l.TryLock(key, ttl)
+		if err == nil {
+			return lease, nil
+		}
+		if l.Timeout > 0 && !time.Now().Before(deadline) {
+			if err == ErrLocked {
+				err = ErrTimeout
+			}
+			return nil, err
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(l.RetryInterval)) + 1))
+	}
+}
+
+//TryLock tries to acquire the lock stored on key without waiting
+//It returns ErrLocked if the lock is held by another owner or if another owner acquired it concurrently
+func (l *Locker) TryLock(key []byte, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, errors.New("Lock TTL should be positive")
+	}
+	v, t, now, read := l.c.GetWithServerTime(key)
+	if !read {
+		return nil, errors.New("Lock failed: servers unreachable")
+	}
+	if isHeld(v, t, now) {
+		return nil, ErrLocked
+	}
+	if v == nil {
+		//CAS on a non-existent pair
+		t = time.Unix(0, 0)
+	}
+	value := make([]byte, 16)
+	if _, err := crand.Read(value[:8]); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(value[8:], uint64(ttl))
+	t, written, _ := l.c.CASWithTime(key, value, t, v)
+	if !written {
+		return nil, ErrLocked
+	}
+	//The write timestamp is the fencing token, it isn't read back: a lagging replica could return an older value
+	lease := &Lease{c: l.c, key: key, value: value, ttl: ttl, token: uint64(t.UnixNano()), timestamp: t, held: true,
+		stop: make(chan struct{}), lost: make(chan struct{})}
+	if l.AutoRenew {
+		go lease.renew()
+	}
+	return lease, nil
+}
+
+//isHeld returns true if v is a lock value whose lease hasn't expired at the server time now
+func isHeld(v []byte, t, now time.Time) bool {
+	if len(v) != 16 {
+		//Released lock or not a lock
+		return false
+	}
+	ttl := time.Duration(binary.LittleEndian.Uint64(v[8:]))
+	return now.Before(t.Add(ttl))
+}
+
+//Token returns the fencing token of the lease
+func (l *Lease) Token() uint64 {
+	return l.token
+}
+
+//Lost returns a channel that will be closed if the lease is lost, the holder should stop
+//using the protected resources
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+//Refresh extends the lease, it returns ErrNotHeld if the lease was lost
+func (l *Lease) Refresh() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if !l.held {
+		return ErrNotHeld
+	}
+	t, written, _ := l.c.CASWithTime(l.key, l.value, l.timestamp, l.value)
+	if written {
+		l.timestamp = t
+		return nil
+	}
+	//The result of a failed CAS could be unknown, sync checks it
+	return l.sync()
+}
+
+//Unlock releases the lock, it returns ErrNotHeld if the lease was already lost
+func (l *Lease) Unlock() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if !l.held {
+		return ErrNotHeld
+	}
+	written, err := l.c.CAS(l.key, nil, l.timestamp, l.value)
+	if !written {
+		//The lock could be released anyway if the CAS result is unknown
+		if serr := l.sync(); serr != nil {
+			return serr
+		}
+		return err
+	}
+	l.held = false
+	close(l.stop)
+	return nil
+}
+
+//sync reads the lock and updates the lease state, lease mutex should be held
+func (l *Lease) sync() error {
+	v, t, now, read := l.c.GetWithServerTime(l.key)
+	if !read {
+		return errors.New("Lock failed: servers unreachable")
+	}
+	if !bytes.Equal(v, l.value) || !now.Before(t.Add(l.ttl)) {
+		l.setLost()
+		return ErrNotHeld
+	}
+	l.timestamp = t
+	return nil
+}
+
+func (l *Lease) setLost() {
+	if l.held {
+		l.held = false
+		close(l.lost)
+	}
+}
+
+//renew refreshes the lease periodically until it is released or lost
+func (l *Lease) renew() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if l.Refresh() == ErrNotHeld {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+//Range returns up to limit pairs whose keys are in the range [start, end), in key order
+//A nil end means no upper bound, the DB server group should have been created with the ordered index enabled
+//Each chunk is read from one of its holders and results are merged, use the last returned key
+//(followed by a zero byte) as the next start to read the following pairs
+//Only the pairs of the keyspace of c are returned, its ordered index should be enabled
+func (c *DBClient) Range(start, end []byte, limit int) (keys, values [][]byte, err error) {
+	ks, err := c.settings()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ks.Ordered {
+		return nil, nil, errors.New("Range failed: the ordered index is disabled")
+	}
+	if limit <= 0 {
+		return nil, nil, errors.New("Range failed: limit should be positive")
+	}
+	request := &protocol.RangeRequest{Start: c.qualify(start), Limit: limit}
+	if end != nil {
+		request.End = c.qualify(end)
+	}
+	numChunks := ks.FirstChunk + ks.NumChunks
+	ops := make([]com.RangeOperation, numChunks)
+	valid := make([]bool, numChunks)
+	next := make([]int, numChunks) //Next holder to try of each chunk
+	for chunkID := ks.FirstChunk; chunkID < numChunks; chunkID++ {
+		for i, s := range c.sg.GetChunkHolders(chunkID) {
+			if s == nil {
+				continue
+			}
+			op, err := s.Range(chunkID, request, c.GetTimeout)
+			if err == nil {
+				ops[chunkID] = op
+				valid[chunkID] = true
+				next[chunkID] = i + 1
+				break
+			}
+		}
+	}
+	var pairs byKey
+	var cutoff []byte //Pairs after the last pair of a truncated chunk result could be missing
+	for chunkID := ks.FirstChunk; chunkID < numChunks; chunkID++ {
+		var r *protocol.RangeResult
+		err := errors.New("Range failed: chunk holders unreachable")
+		if valid[chunkID] {
+			r, err = ops[chunkID].Wait()
+		}
+		//Retry with the other holders
+		holders := c.sg.GetChunkHolders(chunkID)
+		for i := next[chunkID]; err != nil && i < len(holders); i++ {
+			if holders[i] == nil {
+				continue
+			}
+			var op com.RangeOperation
+			op, err = holders[i].Range(chunkID, request, c.GetTimeout)
+			if err == nil {
+				r, err = op.Wait()
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range r.Keys {
+			if v, _, ok := recordValue(r.Values[i]); ok {
+				pairs.keys = append(pairs.keys, r.Keys[i])
+				pairs.values = append(pairs.values, v)
+			}
+		}
+		if r.More && len(r.Keys) > 0 {
+			last := r.Keys[len(r.Keys)-1]
+			if cutoff == nil || bytes.Compare(last, cutoff) < 0 {
+				cutoff = last
+			}
+		}
+	}
+	sort.Sort(pairs)
+	for i := range pairs.keys {
+		if len(keys) == limit || cutoff != nil && bytes.Compare(pairs.keys[i], cutoff) > 0 {
+			break
+		}
+		keys = append(keys, c.unqualify(pairs.keys[i]))
+		values = append(values, pairs.values[i])
+	}
+	return keys, values, nil
+}
+
+type byKey struct {
+	keys, values [][]byte
+}
+
+func (p byKey) Len() int           { return len(p.keys) }
+func (p byKey) Less(i, j int) bool { return bytes.Compare(p.keys[i], p.keys[j]) < 0 }
+func (p byKey) Swap(i, j int) {
+	p.keys[i], p.keys[j] = p.keys[j], p.keys[i]
+	p.values[i], p.values[j] = p.values[j], p.values[i]
+}
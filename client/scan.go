@@ -0,0 +1,199 @@
+package client
+
+import (
+	"errors"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/hlc"
+	"github.com/dv343/treeless/vclock"
+)
+
+//Number of pairs requested by each scan page
+const scanPageSize = 256
+
+//Length of the chunk holders array, see servergroup.ServerGroup.GetChunkHolders
+const maxChunkHolders = 8
+
+//Scan calls foreach for each stored pair whose key starts with prefix (nil matches every key)
+//It walks every chunk once reading it from one of its holders, it stops early if foreach returns false
+//Recent writes that didn't reach the chosen holder yet are missed, and some pairs could be returned
+//more than once: pairs updated during the scan, pairs near the cursor when a chunk is defragmented and
+//pairs of a chunk scanned again from another holder after a failure
+//Only the pairs of the keyspace of c are scanned
+func (c *DBClient) Scan(prefix []byte, foreach func(key, value []byte, lastTime time.Time) (Continue bool)) error {
+	ks, err := c.settings()
+	if err != nil {
+		return err
+	}
+	prefix = c.qualify(prefix)
+	for chunkID := ks.FirstChunk; chunkID < ks.FirstChunk+ks.NumChunks; chunkID++ {
+		Continue, err := c.scanChunk(chunkID, prefix, foreach)
+		if err != nil {
+			return err
+		}
+		if !Continue {
+			return nil
+		}
+	}
+	return nil
+}
+
+//NumChunks returns the number of chunks of the keyspace of c, see ScanChunk
+func (c *DBClient) NumChunks() (int, error) {
+	ks, err := c.settings()
+	if err != nil {
+		return 0, err
+	}
+	return ks.NumChunks, nil
+}
+
+//ScanChunk is like Scan but it only walks the n-th chunk of the keyspace of c, n should be in the range [0, NumChunks)
+//Scanning every chunk is equivalent to Scan, scans can be resumed at chunk boundaries
+func (c *DBClient) ScanChunk(n int, prefix []byte, foreach func(key, value []byte, lastTime time.Time) (Continue bool)) error {
+	ks, err := c.settings()
+	if err != nil {
+		return err
+	}
+	if n < 0 || n >= ks.NumChunks {
+		return errors.New("Chunk out of range")
+	}
+	_, err = c.scanChunk(ks.FirstChunk+n, c.qualify(prefix), foreach)
+	return err
+}
+
+//scanChunk scans a chunk using its first holder that doesn't fail, it returns false if foreach stopped the scan
+//Cursors are only valid on one holder, the chunk is scanned again from the start if a holder fails
+func (c *DBClient) scanChunk(chunkID int, prefix []byte, foreach func(key, value []byte, lastTime time.Time) bool) (bool, error) {
+	errs := errors.New("Scan failed: chunk holders unreachable")
+	for _, s := range c.sg.GetChunkHolders(chunkID) {
+		if s == nil {
+			continue
+		}
+		request := &protocol.ScanRequest{Limit: scanPageSize, Prefix: prefix}
+		for {
+			op, err := s.Scan(chunkID, request, c.GetTimeout)
+			var page *protocol.ScanPage
+			if err == nil {
+				page, err = op.Wait()
+			}
+			if err != nil {
+				errs = err
+				break
+			}
+			for i := range page.Keys {
+				v, t, ok := recordValue(page.Values[i])
+				if !ok {
+					continue
+				}
+				if !foreach(c.unqualify(page.Keys[i]), v, t) {
+					return false, nil
+				}
+			}
+			if page.Done {
+				return true, nil
+			}
+			request.Cursor = page.Next
+		}
+	}
+	return false, errs
+}
+
+//ScanPosition is the position of a paginated scan (see ScanPage), its zero value is the start of the scan
+type ScanPosition struct {
+	Chunk  int                 //Chunk number of the keyspace, the scan is done when it reaches the number of chunks
+	Holder int                 //Index of the chunk holder whose store Cursor points to, see servergroup.ServerGroup.GetChunkHolders
+	Cursor protocol.ScanCursor //Position on the holder store
+}
+
+//ScanPage is like Scan, but it calls foreach for up to limit pairs starting at position
+//It returns the position of the next pair, done is true if every chunk was scanned
+//Positions are only valid on one holder, if it fails (or it doesn't hold the chunk anymore) the chunk is scanned
+//again from the start on another holder, so pairs can be returned more than once
+func (c *DBClient) ScanPage(position ScanPosition, prefix []byte, limit int, foreach func(key, value []byte, lastTime time.Time)) (next ScanPosition, done bool, err error) {
+	ks, err := c.settings()
+	if err != nil {
+		return position, false, err
+	}
+	if position.Chunk < 0 || position.Holder < 0 || position.Holder >= maxChunkHolders {
+		return position, false, errors.New("Invalid scan position")
+	}
+	prefix = c.qualify(prefix)
+	for position.Chunk < ks.NumChunks && limit > 0 {
+		var n int
+		position, n, err = c.scanChunkPage(ks.FirstChunk, position, prefix, limit, foreach)
+		if err != nil {
+			return position, false, err
+		}
+		limit -= n
+	}
+	return position, position.Chunk >= ks.NumChunks, nil
+}
+
+//scanChunkPage scans up to limit pairs of the chunk of position, it returns the next position and the number of pairs read
+//The next position is at the start of the next chunk if the chunk scan is done
+func (c *DBClient) scanChunkPage(firstChunk int, position ScanPosition, prefix []byte, limit int, foreach func(key, value []byte, lastTime time.Time)) (ScanPosition, int, error) {
+	chunkID := firstChunk + position.Chunk
+	holders := c.sg.GetChunkHolders(chunkID)
+	errs := errors.New("Scan failed: chunk holders unreachable")
+	n := 0
+	for i := range holders {
+		h := (position.Holder + i) % len(holders)
+		s := holders[h]
+		if s == nil {
+			continue
+		}
+		if h != position.Holder {
+			//The cursor belongs to another holder
+			position.Holder, position.Cursor = h, protocol.ScanCursor{}
+		}
+		for n < limit {
+			size := limit - n
+			if size > scanPageSize {
+				size = scanPageSize
+			}
+			op, err := s.Scan(chunkID, &protocol.ScanRequest{Cursor: position.Cursor, Limit: size, Prefix: prefix}, c.GetTimeout)
+			var page *protocol.ScanPage
+			if err == nil {
+				page, err = op.Wait()
+			}
+			if err != nil {
+				errs = err
+				break
+			}
+			for j := range page.Keys {
+				if v, t, ok := recordValue(page.Values[j]); ok {
+					foreach(c.unqualify(page.Keys[j]), v, t)
+				}
+			}
+			n += len(page.Keys)
+			position.Cursor = page.Next
+			if page.Done {
+				return ScanPosition{Chunk: position.Chunk + 1}, n, nil
+			}
+		}
+		if n == limit {
+			return position, n, nil
+		}
+		//Retry the chunk from the start on the next holder
+		position.Cursor = protocol.ScanCursor{}
+	}
+	return position, n, errs
+}
+
+//recordValue returns the value of a stored record and its timestamp, multi-value records return their newest sibling
+//ok is false if the record has no value
+func recordValue(record []byte) (value []byte, t time.Time, ok bool) {
+	if len(record) < 8 {
+		return nil, t, false
+	}
+	t = hlc.Time(vclock.Timestamp(record))
+	if vclock.IsMultiValue(record) {
+		siblings, err := vclock.Unmarshal(record)
+		if err != nil || len(siblings) == 0 {
+			return nil, t, false
+		}
+		//Siblings are sorted by timestamp
+		return siblings[len(siblings)-1].Value, t, true
+	}
+	return record[8:], t, true
+}
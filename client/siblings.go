@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/hlc"
+	"github.com/dv343/treeless/vclock"
+)
+
+/*
+	Multi-value (siblings) mode
+
+	Keyspaces with the siblings conflict policy (see protocol.ConflictSiblings) store multi-value pairs,
+	the default keyspace and last-writer-wins keyspaces don't.
+	Pairs written with SetWithContext carry a version vector instead of relying only on timestamps.
+	Servers keep concurrent versions as siblings instead of discarding the older one (see package vclock).
+	GetSiblings returns all the siblings and a causal context, a later SetWithContext using that context
+	replaces all of them.
+
+	Set on a pair that has siblings replaces all of them if it is newer than every sibling, it is a blind overwrite.
+*/
+
+//GetSiblings returns all the concurrent values associated to a given key
+//context is the causal context of the returned values, it should be passed to SetWithContext
+//to resolve the conflict
+//read will be true if at least one server respond
+func (c *DBClient) GetSiblings(key []byte) (values [][]byte, context []byte, read bool) {
+	key = c.qualify(key)
+	chunkID, err := c.chunkID(key)
+	if err != nil {
+		return nil, nil, false
+	}
+	servers := c.sg.GetChunkHolders(chunkID)
+	var charray [8]com.GetOperation
+	var chvalidarray [8]bool
+	var records [8][]byte
+	for i, s := range servers {
+		if s != nil {
+			c, err := s.Get(key, c.GetTimeout)
+			if err == nil {
+				charray[i] = c
+				chvalidarray[i] = true
+			}
+		}
+	}
+	var merged []byte
+	for i := 0; i < len(servers); i++ {
+		if !chvalidarray[i] {
+			continue
+		}
+		r := charray[i].Wait()
+		if r.Err != nil {
+			continue
+		}
+		read = true
+		if _, err := vclock.Unmarshal(r.Value); err != nil {
+			continue
+		}
+		if merged == nil {
+			merged = r.Value
+		} else if m, err := vclock.MergeRecords(merged, r.Value); err == nil {
+			merged = m
+		} else {
+			continue
+		}
+		records[i] = r.Value
+	}
+	if merged == nil {
+		return nil, nil, read
+	}
+	siblings, err := vclock.Unmarshal(merged)
+	if err != nil {
+		return nil, nil, read
+	}
+	//Read-repair
+	for i, s := range servers {
+		if s != nil && chvalidarray[i] && !bytes.Equal(records[i], merged) {
+			s.Set(key, merged, 0)
+		}
+	}
+	for _, s := range siblings {
+		values = append(values, s.Value)
+	}
+	return values, vclock.Context(siblings).Marshal(), read
+}
+
+//SetWithContext sets a key-value pair replacing the siblings seen in context
+//context should be the one returned by GetSiblings, or nil for a pair that has not been read
+//Concurrent writes (with contexts that don't descend from each other) will be kept as siblings
+//written is set to true if at least one server respond without errors
+//Only keyspaces with the siblings conflict policy accept it, see protocol.Keyspace
+func (c *DBClient) SetWithContext(key, value, context []byte) (written bool, errs error) {
+	ks, err := c.settings()
+	if err != nil {
+		return false, err
+	}
+	if ks.Conflicts != protocol.ConflictSiblings {
+		return false, errors.New("SetWithContext failed: the keyspace uses the last-writer-wins policy")
+	}
+	version, _, err := vclock.UnmarshalVersionVector(context)
+	if err != nil {
+		return false, err
+	}
+	version.Increment(c.actor)
+	record := vclock.Marshal([]vclock.Sibling{{Version: version, Timestamp: hlc.Now(), Value: value}})
+	return c.setRecord(c.qualify(key), record, c.SetTimeout)
+}
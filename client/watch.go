@@ -0,0 +1,224 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/dv343/treeless/hashing"
+	"github.com/dv343/treeless/vclock"
+)
+
+/*
+	Watches
+
+	A Watch registers itself on every server of the group (see protocol.OpWatch), each server pushes a
+	notification after each write of a watched key on the chunks it holds.
+	Notifications of every holder are merged like Feed changes (see feed.go), so each change is reported once.
+	Servers forget the watches of closed connections, the Watch checks its registrations periodically
+	and registers itself again on new connections and new servers of the group.
+	Changes made while a server wasn't notifying the Watch are lost, notifications are best-effort.
+	If a server drops notifications (see protocol.OpWatchOverflow) or the Watch receives more than
+	watchPendingSize notifications that weren't read, the Watch is closed and Err returns ErrWatchOverflow.
+*/
+
+//Time between checks of the server registrations of a Watch
+var watchResubscribeInterval = time.Second
+
+const (
+	watchBufferSize  = 1024      //Number of changes received but not yet read from the Events channel
+	watchPendingSize = 64 * 1024 //Number of notifications received but not yet filtered
+)
+
+//ErrWatchOverflow is returned by Watch.Err if notifications were dropped
+var ErrWatchOverflow = errors.New("Watch closed: notifications were dropped, the watched keys should be read again")
+
+//Last used watch ID, IDs are unique on each process
+var lastWatchID uint32
+
+//Watch notifies the changes of a key or a key prefix
+type Watch struct {
+	c        *DBClient
+	id       uint32
+	key      []byte //Stored key or prefix
+	prefix   bool
+	events   chan Change
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error //Error that closed the Watch, set before stop is closed
+	filter   *changeFilter
+	pending  []watchNotification //Notifications received but not yet filtered
+	signal   chan struct{}
+	mutex    sync.Mutex
+}
+
+type watchNotification struct {
+	server      string
+	key, record []byte
+}
+
+//Watch returns a Watch of the changes of key
+func (c *DBClient) Watch(key []byte) (*Watch, error) {
+	return c.watch(key, false)
+}
+
+//WatchPrefix returns a Watch of the changes of every key that starts with prefix
+func (c *DBClient) WatchPrefix(prefix []byte) (*Watch, error) {
+	return c.watch(prefix, true)
+}
+
+func (c *DBClient) watch(key []byte, prefix bool) (*Watch, error) {
+	if _, err := c.settings(); err != nil {
+		return nil, err
+	}
+	w := new(Watch)
+	w.c = c
+	w.id = atomic.AddUint32(&lastWatchID, 1)
+	w.key = c.qualify(key)
+	w.prefix = prefix
+	w.events = make(chan Change, watchBufferSize)
+	w.stop = make(chan struct{})
+	w.filter = newChangeFilter()
+	w.signal = make(chan struct{}, 1)
+	if w.subscribe() == 0 {
+		w.unsubscribe()
+		return nil, errors.New("No server accepted the watch")
+	}
+	go w.resubscribe()
+	go w.deliver()
+	return w, nil
+}
+
+//Events returns the channel of changes, it is closed when the Watch is closed, see Err
+func (w *Watch) Events() <-chan Change {
+	return w.events
+}
+
+//Close stops the Watch
+func (w *Watch) Close() {
+	w.fail(nil)
+}
+
+//Err returns the error that closed the Watch, nil if it is open or it was closed by Close
+func (w *Watch) Err() error {
+	select {
+	case <-w.stop:
+		return w.err
+	default:
+		return nil
+	}
+}
+
+//fail stops the Watch, Err will return err
+func (w *Watch) fail(err error) {
+	w.stopOnce.Do(func() {
+		w.err = err
+		close(w.stop)
+	})
+}
+
+//subscribe registers the watch on the servers that aren't notifying it, it returns the number of
+//servers that are notifying it
+func (w *Watch) subscribe() int {
+	n := 0
+	for _, s := range w.c.sg.Servers() {
+		if s.Watching(w.id) {
+			n++
+			continue
+		}
+		server := s.Phy
+		err := s.Watch(w.id, w.key, w.prefix, func(key, record []byte, overflow bool) {
+			if overflow {
+				w.fail(ErrWatchOverflow)
+				return
+			}
+			w.notify(server, key, record)
+		})
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+//unsubscribe cancels the registrations of the watch
+func (w *Watch) unsubscribe() {
+	for _, s := range w.c.sg.Servers() {
+		if s.Watching(w.id) {
+			s.Unwatch(w.id)
+		}
+	}
+}
+
+//resubscribe keeps the watch registered until it is closed
+func (w *Watch) resubscribe() {
+	ticker := time.NewTicker(watchResubscribeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.subscribe()
+		case <-w.stop:
+			w.unsubscribe()
+			return
+		}
+	}
+}
+
+//notify queues a notification, it is called by the connection readers so it doesn't block
+func (w *Watch) notify(server string, key, record []byte) {
+	w.mutex.Lock()
+	if len(w.pending) >= watchPendingSize {
+		w.mutex.Unlock()
+		w.fail(ErrWatchOverflow)
+		return
+	}
+	w.pending = append(w.pending, watchNotification{server, key, record})
+	w.mutex.Unlock()
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+//deliver sends the queued notifications to the Events channel, removing duplicates, until the watch is closed
+func (w *Watch) deliver() {
+	defer close(w.events)
+	for {
+		select {
+		case <-w.signal:
+		case <-w.stop:
+			return
+		}
+		w.mutex.Lock()
+		pending := w.pending
+		w.pending = nil
+		w.mutex.Unlock()
+		for _, n := range pending {
+			if name, _ := hashing.SplitKeyspace(n.key); name != w.c.keyspace {
+				//Prefixes of the default keyspace match the keys of every keyspace
+				continue
+			}
+			if w.prefix && !bytes.HasPrefix(n.key, w.key) || !w.prefix && !bytes.Equal(n.key, w.key) {
+				continue
+			}
+			var timestamp uint64
+			if len(n.record) >= 8 {
+				timestamp = vclock.Timestamp(n.record)
+			}
+			if w.filter.duplicated(n.server, n.key, n.record, timestamp) {
+				continue
+			}
+			change, ok := recordChange(w.c.unqualify(n.key), n.record)
+			if !ok {
+				continue
+			}
+			select {
+			case w.events <- change:
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
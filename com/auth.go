@@ -0,0 +1,21 @@
+package com
+
+/*
+	Authentication
+
+	Servers with authentication enabled only accept authenticated connections (see protocol.OpAuth),
+	CreateConnection authenticates new connections with the token set by SetToken,
+	CreateConnectionWithToken uses its own token.
+*/
+
+var token []byte //nil means no authentication
+
+//SetToken sets the token used to authenticate new connections, "" disables the authentication
+//It should be called before creating connections
+func SetToken(t string) {
+	if t == "" {
+		token = nil
+	} else {
+		token = []byte(t)
+	}
+}
@@ -1,7 +1,11 @@
 package buffconn
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -19,7 +23,7 @@ const windowTimeDuration = time.Microsecond * 8 * 250
 const fastModeEnableProbability = 1 / 500.0
 
 type Conn struct {
-	tcp                *net.TCPConn
+	tcp                net.Conn
 	readBuffer         []byte
 	readStart, readEnd int
 	writeBuffer        []byte
@@ -27,9 +31,14 @@ type Conn struct {
 	buffering          bool
 	writeMutex         sync.Mutex
 	ch                 chan int
+	compress           bool          //Compress write batches, see compression.go
+	flater             *flate.Writer //Compressor of write batches
+	compressed         bytes.Buffer  //Last compressed write batch
+	inflated           []byte        //Decompressed messages not yet returned by Read
 }
 
-func New(conn *net.TCPConn) *Conn {
+//New returns a buffered connection, conn can be a TCP connection or a TLS connection over TCP
+func New(conn net.Conn) *Conn {
 	c := new(Conn)
 	c.tcp = conn
 	c.readBuffer = make([]byte, readBufferSize)
@@ -58,7 +67,7 @@ func New(conn *net.TCPConn) *Conn {
 					}
 				case <-ticker.C:
 					c.writeMutex.Lock()
-					tcpWrite(c.tcp, c.writeBuffer[:c.writeIndex])
+					c.flush(c.writeBuffer[:c.writeIndex])
 					c.writeIndex = 0
 					c.writeMutex.Unlock()
 				}
@@ -70,8 +79,40 @@ func New(conn *net.TCPConn) *Conn {
 	return c
 }
 
+//Read returns the next message, messages wrapped by OpCompressed messages are returned one by one
 func (c *Conn) Read() (protocol.Message, error) {
 	for {
+		var m protocol.Message
+		var err error
+		if len(c.inflated) > 0 {
+			m, err = c.nextInflated()
+		} else {
+			m, err = c.read()
+			if err == nil && m.Type == protocol.OpCompressed {
+				err = c.inflate(m)
+				if err == nil {
+					continue
+				}
+			}
+		}
+		if err != nil {
+			//Protocol violation or closed connection
+			c.tcp.Close()
+			c.inflated = nil
+			return protocol.Message{}, err
+		}
+		return m, nil
+	}
+}
+
+func (c *Conn) read() (protocol.Message, error) {
+	for {
+		if c.readStart > readBufferSize-protocol.MinimumMessageSize {
+			//Make room for the message header
+			copy(c.readBuffer, c.readBuffer[c.readStart:c.readEnd])
+			c.readEnd = c.readEnd - c.readStart
+			c.readStart = 0
+		}
 		//Read at least the size of the message
 		for c.readEnd-c.readStart < protocol.MinimumMessageSize {
 			//Not enough bytes read to form a message, read more
@@ -83,6 +124,11 @@ func (c *Conn) Read() (protocol.Message, error) {
 			c.readEnd = c.readEnd + n
 		}
 		messageSize := int(binary.LittleEndian.Uint32(c.readBuffer[c.readStart:]))
+		if messageSize < protocol.MinimumMessageSize || messageSize > protocol.MaxMessageSize() {
+			//Don't trust the size of invalid messages
+			c.tcp.Close()
+			return protocol.Message{}, errors.New("Invalid message size: " + fmt.Sprint(messageSize))
+		}
 
 		//Special treatment for big messages
 		if messageSize > readBufferSize-c.readStart {
@@ -100,10 +146,9 @@ func (c *Conn) Read() (protocol.Message, error) {
 				}
 				index += n
 			}
-			msg := protocol.Unmarshal(bigBuffer)
 			c.readStart = 0
 			c.readEnd = 0
-			return msg, nil
+			return protocol.Unmarshal(bigBuffer)
 		}
 
 		//Read the remaining bytes
@@ -124,11 +169,11 @@ func (c *Conn) Read() (protocol.Message, error) {
 			c.readStart = 0
 		}
 		c.readStart = c.readStart + messageSize
-		return protocol.Unmarshal(c.readBuffer[c.readStart-messageSize : c.readStart]), nil
+		return protocol.Unmarshal(c.readBuffer[c.readStart-messageSize : c.readStart])
 	}
 }
 
-func tcpWrite(conn *net.TCPConn, buffer []byte) error {
+func tcpWrite(conn net.Conn, buffer []byte) error {
 	for len(buffer) > 0 {
 		n, err := conn.Write(buffer)
 		if err != nil {
@@ -142,19 +187,20 @@ func tcpWrite(conn *net.TCPConn, buffer []byte) error {
 
 func (c *Conn) Write(m protocol.Message) error {
 	c.writeMutex.Lock()
+	//The flusher should be notified after releasing writeMutex, it may be waiting for it
 	if m.Type == protocol.OpSetBuffered {
 		c.buffering = true
-		c.ch <- 1
+		defer func() { c.ch <- 1 }()
 	} else if m.Type == protocol.OpSetNoDelay {
 		c.buffering = false
-		c.ch <- 0
+		defer func() { c.ch <- 0 }()
 	}
 	//Append message to buffer
 	msgSize, tooLong := m.Marshal(c.writeBuffer[c.writeIndex:])
 	if tooLong {
 		//Message too long for the buffer remaining space
 		//Flush old data on buffer
-		err := tcpWrite(c.tcp, c.writeBuffer[:c.writeIndex])
+		err := c.flush(c.writeBuffer[:c.writeIndex])
 		if err != nil {
 			c.writeMutex.Unlock()
 			return err
@@ -165,7 +211,7 @@ func (c *Conn) Write(m protocol.Message) error {
 			//Send this message
 			bigMsg := make([]byte, msgSize)
 			m.Marshal(bigMsg)
-			err := tcpWrite(c.tcp, bigMsg)
+			err := c.flush(bigMsg)
 			c.writeMutex.Unlock()
 			return err
 		} else {
@@ -175,7 +221,7 @@ func (c *Conn) Write(m protocol.Message) error {
 	}
 	if !c.buffering {
 		c.writeIndex += msgSize
-		err := tcpWrite(c.tcp, c.writeBuffer[:c.writeIndex])
+		err := c.flush(c.writeBuffer[:c.writeIndex])
 		c.writeIndex = 0
 		c.writeMutex.Unlock()
 		return err
@@ -0,0 +1,83 @@
+package buffconn
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+//SetCompression enables or disables the compression of write batches, see protocol.OpCompressed
+//It should be enabled only if the other side supports protocol.FeatureCompression
+func (c *Conn) SetCompression(enabled bool) {
+	c.writeMutex.Lock()
+	c.compress = enabled
+	if enabled && c.flater == nil {
+		c.flater, _ = flate.NewWriter(nil, flate.BestSpeed)
+	}
+	c.writeMutex.Unlock()
+}
+
+//flush writes a batch of serialized messages, compressing it if it is enabled
+//writeMutex should be held
+func (c *Conn) flush(batch []byte) error {
+	if c.compress && len(batch) >= protocol.CompressionThreshold {
+		if frame, ok := c.deflate(batch); ok {
+			batch = frame
+		}
+	}
+	return tcpWrite(c.tcp, batch)
+}
+
+//deflate returns an OpCompressed message that wraps batch, ok is false if it isn't smaller than batch
+func (c *Conn) deflate(batch []byte) (frame []byte, ok bool) {
+	c.compressed.Reset()
+	c.compressed.Write(make([]byte, protocol.MinimumMessageSize))
+	c.flater.Reset(&c.compressed)
+	c.flater.Write(batch)
+	c.flater.Close()
+	frame = c.compressed.Bytes()
+	if len(frame) >= len(batch) {
+		return nil, false
+	}
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(frame[4:8], 0)
+	binary.LittleEndian.PutUint32(frame[8:12], 0)
+	frame[12] = byte(protocol.OpCompressed)
+	return frame, true
+}
+
+//inflate stores the messages wrapped by an OpCompressed message, they will be returned by the next reads
+//Batches wrap small messages or one message, the decompressed size is limited to avoid decompression bombs
+func (c *Conn) inflate(m protocol.Message) error {
+	limit := int64(protocol.MaxMessageSize() + writeBufferSize)
+	batch, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(m.Value)), limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(batch)) > limit {
+		return errors.New("Compressed message exceeds the size limits")
+	}
+	c.inflated = batch
+	return nil
+}
+
+//nextInflated returns the next message stored by inflate
+func (c *Conn) nextInflated() (protocol.Message, error) {
+	if len(c.inflated) < protocol.MinimumMessageSize {
+		return protocol.Message{}, errors.New("Bad formatting of compressed message")
+	}
+	size := int64(binary.LittleEndian.Uint32(c.inflated))
+	if size > int64(len(c.inflated)) {
+		return protocol.Message{}, errors.New("Bad formatting of compressed message")
+	}
+	m, err := protocol.Unmarshal(c.inflated[:size])
+	if err != nil {
+		return m, err
+	}
+	c.inflated = c.inflated[size:]
+	return m, nil
+}
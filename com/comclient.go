@@ -7,9 +7,11 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/dv343/treeless/com/buffconn"
 	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/hlc"
 )
 
 const brokerChannelBufferSize = 1024
@@ -24,6 +26,7 @@ var dialTimeout = 3 * time.Second
 type result struct {
 	Value []byte
 	Err   error
+	Time  uint64 //Server clock (see package hlc) when the response was sent, 0 if it is unknown
 }
 
 type brokerMsg struct {
@@ -46,28 +49,108 @@ type queue struct {
 
 //Conn provides an interface to a possible buffered DB TCP client connection
 type Conn struct {
-	tcpConn                  *net.TCPConn
+	tcpConn                  net.Conn
+	bconn                    *buffconn.Conn
 	brokerSendChannel        chan brokerMsg
 	brokerReceiveChannelPool sync.Pool
+	watches                  map[uint32]func(key, record []byte, overflow bool) //Watch event handlers by watch ID
+	watchMutex               sync.Mutex
+	version                  uint16            //Negotiated protocol version, see protocol.OpHello
+	features                 protocol.Features //Features supported by both sides
 }
 
-//CreateConnection returns a new Conn
+//responseError is the error of an OpErr response
+type responseError string
+
+func (e responseError) Error() string {
+	return "Response error: " + string(e)
+}
+
+//CreateConnection returns a new Conn, addr is a TCP address (ip:port) or a Unix domain socket address (unix:///path)
+//The connection is authenticated with the token set by SetToken
 func CreateConnection(addr string, onClose func()) (*Conn, error) {
-	d := &net.Dialer{Timeout: dialTimeout}
-	tcpconn, err := d.Dial("tcp", addr)
+	return CreateConnectionWithToken(addr, nil, onClose)
+}
+
+//CreateConnectionWithToken is like CreateConnection, but the connection is authenticated with token
+//A nil token uses the token set by SetToken
+func CreateConnectionWithToken(addr string, token []byte, onClose func()) (*Conn, error) {
+	conn, err := dial(&net.Dialer{Timeout: dialTimeout}, addr)
 	if err != nil {
 		return nil, err
 	}
 	c := new(Conn)
-	c.tcpConn = tcpconn.(*net.TCPConn)
+	c.tcpConn = conn
+	c.bconn = buffconn.New(conn)
 	c.brokerSendChannel = make(chan brokerMsg, brokerChannelBufferSize)
+	c.watches = make(map[uint32]func(key, record []byte, overflow bool))
 	c.brokerReceiveChannelPool = sync.Pool{New: func() interface{} {
 		return make(chan result, 1)
 	}}
-	go broker(c, onClose)
+	//onClose shouldn't be called if the handshake fails, the connection is not returned
+	var state int32 //0: handshake, 1: established, 2: closed during the handshake
+	go broker(c, func() {
+		if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+			onClose()
+		}
+	})
+	err = c.handshake(token)
+	if err == nil && !atomic.CompareAndSwapInt32(&state, 0, 1) {
+		err = errors.New("Connection closed during the handshake")
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
 	return c, nil
 }
 
+//handshake negotiates the protocol version and features, then it authenticates the connection
+//with t, or with the token set by SetToken if t is nil
+func (c *Conn) handshake(t []byte) error {
+	if t == nil {
+		t = token
+	}
+	hello := protocol.Hello{Version: protocol.ProtocolVersion, Features: localFeatures()}
+	r := c.sendAndReceive(protocol.OpHello, nil, hello.Marshal(), 500*time.Millisecond)
+	if e, ok := r.Err.(responseError); ok && e == "Operation not supported" {
+		//Version 0 server, it doesn't know OpHello
+		log.Println("Server", c.tcpConn.RemoteAddr(), "uses protocol version 0")
+	} else if r.Err != nil {
+		return r.Err
+	} else {
+		h, err := protocol.HelloUnMarshal(r.Value)
+		if err != nil {
+			return err
+		}
+		c.version = h.Version
+		if c.version > protocol.ProtocolVersion {
+			c.version = protocol.ProtocolVersion
+		}
+		c.features = h.Features & localFeatures()
+		if c.Supports(protocol.FeatureCompression) {
+			c.bconn.SetCompression(true)
+		}
+	}
+	if t != nil {
+		r := c.sendAndReceive(protocol.OpAuth, nil, t, 500*time.Millisecond)
+		if r.Err != nil {
+			return r.Err
+		}
+	}
+	return nil
+}
+
+//Version returns the protocol version used by the connection
+func (c *Conn) Version() uint16 {
+	return c.version
+}
+
+//Supports returns true if both sides of the connection support the feature
+func (c *Conn) Supports(f protocol.Features) bool {
+	return c.features&f == f
+}
+
 func createQueue() (q *queue) {
 	q = new(queue)
 	q.pool = sync.Pool{New: func() interface{} {
@@ -145,7 +228,7 @@ func (q *queue) forall(callback func(tm *timeoutMsg)) {
 }
 
 func broker(c *Conn, onClose func()) {
-	bconn := buffconn.New(c.tcpConn)
+	bconn := c.bconn
 	waits := make(map[uint32]chan<- result)
 	pq := createQueue()
 	tickerActivation := make(chan bool)
@@ -163,7 +246,7 @@ func broker(c *Conn, onClose func()) {
 					w, ok := waits[tm.tid]
 					if ok {
 						delete(waits, tm.tid)
-						w <- result{nil, errors.New("Timeout" + fmt.Sprint("Local", c.tcpConn.LocalAddr(), "Remote", c.tcpConn.RemoteAddr()))}
+						w <- result{nil, errors.New("Timeout" + fmt.Sprint("Local", c.tcpConn.LocalAddr(), "Remote", c.tcpConn.RemoteAddr())), 0}
 					}
 				})
 				if pq.len() == 0 {
@@ -194,7 +277,7 @@ func broker(c *Conn, onClose func()) {
 							panic("w rch == nil")
 						}
 						delete(waits, tm.tid)
-						w <- result{nil, errors.New("Connection closed => fast timeout" + fmt.Sprint("Local", c.tcpConn.LocalAddr(), "Remote", c.tcpConn.RemoteAddr()))}
+						w <- result{nil, errors.New("Connection closed => fast timeout" + fmt.Sprint("Local", c.tcpConn.LocalAddr(), "Remote", c.tcpConn.RemoteAddr())), 0}
 					}
 				})
 				bconn.Close()
@@ -238,9 +321,27 @@ func broker(c *Conn, onClose func()) {
 			if err != nil {
 				//Connection closed
 				mutex.Unlock()
+				c.watchMutex.Lock()
+				c.watches = nil
+				c.watchMutex.Unlock()
 				onClose()
 				return
 			}
+			if m.Type == protocol.OpWatchEvent || m.Type == protocol.OpWatchOverflow {
+				//Unsolicited message, its ID is the watch ID
+				mutex.Unlock()
+				c.watchMutex.Lock()
+				handler := c.watches[m.ID]
+				if m.Type == protocol.OpWatchOverflow {
+					//The server removed the watch
+					delete(c.watches, m.ID)
+				}
+				c.watchMutex.Unlock()
+				if handler != nil {
+					handler(m.Key, m.Value, m.Type == protocol.OpWatchOverflow)
+				}
+				continue
+			}
 			w, ok := waits[m.ID]
 			if !ok {
 				//Was timeout'ed
@@ -250,15 +351,21 @@ func broker(c *Conn, onClose func()) {
 			ch := w
 			delete(waits, m.ID)
 			mutex.Unlock()
+			var serverTime uint64
+			if len(m.Key) == 8 {
+				//Responses carry the server clock
+				serverTime = binary.LittleEndian.Uint64(m.Key)
+				hlc.Update(serverTime)
+			}
 			switch m.Type {
 			case protocol.OpResponse:
-				ch <- result{m.Value, nil}
+				ch <- result{m.Value, nil, serverTime}
 			case protocol.OpOK:
-				ch <- result{nil, nil}
+				ch <- result{nil, nil, serverTime}
 			case protocol.OpErr:
-				ch <- result{nil, errors.New("Response error: " + string(m.Value))}
+				ch <- result{nil, responseError(m.Value), serverTime}
 			default:
-				ch <- result{nil, errors.New("Invalid response operation code: " + fmt.Sprint(m.Type))}
+				ch <- result{nil, errors.New("Invalid response operation code: " + fmt.Sprint(m.Type)), 0}
 			}
 		}
 	}()
@@ -271,6 +378,16 @@ func (c *Conn) Close() {
 
 func (c *Conn) send(opType protocol.Operation, key, value []byte,
 	timeout time.Duration) chan result {
+	if err := protocol.CheckSize(key, value); err != nil {
+		//The server would close the connection
+		if timeout == 0 {
+			log.Println(err)
+			return nil
+		}
+		rch := c.brokerReceiveChannelPool.Get().(chan result)
+		rch <- result{nil, err, 0}
+		return rch
+	}
 	if timeout == 0 {
 		//Send-only
 		var m brokerMsg
@@ -320,9 +437,45 @@ type CASOperation struct {
 	c   *Conn
 }
 
+//IncrOperation is a pending increment, its response stores the new value
+type IncrOperation struct {
+	rch chan result
+	c   *Conn
+}
+
+//AppendOperation is a pending append
+type AppendOperation struct {
+	rch chan result
+	c   *Conn
+}
+
+//ScanOperation is a pending scan request, its response stores a page of pairs
+type ScanOperation struct {
+	rch chan result
+	c   *Conn
+}
+
+//RangeOperation is a pending range request, its response stores the pairs of the range
+type RangeOperation struct {
+	rch chan result
+	c   *Conn
+}
+
+//SubscribeOperation is a pending subscribe request, its response stores a page of changes
+type SubscribeOperation struct {
+	rch chan result
+	c   *Conn
+}
+
+//PaxosOperation is a pending Paxos request (prepare, propose or commit)
+type PaxosOperation struct {
+	rch chan result
+	c   *Conn
+}
+
 func (g *GetOperation) Wait() result {
 	if g.rch == nil {
-		return result{nil, errors.New("Already returned")}
+		return result{nil, errors.New("Already returned"), 0}
 	}
 	r := <-g.rch
 	g.c.brokerReceiveChannelPool.Put(g.rch)
@@ -360,6 +513,26 @@ func (g *CASOperation) Wait() error {
 	return r.Err
 }
 
+func (g *IncrOperation) Wait() result {
+	if g.rch == nil {
+		return result{nil, errors.New("Already returned"), 0}
+	}
+	r := <-g.rch
+	g.c.brokerReceiveChannelPool.Put(g.rch)
+	g.rch = nil
+	return r
+}
+
+func (g *AppendOperation) Wait() error {
+	if g.rch == nil {
+		return errors.New("Already returned")
+	}
+	r := <-g.rch
+	g.c.brokerReceiveChannelPool.Put(g.rch)
+	g.rch = nil
+	return r.Err
+}
+
 //Get the value of key
 func (c *Conn) Get(key []byte, timeout time.Duration) GetOperation {
 	if timeout <= 0 {
@@ -396,6 +569,146 @@ func (c *Conn) CAS(key []byte, value []byte, timeout time.Duration) CASOperation
 	return CASOperation{rch: ch, c: c}
 }
 
+//SetIfAbsent sets a new key/value pair only if the pair doesn't exists
+func (c *Conn) SetIfAbsent(key, value []byte, timeout time.Duration) SetOperation {
+	if timeout <= 0 {
+		panic("SetIfAbsent timeout <=0")
+	}
+	ch := c.send(protocol.OpSetIfAbsent, key, value, timeout)
+	return SetOperation{rch: ch, c: c}
+}
+
+//SetIfTimestamp sets a key/value pair only if the stored timestamp matches the expected one
+//value uses a special convention, see package pmap
+func (c *Conn) SetIfTimestamp(key, value []byte, timeout time.Duration) SetOperation {
+	if timeout <= 0 {
+		panic("SetIfTimestamp timeout <=0")
+	}
+	ch := c.send(protocol.OpSetIfTimestamp, key, value, timeout)
+	return SetOperation{rch: ch, c: c}
+}
+
+//Batch sends a serialized protocol.Batch, it will be applied atomically
+func (c *Conn) Batch(batch []byte, timeout time.Duration) SetOperation {
+	ch := c.send(protocol.OpBatch, nil, batch, timeout)
+	return SetOperation{rch: ch, c: c}
+}
+
+//Incr adds delta to the int64 value of key, the response stores the new value (8 bytes, little endian)
+func (c *Conn) Incr(key []byte, delta int64, timeout time.Duration) IncrOperation {
+	if timeout <= 0 {
+		panic("Incr timeout <=0")
+	}
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(delta))
+	ch := c.send(protocol.OpIncr, key, value, timeout)
+	return IncrOperation{rch: ch, c: c}
+}
+
+//Append appends value to the value of key
+func (c *Conn) Append(key, value []byte, timeout time.Duration) AppendOperation {
+	if timeout <= 0 {
+		panic("Append timeout <=0")
+	}
+	ch := c.send(protocol.OpAppend, key, value, timeout)
+	return AppendOperation{rch: ch, c: c}
+}
+
+//Scan requests a page of pairs of a chunk, see protocol.ScanRequest
+func (c *Conn) Scan(chunkID int, request *protocol.ScanRequest, timeout time.Duration) ScanOperation {
+	if timeout <= 0 {
+		panic("Scan timeout <=0")
+	}
+	key := make([]byte, 4)
+	binary.LittleEndian.PutUint32(key, uint32(chunkID))
+	ch := c.send(protocol.OpScan, key, request.Marshal(), timeout)
+	return ScanOperation{rch: ch, c: c}
+}
+
+//Wait waits for the response and returns the page
+func (g *ScanOperation) Wait() (*protocol.ScanPage, error) {
+	if g.rch == nil {
+		return nil, errors.New("Already returned")
+	}
+	r := <-g.rch
+	g.c.brokerReceiveChannelPool.Put(g.rch)
+	g.rch = nil
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return protocol.ScanPageUnMarshal(r.Value)
+}
+
+//Range requests the pairs of a chunk in a key range, see protocol.RangeRequest
+func (c *Conn) Range(chunkID int, request *protocol.RangeRequest, timeout time.Duration) RangeOperation {
+	if timeout <= 0 {
+		panic("Range timeout <=0")
+	}
+	key := make([]byte, 4)
+	binary.LittleEndian.PutUint32(key, uint32(chunkID))
+	ch := c.send(protocol.OpRange, key, request.Marshal(), timeout)
+	return RangeOperation{rch: ch, c: c}
+}
+
+//Wait waits for the response and returns the pairs
+func (g *RangeOperation) Wait() (*protocol.RangeResult, error) {
+	if g.rch == nil {
+		return nil, errors.New("Already returned")
+	}
+	r := <-g.rch
+	g.c.brokerReceiveChannelPool.Put(g.rch)
+	g.rch = nil
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return protocol.RangeResultUnMarshal(r.Value)
+}
+
+//Subscribe requests the changes of a chunk written after a cursor, see protocol.SubscribeRequest
+func (c *Conn) Subscribe(chunkID int, request *protocol.SubscribeRequest, timeout time.Duration) SubscribeOperation {
+	if timeout <= 0 {
+		panic("Subscribe timeout <=0")
+	}
+	key := make([]byte, 4)
+	binary.LittleEndian.PutUint32(key, uint32(chunkID))
+	ch := c.send(protocol.OpSubscribe, key, request.Marshal(), timeout)
+	return SubscribeOperation{rch: ch, c: c}
+}
+
+//Wait waits for the response and returns the changes
+func (g *SubscribeOperation) Wait() (*protocol.ChangePage, error) {
+	if g.rch == nil {
+		return nil, errors.New("Already returned")
+	}
+	r := <-g.rch
+	g.c.brokerReceiveChannelPool.Put(g.rch)
+	g.rch = nil
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return protocol.ChangePageUnMarshal(r.Value)
+}
+
+//Wait waits for the response, prepare responses store a serialized protocol.PaxosPromise
+func (g *PaxosOperation) Wait() result {
+	if g.rch == nil {
+		return result{nil, errors.New("Already returned"), 0}
+	}
+	r := <-g.rch
+	g.c.brokerReceiveChannelPool.Put(g.rch)
+	g.rch = nil
+	return r
+}
+
+//Paxos sends a Paxos request, op should be OpPaxosPrepare, OpPaxosPropose or OpPaxosCommit
+func (c *Conn) Paxos(op protocol.Operation, key, value []byte, timeout time.Duration) PaxosOperation {
+	if timeout <= 0 {
+		panic("Paxos timeout <=0")
+	}
+	ch := c.send(op, key, value, timeout)
+	return PaxosOperation{rch: ch, c: c}
+}
+
 func (c *Conn) SetNoDelay() {
 	c.send(protocol.OpSetNoDelay, nil, nil, 0)
 }
@@ -426,6 +739,60 @@ func (c *Conn) AddServerToGroup(addr string) error {
 	return r.Err
 }
 
+//ForgetNode request to remove a server from the server group
+func (c *Conn) ForgetNode(addr string) error {
+	key := []byte(addr)
+	r := c.sendAndReceive(protocol.OpForgetNode, key, nil, 500*time.Millisecond)
+	return r.Err
+}
+
+//CreateKeyspace request to create a named keyspace
+func (c *Conn) CreateKeyspace(k *protocol.Keyspace) error {
+	r := c.sendAndReceive(protocol.OpCreateKeyspace, nil, k.Marshal(), 500*time.Millisecond)
+	return r.Err
+}
+
+//Watch asks the server to notify the writes of key (or of every key with the prefix key) made on its chunks
+//handler is called by the connection reader for each notification, it must not block
+//handler is called with overflow set if the server removed the watch because it dropped notifications
+//Watches are lost when the connection is closed
+func (c *Conn) Watch(id uint32, key []byte, prefix bool, handler func(key, record []byte, overflow bool)) error {
+	c.watchMutex.Lock()
+	if c.watches == nil {
+		c.watchMutex.Unlock()
+		return errors.New("Connection closed")
+	}
+	c.watches[id] = handler
+	c.watchMutex.Unlock()
+	request := protocol.WatchRequest{ID: id, Prefix: prefix}
+	r := c.sendAndReceive(protocol.OpWatch, key, request.Marshal(), 500*time.Millisecond)
+	if r.Err != nil {
+		c.watchMutex.Lock()
+		delete(c.watches, id)
+		c.watchMutex.Unlock()
+	}
+	return r.Err
+}
+
+//Unwatch cancels a watch
+func (c *Conn) Unwatch(id uint32) error {
+	c.watchMutex.Lock()
+	delete(c.watches, id)
+	c.watchMutex.Unlock()
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, id)
+	r := c.sendAndReceive(protocol.OpUnwatch, nil, value, 500*time.Millisecond)
+	return r.Err
+}
+
+//Watching returns true if the watch is active on this connection
+func (c *Conn) Watching(id uint32) bool {
+	c.watchMutex.Lock()
+	defer c.watchMutex.Unlock()
+	_, ok := c.watches[id]
+	return ok
+}
+
 func (c *Conn) Protect(chunkID int) error {
 	key := make([]byte, 4) //TODO static array
 	binary.LittleEndian.PutUint32(key, uint32(chunkID))
@@ -451,7 +818,7 @@ func (c *Conn) GetChunkInfo(chunkID int) (size uint64, err error) {
 	UDP
 */
 //UDPRequest sends an UDP request to the specified address with a timeout
-func UDPRequest(addr string, timeout time.Duration) (response *protocol.AmAlive, err error) {
+func UDPRequest(addr string, request protocol.HeartbeatRequest, timeout time.Duration) (response *protocol.AmAlive, err error) {
 	conn, err := net.ListenUDP("udp", nil)
 	if err != nil {
 		return nil, err
@@ -462,14 +829,30 @@ func UDPRequest(addr string, timeout time.Duration) (response *protocol.AmAlive,
 		return nil, err
 	}
 	conn.SetDeadline(time.Now().Add(timeout))
-	conn.WriteTo([]byte("ping"), destAddr)
+	packet := request.Marshal()
+	var nonce uint64
+	key := sendingKey()
+	if key != nil {
+		nonce = newNonce()
+		packet = protocol.SignHeartbeatRequest(key, packet, nonce, time.Now().UnixNano())
+	}
+	conn.WriteTo(packet, destAddr)
 	for {
-		message := make([]byte, protocol.MaxHeartbeatSize)
+		message := make([]byte, protocol.MaxHeartbeatSize+protocol.HeartbeatResponseSignatureSize)
 		n, readAddr, err := conn.ReadFromUDP(message)
 		if err != nil {
 			return nil, err
 		} else if readAddr.IP.Equal(destAddr.IP) {
-			aa, err := protocol.AmAliveUnMarshal(message[:n])
+			response := message[:n]
+			if key != nil {
+				response, err = protocol.VerifyHeartbeatResponse(key, response, nonce)
+				if err != nil {
+					//Wait for the genuine response
+					log.Println(err, readAddr)
+					continue
+				}
+			}
+			aa, err := protocol.AmAliveUnMarshal(response)
 			if err != nil {
 				log.Println(err)
 			}
@@ -0,0 +1,26 @@
+package com
+
+import "github.com/dv343/treeless/com/protocol"
+
+/*
+	Compression
+
+	Connections compress their write batches (see protocol.OpCompressed) if both sides enabled compression,
+	it is negotiated by the OpHello handshake (see protocol.FeatureCompression).
+*/
+
+var compression bool
+
+//SetCompression enables or disables the compression of new connections, including accepted ones
+//It should be called before creating connections or starting servers
+func SetCompression(enabled bool) {
+	compression = enabled
+}
+
+//localFeatures returns the features offered to the other side of new connections
+func localFeatures() protocol.Features {
+	if compression {
+		return protocol.SupportedFeatures
+	}
+	return protocol.SupportedFeatures &^ protocol.FeatureCompression
+}
@@ -1,6 +1,8 @@
 package com
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -13,24 +15,90 @@ import (
 type Server struct {
 	localIP string
 	//Net
-	tcpListener *net.TCPListener
-	udpListener *net.UDPConn
+	tcpListener  *net.TCPListener
+	udpListener  *net.UDPConn
+	unixListener net.Listener //nil if there is no Unix domain socket, see SetUnixSocket
 	//Status
 	stopped int32
 }
 
 //TCPCallback is the main callback, it returns a response message, if the response message type is 0 the response will be dropped
-type TCPCallback func(protocol.Message) (response protocol.Message)
+//peer can be used to send unsolicited messages to the other side of the connection
+type TCPCallback func(message protocol.Message, peer *Peer) (response protocol.Message)
 
-//UDPCallback function should respond to incoming UDP pings
-type UDPCallback func() protocol.AmAlive
+//Peer is the client side of an accepted TCP connection
+type Peer struct {
+	conn   *buffconn.Conn
+	closed chan struct{}
+	role   protocol.Role
+	hello  protocol.Hello //Protocol version and features supported by both sides
+}
+
+//Push sends an unsolicited message to the peer, it fails if the connection is closed
+func (p *Peer) Push(m protocol.Message) error {
+	select {
+	case <-p.closed:
+		return errors.New("Connection closed")
+	default:
+	}
+	return p.conn.Write(m)
+}
+
+//Closed returns a channel that will be closed when the connection is closed
+func (p *Peer) Closed() <-chan struct{} {
+	return p.closed
+}
 
-//Start a Treeless server
-func Start(localIP string, localPort int, tcpCallback func(protocol.Message) (response protocol.Message), udpCallback UDPCallback) *Server {
+//Role returns the role of the authenticated peer, it should be called by the TCP callback
+func (p *Peer) Role() protocol.Role {
+	return p.role
+}
+
+//SetRole sets the role of the authenticated peer, it should be called by the TCP callback
+func (p *Peer) SetRole(r protocol.Role) {
+	p.role = r
+}
+
+//Hello negotiates the protocol version and features with the peer hello, it returns the local hello
+//It should be called by the TCP callback
+func (p *Peer) Hello(h *protocol.Hello) (*protocol.Hello, error) {
+	if h.Version < protocol.MinProtocolVersion {
+		return nil, errors.New("Unsupported protocol version " + fmt.Sprint(h.Version))
+	}
+	p.hello.Version = h.Version
+	if p.hello.Version > protocol.ProtocolVersion {
+		p.hello.Version = protocol.ProtocolVersion
+	}
+	p.hello.Features = h.Features & localFeatures()
+	if p.Supports(protocol.FeatureCompression) {
+		p.conn.SetCompression(true)
+	}
+	return &protocol.Hello{Version: protocol.ProtocolVersion, Features: localFeatures()}, nil
+}
+
+//Version returns the protocol version used by the peer, 0 if it didn't send OpHello
+func (p *Peer) Version() uint16 {
+	return p.hello.Version
+}
+
+//Supports returns true if both sides of the connection support the feature
+func (p *Peer) Supports(f protocol.Features) bool {
+	return p.hello.Features&f == f
+}
+
+//UDPCallback function should respond to incoming UDP pings, the response will be dropped if ok is false
+//node is true if the request was signed by a server group node, see SetHeartbeatNodeKey
+type UDPCallback func(request protocol.HeartbeatRequest, node bool) (response protocol.AmAlive, ok bool)
+
+//Start a Treeless server, it also listens on a Unix domain socket if it is set, see SetUnixSocket
+func Start(localIP string, localPort int, tcpCallback TCPCallback, udpCallback UDPCallback) *Server {
 	s := new(Server)
 	s.localIP = localIP
 	listenUDP(s, udpCallback, localPort)
 	listenTCP(s, tcpCallback, localPort)
+	if unixSocket != "" {
+		listenUnix(s, tcpCallback)
+	}
 	return s
 }
 
@@ -44,20 +112,25 @@ func (s *Server) Stop() {
 	atomic.StoreInt32(&s.stopped, 1)
 	s.tcpListener.Close()
 	s.udpListener.Close()
+	if s.unixListener != nil {
+		s.unixListener.Close()
+	}
 }
 
 /*
 	TCP
 */
-func listenRequests(conn *net.TCPConn, worker TCPCallback) {
+func listenRequests(conn net.Conn, worker TCPCallback) {
 	//log.Println("New connection accepted. Connection ID:", id)
 	go func() {
 		c := buffconn.New(conn)
+		peer := &Peer{conn: c, closed: make(chan struct{})}
 		defer c.Close()
+		defer close(peer.closed)
 		for {
 			msg, err := c.Read()
 			if err == nil {
-				response := worker(msg)
+				response := worker(msg, peer)
 				if response.Type > 0 {
 					//fmt.Println(msg.Type, response.Type, conn.LocalAddr().String(), conn.RemoteAddr().String())
 					c.Write(response)
@@ -78,24 +151,30 @@ func listenTCP(s *Server, callback TCPCallback, port int) {
 	if err != nil {
 		panic(err)
 	}
-	go func(s *Server) {
-		var tcpConnections []*net.TCPConn
-		for {
-			conn, err := s.tcpListener.AcceptTCP()
-			//log.Println("TCP Accept", conn, "ASD", conn.LocalAddr(), conn.RemoteAddr())
-			if err != nil {
-				for _, conn := range tcpConnections {
-					conn.Close()
-				}
-				if s.IsStopped() {
-					return
-				}
-				panic(err)
+	go accept(s, s.tcpListener, serverTLS, callback)
+}
+
+//accept accepts the connections of a listener, tlsConfig is nil if TLS is disabled
+func accept(s *Server, l net.Listener, tlsConfig *tls.Config, callback TCPCallback) {
+	var connections []net.Conn
+	for {
+		conn, err := l.Accept()
+		//log.Println("TCP Accept", conn, "ASD", conn.LocalAddr(), conn.RemoteAddr())
+		if err != nil {
+			for _, conn := range connections {
+				conn.Close()
+			}
+			if s.IsStopped() {
+				return
 			}
-			tcpConnections = append(tcpConnections, conn)
-			go listenRequests(conn, callback)
+			panic(err)
 		}
-	}(s)
+		if tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
+		}
+		connections = append(connections, conn)
+		go listenRequests(conn, callback)
+	}
 }
 
 /*
@@ -107,9 +186,11 @@ func listenUDP(s *Server, callback UDPCallback, udpPort int) *net.UDPConn {
 	if err != nil {
 		panic(err)
 	}
+	nonces := newNonceCache()
 	go func(s *Server) {
 		for {
-			_, addr, err := conn.ReadFromUDP(nil)
+			message := make([]byte, protocol.MaxHeartbeatSize+protocol.HeartbeatRequestSignatureSize)
+			n, addr, err := conn.ReadFromUDP(message)
 			if err != nil {
 				conn.Close()
 				if s.IsStopped() {
@@ -117,11 +198,36 @@ func listenUDP(s *Server, callback UDPCallback, udpPort int) *net.UDPConn {
 				}
 				panic(err)
 			}
-			saa := callback()
-			_, err = conn.WriteTo(saa.Marshal(), addr)
+			packet, nonce, key, node, err := nonces.authenticate(message[:n])
+			if err != nil {
+				log.Println(err, addr)
+				continue
+			}
+			request, err := protocol.HeartbeatRequestUnMarshal(packet)
 			if err != nil {
 				log.Println(err)
+				continue
 			}
+			//Indirect pings block until the target responds, don't delay other requests
+			go func(request protocol.HeartbeatRequest, addr *net.UDPAddr, nonce uint64) {
+				saa, ok := callback(request, node)
+				if !ok {
+					return
+				}
+				response, err := saa.Marshal()
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				if key != nil {
+					//Responses are signed with the key of the request
+					response = protocol.SignHeartbeatResponse(key, response, nonce)
+				}
+				_, err = conn.WriteTo(response, addr)
+				if err != nil {
+					log.Println(err)
+				}
+			}(*request, addr, nonce)
 		}
 	}(s)
 	return conn
@@ -0,0 +1,122 @@
+package com
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+/*
+	Heartbeat authentication
+
+	Heartbeats are signed when a heartbeat key is set (see protocol.SignHeartbeatRequest),
+	unsigned or badly signed packets are dropped. Every node and client of a server group should use the same key.
+	Requests older (or newer) than heartbeatMaxAge are dropped, so clocks should be loosely synchronized.
+
+	Clients know the heartbeat key, so it doesn't authenticate the membership gossip (see protocol.HeartbeatRequest.Origin).
+	Nodes sign their requests with the node key instead (see SetHeartbeatNodeKey), only the requests signed with it
+	are node requests. Without a node key every accepted request is a node request.
+*/
+
+var heartbeatKey []byte //nil means unsigned heartbeats
+
+var heartbeatNodeKey []byte //Key of the requests sent by nodes, nil means that they use heartbeatKey
+
+//heartbeatMaxAge is the maximum difference between the time of a request and the receiver clock
+var heartbeatMaxAge = time.Second * 10
+
+//SetHeartbeatKey sets the key used to sign heartbeats, "" disables the signatures
+//It should be called before starting servers or sending heartbeats
+func SetHeartbeatKey(key string) {
+	if key == "" {
+		heartbeatKey = nil
+	} else {
+		heartbeatKey = []byte(key)
+	}
+}
+
+//SetHeartbeatNodeKey sets the key used by the server group nodes to sign their heartbeats, it shouldn't be known by clients
+//Requests signed with the heartbeat key are still answered, but they aren't node requests
+//It should be called before starting servers or sending heartbeats
+func SetHeartbeatNodeKey(key string) {
+	if key == "" {
+		heartbeatNodeKey = nil
+	} else {
+		heartbeatNodeKey = []byte(key)
+	}
+}
+
+//sendingKey returns the key used to sign the sent requests, nil if they are unsigned
+func sendingKey() []byte {
+	if heartbeatNodeKey != nil {
+		return heartbeatNodeKey
+	}
+	return heartbeatKey
+}
+
+//newNonce returns a random request nonce
+func newNonce() uint64 {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+//nonceCache stores the nonces of the recently accepted requests
+type nonceCache struct {
+	seen      map[uint64]time.Time //Nonce expiration time by nonce
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[uint64]time.Time), lastPrune: time.Now()}
+}
+
+//authenticate checks a request packet, it returns the request, its nonce and the key that signed it (nil if unsigned)
+//node is true if the request was sent by a server group node
+func (c *nonceCache) authenticate(packet []byte) (request []byte, nonce uint64, key []byte, node bool, err error) {
+	if heartbeatNodeKey != nil {
+		if request, nonce, err = c.verify(heartbeatNodeKey, packet); err == nil {
+			return request, nonce, heartbeatNodeKey, true, nil
+		}
+	}
+	if heartbeatKey == nil {
+		return packet, 0, nil, heartbeatNodeKey == nil, nil
+	}
+	request, nonce, err = c.verify(heartbeatKey, packet)
+	return request, nonce, heartbeatKey, heartbeatNodeKey == nil, err
+}
+
+//verify checks the signature, time and nonce of a request packet, it returns the request and its nonce
+func (c *nonceCache) verify(key, packet []byte) ([]byte, uint64, error) {
+	request, nonce, t, err := protocol.VerifyHeartbeatRequest(key, packet)
+	if err != nil {
+		return nil, 0, err
+	}
+	now := time.Now()
+	sent := time.Unix(0, t)
+	if now.Sub(sent) > heartbeatMaxAge || sent.Sub(now) > heartbeatMaxAge {
+		return nil, 0, errors.New("Heartbeat request dropped: time out of the accepted window")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.Sub(c.lastPrune) > heartbeatMaxAge {
+		for n, expiration := range c.seen {
+			if now.After(expiration) {
+				delete(c.seen, n)
+			}
+		}
+		c.lastPrune = now
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return nil, 0, errors.New("Heartbeat request dropped: replayed nonce")
+	}
+	//Requests with this nonce will be rejected by the time window after the expiration
+	c.seen[nonce] = sent.Add(heartbeatMaxAge)
+	return request, nonce, nil
+}
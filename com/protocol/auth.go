@@ -0,0 +1,51 @@
+package protocol
+
+import "errors"
+
+/*
+	OpAuth messages
+
+	When authentication is enabled each connection should start with an OpAuth message (after OpHello),
+	its value stores the token (a shared secret), the response is OpOK or OpErr.
+	Operations sent before the authentication, or not allowed to the token role, are rejected with OpErr.
+*/
+
+//Role is the set of operations allowed to an authenticated connection
+type Role uint8
+
+//These constants represents the different roles
+const (
+	RoleNone    Role = iota //No operation allowed, connections are not authenticated yet
+	RoleClient              //Data operations and server group configuration reads
+	RoleCluster             //Every operation, used by server group nodes and administration tools
+)
+
+//ParseRole returns the role named s ("client" or "cluster")
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "client":
+		return RoleClient, nil
+	case "cluster":
+		return RoleCluster, nil
+	}
+	return RoleNone, errors.New("Unknown role " + s)
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleClient:
+		return "client"
+	case RoleCluster:
+		return "cluster"
+	}
+	return "none"
+}
+
+//Allows returns true if the role can send op messages
+func (r Role) Allows(op Operation) bool {
+	switch op {
+	case OpAddServerToGroup, OpGetChunkInfo, OpProtect, OpTransfer, OpDefrag, OpForgetNode, OpCreateKeyspace:
+		return r >= RoleCluster
+	}
+	return r >= RoleClient
+}
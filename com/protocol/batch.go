@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	OpBatch messages
+
+	An OpBatch value stores a list of set and delete operations, every key should belong to the same chunk.
+	Each operation is serialized this way:
+		1 byte:				operation type (OpSet or OpDel)
+		4 bytes:			key len
+		4 bytes:			value len
+		key len bytes:		key
+		value len bytes:	value (timestamp header + value, delete operations only store the timestamp)
+*/
+
+//BatchOp is a set or delete operation of a batch
+type BatchOp struct {
+	Type       Operation
+	Key, Value []byte
+}
+
+//Batch is a list of operations that should be applied atomically
+type Batch []BatchOp
+
+//Marshal serializes the batch
+func (b Batch) Marshal() []byte {
+	size := 0
+	for _, op := range b {
+		size += 9 + len(op.Key) + len(op.Value)
+	}
+	msg := make([]byte, size)
+	i := 0
+	for _, op := range b {
+		msg[i] = byte(op.Type)
+		binary.LittleEndian.PutUint32(msg[i+1:], uint32(len(op.Key)))
+		binary.LittleEndian.PutUint32(msg[i+5:], uint32(len(op.Value)))
+		i += 9
+		i += copy(msg[i:], op.Key)
+		i += copy(msg[i:], op.Value)
+	}
+	return msg
+}
+
+//BatchUnMarshal deserializes a batch, returned operations reference msg
+func BatchUnMarshal(msg []byte) (Batch, error) {
+	var b Batch
+	for len(msg) > 0 {
+		if len(msg) < 9 {
+			return nil, errors.New("Bad formatting, error 1")
+		}
+		var op BatchOp
+		op.Type = Operation(msg[0])
+		if op.Type != OpSet && op.Type != OpDel {
+			return nil, errors.New("Bad formatting, error 2")
+		}
+		keyLen := uint64(binary.LittleEndian.Uint32(msg[1:]))
+		valueLen := uint64(binary.LittleEndian.Uint32(msg[5:]))
+		msg = msg[9:]
+		if uint64(len(msg)) < keyLen+valueLen {
+			return nil, errors.New("Bad formatting, error 3")
+		}
+		op.Key = msg[:keyLen]
+		op.Value = msg[keyLen : keyLen+valueLen]
+		msg = msg[keyLen+valueLen:]
+		b = append(b, op)
+	}
+	return b, nil
+}
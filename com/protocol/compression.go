@@ -0,0 +1,13 @@
+package protocol
+
+/*
+	OpCompressed messages
+
+	Connections that negotiated FeatureCompression can wrap a batch of messages on an OpCompressed message,
+	its value is a DEFLATE stream (RFC 1951) of the serialized messages, its ID and key are not used.
+	Receivers process the wrapped messages in order, as if they were received without compression.
+	Batches smaller than CompressionThreshold and batches that don't compress are sent without compression.
+*/
+
+//CompressionThreshold is the minimum size of a compressed batch of messages
+const CompressionThreshold = 512
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/*
+	OpSubscribe messages
+
+	A change feed is the sequence of records written to a chunk store: sets, overwritten pairs and
+	deletions (records with an empty value), in write order.
+	Feed positions are scan cursors (see OpScan), they are only valid on the same chunk holder.
+	Subscribers stream the feed with OpSubscribe requests, resuming from the cursor returned by the previous one.
+	If there are no changes after the cursor the server holds the request until a change is written or
+	the wait time expires, then it responds (possibly with an empty page). Servers without FeatureFeedWait
+	ignore the wait time and respond immediately.
+	The zero cursor is the beginning of the feed. Cursors of unknown revisions (the chunk was released or
+	too many defrags were made) are rejected with an error starting with ErrInvalidCursor.
+
+	An OpSubscribe message key stores the chunk ID (4 bytes), its value stores the request:
+		8 bytes:			cursor revision
+		8 bytes:			cursor offset
+		4 bytes:			maximum number of changes to return
+		4 bytes:			wait time in milliseconds (optional)
+
+	The response value stores a page:
+		8 bytes:			next cursor revision
+		8 bytes:			next cursor offset
+		4 bytes:			number of changes (N)
+		N*8 bytes:			store offset of each change
+		Then, each change is serialized like an OpScan pair, deletions have an empty value
+*/
+
+//ErrInvalidCursor is the prefix of the errors returned by servers when a feed cursor can't be resumed
+const ErrInvalidCursor = "Invalid feed cursor"
+
+//MaxSubscribeWait is the longest wait time of an OpSubscribe request, longer wait times are shortened
+const MaxSubscribeWait = time.Minute
+
+//SubscribeRequest asks for the changes of a chunk written after a cursor
+//If there are no changes the server waits up to Wait for new changes before responding
+type SubscribeRequest struct {
+	Cursor ScanCursor
+	Limit  int
+	Wait   time.Duration
+}
+
+//ChangePage is a list of changes of a chunk
+//The changes are stored at Offsets (of revision Next.Revision), Next is the position after the last one
+type ChangePage struct {
+	Next         ScanCursor
+	Offsets      []uint64
+	Keys, Values [][]byte
+}
+
+//Marshal serializes the request
+func (r *SubscribeRequest) Marshal() []byte {
+	msg := make([]byte, 24)
+	binary.LittleEndian.PutUint64(msg, uint64(r.Cursor.Revision))
+	binary.LittleEndian.PutUint64(msg[8:], r.Cursor.Offset)
+	binary.LittleEndian.PutUint32(msg[16:], uint32(r.Limit))
+	binary.LittleEndian.PutUint32(msg[20:], uint32(r.Wait/time.Millisecond))
+	return msg
+}
+
+//SubscribeRequestUnMarshal deserializes a request
+func SubscribeRequestUnMarshal(msg []byte) (*SubscribeRequest, error) {
+	if len(msg) < 20 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	r := new(SubscribeRequest)
+	r.Cursor.Revision = int64(binary.LittleEndian.Uint64(msg))
+	r.Cursor.Offset = binary.LittleEndian.Uint64(msg[8:])
+	r.Limit = int(binary.LittleEndian.Uint32(msg[16:]))
+	if len(msg) >= 24 {
+		r.Wait = time.Duration(binary.LittleEndian.Uint32(msg[20:])) * time.Millisecond
+	}
+	if r.Wait > MaxSubscribeWait {
+		r.Wait = MaxSubscribeWait
+	}
+	return r, nil
+}
+
+//Marshal serializes the page
+func (p *ChangePage) Marshal() []byte {
+	header := 20 + 8*len(p.Offsets)
+	msg := marshalPairs(header, p.Keys, p.Values)
+	binary.LittleEndian.PutUint64(msg, uint64(p.Next.Revision))
+	binary.LittleEndian.PutUint64(msg[8:], p.Next.Offset)
+	binary.LittleEndian.PutUint32(msg[16:], uint32(len(p.Offsets)))
+	for i, offset := range p.Offsets {
+		binary.LittleEndian.PutUint64(msg[20+8*i:], offset)
+	}
+	return msg
+}
+
+//ChangePageUnMarshal deserializes a page, returned changes reference msg
+func ChangePageUnMarshal(msg []byte) (*ChangePage, error) {
+	if len(msg) < 20 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	p := new(ChangePage)
+	p.Next.Revision = int64(binary.LittleEndian.Uint64(msg))
+	p.Next.Offset = binary.LittleEndian.Uint64(msg[8:])
+	n := uint64(binary.LittleEndian.Uint32(msg[16:]))
+	if uint64(len(msg)-20)/8 < n {
+		return nil, errors.New("Bad formatting, error 2")
+	}
+	p.Offsets = make([]uint64, n)
+	for i := range p.Offsets {
+		p.Offsets[i] = binary.LittleEndian.Uint64(msg[20+8*i:])
+	}
+	var err error
+	p.Keys, p.Values, err = unmarshalPairs(msg[20+8*n:])
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Keys) != len(p.Offsets) {
+		return nil, errors.New("Bad formatting, error 3")
+	}
+	return p, nil
+}
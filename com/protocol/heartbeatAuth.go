@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	Signed heartbeats
+
+	When the server group uses a heartbeat key, UDP packets are signed with HMAC-SHA256.
+	Requests are followed by:
+		8 bytes:			nonce, random
+		8 bytes:			sender time (Unix nanoseconds)
+		32 bytes:			HMAC of "Q" + request + nonce + time
+	Responses are followed by:
+		32 bytes:			HMAC of "R" + request nonce + response
+	Receivers reject requests with an old time or an already seen nonce, and responses that don't match
+	the nonce of their request, so recorded packets can't be replayed.
+*/
+
+//HeartbeatRequestSignatureSize is the number of bytes added to signed requests
+const HeartbeatRequestSignatureSize = 16 + sha256.Size
+
+//HeartbeatResponseSignatureSize is the number of bytes added to signed responses
+const HeartbeatResponseSignatureSize = sha256.Size
+
+//SignHeartbeatRequest returns the signed packet of a serialized request
+func SignHeartbeatRequest(key, request []byte, nonce uint64, t int64) []byte {
+	packet := make([]byte, len(request)+16, len(request)+HeartbeatRequestSignatureSize)
+	copy(packet, request)
+	binary.LittleEndian.PutUint64(packet[len(request):], nonce)
+	binary.LittleEndian.PutUint64(packet[len(request)+8:], uint64(t))
+	return append(packet, heartbeatMAC(key, 'Q', packet)...)
+}
+
+//VerifyHeartbeatRequest checks the signature of a request packet, it returns the request, its nonce and time
+func VerifyHeartbeatRequest(key, packet []byte) (request []byte, nonce uint64, t int64, err error) {
+	if len(packet) < HeartbeatRequestSignatureSize {
+		return nil, 0, 0, errors.New("Unsigned heartbeat request")
+	}
+	signed := packet[:len(packet)-sha256.Size]
+	if !hmac.Equal(heartbeatMAC(key, 'Q', signed), packet[len(signed):]) {
+		return nil, 0, 0, errors.New("Invalid heartbeat request signature")
+	}
+	request = signed[:len(signed)-16]
+	nonce = binary.LittleEndian.Uint64(signed[len(request):])
+	t = int64(binary.LittleEndian.Uint64(signed[len(request)+8:]))
+	return request, nonce, t, nil
+}
+
+//SignHeartbeatResponse returns the signed packet of a serialized response to the request with nonce
+func SignHeartbeatResponse(key, response []byte, nonce uint64) []byte {
+	packet := make([]byte, len(response), len(response)+HeartbeatResponseSignatureSize)
+	copy(packet, response)
+	return append(packet, heartbeatResponseMAC(key, response, nonce)...)
+}
+
+//VerifyHeartbeatResponse checks the signature of a response packet to the request with nonce, it returns the response
+func VerifyHeartbeatResponse(key, packet []byte, nonce uint64) ([]byte, error) {
+	if len(packet) < HeartbeatResponseSignatureSize {
+		return nil, errors.New("Unsigned heartbeat response")
+	}
+	response := packet[:len(packet)-sha256.Size]
+	if !hmac.Equal(heartbeatResponseMAC(key, response, nonce), packet[len(response):]) {
+		return nil, errors.New("Invalid heartbeat response signature")
+	}
+	return response, nil
+}
+
+func heartbeatResponseMAC(key, response []byte, nonce uint64) []byte {
+	b := make([]byte, 8+len(response))
+	binary.LittleEndian.PutUint64(b, nonce)
+	copy(b[8:], response)
+	return heartbeatMAC(key, 'R', b)
+}
+
+func heartbeatMAC(key []byte, kind byte, b []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{kind})
+	mac.Write(b)
+	return mac.Sum(nil)
+}
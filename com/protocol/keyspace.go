@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+	"github.com/dv343/treeless/hashing"
+)
+
+//Conflict policies, they select how Set resolves concurrent writes
+const (
+	//ConflictLastWriteWins keeps the write with the newest timestamp
+	ConflictLastWriteWins = "lww"
+	//ConflictSiblings keeps concurrent writes as siblings, see package vclock
+	ConflictSiblings = "siblings"
+)
+
+/*
+	OpCreateKeyspace messages
+
+	An OpCreateKeyspace message value stores a JSON serialized Keyspace.
+	It should be sent to the key master of hashing.KeyspacesKey, which assigns the chunk IDs of the keyspace, and
+	the new configuration is spread to the other servers by the heartbeat (see configuration epochs).
+*/
+
+//ErrNotKeyspacesMaster is the error returned by servers that receive an OpCreateKeyspace message
+//without being the key master of hashing.KeyspacesKey
+const ErrNotKeyspacesMaster = "Keyspace creation rejected: this server is not the keyspaces key master"
+
+//Keyspace stores the settings of a named keyspace
+//Chunks of every keyspace share the chunk ID space, keyspace chunks follow the chunks of the default keyspace
+type Keyspace struct {
+	Name       string
+	NumChunks  int
+	Redundancy int
+	ChunkSize  uint64        //Chunk size in bytes, 0 means the chunk size of each server
+	TTL        time.Duration //Default time to live of the pairs, 0 means no expiration
+	Conflicts  string        //Conflict policy, "" means ConflictLastWriteWins
+	Ordered    bool          //Maintain an ordered index, needed by range queries
+	HashTags   bool          //Keys with a hash tag select their chunk by the tag, see hashing.HashTag
+	FirstChunk int           //ID of the first chunk of the keyspace, assigned on creation
+}
+
+//Validate returns an error if the settings are invalid
+func (k *Keyspace) Validate() error {
+	if !hashing.ValidKeyspaceName(k.Name) {
+		return errors.New("Invalid keyspace name")
+	}
+	if k.NumChunks <= 0 {
+		return errors.New("Invalid keyspace settings: NumChunks should be positive")
+	}
+	if k.NumChunks > MaxHeartbeatChunks {
+		return errors.New("Invalid keyspace settings: NumChunks can't be greater than " + strconv.Itoa(MaxHeartbeatChunks))
+	}
+	if k.Redundancy <= 0 || k.Redundancy > 8 {
+		return errors.New("Invalid keyspace settings: redundancy should be in the range [1, 8]")
+	}
+	if k.TTL < 0 {
+		return errors.New("Invalid keyspace settings: negative TTL")
+	}
+	if k.Conflicts != "" && k.Conflicts != ConflictLastWriteWins && k.Conflicts != ConflictSiblings {
+		return errors.New("Invalid keyspace settings: unknown conflict policy")
+	}
+	return nil
+}
+
+//ChunkID returns the ID of the chunk that stores key (unqualified, see hashing.SplitKeyspace)
+func (k *Keyspace) ChunkID(key []byte) int {
+	if k.HashTags {
+		return k.FirstChunk + hashing.GetTaggedChunkID(key, k.NumChunks)
+	}
+	return k.FirstChunk + hashing.GetChunkID(key, k.NumChunks)
+}
+
+//Marshal serializes the keyspace settings
+func (k *Keyspace) Marshal() []byte {
+	b, err := json.Marshal(k)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+//KeyspaceUnMarshal deserializes keyspace settings, they are validated
+func KeyspaceUnMarshal(msg []byte) (*Keyspace, error) {
+	k := new(Keyspace)
+	if err := json.Unmarshal(msg, k); err != nil {
+		return nil, err
+	}
+	if err := k.Validate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	Paxos messages, used by the linearizable CAS
+
+	Prepare requests store the ballot in the message value, optionally followed by the FNV1a64 hash of
+	a previous proposal of the proposer (8 bytes), the acceptor will report if it was chosen.
+	Propose and commit requests store the ballot followed by the proposed value (with its timestamp header).
+	Prepare responses store a serialized PaxosPromise.
+*/
+
+//BallotSize is the size of a serialized ballot
+const BallotSize = 16
+
+//Ballot is a Paxos proposal number, ballots are ordered by time and then by proposer ID
+type Ballot struct {
+	Time     uint64
+	Proposer uint64
+}
+
+//Less returns true if b is lower than o
+func (b Ballot) Less(o Ballot) bool {
+	return b.Time < o.Time || (b.Time == o.Time && b.Proposer < o.Proposer)
+}
+
+//IsZero returns true if b is the zero ballot, lower than any real ballot
+func (b Ballot) IsZero() bool {
+	return b.Time == 0 && b.Proposer == 0
+}
+
+//Marshal serializes b into a []byte
+func (b Ballot) Marshal() []byte {
+	msg := make([]byte, BallotSize)
+	binary.LittleEndian.PutUint64(msg, b.Time)
+	binary.LittleEndian.PutUint64(msg[8:], b.Proposer)
+	return msg
+}
+
+//BallotUnMarshal unserializes msg into a Ballot
+func BallotUnMarshal(msg []byte) (Ballot, error) {
+	if len(msg) < BallotSize {
+		return Ballot{}, errors.New("Bad ballot formatting")
+	}
+	return Ballot{Time: binary.LittleEndian.Uint64(msg), Proposer: binary.LittleEndian.Uint64(msg[8:])}, nil
+}
+
+//PaxosPromise stores the response of an acceptor to a prepare request
+type PaxosPromise struct {
+	Promised      bool   //True if the acceptor promised the requested ballot
+	Chosen        bool   //True if the proposal identified in the request was recently committed
+	Ballot        Ballot //Highest ballot promised by the acceptor
+	Committed     Ballot //Most recent committed ballot
+	Accepted      Ballot //Ballot of the accepted proposal, zero if there isn't any
+	AcceptedValue []byte //Accepted proposal value
+	Value         []byte //Stored value of the pair, nil if the pair doesn't exist
+}
+
+//Marshal serializes p into a []byte
+func (p *PaxosPromise) Marshal() []byte {
+	msg := make([]byte, 1+3*BallotSize+4+len(p.AcceptedValue)+len(p.Value))
+	if p.Promised {
+		msg[0] |= 1
+	}
+	if p.Chosen {
+		msg[0] |= 2
+	}
+	copy(msg[1:], p.Ballot.Marshal())
+	copy(msg[1+BallotSize:], p.Committed.Marshal())
+	copy(msg[1+2*BallotSize:], p.Accepted.Marshal())
+	m := msg[1+3*BallotSize:]
+	binary.LittleEndian.PutUint32(m, uint32(len(p.AcceptedValue)))
+	copy(m[4:], p.AcceptedValue)
+	copy(m[4+len(p.AcceptedValue):], p.Value)
+	return msg
+}
+
+//PaxosPromiseUnMarshal unserializes msg into a PaxosPromise object
+func PaxosPromiseUnMarshal(msg []byte) (*PaxosPromise, error) {
+	if len(msg) < 1+3*BallotSize+4 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	p := new(PaxosPromise)
+	p.Promised = msg[0]&1 != 0
+	p.Chosen = msg[0]&2 != 0
+	p.Ballot, _ = BallotUnMarshal(msg[1:])
+	p.Committed, _ = BallotUnMarshal(msg[1+BallotSize:])
+	p.Accepted, _ = BallotUnMarshal(msg[1+2*BallotSize:])
+	m := msg[1+3*BallotSize:]
+	l := int(binary.LittleEndian.Uint32(m))
+	if len(m) < 4+l {
+		return nil, errors.New("Bad formatting, error 2")
+	}
+	if l > 0 {
+		p.AcceptedValue = m[4 : 4+l]
+	}
+	if len(m) > 4+l {
+		p.Value = m[4+l:]
+	}
+	return p, nil
+}
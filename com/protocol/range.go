@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	OpRange messages
+
+	An OpRange message key stores the chunk ID (4 bytes), its value stores the request:
+		4 bytes:			maximum number of pairs to return
+		4 bytes:			start len
+		start len bytes:	start key (inclusive)
+		remaining bytes:	end key (exclusive), an empty end key means no upper bound
+
+	The response value stores:
+		1 byte:				1 if the result was truncated (there could be more pairs in the range), 0 otherwise
+		Then, the pairs in key order, serialized like the pairs of a scan page.
+*/
+
+//RangeRequest asks for the pairs of a chunk whose keys are in the range [Start, End)
+type RangeRequest struct {
+	Start, End []byte
+	Limit      int
+}
+
+//RangeResult stores the pairs of a range in key order
+type RangeResult struct {
+	More         bool //The result was truncated, more pairs could follow the last one
+	Keys, Values [][]byte
+}
+
+//Marshal serializes the request
+func (r *RangeRequest) Marshal() []byte {
+	msg := make([]byte, 8+len(r.Start)+len(r.End))
+	binary.LittleEndian.PutUint32(msg, uint32(r.Limit))
+	binary.LittleEndian.PutUint32(msg[4:], uint32(len(r.Start)))
+	copy(msg[8:], r.Start)
+	copy(msg[8+len(r.Start):], r.End)
+	return msg
+}
+
+//RangeRequestUnMarshal deserializes a request, returned keys reference msg
+func RangeRequestUnMarshal(msg []byte) (*RangeRequest, error) {
+	if len(msg) < 8 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	r := new(RangeRequest)
+	r.Limit = int(binary.LittleEndian.Uint32(msg))
+	startLen := uint64(binary.LittleEndian.Uint32(msg[4:]))
+	msg = msg[8:]
+	if uint64(len(msg)) < startLen {
+		return nil, errors.New("Bad formatting, error 2")
+	}
+	r.Start = msg[:startLen]
+	if uint64(len(msg)) > startLen {
+		r.End = msg[startLen:]
+	}
+	return r, nil
+}
+
+//Marshal serializes the result
+func (r *RangeResult) Marshal() []byte {
+	msg := marshalPairs(1, r.Keys, r.Values)
+	if r.More {
+		msg[0] = 1
+	}
+	return msg
+}
+
+//RangeResultUnMarshal deserializes a result, returned pairs reference msg
+func RangeResultUnMarshal(msg []byte) (*RangeResult, error) {
+	if len(msg) < 1 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	r := new(RangeResult)
+	r.More = msg[0] == 1
+	var err error
+	r.Keys, r.Values, err = unmarshalPairs(msg[1:])
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
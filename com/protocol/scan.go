@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	OpScan messages
+
+	An OpScan message key stores the chunk ID (4 bytes), its value stores the request:
+		8 bytes:			cursor revision
+		8 bytes:			cursor offset
+		4 bytes:			maximum number of pairs to return
+		remaining bytes:	key prefix, only keys starting with it are returned
+
+	The response value stores a page:
+		8 bytes:			next cursor revision
+		8 bytes:			next cursor offset
+		1 byte:				1 if the chunk scan is done, 0 otherwise
+		Then, each pair is serialized this way:
+		4 bytes:			key len
+		4 bytes:			value len
+		key len bytes:		key
+		value len bytes:	value (timestamp header + value)
+*/
+
+//ScanCursor is a position on a chunk store, its zero value is the start of the chunk
+//Offsets are only valid on the same chunk holder, the revision number changes when the chunk is defragmented
+type ScanCursor struct {
+	Revision int64
+	Offset   uint64
+}
+
+//ScanRequest asks for a page of pairs of a chunk
+type ScanRequest struct {
+	Cursor ScanCursor
+	Limit  int
+	Prefix []byte
+}
+
+//ScanPage is a page of pairs returned by a scan
+type ScanPage struct {
+	Next         ScanCursor
+	Done         bool
+	Keys, Values [][]byte
+}
+
+//Marshal serializes the request
+func (r *ScanRequest) Marshal() []byte {
+	msg := make([]byte, 20+len(r.Prefix))
+	binary.LittleEndian.PutUint64(msg, uint64(r.Cursor.Revision))
+	binary.LittleEndian.PutUint64(msg[8:], r.Cursor.Offset)
+	binary.LittleEndian.PutUint32(msg[16:], uint32(r.Limit))
+	copy(msg[20:], r.Prefix)
+	return msg
+}
+
+//ScanRequestUnMarshal deserializes a request, the returned prefix references msg
+func ScanRequestUnMarshal(msg []byte) (*ScanRequest, error) {
+	if len(msg) < 20 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	r := new(ScanRequest)
+	r.Cursor.Revision = int64(binary.LittleEndian.Uint64(msg))
+	r.Cursor.Offset = binary.LittleEndian.Uint64(msg[8:])
+	r.Limit = int(binary.LittleEndian.Uint32(msg[16:]))
+	r.Prefix = msg[20:]
+	return r, nil
+}
+
+//Marshal serializes the page
+func (p *ScanPage) Marshal() []byte {
+	msg := marshalPairs(17, p.Keys, p.Values)
+	binary.LittleEndian.PutUint64(msg, uint64(p.Next.Revision))
+	binary.LittleEndian.PutUint64(msg[8:], p.Next.Offset)
+	if p.Done {
+		msg[16] = 1
+	}
+	return msg
+}
+
+//ScanPageUnMarshal deserializes a page, returned pairs reference msg
+func ScanPageUnMarshal(msg []byte) (*ScanPage, error) {
+	if len(msg) < 17 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	p := new(ScanPage)
+	p.Next.Revision = int64(binary.LittleEndian.Uint64(msg))
+	p.Next.Offset = binary.LittleEndian.Uint64(msg[8:])
+	p.Done = msg[16] == 1
+	var err error
+	p.Keys, p.Values, err = unmarshalPairs(msg[17:])
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//marshalPairs serializes a list of pairs after a header of headerSize bytes
+func marshalPairs(headerSize int, keys, values [][]byte) []byte {
+	size := headerSize
+	for i := range keys {
+		size += 8 + len(keys[i]) + len(values[i])
+	}
+	msg := make([]byte, size)
+	i := headerSize
+	for k := range keys {
+		binary.LittleEndian.PutUint32(msg[i:], uint32(len(keys[k])))
+		binary.LittleEndian.PutUint32(msg[i+4:], uint32(len(values[k])))
+		i += 8
+		i += copy(msg[i:], keys[k])
+		i += copy(msg[i:], values[k])
+	}
+	return msg
+}
+
+//unmarshalPairs deserializes a list of pairs, returned pairs reference msg
+func unmarshalPairs(msg []byte) (keys, values [][]byte, err error) {
+	for len(msg) > 0 {
+		if len(msg) < 8 {
+			return nil, nil, errors.New("Bad formatting, error 2")
+		}
+		keyLen := uint64(binary.LittleEndian.Uint32(msg))
+		valueLen := uint64(binary.LittleEndian.Uint32(msg[4:]))
+		msg = msg[8:]
+		if uint64(len(msg)) < keyLen+valueLen {
+			return nil, nil, errors.New("Bad formatting, error 3")
+		}
+		keys = append(keys, msg[:keyLen])
+		values = append(values, msg[keyLen:keyLen+valueLen])
+		msg = msg[keyLen+valueLen:]
+	}
+	return keys, values, nil
+}
@@ -1,6 +1,9 @@
 package protocol
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+)
 
 /*
 	TCP treeless protocol
@@ -13,6 +16,13 @@ import "encoding/binary"
 		13:13+key len bytes:			key
 		13+key len:message size bytes:	value
 
+	Response messages (OpOK, OpErr and OpResponse) use the key to carry
+	the hybrid logical clock timestamp of the server (8 bytes).
+	OpWatchEvent and OpWatchOverflow messages are sent by servers without a request, see OpWatch.
+	OpCompressed messages wrap a batch of messages, see compression.go.
+
+	Keys and values longer than MaxKeySize and MaxValueSize are protocol violations,
+	connections are closed when they receive an invalid message.
 */
 
 //Operation represents a DB operation or result, the Message type
@@ -26,6 +36,19 @@ const (
 	OpAsyncSet
 	OpDel
 	OpCAS
+	OpPaxosPrepare
+	OpPaxosPropose
+	OpPaxosCommit
+	OpIncr
+	OpAppend
+	OpSetIfAbsent
+	OpSetIfTimestamp
+	OpBatch
+	OpScan
+	OpRange
+	OpSubscribe
+	OpWatch
+	OpUnwatch
 )
 const (
 	//Advanced ops
@@ -38,12 +61,18 @@ const (
 	OpSetNoDelay
 	OpDefrag
 	OpForgetNode
+	OpCreateKeyspace
+	OpAuth
+	OpHello
+	OpCompressed
 )
 const (
 	//Responses
 	OpOK Operation = iota + 200
 	OpErr
 	OpResponse
+	OpWatchEvent
+	OpWatchOverflow
 )
 
 //Message stores a DB message that can be sent and recieved using a network connection
@@ -56,6 +85,30 @@ type Message struct {
 //MinimumMessageSize is the minimum size of every Message
 const MinimumMessageSize = 13
 
+//MaxKeySize is the maximum key length of a message
+//It should be set before creating connections or starting servers, both sides should use the same limits
+var MaxKeySize = 64 * 1024
+
+//MaxValueSize is the maximum value length of a message, including batches and pages of pairs
+//It should be set before creating connections or starting servers, both sides should use the same limits
+var MaxValueSize = 64 * 1024 * 1024
+
+//MaxMessageSize returns the size of the longest valid message
+func MaxMessageSize() int {
+	return MinimumMessageSize + MaxKeySize + MaxValueSize
+}
+
+//CheckSize returns an error if the key or the value are too long to be sent
+func CheckSize(key, value []byte) error {
+	if len(key) > MaxKeySize {
+		return errors.New("Key too long")
+	}
+	if len(value) > MaxValueSize {
+		return errors.New("Value too long")
+	}
+	return nil
+}
+
 //Marshal serializes the message on the destination buffer if the destination buffer has enought size
 //If it doesn't it returns the message size and "true"
 func (m *Message) Marshal(dest []byte) (msgSize int, tooLong bool) {
@@ -75,15 +128,28 @@ func (m *Message) Marshal(dest []byte) (msgSize int, tooLong bool) {
 	return size, false
 }
 
-//Unmarshal unserializes a message from a buffer
+//Unmarshal unserializes a message from a buffer, src should store exactly one message
 //Returned message key and value are copied (src can be reused after calling this)
-func Unmarshal(src []byte) (m Message) {
+//It returns an error if the message is malformed or if it exceeds the size limits
+func Unmarshal(src []byte) (m Message, err error) {
+	if len(src) < MinimumMessageSize {
+		return m, errors.New("Bad formatting, message too short")
+	}
+	if int64(binary.LittleEndian.Uint32(src[0:4])) != int64(len(src)) {
+		return m, errors.New("Bad formatting, message size mismatch")
+	}
+	keySize := int64(binary.LittleEndian.Uint32(src[8:12]))
+	if keySize > int64(len(src)-MinimumMessageSize) {
+		return m, errors.New("Bad formatting, key size out of bounds")
+	}
+	if keySize > int64(MaxKeySize) || int64(len(src)-MinimumMessageSize)-keySize > int64(MaxValueSize) {
+		return m, errors.New("Message exceeds the size limits")
+	}
 	m.ID = binary.LittleEndian.Uint32(src[4:8])
-	keySize := binary.LittleEndian.Uint32(src[8:12])
 	m.Type = Operation(src[12])
 	array := make([]byte, len(src[13:]))
 	copy(array, src[13:])
 	m.Key = array[:keySize]
 	m.Value = array[keySize:]
-	return m
+	return m, nil
 }
@@ -7,63 +7,95 @@ import (
 
 const MaxHeartbeatSize = 1400
 
+//MaxHeartbeatChunks is the maximum number of chunks of a server group, the heartbeat responses list the chunks
+//known by a server and they should fit in MaxHeartbeatSize bytes
+const MaxHeartbeatChunks = (MaxHeartbeatSize - 3 - 20 - 2) / 12
+
+//HeartbeatVersion is the version of the heartbeat packet format, it is the first byte of requests and responses
+//Packets of other versions are rejected
+const HeartbeatVersion = 1
+
+var errHeartbeatVersion = errors.New("Unsupported heartbeat version")
+
 type AmAliveChunk struct {
 	ID       int
 	Checksum uint64
 }
 
+//MemberStatus is the status of a server group member as seen by the membership protocol
+type MemberStatus uint8
+
+//These constants represents the different member status
+const (
+	MemberAlive MemberStatus = iota
+	MemberSuspect
+	MemberDead
+)
+
+//MemberUpdate stores a membership change, these changes are piggybacked on heartbeats
+//Incarnation numbers are only incremented by the member itself to refute a suspicion
+type MemberUpdate struct {
+	Addr        string
+	Status      MemberStatus
+	Incarnation uint32
+}
+
 //AmAlive stores heartbeat information
 type AmAlive struct {
-	KnownChunks          []AmAliveChunk //Chunks known by the server
-	RecentlyAddedServers []string
-	RecentlyDeadServers  []string
+	KnownChunks []AmAliveChunk //Chunks known by the server
+	Incarnation uint32         //Incarnation number of the server
+	Epoch       uint64         //Server group configuration epoch known by the server
+	ConfigHash  uint64         //Server group configuration hash, it breaks the ties between configurations of the same epoch
+	Updates     []MemberUpdate //Piggybacked membership updates
+}
+
+//HeartbeatRequest stores a heartbeat request (ping)
+type HeartbeatRequest struct {
+	Target  string         //Indirect ping target, the receiver should ping it on behalf of the requester. Empty on direct pings
+	Origin  string         //Server group address of the requester, empty on client requests
+	Updates []MemberUpdate //Piggybacked membership updates
 }
 
-//Marshal serializes aa into a []byte
-func (aa *AmAlive) Marshal() []byte {
+//Marshal serializes aa into a []byte, it fails if aa has more than MaxHeartbeatChunks chunks
+func (aa *AmAlive) Marshal() ([]byte, error) {
+	if len(aa.KnownChunks) > MaxHeartbeatChunks {
+		return nil, errors.New("Too many chunks for a heartbeat response")
+	}
 	//KnownChunks
 	msg := make([]byte, MaxHeartbeatSize)
-	binary.LittleEndian.PutUint16(msg[0:], uint16(len(aa.KnownChunks)))
-	m := msg[2:]
+	msg[0] = HeartbeatVersion
+	binary.LittleEndian.PutUint16(msg[1:], uint16(len(aa.KnownChunks)))
+	m := msg[3:]
 	for _, c := range aa.KnownChunks {
 		binary.LittleEndian.PutUint32(m[:], uint32(c.ID))
 		binary.LittleEndian.PutUint64(m[4:], c.Checksum)
 		m = m[12:]
 	}
-
-	//RecentlyAddedServers
-	for _, addr := range aa.RecentlyAddedServers {
-		if len(addr)+64 >= len(m[:]) {
-			break
-		}
-		binary.LittleEndian.PutUint16(m, uint16(len([]byte(addr))))
-		copy(m[2:], addr)
-		m = m[2+len([]byte(addr)):]
-	}
-
-	binary.LittleEndian.PutUint16(m, 0)
-	m = m[2:]
-	//RecentlyDeadServers
-	for _, addr := range aa.RecentlyDeadServers {
-		if len(addr)+4 >= len(m[:]) {
-			break
-		}
-		binary.LittleEndian.PutUint16(m[:2], uint16(len([]byte(addr))))
-		copy(m[2:], addr)
-		m = m[2+len([]byte(addr)):]
-	}
-	binary.LittleEndian.PutUint16(m, 0)
-
-	return msg
+	binary.LittleEndian.PutUint32(m, aa.Incarnation)
+	binary.LittleEndian.PutUint64(m[4:], aa.Epoch)
+	binary.LittleEndian.PutUint64(m[12:], aa.ConfigHash)
+	m = m[20:]
+	marshalUpdates(m, aa.Updates)
+	return msg, nil
 }
 
 //AmAliveUnMarshal unserializes s into an AmAlive object
 func AmAliveUnMarshal(msg []byte) (*AmAlive, error) {
 	aa := new(AmAlive)
-	lenKnownChunks := binary.LittleEndian.Uint16(msg)
+	if len(msg) < 3 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	if msg[0] != HeartbeatVersion {
+		return nil, errHeartbeatVersion
+	}
+	lenKnownChunks := int(binary.LittleEndian.Uint16(msg[1:]))
+	m := msg[3:]
+	if len(m) < 12*lenKnownChunks+20 {
+		//Don't trust the number of chunks of truncated messages
+		return nil, errors.New("Bad formatting, error 1")
+	}
 	aa.KnownChunks = make([]AmAliveChunk, 0, lenKnownChunks)
-	m := msg[2:]
-	for i := 0; i < int(lenKnownChunks); i++ {
+	for i := 0; i < lenKnownChunks; i++ {
 		if len(m) < 16 {
 			return nil, errors.New("Bad formatting, error 1")
 		}
@@ -73,32 +105,107 @@ func AmAliveUnMarshal(msg []byte) (*AmAlive, error) {
 		aa.KnownChunks = append(aa.KnownChunks, chunk)
 		m = m[12:]
 	}
+	if len(m) < 20 {
+		return nil, errors.New("Bad formatting, error 2")
+	}
+	aa.Incarnation = binary.LittleEndian.Uint32(m)
+	aa.Epoch = binary.LittleEndian.Uint64(m[4:])
+	aa.ConfigHash = binary.LittleEndian.Uint64(m[12:])
+	var err error
+	aa.Updates, err = unmarshalUpdates(m[20:])
+	if err != nil {
+		return nil, err
+	}
+	return aa, nil
+}
 
-	for {
-		if len(m) < 4 {
+//Marshal serializes r into a []byte
+func (r *HeartbeatRequest) Marshal() []byte {
+	msg := make([]byte, MaxHeartbeatSize)
+	msg[0] = HeartbeatVersion
+	n := 1
+	for _, str := range []string{r.Target, r.Origin} {
+		binary.LittleEndian.PutUint16(msg[n:], uint16(len(str)))
+		copy(msg[n+2:], str)
+		n += 2 + len(str)
+	}
+	n += marshalUpdates(msg[n:], r.Updates)
+	return msg[:n]
+}
+
+//HeartbeatRequestUnMarshal unserializes msg into a HeartbeatRequest object
+func HeartbeatRequestUnMarshal(msg []byte) (*HeartbeatRequest, error) {
+	r := new(HeartbeatRequest)
+	if len(msg) < 1 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	if msg[0] != HeartbeatVersion {
+		return nil, errHeartbeatVersion
+	}
+	m := msg[1:]
+	var fields [2]string
+	for i := range fields {
+		if len(m) < 2 {
+			return nil, errors.New("Bad formatting, error 1")
+		}
+		l := int(binary.LittleEndian.Uint16(m))
+		if len(m) < 2+l {
 			return nil, errors.New("Bad formatting, error 2")
 		}
-		lenAddr := binary.LittleEndian.Uint16(m)
-		if lenAddr == 0 {
+		fields[i] = string(m[2 : 2+l])
+		m = m[2+l:]
+	}
+	r.Target, r.Origin = fields[0], fields[1]
+	var err error
+	r.Updates, err = unmarshalUpdates(m)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+	Membership updates are serialized as a list of:
+		2 bytes:	address length, 0 marks the end of the list
+		N bytes:	address
+		1 byte:		status
+		4 bytes:	incarnation
+	Updates that don't fit in m are dropped, they will be piggybacked on the next heartbeats
+*/
+func marshalUpdates(m []byte, updates []MemberUpdate) (n int) {
+	for _, u := range updates {
+		if n+2+len(u.Addr)+5+2 > len(m) {
 			break
 		}
-		addr := string(m[2 : 2+lenAddr])
-		aa.RecentlyAddedServers = append(aa.RecentlyAddedServers, addr)
-		m = m[2+lenAddr:]
+		binary.LittleEndian.PutUint16(m[n:], uint16(len(u.Addr)))
+		copy(m[n+2:], u.Addr)
+		n += 2 + len(u.Addr)
+		m[n] = byte(u.Status)
+		binary.LittleEndian.PutUint32(m[n+1:], u.Incarnation)
+		n += 5
 	}
+	binary.LittleEndian.PutUint16(m[n:], 0)
+	return n + 2
+}
 
+func unmarshalUpdates(m []byte) ([]MemberUpdate, error) {
+	var updates []MemberUpdate
 	for {
 		if len(m) < 2 {
 			return nil, errors.New("Bad formatting, error 3")
 		}
-		lenAddr := binary.LittleEndian.Uint16(m)
+		lenAddr := int(binary.LittleEndian.Uint16(m))
 		if lenAddr == 0 {
-			break
+			return updates, nil
+		}
+		if len(m) < 2+lenAddr+5 {
+			return nil, errors.New("Bad formatting, error 4")
 		}
-		addr := string(m[2 : 2+lenAddr])
-		aa.RecentlyDeadServers = append(aa.RecentlyDeadServers, addr)
-		m = m[2+lenAddr:]
+		var u MemberUpdate
+		u.Addr = string(m[2 : 2+lenAddr])
+		u.Status = MemberStatus(m[2+lenAddr])
+		u.Incarnation = binary.LittleEndian.Uint32(m[3+lenAddr:])
+		updates = append(updates, u)
+		m = m[2+lenAddr+5:]
 	}
-
-	return aa, nil
 }
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	OpHello messages
+
+	Connections start with an OpHello message (before OpAuth), its value stores:
+		2 bytes:			protocol version of the sender
+		4 bytes:			features supported by the sender
+	The response value stores the version and the features of the server.
+	Each side uses the features supported by both, servers that don't know OpHello (protocol version 0)
+	respond with OpErr, clients should use only the operations of version 0 with them.
+	Connections that don't start with OpHello are version 0 connections.
+*/
+
+//ProtocolVersion is the version of the protocol implemented by this package
+const ProtocolVersion = 1
+
+//MinProtocolVersion is the oldest protocol version accepted by servers (0 is always accepted)
+const MinProtocolVersion = 1
+
+//Features is a set of optional protocol features
+type Features uint32
+
+//These constants represents the different features
+const (
+	FeatureBatch       Features = 1 << iota //OpBatch
+	FeatureKeyspaces                        //OpCreateKeyspace
+	FeatureTTL                              //Keyspace TTL
+	FeatureScan                             //OpScan and OpRange
+	FeatureFeed                             //OpSubscribe
+	FeatureWatch                            //OpWatch, OpUnwatch, OpWatchEvent and OpWatchOverflow
+	FeatureCompression                      //OpCompressed
+	FeatureFeedWait                         //OpSubscribe wait time
+	FeaturePaxos                            //OpPaxosPrepare, OpPaxosPropose and OpPaxosCommit
+	FeatureAtomic                           //OpIncr, OpAppend, OpSetIfAbsent and OpSetIfTimestamp
+)
+
+//SupportedFeatures are the features implemented by this package
+const SupportedFeatures = FeatureBatch | FeatureKeyspaces | FeatureTTL | FeatureScan | FeatureFeed | FeatureWatch | FeatureCompression | FeatureFeedWait |
+	FeaturePaxos | FeatureAtomic
+
+//Hello stores the protocol version and features of a connection side
+type Hello struct {
+	Version  uint16
+	Features Features
+}
+
+//Marshal serializes the hello
+func (h *Hello) Marshal() []byte {
+	msg := make([]byte, 6)
+	binary.LittleEndian.PutUint16(msg, h.Version)
+	binary.LittleEndian.PutUint32(msg[2:], uint32(h.Features))
+	return msg
+}
+
+//HelloUnMarshal deserializes a hello, unknown features are ignored
+func HelloUnMarshal(msg []byte) (*Hello, error) {
+	if len(msg) < 6 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	h := new(Hello)
+	h.Version = binary.LittleEndian.Uint16(msg)
+	h.Features = Features(binary.LittleEndian.Uint32(msg[2:])) & SupportedFeatures
+	return h, nil
+}
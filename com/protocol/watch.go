@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+	OpWatch messages
+
+	An OpWatch message key stores the watched key or key prefix, its value stores:
+		4 bytes:			watch ID, chosen by the client
+		1 byte:				1 if the key is a prefix, 0 otherwise
+	The server responds with OpOK, then it sends an OpWatchEvent message (with the watch ID as message ID)
+	after each write of a watched key on the chunks it holds, until an OpUnwatch message (its value stores the watch ID)
+	is received or the connection is closed.
+
+	OpWatchEvent messages store the written key and its stored record (timestamp header + value),
+	an empty record means that the pair was deleted.
+	Events are sent after the write is applied, concurrent writes could report the same record twice.
+	If the server can't queue an event it removes the watch and sends an OpWatchOverflow message
+	(with the watch ID as message ID), the client should watch again and read the current state.
+*/
+
+//WatchRequest asks for the changes of a key or a key prefix
+type WatchRequest struct {
+	ID     uint32
+	Prefix bool
+}
+
+//Marshal serializes the request
+func (r *WatchRequest) Marshal() []byte {
+	msg := make([]byte, 5)
+	binary.LittleEndian.PutUint32(msg, r.ID)
+	if r.Prefix {
+		msg[4] = 1
+	}
+	return msg
+}
+
+//WatchRequestUnMarshal deserializes a request
+func WatchRequestUnMarshal(msg []byte) (*WatchRequest, error) {
+	if len(msg) != 5 {
+		return nil, errors.New("Bad formatting, error 1")
+	}
+	return &WatchRequest{ID: binary.LittleEndian.Uint32(msg), Prefix: msg[4] == 1}, nil
+}
@@ -0,0 +1,55 @@
+package com
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+/*
+	TLS
+
+	TCP connections (client requests, inter-node requests and chunk transfers) use TLS when it is enabled,
+	every node and client of a server group should use the same settings.
+	UDP heartbeats are not encrypted, they don't carry keys or values.
+*/
+
+var serverTLS, clientTLS *tls.Config //nil means plain TCP
+
+//SetTLS sets the TLS configuration of accepted connections (server) and of created connections (client)
+//A nil configuration disables TLS, it should be called before starting servers or creating connections
+func SetTLS(server, client *tls.Config) {
+	serverTLS = server
+	clientTLS = client
+}
+
+//LoadTLS enables TLS with a certificate and its private key (PEM files)
+//caFile is a PEM bundle of the CAs used to verify peer certificates, "" uses the system CAs
+//If mutual is true, servers will require and verify client certificates, clients will present the same certificate
+func LoadTLS(certFile, keyFile, caFile string, mutual bool) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in the CA file " + caFile)
+		}
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	client := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if mutual {
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+		server.ClientCAs = pool
+		client.Certificates = []tls.Certificate{cert}
+	}
+	SetTLS(server, client)
+	return nil
+}
@@ -0,0 +1,58 @@
+package com
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+)
+
+/*
+	Unix domain sockets
+
+	Servers can also accept connections on a Unix domain socket, clients running on the same host use it
+	to avoid the TCP loopback cost. Unix connections don't use TLS, the socket file permissions protect them,
+	authentication (see SetToken) is still required if the server enables it.
+	Connections are created on Unix sockets if their address is a unix:// URL, for example unix:///tmp/treeless.sock
+*/
+
+//UnixScheme is the prefix of Unix domain socket addresses
+const UnixScheme = "unix://"
+
+var unixSocket string
+
+//SetUnixSocket sets the path of the Unix domain socket of the servers, "" disables it
+//It should be called before starting servers
+func SetUnixSocket(path string) {
+	unixSocket = path
+}
+
+//IsUnixAddr returns true if addr is a Unix domain socket address (unix:///path)
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixScheme)
+}
+
+//dial connects to addr, a TCP address (ip:port) or a Unix domain socket address
+func dial(d *net.Dialer, addr string) (net.Conn, error) {
+	if IsUnixAddr(addr) {
+		return d.Dial("unix", strings.TrimPrefix(addr, UnixScheme))
+	}
+	if clientTLS != nil {
+		return tls.DialWithDialer(d, "tcp", addr, clientTLS)
+	}
+	return d.Dial("tcp", addr)
+}
+
+//listenUnix accepts connections on the Unix domain socket, a stale socket file is removed first
+//Other files are kept, listening fails if the path exists and it isn't a socket
+func listenUnix(s *Server, callback TCPCallback) {
+	if fi, err := os.Lstat(unixSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(unixSocket)
+	}
+	l, err := net.Listen("unix", unixSocket)
+	if err != nil {
+		panic(err)
+	}
+	s.unixListener = l
+	go accept(s, l, nil, callback)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +14,8 @@ import (
 	"github.com/dv343/treeless/com/protocol"
 	"github.com/dv343/treeless/core/pmap"
 	"github.com/dv343/treeless/hashing"
+	"github.com/dv343/treeless/hlc"
+	"github.com/dv343/treeless/vclock"
 )
 
 var protectionTime = time.Second * 10
@@ -22,16 +25,27 @@ type Core struct {
 	dbpath        string
 	chunkSize     uint64
 	knownChunks   int
-	chunks        []*metaChunk
+	chunks        []*metaChunk         //Chunks of every keyspace, indexed by chunk ID
+	keyspaces     map[string]*keyspace //Keyspaces by name, "" is the default keyspace, see keyspace.go
 	defragChannel chan<- defragOp
+	listener      WriteListener //See watch.go
+	compress      bool          //Compress the values of every chunk, see EnableCompression
 	mutex         sync.RWMutex //Global mutex, only some operations will use it
+	//Paxos ballot lease, see paxos.go
+	paxosLease, paxosFence uint64
+	paxosMutex             sync.Mutex
 }
 
 type metaChunk struct {
+	ks                 *keyspace
 	pm                 *pmap.PMap
 	present, protected bool
 	revision           int64
 	protectionTime     time.Time
+	paxos              map[string]*paxosState //Paxos acceptor state of each key, see paxos.go
+	paxosFloor         protocol.Ballot        //Highest promise of the dropped acceptor states, see paxos.go
+	remaps             []offsetRemap          //Scan cursor remaps of the last defrags, see scan.go
+	changed            chan struct{}          //Closed after the next write, see ChangesWritten
 	sync.Mutex
 	defragMutex sync.Mutex
 }
@@ -39,7 +53,7 @@ type metaChunk struct {
 //New creates a new server core instance
 //dbpath is the path to store the DB, dbpath="" means RAM only
 //chunkSize is the size in bytes of the chunk
-//numChunks is the number of chunks of the DB
+//numChunks is the number of chunks of the default keyspace
 //Every chunk will be disabled (present flag = false)
 func New(dbpath string, chunkSize uint64, numChunks int) *Core {
 	c := new(Core)
@@ -49,10 +63,9 @@ func New(dbpath string, chunkSize uint64, numChunks int) *Core {
 	}
 	c.dbpath = dbpath
 	c.chunkSize = chunkSize
-	c.chunks = make([]*metaChunk, numChunks)
-	for i := 0; i < len(c.chunks); i++ {
-		c.chunks[i] = new(metaChunk)
-	}
+	c.keyspaces = make(map[string]*keyspace)
+	c.addKeyspace(protocol.Keyspace{NumChunks: numChunks})
+	c.openPaxosLease()
 	c.defragChannel = newDefragmenter(c)
 	return c
 }
@@ -81,15 +94,24 @@ func (c *Core) findChunk(chunkID int) string {
 }
 
 //Open will open an already stored DB, Open should be called after New
+//Stored keyspaces are restored, see Keyspaces
 func (c *Core) Open() {
 	log.Println("Opening...")
-	for i, chunk := range c.chunks {
+	c.openKeyspaces()
+	for i, chunk := range c.allChunks() {
 		chunk.Lock()
 		path := c.findChunk(i)
 		if path != "" {
 			log.Println("Opening", path)
 			chunk.pm = pmap.Open(path)
+			if chunk.ks.Ordered {
+				chunk.pm.EnableOrderedIndex()
+			}
+			if c.compress {
+				chunk.pm.EnableCompression()
+			}
 			chunk.present = true
+			fmt.Sscan(path[strings.LastIndex(path, "_rev")+4:], &chunk.revision)
 		}
 		chunk.Unlock()
 	}
@@ -98,7 +120,7 @@ func (c *Core) Open() {
 
 //Close will close the DB, flushing all changes to disk
 func (c *Core) Close() {
-	for _, chunk := range c.chunks {
+	for _, chunk := range c.allChunks() {
 		chunk.Lock()
 		if chunk.pm != nil {
 			chunk.pm.Close()
@@ -107,6 +129,38 @@ func (c *Core) Close() {
 	}
 }
 
+//EnableOrderedIndex enables the ordered index of the default keyspace chunks, it is needed by Range
+//Indexes are built when chunks are opened or created, it should be called before Open
+//Named keyspaces use their own setting
+func (c *Core) EnableOrderedIndex() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ks := c.keyspaces[""]
+	ks.Ordered = true
+	for _, chunk := range ks.chunks {
+		chunk.Lock()
+		if chunk.present {
+			chunk.pm.EnableOrderedIndex()
+		}
+		chunk.Unlock()
+	}
+}
+
+//EnableCompression enables the compression of the values written to every chunk, including the chunks of named keyspaces
+//Records are flagged, chunks can store compressed and uncompressed values, it should be called before Open
+func (c *Core) EnableCompression() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.compress = true
+	for _, chunk := range c.chunks {
+		chunk.Lock()
+		if chunk.present {
+			chunk.pm.EnableCompression()
+		}
+		chunk.Unlock()
+	}
+}
+
 /*
 	Getters
 */
@@ -137,7 +191,7 @@ func (c *Core) PresentChunksList() []protocol.AmAliveChunk {
 //IsPresent returns true if the chunk is present, false otherwise
 func (c *Core) IsPresent(id int) bool {
 	c.mutex.RLock()
-	p := c.chunks[id].present
+	p := id >= 0 && id < len(c.chunks) && c.chunks[id].present
 	c.mutex.RUnlock()
 	return p
 }
@@ -145,7 +199,7 @@ func (c *Core) IsPresent(id int) bool {
 //IsPresent returns true if the chunk is protected, false otherwise
 func (c *Core) IsProtected(id int) bool {
 	c.mutex.RLock()
-	p := c.chunks[id].protected
+	p := id >= 0 && id < len(c.chunks) && c.chunks[id].protected
 	c.mutex.RUnlock()
 	return p
 }
@@ -157,12 +211,23 @@ func (c *Core) IsProtected(id int) bool {
 //ChunkSetPresent enables the present flag of a chunk
 func (c *Core) ChunkSetPresent(cid int) {
 	c.mutex.Lock()
+	if cid < 0 || cid >= len(c.chunks) {
+		c.mutex.Unlock()
+		log.Println("ChunkSetPresent: unknown chunk", cid)
+		return
+	}
 	chunk := c.chunks[cid]
 	chunk.Lock()
 	defer chunk.Unlock()
 	defer c.mutex.Unlock()
 	if !chunk.present {
-		chunk.pm = pmap.New(c.chunkPath(cid, 0), c.chunkSize)
+		chunk.pm = pmap.New(c.chunkPath(cid, chunk.revision), c.chunkSizeOf(chunk))
+		if chunk.ks.Ordered {
+			chunk.pm.EnableOrderedIndex()
+		}
+		if c.compress {
+			chunk.pm.EnableCompression()
+		}
 		c.knownChunks++
 		chunk.present = true
 	}
@@ -171,6 +236,10 @@ func (c *Core) ChunkSetPresent(cid int) {
 //ChunkSetNoPresent disables the present flag of a chunk
 func (c *Core) ChunkSetNoPresent(cid int) {
 	c.mutex.Lock()
+	if cid < 0 || cid >= len(c.chunks) {
+		c.mutex.Unlock()
+		return
+	}
 	chunk := c.chunks[cid]
 	chunk.Lock()
 	defer chunk.Unlock()
@@ -178,9 +247,13 @@ func (c *Core) ChunkSetNoPresent(cid int) {
 	if chunk.present {
 		chunk.pm.CloseAndDelete()
 		chunk.pm = nil
+		//Scan cursors of the deleted chunk are invalid
+		chunk.revision++
+		chunk.remaps = nil
 		c.knownChunks--
 		chunk.present = false
 		chunk.protected = false
+		chunk.notifyChange()
 	}
 }
 
@@ -188,6 +261,10 @@ func (c *Core) ChunkSetNoPresent(cid int) {
 //The flag will be disabled automatically after a period of time
 func (c *Core) ChunkSetProtected(cid int) error {
 	c.mutex.Lock()
+	if cid < 0 || cid >= len(c.chunks) {
+		c.mutex.Unlock()
+		return errors.New("Not present")
+	}
 	chunk := c.chunks[cid]
 	chunk.Lock()
 	defer chunk.Unlock()
@@ -218,30 +295,32 @@ func (c *Core) ChunkSetProtected(cid int) error {
 */
 
 //Get gets the value for the provided key
+//Expired pairs (see keyspace TTL) are not returned
 func (lh *Core) Get(key []byte) ([]byte, error) {
-	h := hashing.FNV1a64(key)
-	chunkIndex := int((h >> 32) % uint64(len(lh.chunks)))
-	chunk := lh.chunks[chunkIndex]
-	chunk.Lock()
-	if !chunk.present {
-		chunk.Unlock()
-		return nil, errors.New("ChunkNotPresent")
+	chunk, h, err := lh.lockChunk(key)
+	if err != nil {
+		return nil, err
 	}
 	v, err := chunk.pm.Get(uint32(h), key)
 	chunk.Unlock()
+	if v != nil && chunk.ks.expired(v) {
+		return nil, err
+	}
 	return v, err
 }
 
 //Set sets the value for the provided key
 func (c *Core) Set(key, value []byte) (err error) {
-	h := hashing.FNV1a64(key)
-	chunkIndex := int((h >> 32) % uint64(len(c.chunks)))
-	chunk := c.chunks[chunkIndex]
-	chunk.Lock()
-	if !chunk.present {
-		err = errors.New("ChunkNotPresent")
-	} else {
-		err = chunk.pm.Set(h, key, value)
+	chunk, h, err := c.lockChunk(key)
+	if err != nil {
+		return err
+	}
+	written := false
+	if err = chunk.ks.checkRecord(value); err == nil {
+		written, err = chunk.pm.Set(h, key, value)
+	}
+	if written {
+		c.notifyWrite(chunk, key)
 	}
 	chunk.Unlock()
 	return err
@@ -249,15 +328,20 @@ func (c *Core) Set(key, value []byte) (err error) {
 
 //Delete deletes the pair indexed by key
 func (c *Core) Delete(key, value []byte) error {
+	chunkIndex, chunk, err := c.keyChunk(key)
+	if err != nil {
+		return err
+	}
 	h := hashing.FNV1a64(key)
-	chunkIndex := int((h >> 32) % uint64(len(c.chunks)))
-	chunk := c.chunks[chunkIndex]
 	chunk.Lock()
 	if !chunk.present {
 		chunk.Unlock()
 		return errors.New("ChunkNotPresent")
 	}
-	err := chunk.pm.Del(h, key, value)
+	written, err := chunk.pm.Del(h, key, value)
+	if written {
+		c.notifyWrite(chunk, key)
+	}
 	delP := float64(chunk.pm.Deleted()) / float64(chunk.pm.Used())
 	usedP := float64(chunk.pm.Used()) / float64(chunk.pm.Size())
 	chunk.Unlock()
@@ -271,9 +355,11 @@ func (c *Core) Delete(key, value []byte) error {
 //isSynced should return true if the chunk is synced
 //value uses a special convention, see package pmap
 func (c *Core) CAS(key, value []byte, isSynced func(chunkIndex int) bool) error {
+	chunkIndex, chunk, err := c.keyChunk(key)
+	if err != nil {
+		return err
+	}
 	h := hashing.FNV1a64(key)
-	chunkIndex := int((h >> 32) % uint64(len(c.chunks)))
-	chunk := c.chunks[chunkIndex]
 	chunk.Lock()
 	if !chunk.present {
 		chunk.Unlock()
@@ -283,15 +369,160 @@ func (c *Core) CAS(key, value []byte, isSynced func(chunkIndex int) bool) error
 		chunk.Unlock()
 		return errors.New("ChunkNotSynced")
 	}
-	err := chunk.pm.CAS(h, key, value)
+	err = chunk.pm.CAS(h, key, value)
+	if err == nil {
+		c.notifyWrite(chunk, key)
+	}
 	chunk.Unlock()
 	return err
 }
 
+//SetIfAbsent sets the value for the provided key only if the pair doesn't exists
+func (c *Core) SetIfAbsent(key, value []byte) error {
+	chunk, h, err := c.lockChunk(key)
+	if err != nil {
+		return err
+	}
+	defer chunk.Unlock()
+	written := true
+	if old, _ := chunk.pm.Get(uint32(h), key); old != nil && chunk.ks.expired(old) {
+		written, err = chunk.pm.Set(h, key, value)
+	} else {
+		err = chunk.pm.SetIfAbsent(h, key, value)
+	}
+	if written && err == nil {
+		c.notifyWrite(chunk, key)
+	}
+	return err
+}
+
+//SetIfTimestamp sets the value for the provided key only if the stored timestamp matches the expected one
+//value uses a special convention, see package pmap
+func (c *Core) SetIfTimestamp(key, value []byte) error {
+	chunk, h, err := c.lockChunk(key)
+	if err != nil {
+		return err
+	}
+	defer chunk.Unlock()
+	err = chunk.pm.SetIfTimestamp(h, key, value)
+	if err == nil {
+		c.notifyWrite(chunk, key)
+	}
+	return err
+}
+
+//Batch applies a list of set and delete operations atomically, every key should belong to the same chunk
+func (c *Core) Batch(batch protocol.Batch) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	chunkIndex, chunk, err := c.keyChunk(batch[0].Key)
+	if err != nil {
+		return err
+	}
+	ops := make([]pmap.BatchOp, len(batch))
+	for i, op := range batch {
+		if id, _, err := c.keyChunk(op.Key); err != nil || id != chunkIndex {
+			return errors.New("Batch failed: keys belong to different chunks")
+		}
+		if op.Type != protocol.OpDel {
+			if err := chunk.ks.checkRecord(op.Value); err != nil {
+				return err
+			}
+		}
+		ops[i] = pmap.BatchOp{Key: op.Key, Value: op.Value, Del: op.Type == protocol.OpDel}
+	}
+	chunk, _, err = c.lockChunk(batch[0].Key)
+	if err != nil {
+		return err
+	}
+	defer chunk.Unlock()
+	err = chunk.pm.Batch(ops)
+	if err == nil {
+		for _, op := range ops {
+			c.notifyWrite(chunk, op.Key)
+		}
+	}
+	return err
+}
+
+//Incr adds delta to the int64 (8 bytes, little endian) value of the pair, a non-existent pair is considered 0
+//It returns the new stored value, with the timestamp header, it should be replicated to the other holders
+func (c *Core) Incr(key []byte, delta int64) (value []byte, err error) {
+	return c.update(key, func(old []byte) ([]byte, error) {
+		var x int64
+		if old != nil {
+			if len(old) != 8 {
+				return nil, errors.New("Incr failed: the value is not an int64")
+			}
+			x = int64(binary.LittleEndian.Uint64(old))
+		}
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, uint64(x+delta))
+		return v, nil
+	})
+}
+
+//Append appends data to the value of the pair, a non-existent pair is considered empty
+//It returns the new stored value, with the timestamp header, it should be replicated to the other holders
+func (c *Core) Append(key, data []byte) (value []byte, err error) {
+	return c.update(key, func(old []byte) ([]byte, error) {
+		v := make([]byte, len(old)+len(data))
+		copy(v, old)
+		copy(v[len(old):], data)
+		return v, nil
+	})
+}
+
+//update makes an atomic read-modify-write operation, f gets the old value (without timestamp)
+//and returns the new one, the new timestamp will be newer than the old one
+//New values longer than protocol.MaxValueSize (including the timestamp) are rejected
+func (c *Core) update(key []byte, f func(old []byte) ([]byte, error)) ([]byte, error) {
+	chunk, h, err := c.lockChunk(key)
+	if err != nil {
+		return nil, err
+	}
+	defer chunk.Unlock()
+	old, err := chunk.pm.Get(uint32(h), key)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil && chunk.ks.expired(old) {
+		old = nil
+	}
+	t := hlc.Now()
+	if old != nil {
+		if vclock.IsMultiValue(old) {
+			return nil, errors.New("Operation not supported on multi-value pairs")
+		}
+		t = hlc.Update(vclock.Timestamp(old))
+		old = old[8:]
+	}
+	v, err := f(old)
+	if err != nil {
+		return nil, err
+	}
+	if 8+len(v) > protocol.MaxValueSize {
+		//The new value couldn't be replicated nor read
+		return nil, errors.New("Value too long: the new value exceeds the maximum value size")
+	}
+	value := make([]byte, 8+len(v))
+	binary.LittleEndian.PutUint64(value, t)
+	copy(value[8:], v)
+	written, err := chunk.pm.Set(h, key, value)
+	if written {
+		c.notifyWrite(chunk, key)
+	}
+	return value, err
+}
+
 //Iterate all key-value pairs of a chunk, executing foreach for each key-value pair
 //it will stop early if foreach returns false
 func (c *Core) Iterate(chunkIndex int, foreach func(key, value []byte) bool) error {
-	chunk := c.chunks[chunkIndex]
+	chunk := c.chunk(chunkIndex)
+	if chunk == nil {
+		return errors.New("ChunkNotPresent")
+	}
 	chunk.Lock()
 	if !chunk.present {
 		chunk.Unlock()
@@ -310,7 +541,10 @@ func (c *Core) Iterate(chunkIndex int, foreach func(key, value []byte) bool) err
 //Iterate all key-value pairs of a chunk in backwards direction, executing foreach for each key-value pair
 //it will stop early if foreach returns false
 func (c *Core) BackwardsIterate(chunkIndex int, foreach func(key, value []byte) bool) error {
-	chunk := c.chunks[chunkIndex]
+	chunk := c.chunk(chunkIndex)
+	if chunk == nil {
+		return errors.New("ChunkNotPresent")
+	}
 	chunk.Lock()
 	if !chunk.present {
 		chunk.Unlock()
@@ -330,7 +564,10 @@ func (c *Core) BackwardsIterate(chunkIndex int, foreach func(key, value []byte)
 
 //LengthOfChunk returns the number of bytes used in the store, or math.MaxUint64 if the chunk isn't present
 func (c *Core) LengthOfChunk(chunkIndex int) uint64 {
-	chunk := c.chunks[chunkIndex]
+	chunk := c.chunk(chunkIndex)
+	if chunk == nil {
+		return math.MaxUint64
+	}
 	chunk.Lock()
 	defer chunk.Unlock()
 	if !chunk.present {
@@ -17,7 +17,7 @@ func newDefragmenter(c *Core) chan<- defragOp {
 	inputChannel := make(chan defragOp, defragBufferSize)
 	go func() {
 		for op := range inputChannel {
-			chunk := c.chunks[op.chunkID]
+			chunk := c.chunk(op.chunkID)
 			log.Println("Defrag id: ", op.chunkID, " Deleted: ", chunk.pm.Deleted(), " Length: ", chunk.pm.Used())
 
 			chunk.defragMutex.Lock()
@@ -26,19 +26,37 @@ func newDefragmenter(c *Core) chan<- defragOp {
 			old := chunk.pm
 			chunk.revision++
 			if c.dbpath == "" {
-				chunk.pm = pmap.New("", c.chunkSize)
+				chunk.pm = pmap.New("", c.chunkSizeOf(chunk))
 			} else {
-				chunk.pm = pmap.New(c.chunkPath(op.chunkID, chunk.revision), c.chunkSize)
+				chunk.pm = pmap.New(c.chunkPath(op.chunkID, chunk.revision), c.chunkSizeOf(chunk))
+			}
+			if chunk.ks.Ordered {
+				chunk.pm.EnableOrderedIndex()
+			}
+			if c.compress {
+				chunk.pm.EnableCompression()
 			}
 
-			old.Iterate(func(key, value []byte) bool {
+			remap := offsetRemap{revision: chunk.revision - 1}
+			i := 0
+			end, _ := old.Scan(0, func(offset uint64, key, value []byte) bool {
+				if i%defragRemapInterval == 0 {
+					remap.samples = append(remap.samples, [2]uint64{offset, uint64(chunk.pm.Used())})
+				}
+				i++
+				if chunk.ks.expired(value) {
+					//Expired pairs are dropped
+					return true
+				}
 				h := hashing.FNV1a64(key)
-				err := chunk.pm.Set(h, key, value)
+				_, err := chunk.pm.Set(h, key, value)
 				if err != nil {
 					panic(err)
 				}
 				return true
 			})
+			remap.samples = append(remap.samples, [2]uint64{end, uint64(chunk.pm.Used())})
+			chunk.addRemap(remap)
 			old.CloseAndDelete()
 
 			chunk.Unlock()
@@ -0,0 +1,40 @@
+package core
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"github.com/dv343/treeless/core/pmap"
+)
+
+//The server group configuration epoch is stored in the "epoch" file of the DB path,
+//a reopened server doesn't go back to an old epoch
+
+//StoreEpoch writes the configuration epoch to disk
+func (c *Core) StoreEpoch(epoch uint64) error {
+	if c.dbpath == "" {
+		return nil
+	}
+	return ioutil.WriteFile(c.dbpath+"/epoch", []byte(strconv.FormatUint(epoch, 10)), pmap.FilePerms)
+}
+
+//StoredEpoch returns the configuration epoch stored on disk, 0 if there isn't any
+func (c *Core) StoredEpoch() uint64 {
+	if c.dbpath == "" {
+		return 0
+	}
+	b, err := ioutil.ReadFile(c.dbpath + "/epoch")
+	if os.IsNotExist(err) {
+		return 0
+	}
+	var epoch uint64
+	if err == nil {
+		epoch, err = strconv.ParseUint(string(b), 10, 64)
+	}
+	if err != nil {
+		log.Println("Configuration epoch couldn't be restored:", err)
+		return 0
+	}
+	return epoch
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"errors"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+//Changes returns up to limit changes of a chunk (see protocol.ChangePage) written after cursor
+//Cursors of old revisions are translated (some changes could be returned again), cursors of unknown revisions
+//and cursors that don't point to a record return an error starting with protocol.ErrInvalidCursor
+func (c *Core) Changes(chunkID int, cursor protocol.ScanCursor, limit int) (*protocol.ChangePage, error) {
+	chunk := c.chunk(chunkID)
+	if chunk == nil {
+		return nil, errors.New("Invalid chunk ID")
+	}
+	if limit <= 0 || limit > scanMaxVisited {
+		limit = scanMaxVisited
+	}
+	chunk.Lock()
+	defer chunk.Unlock()
+	if !chunk.present {
+		return nil, errors.New("ChunkNotPresent")
+	}
+	cursor, ok := chunk.remapCursor(cursor)
+	if !ok {
+		return nil, errors.New(protocol.ErrInvalidCursor + ": unknown revision")
+	}
+	page := new(protocol.ChangePage)
+	size := 0
+	next, err := chunk.pm.Changes(cursor.Offset, func(offset uint64, key, value []byte) bool {
+		if len(page.Keys) == limit || len(page.Keys) > 0 && size+len(key)+len(value) > scanMaxPageSize {
+			return false
+		}
+		page.Offsets = append(page.Offsets, offset)
+		page.Keys = append(page.Keys, key)
+		page.Values = append(page.Values, value)
+		size += len(key) + len(value)
+		return true
+	})
+	if err != nil && len(page.Keys) == 0 {
+		return nil, errors.New(protocol.ErrInvalidCursor + ": " + err.Error())
+	}
+	//If the feed was cut by an error the next request will return it
+	page.Next = protocol.ScanCursor{Revision: chunk.revision, Offset: next}
+	return page, nil
+}
+
+//ChangesWritten returns a channel that is closed when the chunk has changes after cursor
+//The channel is already closed if there are changes after cursor, if the cursor is invalid or if the chunk isn't present
+func (c *Core) ChangesWritten(chunkID int, cursor protocol.ScanCursor) (<-chan struct{}, error) {
+	chunk := c.chunk(chunkID)
+	if chunk == nil {
+		return nil, errors.New("Invalid chunk ID")
+	}
+	chunk.Lock()
+	defer chunk.Unlock()
+	cursor, ok := chunk.remapCursor(cursor)
+	if !chunk.present || !ok || cursor.Offset != uint64(chunk.pm.Used()) {
+		changed := make(chan struct{})
+		close(changed)
+		return changed, nil
+	}
+	if chunk.changed == nil {
+		chunk.changed = make(chan struct{})
+	}
+	return chunk.changed, nil
+}
+
+//notifyChange wakes up the waiters of ChangesWritten, chunk lock should be held
+func (chunk *metaChunk) notifyChange() {
+	if chunk.changed != nil {
+		close(chunk.changed)
+		chunk.changed = nil
+	}
+}
@@ -0,0 +1,175 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/core/pmap"
+	"github.com/dv343/treeless/hashing"
+	"github.com/dv343/treeless/hlc"
+	"github.com/dv343/treeless/vclock"
+)
+
+/*
+	Keyspaces
+
+	Each keyspace has its own chunk array, chunks of every keyspace share the chunk ID space:
+	the default keyspace ("") uses the first chunk IDs, named keyspaces follow it in creation order.
+	Keys of named keyspaces are qualified by hashing.KeyspaceKey.
+	Named keyspaces are stored in the "keyspaces" file of the DB path, they are restored by Open.
+*/
+
+type keyspace struct {
+	protocol.Keyspace
+	chunks []*metaChunk
+}
+
+//expired returns true if the record is older than the keyspace TTL
+func (ks *keyspace) expired(record []byte) bool {
+	if ks.TTL == 0 || len(record) < 8 {
+		return false
+	}
+	return time.Since(hlc.Time(vclock.Timestamp(record))) > ks.TTL
+}
+
+//checkRecord returns an error if the record can't be stored on the keyspace due to its conflict policy
+//Multi-value records are only stored on keyspaces with the siblings policy, the default keyspace is last-writer-wins
+func (ks *keyspace) checkRecord(record []byte) error {
+	if ks.Conflicts != protocol.ConflictSiblings && vclock.IsMultiValue(record) {
+		return errors.New("Multi-value pairs are not allowed on last-writer-wins keyspaces")
+	}
+	return nil
+}
+
+//addKeyspace creates the chunks of a keyspace, c mutex should be held
+func (c *Core) addKeyspace(k protocol.Keyspace) error {
+	if _, ok := c.keyspaces[k.Name]; ok {
+		return errors.New("Keyspace " + k.Name + " already exists")
+	}
+	if k.FirstChunk != len(c.chunks) {
+		return errors.New("Keyspace " + k.Name + " chunk IDs mismatch")
+	}
+	ks := &keyspace{Keyspace: k, chunks: make([]*metaChunk, k.NumChunks)}
+	for i := range ks.chunks {
+		ks.chunks[i] = &metaChunk{ks: ks}
+	}
+	c.keyspaces[k.Name] = ks
+	c.chunks = append(c.chunks, ks.chunks...)
+	return nil
+}
+
+//AddKeyspace adds a named keyspace, its chunks are not present
+//Adding an already known keyspace with the same chunk IDs does nothing
+func (c *Core) AddKeyspace(k protocol.Keyspace) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ks, ok := c.keyspaces[k.Name]; ok && ks.FirstChunk == k.FirstChunk && ks.NumChunks == k.NumChunks {
+		return nil
+	}
+	if err := c.addKeyspace(k); err != nil {
+		return err
+	}
+	log.Println("Keyspace", k.Name, "added, chunks", k.FirstChunk, "to", k.FirstChunk+k.NumChunks-1)
+	return c.storeKeyspaces()
+}
+
+//Keyspaces returns the settings of every named keyspace, sorted by their first chunk ID
+func (c *Core) Keyspaces() []protocol.Keyspace {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.namedKeyspaces()
+}
+
+//namedKeyspaces returns the settings of every named keyspace, c mutex should be held
+func (c *Core) namedKeyspaces() []protocol.Keyspace {
+	var l []protocol.Keyspace
+	for i := c.keyspaces[""].NumChunks; i < len(c.chunks); i += c.chunks[i].ks.NumChunks {
+		l = append(l, c.chunks[i].ks.Keyspace)
+	}
+	return l
+}
+
+//storeKeyspaces writes the named keyspaces to disk, c mutex should be held
+func (c *Core) storeKeyspaces() error {
+	if c.dbpath == "" {
+		return nil
+	}
+	b, err := json.Marshal(c.namedKeyspaces())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.dbpath+"/keyspaces", b, pmap.FilePerms)
+}
+
+//openKeyspaces restores the named keyspaces stored on disk
+func (c *Core) openKeyspaces() {
+	if c.dbpath == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(c.dbpath + "/keyspaces")
+	if os.IsNotExist(err) {
+		return
+	}
+	var l []protocol.Keyspace
+	if err == nil {
+		err = json.Unmarshal(b, &l)
+	}
+	if err != nil {
+		log.Println("Keyspaces couldn't be restored:", err)
+		return
+	}
+	for _, k := range l {
+		if err := c.AddKeyspace(k); err != nil {
+			log.Println("Keyspace", k.Name, "couldn't be restored:", err)
+		}
+	}
+}
+
+//allChunks returns the chunks of every keyspace, indexed by chunk ID
+func (c *Core) allChunks() []*metaChunk {
+	c.mutex.RLock()
+	chunks := c.chunks
+	c.mutex.RUnlock()
+	return chunks
+}
+
+//chunk returns the chunk with the provided ID, nil if there isn't any
+func (c *Core) chunk(id int) *metaChunk {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if id < 0 || id >= len(c.chunks) {
+		return nil
+	}
+	return c.chunks[id]
+}
+
+//keyChunk returns the chunk ID and the chunk of a stored key, keys of named keyspaces are qualified
+func (c *Core) keyChunk(key []byte) (int, *metaChunk, error) {
+	name, k := hashing.SplitKeyspace(key)
+	if name == "" && hashing.HasKeyspacePrefix(key) {
+		return 0, nil, errors.New("Reserved key: keys of the default keyspace can't start with the keyspace prefix")
+	}
+	c.mutex.RLock()
+	ks, ok := c.keyspaces[name]
+	c.mutex.RUnlock()
+	if !ok {
+		return 0, nil, errors.New("Unknown keyspace " + name)
+	}
+	id := ks.ChunkID(k)
+	return id, ks.chunks[id-ks.FirstChunk], nil
+}
+
+//chunkSizeOf returns the size of the stores of a chunk
+func (c *Core) chunkSizeOf(chunk *metaChunk) uint64 {
+	if chunk.ks.ChunkSize != 0 {
+		return chunk.ks.ChunkSize
+	}
+	return c.chunkSize
+}
@@ -0,0 +1,258 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/core/pmap"
+	"github.com/dv343/treeless/hashing"
+)
+
+/*
+	Paxos acceptor
+
+	Each key has its own single-decree Paxos instance, a committed proposal resets the instance
+	so the next CAS on the same key can choose a new value.
+
+	Acceptor state is kept in memory, it is lost if the server restarts and it isn't sent with chunk transfers.
+	The loss is made safe by two rules:
+		Promises: acceptors only take part in ballots covered by a ballot lease, the highest ballot time
+		they may have promised. The lease is stored in the "paxos" file of the DB path and extended by
+		paxosLeaseWindow when a newer ballot arrives. A restarted acceptor rejects every ballot up to the
+		stored lease, so it can't break the promises it forgot.
+		Accepted proposals: a CAS succeeds only after a majority of the holders commits (stores) the chosen value,
+		later quorums read it from the stored pair. Proposals that weren't committed by a majority can be lost,
+		their CAS returns an unknown result error.
+	New chunk holders start with an empty acceptor state, like acceptors that didn't receive the previous messages.
+	RAM-only servers (empty DB path) don't store the lease, they shouldn't be restarted while a CAS is in progress.
+
+	Acceptors remember the hashes of the last committed values, a proposer whose proposal was rejected
+	can learn if the proposal was chosen anyway (completed by another proposer).
+
+	Each chunk keeps up to paxosMaxKeys acceptor states. When the limit is reached the states without
+	an accepted proposal are dropped, the chunk remembers the highest ballot they promised (its floor) and
+	new states promise it, so dropped promises can't be broken. Accepted proposals are never dropped,
+	they are cleared when a value is committed.
+*/
+
+//paxosLeaseWindow is the time added to the ballot lease each time it is extended
+var paxosLeaseWindow = uint64(time.Second)
+
+//paxosHistory is the number of committed value hashes remembered by each key acceptor
+const paxosHistory = 32
+
+//paxosMaxKeys is the number of acceptor states that a chunk keeps before dropping the idle ones
+const paxosMaxKeys = 4096
+
+type paxosState struct {
+	promised      protocol.Ballot
+	committed     protocol.Ballot
+	accepted      protocol.Ballot
+	acceptedValue []byte
+	chosen        [paxosHistory]uint64 //Hashes of the last committed values
+	chosenIndex   int
+}
+
+//paxosState returns the acceptor state of key, chunk mutex should be held
+func (chunk *metaChunk) paxosState(key []byte) *paxosState {
+	if chunk.paxos == nil {
+		chunk.paxos = make(map[string]*paxosState)
+	}
+	st, ok := chunk.paxos[string(key)]
+	if !ok {
+		if len(chunk.paxos) >= paxosMaxKeys {
+			chunk.prunePaxos()
+		}
+		st = &paxosState{promised: chunk.paxosFloor}
+		chunk.paxos[string(key)] = st
+	}
+	return st
+}
+
+//prunePaxos drops the acceptor states without an accepted proposal, raising the chunk floor to their promises
+//chunk mutex should be held
+func (chunk *metaChunk) prunePaxos() {
+	for key, st := range chunk.paxos {
+		if st.acceptedValue != nil {
+			continue
+		}
+		if chunk.paxosFloor.Less(st.promised) {
+			chunk.paxosFloor = st.promised
+		}
+		delete(chunk.paxos, key)
+	}
+}
+
+//openPaxosLease restores the ballot lease of a previous execution, ballots up to it are rejected
+func (c *Core) openPaxosLease() {
+	if c.dbpath == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(c.dbpath + "/paxos")
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil || len(b) != 8 {
+		//Be conservative, reject the ballots of the next window
+		log.Println("Paxos ballot lease couldn't be restored:", err)
+		c.paxosFence = uint64(time.Now().UnixNano()) + 2*paxosLeaseWindow
+	} else {
+		c.paxosFence = binary.LittleEndian.Uint64(b)
+	}
+	c.paxosLease = c.paxosFence
+}
+
+//admitBallot returns an error if the acceptor can't take part in ballot, extending the ballot lease if needed
+func (c *Core) admitBallot(ballot protocol.Ballot) error {
+	c.paxosMutex.Lock()
+	defer c.paxosMutex.Unlock()
+	if ballot.Time <= c.paxosFence {
+		return errors.New("Ballot rejected: the acceptor was restarted, its previous promises are unknown")
+	}
+	if ballot.Time <= c.paxosLease {
+		return nil
+	}
+	lease := ballot.Time + paxosLeaseWindow
+	if c.dbpath != "" {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, lease)
+		if err := writeFileSync(c.dbpath+"/paxos", b); err != nil {
+			return err
+		}
+	}
+	c.paxosLease = lease
+	return nil
+}
+
+//writeFileSync replaces the file at path with data, the file is synced before it replaces the previous one
+//so a power failure leaves either the old or the new data
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, pmap.FilePerms)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	//The rename is durable after the directory is synced
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (c *Core) lockChunk(key []byte) (*metaChunk, uint64, error) {
+	_, chunk, err := c.keyChunk(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	h := hashing.FNV1a64(key)
+	chunk.Lock()
+	if !chunk.present {
+		chunk.Unlock()
+		return nil, 0, errors.New("ChunkNotPresent")
+	}
+	return chunk, h, nil
+}
+
+//PaxosPrepare handles a Paxos prepare request, promising to not accept proposals with lower ballots
+//The returned promise contains the accepted proposal and the stored value of the pair
+//proposal is the hash of a previous proposal, 0 if there isn't any
+func (c *Core) PaxosPrepare(key []byte, ballot protocol.Ballot, proposal uint64) (*protocol.PaxosPromise, error) {
+	chunk, h, err := c.lockChunk(key)
+	if err != nil {
+		return nil, err
+	}
+	defer chunk.Unlock()
+	if err := c.admitBallot(ballot); err != nil {
+		return nil, err
+	}
+	st := chunk.paxosState(key)
+	p := new(protocol.PaxosPromise)
+	if st.promised.Less(ballot) {
+		st.promised = ballot
+		p.Promised = true
+	}
+	if proposal != 0 {
+		for _, h := range st.chosen {
+			if h == proposal {
+				p.Chosen = true
+			}
+		}
+	}
+	p.Ballot = st.promised
+	p.Committed = st.committed
+	p.Accepted = st.accepted
+	p.AcceptedValue = st.acceptedValue
+	p.Value, err = chunk.pm.Get(uint32(h), key)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//PaxosPropose handles a Paxos propose (accept) request
+func (c *Core) PaxosPropose(key []byte, ballot protocol.Ballot, value []byte) error {
+	chunk, _, err := c.lockChunk(key)
+	if err != nil {
+		return err
+	}
+	defer chunk.Unlock()
+	if err := c.admitBallot(ballot); err != nil {
+		return err
+	}
+	st := chunk.paxosState(key)
+	if ballot.Less(st.promised) {
+		return errors.New("Proposal rejected: higher ballot promised")
+	}
+	st.promised = ballot
+	st.accepted = ballot
+	st.acceptedValue = append([]byte(nil), value...)
+	return nil
+}
+
+//PaxosCommit handles a Paxos commit request, writing the chosen value
+func (c *Core) PaxosCommit(key []byte, ballot protocol.Ballot, value []byte) error {
+	chunk, h, err := c.lockChunk(key)
+	if err != nil {
+		return err
+	}
+	defer chunk.Unlock()
+	st := chunk.paxosState(key)
+	if st.committed.Less(ballot) {
+		st.committed = ballot
+	}
+	if !ballot.Less(st.accepted) {
+		//The accepted proposal is no longer in progress
+		st.accepted = protocol.Ballot{}
+		st.acceptedValue = nil
+	}
+	hv := hashing.FNV1a64(value)
+	if st.chosen[(st.chosenIndex+paxosHistory-1)%paxosHistory] != hv {
+		st.chosen[st.chosenIndex] = hv
+		st.chosenIndex = (st.chosenIndex + 1) % paxosHistory
+	}
+	written, err := chunk.pm.Set(h, key, value)
+	if written {
+		c.notifyWrite(chunk, key)
+	}
+	return err
+}
@@ -11,6 +11,7 @@ import (
 	"log"
 	"time"
 	"github.com/dv343/treeless/hashing"
+	"github.com/dv343/treeless/vclock"
 )
 
 //FilePerms i
@@ -40,6 +41,7 @@ type PMap struct {
 	st       *store
 	checksum syncChecksum
 	path     string
+	index    *skiplist //Ordered index of the present keys, nil if it is disabled
 }
 
 //New returns an initialized PMap stored in path with a maximum store size.
@@ -54,17 +56,14 @@ func New(path string, size uint64) *PMap {
 }
 
 //Open opens a previous closed pmap returning a new pmap
+//Batches are restored all-or-nothing, an incomplete batch at the end of the store is discarded
 func Open(path string) *PMap {
 	c := new(PMap)
 	c.path = path
 	c.hm = newHashMap(defaultHashMapInitialLog2Size, defaultHashMapSizeLimit)
 	c.st = openStore(c.path)
 	//Restore every pair, introduce all pairs into the hashmap and calculate deleted bytes and length of the opened store
-	for index := uint64(0); ; {
-		if c.st.keyLen(index) <= 0 {
-			break
-		}
-		//if not 2 totallen => corrupt=> break
+	restore := func(index uint64) {
 		key := c.st.key(index)
 		val := c.st.val(index)
 		c.restorePair(key, val, uint32(index))
@@ -73,15 +72,42 @@ func Open(path string) *PMap {
 		} else {
 			c.st.deleted += uint64(12 + len(key))
 		}
+	}
+	var batch []uint64
+	index := uint64(0)
+	for {
+		if c.st.keyLen(index) <= 0 {
+			break
+		}
+		//if not 2 totallen => corrupt=> break
+		if c.st.inBatch(index) {
+			//Wait for the last pair of the batch
+			batch = append(batch, index)
+		} else {
+			for _, b := range batch {
+				restore(b)
+			}
+			batch = nil
+			restore(index)
+		}
 
 		index += 12 + uint64(c.st.totalLen(index))
-		c.st.length = index
+		if len(batch) == 0 {
+			c.st.length = index
+		}
+	}
+	if len(batch) > 0 {
+		log.Println("Discarding incomplete batch, pairs:", len(batch))
+		//Erase it, new pairs will be written at the batch position
+		for i := c.st.length; i < index; i++ {
+			c.st.file[i] = 0
+		}
 	}
 	//c.checksum.SetInterval(defaultCheckSumInterval)
 	return c
 }
 
-//This function is only used to restore the PMap after a DB close
+//This function is only used to restore the PMap after a DB close, and to index the pairs of a batch
 func (c *PMap) restorePair(key, value []byte, storeIndex uint32) error {
 	//Check for available space
 	if c.hm.numStoredKeys >= c.hm.numKeysToExpand {
@@ -97,11 +123,16 @@ func (c *PMap) restorePair(key, value []byte, storeIndex uint32) error {
 	for {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
+			if len(value) == 0 {
+				//Tombstone of a non-existent pair
+				return nil
+			}
 			//Empty bucket: put the pair
 			c.hm.setHash(index, h)
 			c.hm.setStoreIndex(index, storeIndex)
 			c.hm.numStoredKeys++
-			t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
+			c.indexInsert(storeIndex)
+			t := valueTime(value)
 			//fmt.Println("Sum", value)
 			c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
 			return nil
@@ -118,7 +149,10 @@ func (c *PMap) restorePair(key, value []byte, storeIndex uint32) error {
 				//Full match, the key was in the map
 				//Last write wins
 				v := c.st.val(uint64(stIndex))
-				t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
+				t := valueTime(v)
+				if len(value) > 0 {
+					t = valueTime(value)
+				}
 				c.checksum.sub(h64^binary.LittleEndian.Uint64(v[:8]), t)
 				//fmt.Println("Sub", v)
 				c.st.deleted += uint64(12 + len(key) + len(v))
@@ -129,6 +163,7 @@ func (c *PMap) restorePair(key, value []byte, storeIndex uint32) error {
 					//fmt.Println("Sum2", value)
 				} else {
 					c.hm.setHash(index, deletedBucket)
+					c.indexRemove(key)
 				}
 				return nil
 			}
@@ -178,25 +213,28 @@ func (c *PMap) Size() int {
 //The first 8 bytes contain the timestamp of the pair (nanoseconds elapsed since Unix time).
 //Returned value is a copy of the stored one
 func (c *PMap) Get(h32 uint32, key []byte) ([]byte, error) {
-	h := uint32(h32)
+	stIndex, ok := c.lookup(h32, key)
+	if !ok {
+		return nil, nil
+	}
+	//We need to copy the value, returning a memory mapped file slice is dangerous,
+	//the mutex wont be hold after this function returns
+	return c.st.record(uint64(stIndex))
+}
+
+//lookup returns the store index of a present key
+func (c *PMap) lookup(h uint32, key []byte) (stIndex uint32, ok bool) {
 	//Search for the key by using open adressing with linear probing
 	index := h & c.hm.sizeMask
 	for {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
-			return nil, nil
+			return 0, false
 		} else if h == storedHash {
 			//Same hash: perform full key comparison
 			stIndex := c.hm.getStoreIndex(index)
-			storedKey := c.st.key(uint64(stIndex))
-			if bytes.Equal(storedKey, key) {
-				//Full match, the key was in the map
-				v := c.st.val(uint64(stIndex))
-				//We need to copy the value, returning a memory mapped file slice is dangerous,
-				//the mutex wont be hold after this function returns
-				vc := make([]byte, len(v))
-				copy(vc, v)
-				return vc, nil
+			if bytes.Equal(c.st.key(uint64(stIndex)), key) {
+				return stIndex, true
 			}
 		}
 		index = (index + 1) & c.hm.sizeMask
@@ -206,15 +244,24 @@ func (c *PMap) Get(h32 uint32, key []byte) ([]byte, error) {
 //Set sets the value of a pair if the pair doesn't exists or if
 //the already stored pair timestamp is before the provided timestamp.
 //The first 8 bytes of value should contain the timestamp of the pair (nanoseconds elapsed since Unix time).
-func (c *PMap) Set(h64 uint64, key, value []byte) error {
+//Multi-value records (see package vclock) are merged with the stored pair instead,
+//concurrent versions are kept as siblings.
+//written is false if the provided pair was discarded (the stored pair is newer or it already has the siblings)
+func (c *PMap) Set(h64 uint64, key, value []byte) (written bool, err error) {
 	if len(value) < 8 {
-		return errors.New(("Error: message value len < 8"))
+		return false, errors.New(("Error: message value len < 8"))
 	}
+	return c.set(h64, key, value, nil)
+}
+
+//set is Set with an optional precondition, test gets the stored value (nil if the pair doesn't exists)
+//and the pair is only written if it returns nil
+func (c *PMap) set(h64 uint64, key, value []byte, test func(stored []byte) error) (written bool, err error) {
 	//Check for available space
 	if c.hm.numStoredKeys >= c.hm.numKeysToExpand {
 		err := c.hm.expand()
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
 
@@ -225,16 +272,22 @@ func (c *PMap) Set(h64 uint64, key, value []byte) error {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
 			//Empty bucket: put the pair
+			if test != nil {
+				if err := test(nil); err != nil {
+					return false, err
+				}
+			}
 			storeIndex, err := c.st.put(key, value)
 			if err != nil {
-				return err
+				return false, err
 			}
 			c.hm.setHash(index, h)
 			c.hm.setStoreIndex(index, storeIndex)
 			c.hm.numStoredKeys++
-			t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
+			c.indexInsert(storeIndex)
+			t := valueTime(value)
 			c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
-			return nil
+			return true, nil
 		}
 
 		if h == storedHash {
@@ -247,24 +300,47 @@ func (c *PMap) Set(h64 uint64, key, value []byte) error {
 			storedKey := c.st.key(uint64(stIndex))
 			if bytes.Equal(storedKey, key) {
 				//Full match, the key was in the map
-				//Last write wins
 				v := c.st.val(uint64(stIndex))
-				oldT := time.Unix(0, int64(binary.LittleEndian.Uint64(v[:8])))
-				t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
-				if oldT.After(t) || oldT.Equal(t) {
-					//Stored pair is newer than the provided pair
-					//fmt.Println("Discarded", key, value, t)
-					return nil
+				if test != nil {
+					if err := test(v); err != nil {
+						return false, err
+					}
 				}
+				if vclock.IsMultiValue(v) || vclock.IsMultiValue(value) {
+					//Multi-value records keep concurrent siblings instead of using last write wins
+					stored, err := c.st.record(uint64(stIndex))
+					if err != nil {
+						return false, err
+					}
+					merged, err := vclock.MergeRecords(stored, value)
+					if err != nil {
+						return false, err
+					}
+					if bytes.Equal(merged, stored) {
+						//The provided siblings were already known
+						return false, nil
+					}
+					value = merged
+				} else {
+					//Last write wins
+					oldT := valueTime(v)
+					t := valueTime(value)
+					if oldT.After(t) || oldT.Equal(t) {
+						//Stored pair is newer than the provided pair
+						//fmt.Println("Discarded", key, value, t)
+						return false, nil
+					}
+				}
+				t := valueTime(value)
 				storeIndex, err := c.st.put(key, value)
 				if err != nil {
-					return err
+					return false, err
 				}
 				c.checksum.sub(h64^binary.LittleEndian.Uint64(v[:8]), t)
 				c.hm.setHash(index, h)
 				c.hm.setStoreIndex(index, storeIndex)
 				c.checksum.sum(h64^binary.LittleEndian.Uint64(value[:8]), t)
-				return nil
+				return true, nil
 			}
 		}
 		index = (index + 1) & c.hm.sizeMask
@@ -293,9 +369,9 @@ func (c *PMap) CAS(h64 uint64, key, value []byte) error {
 		}
 	}
 
-	providedTime := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
+	providedTime := valueTime(value)
 	hv := binary.LittleEndian.Uint64(value[8:16])
-	t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[16:24])))
+	t := valueTime(value[16:])
 	//fmt.Println(t.UnixNano())
 	h := hashReMap(uint32(h64))
 	index := h & c.hm.sizeMask
@@ -313,6 +389,7 @@ func (c *PMap) CAS(h64 uint64, key, value []byte) error {
 			c.hm.setHash(index, h)
 			c.hm.setStoreIndex(index, storeIndex)
 			c.hm.numStoredKeys++
+			c.indexInsert(storeIndex)
 			c.checksum.sum(h64^binary.LittleEndian.Uint64(value[16:24]), t)
 			return nil
 		}
@@ -323,14 +400,18 @@ func (c *PMap) CAS(h64 uint64, key, value []byte) error {
 			if bytes.Equal(storedKey, key) {
 				//Full match, the key was in the map
 				v := c.st.val(uint64(stIndex))
-				oldT := time.Unix(0, int64(binary.LittleEndian.Uint64(v[:8])))
+				oldT := valueTime(v)
 				if t.Equal(oldT) {
 					log.Println("Equal times!")
 				}
 				if oldT != providedTime {
 					return errors.New("CAS failed: timestamp mismatch")
 				}
-				if hv != hashing.FNV1a64(v[8:]) {
+				stored, err := c.st.record(uint64(stIndex))
+				if err != nil {
+					return err
+				}
+				if hv != hashing.FNV1a64(stored[8:]) {
 					log.Println("hash mismatch!")
 					return errors.New("CAS failed: hash mismatch")
 				}
@@ -349,10 +430,130 @@ func (c *PMap) CAS(h64 uint64, key, value []byte) error {
 	}
 }
 
+//SetIfAbsent sets the value of a pair only if the pair doesn't exists
+//The first 8 bytes of value should contain the timestamp of the pair
+//It returns nil if the new value was written
+func (c *PMap) SetIfAbsent(h64 uint64, key, value []byte) error {
+	if len(value) < 8 {
+		return errors.New("Error: message value len < 8")
+	}
+	_, err := c.set(h64, key, value, func(stored []byte) error {
+		if stored != nil {
+			return errors.New("SetIfAbsent failed: the pair already exists")
+		}
+		return nil
+	})
+	return err
+}
+
+//SetIfTimestamp sets the value of a pair only if the stored timestamp matches the expected timestamp
+//The value should be in this format:
+//[0:8]   => expected timestamp, if the pair doesn't exists the expected timestamp should be 0
+//[8:16]  => new timestamp, it should be newer than the expected timestamp
+//[16:]   => new value
+//It returns nil if the new value was written
+func (c *PMap) SetIfTimestamp(h64 uint64, key, value []byte) error {
+	if len(value) < 16 {
+		return errors.New("Error: SetIfTimestamp value len < 16")
+	}
+	expected := binary.LittleEndian.Uint64(value[:8])
+	if vclock.Timestamp(value[8:]) <= expected {
+		return errors.New("SetIfTimestamp failed: the new timestamp is not newer than the expected timestamp")
+	}
+	_, err := c.set(h64, key, value[8:], func(stored []byte) error {
+		if stored == nil {
+			if expected != 0 {
+				return errors.New("SetIfTimestamp failed: empty pair: non-zero timestamp")
+			}
+		} else if vclock.Timestamp(stored) != expected {
+			return errors.New("SetIfTimestamp failed: timestamp mismatch")
+		}
+		return nil
+	})
+	return err
+}
+
+//BatchOp is a set or delete operation of a batch
+//Value should contain the timestamp header, delete operations only use the timestamp
+type BatchOp struct {
+	Key, Value []byte
+	Del        bool
+}
+
+//Batch applies a list of set and delete operations atomically
+//Each operation follows the Set or Del timestamp semantics, outdated operations are discarded
+//The batch is written to the store all-or-nothing, Open won't restore half-written batches
+func (c *PMap) Batch(ops []BatchOp) error {
+	//Filter outdated operations, operations on the same key see the previous ones
+	current := make(map[string][]byte)
+	var pairs []BatchOp
+	size := uint64(0)
+	for _, op := range ops {
+		if len(op.Value) < 8 {
+			return errors.New("Error: batch value len < 8")
+		}
+		if vclock.IsMultiValue(op.Value) {
+			return errors.New("Batch failed: multi-value records are not supported")
+		}
+		old, ok := current[string(op.Key)]
+		if !ok {
+			old, _ = c.Get(hashReMap(uint32(hashing.FNV1a64(op.Key))), op.Key)
+		}
+		t := valueTime(op.Value)
+		if op.Del {
+			if old == nil || t.Before(valueTime(old)) {
+				continue
+			}
+			current[string(op.Key)] = nil
+			size += uint64(12 + len(op.Key))
+		} else {
+			if old != nil && !valueTime(old).Before(t) {
+				continue
+			}
+			current[string(op.Key)] = op.Value
+			size += uint64(12 + len(op.Key) + len(op.Value))
+		}
+		pairs = append(pairs, op)
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	//Check for available space, the batch shouldn't fail once started
+	if c.st.length+size >= c.st.size {
+		return errors.New("store size limit reached: denied batch operation")
+	}
+	for c.hm.numStoredKeys+uint32(len(pairs)) >= c.hm.numKeysToExpand {
+		err := c.hm.expand()
+		if err != nil {
+			return err
+		}
+	}
+	//Write the pairs, every pair except the last one is flagged
+	indexes := make([]uint32, len(pairs))
+	for i, op := range pairs {
+		value := op.Value
+		if op.Del {
+			//Tombstone
+			value = nil
+		}
+		var err error
+		indexes[i], err = c.st.putPair(op.Key, value, i < len(pairs)-1)
+		if err != nil {
+			return err
+		}
+	}
+	//Index them
+	for i, op := range pairs {
+		c.restorePair(op.Key, c.st.val(uint64(indexes[i])), indexes[i])
+	}
+	return nil
+}
+
 //Del marks as deleted a pair, future read instructions won't see the old value.
 //However, it never frees the memory-mapped region associated with the deleted pair.
 //It "leaks". The only way to free those regions is to delete the entire PMap.
-func (c *PMap) Del(h64 uint64, key, value []byte) error {
+//written is false if there was nothing to delete (the pair doesn't exist or the stored pair is newer)
+func (c *PMap) Del(h64 uint64, key, value []byte) (written bool, err error) {
 	h := hashReMap(uint32(h64))
 
 	//Search for the key by using open adressing with linear probing
@@ -360,7 +561,7 @@ func (c *PMap) Del(h64 uint64, key, value []byte) error {
 	for {
 		storedHash := c.hm.getHash(index)
 		if storedHash == emptyBucket {
-			return nil
+			return false, nil
 		}
 		if h == storedHash {
 			//Same hash: perform full key comparison
@@ -371,33 +572,35 @@ func (c *PMap) Del(h64 uint64, key, value []byte) error {
 
 				//Last write wins
 				v := c.st.val(uint64(stIndex))
-				oldT := time.Unix(0, int64(binary.LittleEndian.Uint64(v[:8])))
-				t := time.Unix(0, int64(binary.LittleEndian.Uint64(value[:8])))
+				oldT := valueTime(v)
+				t := valueTime(value)
 				if t.Before(oldT) {
 					//Stored pair is newer than the provided pair
-					return nil
+					return false, nil
 				}
 				c.st.deleted += uint64(12 + len(key) + len(v))
 				c.checksum.sub(h64^binary.LittleEndian.Uint64(v[:8]), t)
 				c.hm.setHash(index, deletedBucket)
+				c.indexRemove(key)
 				//Tombstone
 				_, err := c.st.put(key, nil)
-				return err
+				return err == nil, err
 			}
 		}
 		index = (index + 1) & c.hm.sizeMask
 	}
 }
 
+//valueTime returns the timestamp stored on the value header, ignoring the multi-value flag
+func valueTime(value []byte) time.Time {
+	return time.Unix(0, int64(vclock.Timestamp(value)))
+}
+
+//isPresent returns true if the pair stored at index is the current pair of its key, values aren't read
 func (c *PMap) isPresent(index uint64) bool {
 	key := c.st.key(index)
-	h32 := uint32(hashing.FNV1a64(key))
-	value, err := c.Get(h32, key)
-	if value == nil || err != nil {
-		return false
-	}
-	storeValue := c.st.val(index)
-	return bytes.Compare(value[0:8], storeValue[0:8]) == 0
+	stIndex, ok := c.lookup(uint32(hashing.FNV1a64(key)), key)
+	return ok && uint64(stIndex) == index
 }
 
 //BackwardsIterate calls foreach for each stored pair in backwards direction, it will stop iterating if the call returns false
@@ -415,11 +618,12 @@ func (c *PMap) BackwardsIterate(foreach func(key, value []byte) (Continue bool))
 	for index >= 0 {
 		if c.isPresent(index) {
 			key := c.st.key(index)
-			val := c.st.val(index)
 			kc := make([]byte, len(key))
-			vc := make([]byte, len(val))
 			copy(kc, key)
-			copy(vc, val)
+			vc, err := c.st.record(index)
+			if err != nil {
+				return err
+			}
 			ok := foreach(kc, vc)
 			if !ok {
 				break
@@ -440,11 +644,12 @@ func (c *PMap) Iterate(foreach func(key, value []byte) (Continue bool)) error {
 	for index := uint64(0); index < c.st.length; {
 		if c.isPresent(index) {
 			key := c.st.key(index)
-			val := c.st.val(index)
 			kc := make([]byte, len(key))
-			vc := make([]byte, len(val))
 			copy(kc, key)
-			copy(vc, val)
+			vc, err := c.st.record(index)
+			if err != nil {
+				return err
+			}
 			ok := foreach(kc, vc)
 			if !ok {
 				break
@@ -454,3 +659,113 @@ func (c *PMap) Iterate(foreach func(key, value []byte) (Continue bool)) error {
 	}
 	return nil
 }
+
+//Scan calls foreach for each stored pair starting at the store offset start, offset is the store offset of the pair
+//It stops early if foreach returns false, the pair passed to that call is not considered visited
+//It returns the offset of the next pair to visit, start should be 0 or an offset returned by Scan
+func (c *PMap) Scan(start uint64, foreach func(offset uint64, key, value []byte) (Continue bool)) (next uint64, err error) {
+	if !c.st.isPair(start) && start != c.st.length {
+		return start, errors.New("Invalid scan offset")
+	}
+	index := start
+	for index < c.st.length {
+		if !c.st.isPair(index) {
+			return index, errors.New("Invalid scan offset")
+		}
+		if c.isPresent(index) {
+			key := c.st.key(index)
+			kc := make([]byte, len(key))
+			copy(kc, key)
+			vc, err := c.st.record(index)
+			if err != nil {
+				return index, err
+			}
+			if !foreach(index, kc, vc) {
+				break
+			}
+		}
+		index += 12 + uint64(c.st.totalLen(index))
+	}
+	return index, nil
+}
+
+//Changes calls foreach for each stored record starting at the store offset start, including overwritten pairs
+//and tombstones (records with an empty value), in write order
+//It stops early if foreach returns false (that record is not consumed), next is the offset of the next record
+func (c *PMap) Changes(start uint64, foreach func(offset uint64, key, value []byte) (Continue bool)) (next uint64, err error) {
+	if !c.st.isPair(start) && start != c.st.length {
+		return start, errors.New("Invalid change feed offset")
+	}
+	index := start
+	for index < c.st.length {
+		if !c.st.isPair(index) {
+			return index, errors.New("Invalid change feed offset")
+		}
+		key := c.st.key(index)
+		kc := make([]byte, len(key))
+		copy(kc, key)
+		vc, err := c.st.record(index)
+		if err != nil {
+			return index, err
+		}
+		if !foreach(index, kc, vc) {
+			break
+		}
+		index += 12 + uint64(c.st.totalLen(index))
+	}
+	return index, nil
+}
+
+//EnableCompression enables the compression of the new values, see store
+//Values written before are kept as they are, reads decompress values when it is needed
+func (c *PMap) EnableCompression() {
+	c.st.enableCompression()
+}
+
+//EnableOrderedIndex builds an ordered index of the present keys, it will be maintained by every write
+//The ordered index is needed by Range
+func (c *PMap) EnableOrderedIndex() {
+	if c.index != nil {
+		return
+	}
+	c.index = newSkiplist()
+	for index := uint64(0); index < c.st.length; index += 12 + uint64(c.st.totalLen(index)) {
+		if c.isPresent(index) {
+			c.index.insert(c.st.key(index))
+		}
+	}
+}
+
+func (c *PMap) indexInsert(storeIndex uint32) {
+	if c.index != nil {
+		c.index.insert(c.st.key(uint64(storeIndex)))
+	}
+}
+
+func (c *PMap) indexRemove(key []byte) {
+	if c.index != nil {
+		c.index.remove(key)
+	}
+}
+
+//Range calls foreach for each present pair whose key is in the range [start, end) in key order
+//A nil end means no upper bound, it stops early if foreach returns false
+//It returns an error if the ordered index is disabled
+func (c *PMap) Range(start, end []byte, foreach func(key, value []byte) (Continue bool)) error {
+	if c.index == nil {
+		return errors.New("Ordered index disabled")
+	}
+	c.index.ascend(start, func(key []byte) bool {
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return false
+		}
+		kc := make([]byte, len(key))
+		copy(kc, key)
+		value, err := c.Get(uint32(hashing.FNV1a64(key)), key)
+		if value == nil || err != nil {
+			return true
+		}
+		return foreach(kc, value)
+	})
+	return nil
+}
@@ -0,0 +1,98 @@
+package pmap
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+const skiplistMaxLevel = 24
+
+/*
+	A skiplist stores the keys of the present pairs in order.
+
+	Keys reference the memory-mapped store, they are valid while the store is open.
+	Each node has a random number of levels (p=1/4), level 0 links every node.
+*/
+type skiplist struct {
+	head   skipNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+type skipNode struct {
+	key  []byte
+	next []*skipNode
+}
+
+func newSkiplist() *skiplist {
+	l := new(skiplist)
+	l.head.next = make([]*skipNode, skiplistMaxLevel)
+	l.level = 1
+	l.rnd = rand.New(rand.NewSource(rand.Int63()))
+	return l
+}
+
+//findPrevious fills prev with the last node of each level whose key is lower than key
+func (l *skiplist) findPrevious(key []byte, prev []*skipNode) *skipNode {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x
+}
+
+//insert adds key to the list, or replaces the stored key reference if it was already in the list
+func (l *skiplist) insert(key []byte) {
+	var prev [skiplistMaxLevel]*skipNode
+	x := l.findPrevious(key, prev[:])
+	if n := x.next[0]; n != nil && bytes.Equal(n.key, key) {
+		n.key = key
+		return
+	}
+	level := 1
+	for level < skiplistMaxLevel && l.rnd.Intn(4) == 0 {
+		level++
+	}
+	for ; l.level < level; l.level++ {
+		prev[l.level] = &l.head
+	}
+	n := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+	l.length++
+}
+
+//remove deletes key from the list, it does nothing if key is not in the list
+func (l *skiplist) remove(key []byte) {
+	var prev [skiplistMaxLevel]*skipNode
+	x := l.findPrevious(key, prev[:])
+	n := x.next[0]
+	if n == nil || !bytes.Equal(n.key, key) {
+		return
+	}
+	for i := 0; i < len(n.next); i++ {
+		prev[i].next[i] = n.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+}
+
+//ascend calls foreach for each key greater than or equal to start, in order
+//It stops early if foreach returns false
+func (l *skiplist) ascend(start []byte, foreach func(key []byte) (Continue bool)) {
+	for n := l.findPrevious(start, nil).next[0]; n != nil; n = n.next[0] {
+		if !foreach(n.key) {
+			return
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package pmap
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 
@@ -24,23 +27,39 @@ Binary structure of the store
 The store is composed of key-value pairs.
 Each pair is represented this way:
 	4 bytes:
-		1  bit (MSB)	is the pair present?
+		1  bit (MSB)	batch flag, the pair is part of a batch and the batch continues on the next pair
 		31 bits			key length
-	4 bytes: value len
+	4 bytes:
+		1  bit (MSB)	compression flag, the value is compressed
+		31 bits			value length
 	Key len   bytes: key
 	Value len bytes: value
+	4 bytes: key len + value len
 Metadata is not saved on the memory-mapped file.
+
+The key length is written last, a pair without key length marks the end of the store.
+
+Compressed values keep the 8 byte timestamp header uncompressed, the rest of the value is stored as
+a DEFLATE stream (RFC 1951). Values are compressed only if compression is enabled and it saves space.
 */
 
 //store stores a list of pairs, in an *unordered* way
 type store struct {
-	deleted uint64      //deleted number of bytes
-	length  uint64      //Total length, index of new items
-	size    uint64      //Allocated size, it remains constant, the store cannot expand itself
-	osFile  *os.File    //OS mapped file located at Path
-	file    gommap.MMap //Memory mapped file located at Path
+	deleted uint64        //deleted number of bytes
+	length  uint64        //Total length, index of new items
+	size    uint64        //Allocated size, it remains constant, the store cannot expand itself
+	osFile  *os.File      //OS mapped file located at Path
+	file    gommap.MMap   //Memory mapped file located at Path
+	flater  *flate.Writer //Compressor of new values, nil if compression is disabled
 }
 
+const batchFlag = 1 << 31
+
+const compressedFlag = 1 << 31
+
+//Values shorter than this (excluding the timestamp header) are never compressed
+const compressionThreshold = 256
+
 const (
 	headerKeyOffset   = 0
 	headerValueOffset = 4
@@ -139,10 +158,16 @@ func (st *store) deleteStore() {
 	Store access utility functions
 */
 func (st *store) keyLen(index uint64) uint32 {
-	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])
+	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:]) &^ batchFlag
+}
+func (st *store) inBatch(index uint64) bool {
+	return binary.LittleEndian.Uint32(st.file[index+headerKeyOffset:])&batchFlag != 0
 }
 func (st *store) valLen(index uint64) uint32 {
-	return binary.LittleEndian.Uint32(st.file[index+headerValueOffset:])
+	return binary.LittleEndian.Uint32(st.file[index+headerValueOffset:]) &^ compressedFlag
+}
+func (st *store) isCompressed(index uint64) bool {
+	return binary.LittleEndian.Uint32(st.file[index+headerValueOffset:])&compressedFlag != 0
 }
 func (st *store) totalLen(index uint64) uint32 {
 	return st.keyLen(index) + st.valLen(index)
@@ -154,6 +179,18 @@ func (st *store) setValLen(index uint64, x uint32) {
 	binary.LittleEndian.PutUint32(st.file[index+headerValueOffset:], x)
 }
 
+//isPair returns true if index is the offset of a stored pair, it is used to validate external offsets
+func (st *store) isPair(index uint64) bool {
+	if index >= st.length || index+12 > st.length {
+		return false
+	}
+	total := uint64(st.totalLen(index))
+	if index+12+total > st.length {
+		return false
+	}
+	return uint64(binary.LittleEndian.Uint32(st.file[index+headerSize+total:])) == total
+}
+
 func (st *store) prev(index uint64) int64 {
 	if int64(index)-4 > 0 {
 		return int64(index) - 12 - int64(binary.LittleEndian.Uint32(st.file[index-4:index]))
@@ -166,13 +203,62 @@ func (st *store) key(index uint64) []byte {
 	return st.file[index+headerSize : index+headerSize+uint64(st.keyLen(index))]
 }
 
-//Returns a slice to the selected value
+//Returns a slice to the selected value, as stored (the value can be compressed, see record)
 func (st *store) val(index uint64) []byte { //TODO use uint32 instead of uint64
 	return st.file[index+headerSize+uint64(st.keyLen(index)) : index+headerSize+uint64(st.totalLen(index))]
 }
 
+//Returns a copy of the selected value, decompressing it if it is needed
+//It returns an error if the compressed value is corrupt
+func (st *store) record(index uint64) ([]byte, error) {
+	v := st.val(index)
+	if !st.isCompressed(index) {
+		vc := make([]byte, len(v))
+		copy(vc, v)
+		return vc, nil
+	}
+	value, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(v[8:])))
+	if err != nil {
+		return nil, errors.New("Corrupt compressed value: " + err.Error())
+	}
+	return append(v[:8:8], value...), nil
+}
+
+//enableCompression enables the compression of new values
+func (st *store) enableCompression() {
+	if st.flater == nil {
+		st.flater, _ = flate.NewWriter(nil, flate.DefaultCompression)
+	}
+}
+
+//compress returns the compressed value, ok is false if the value shouldn't be compressed
+func (st *store) compress(val []byte) (compressed []byte, ok bool) {
+	if st.flater == nil || len(val)-8 < compressionThreshold {
+		return nil, false
+	}
+	var b bytes.Buffer
+	b.Write(val[:8])
+	st.flater.Reset(&b)
+	st.flater.Write(val[8:])
+	st.flater.Close()
+	if b.Len() >= len(val) {
+		return nil, false
+	}
+	return b.Bytes(), true
+}
+
 //Inserts a new pair at the end of the store, it can fail (with a returning error) if the store size limit is reached
 func (st *store) put(key, val []byte) (uint32, error) {
+	return st.putPair(key, val, false)
+}
+
+//putPair inserts a new pair, inBatch sets the batch flag
+func (st *store) putPair(key, val []byte, inBatch bool) (uint32, error) {
+	valLen := uint32(len(val))
+	if compressed, ok := st.compress(val); ok {
+		val = compressed
+		valLen = uint32(len(val)) | compressedFlag
+	}
 	size := uint64(4 + 4 + 4 + len(key) + len(val))
 	//Cache-alignment
 	//if size <= 64 && st.length%64 >= 32 && (64-st.length%64) < size {
@@ -184,10 +270,14 @@ func (st *store) put(key, val []byte) (uint32, error) {
 	}
 	index := st.length
 	st.length += size
-	st.setKeyLen(index, uint32(len(key)))
-	st.setValLen(index, uint32(len(val)))
-	copy(st.key(index), key)
-	copy(st.val(index), val)
+	st.setValLen(index, valLen)
+	copy(st.file[index+headerSize:], key)
+	copy(st.file[index+headerSize+uint64(len(key)):], val)
 	binary.LittleEndian.PutUint32(st.file[int(index)+8+len(key)+len(val):], uint32(len(key)+len(val)))
+	keyLen := uint32(len(key))
+	if inBatch {
+		keyLen |= batchFlag
+	}
+	st.setKeyLen(index, keyLen)
 	return uint32(index), nil
 }
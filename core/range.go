@@ -0,0 +1,42 @@
+package core
+
+import (
+	"errors"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+//Range returns up to limit pairs of a chunk whose keys are in the range [start, end), in key order
+//A nil end means no upper bound, the ordered index should be enabled
+func (c *Core) Range(chunkID int, start, end []byte, limit int) (*protocol.RangeResult, error) {
+	chunk := c.chunk(chunkID)
+	if chunk == nil {
+		return nil, errors.New("Invalid chunk ID")
+	}
+	if limit <= 0 || limit > scanMaxVisited {
+		limit = scanMaxVisited
+	}
+	chunk.Lock()
+	defer chunk.Unlock()
+	if !chunk.present {
+		return nil, errors.New("ChunkNotPresent")
+	}
+	r := new(protocol.RangeResult)
+	size := 0
+	err := chunk.pm.Range(start, end, func(key, value []byte) bool {
+		if chunk.ks.expired(value) {
+			return true
+		}
+		if len(r.Keys) == limit || len(r.Keys) > 0 && size+len(key)+len(value) > scanMaxPageSize {
+			r.More = true
+			return false
+		}
+		r.Keys = append(r.Keys, key)
+		r.Values = append(r.Values, value)
+		size += len(key) + len(value)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+const (
+	scanMaxPageSize     = 1024 * 1024 //Maximum number of bytes returned by a scan page (if there is more than one pair)
+	scanMaxVisited      = 4096        //Maximum number of pairs visited by a scan page, it limits the chunk lock time
+	defragRemapInterval = 64          //A defrag records the new offset of one of each defragRemapInterval pairs
+	defragRemapHistory  = 4           //Number of defrag remaps kept by each chunk
+)
+
+/*
+	Scans and defrag remaps
+
+	A scan cursor is a store offset and the revision of the store.
+	A defrag copies the present pairs to a new store (with a new revision) keeping their order,
+	it records the new offsets of some of them (a remap), which are used to translate cursors of old revisions.
+	A translated cursor points to a previous pair, some pairs could be returned again but none will be skipped.
+	Cursors of unknown revisions are restarted at the beginning of the chunk.
+*/
+
+//offsetRemap translates offsets of a store revision to the next revision
+type offsetRemap struct {
+	revision int64
+	samples  [][2]uint64 //Old offset, new offset; sorted
+}
+
+func (r *offsetRemap) remap(offset uint64) uint64 {
+	i := sort.Search(len(r.samples), func(i int) bool {
+		return r.samples[i][0] > offset
+	})
+	if i == 0 {
+		return 0
+	}
+	return r.samples[i-1][1]
+}
+
+//addRemap records a defrag remap, chunk mutex should be held
+func (chunk *metaChunk) addRemap(r offsetRemap) {
+	chunk.remaps = append(chunk.remaps, r)
+	if len(chunk.remaps) > defragRemapHistory {
+		chunk.remaps = chunk.remaps[1:]
+	}
+}
+
+//remapCursor translates a cursor to the current revision, chunk mutex should be held
+//It returns false if the cursor revision is unknown, the zero cursor is translated to the beginning of the chunk
+func (chunk *metaChunk) remapCursor(cursor protocol.ScanCursor) (protocol.ScanCursor, bool) {
+	if cursor == (protocol.ScanCursor{}) {
+		return protocol.ScanCursor{Revision: chunk.revision}, true
+	}
+	for cursor.Revision != chunk.revision {
+		var r *offsetRemap
+		for i := range chunk.remaps {
+			if chunk.remaps[i].revision == cursor.Revision {
+				r = &chunk.remaps[i]
+			}
+		}
+		if r == nil {
+			return protocol.ScanCursor{Revision: chunk.revision}, false
+		}
+		cursor = protocol.ScanCursor{Revision: cursor.Revision + 1, Offset: r.remap(cursor.Offset)}
+	}
+	return cursor, true
+}
+
+//Scan returns a page with up to limit pairs of a chunk starting at cursor
+//Only pairs whose key starts with prefix are returned, a page could be empty even if the scan isn't done
+func (c *Core) Scan(chunkID int, cursor protocol.ScanCursor, prefix []byte, limit int) (*protocol.ScanPage, error) {
+	chunk := c.chunk(chunkID)
+	if chunk == nil {
+		return nil, errors.New("Invalid chunk ID")
+	}
+	if limit <= 0 || limit > scanMaxVisited {
+		limit = scanMaxVisited
+	}
+	chunk.Lock()
+	defer chunk.Unlock()
+	if !chunk.present {
+		return nil, errors.New("ChunkNotPresent")
+	}
+	cursor, _ = chunk.remapCursor(cursor)
+	page := new(protocol.ScanPage)
+	size, visited := 0, 0
+	next, err := chunk.pm.Scan(cursor.Offset, func(offset uint64, key, value []byte) bool {
+		if visited == scanMaxVisited || len(page.Keys) == limit ||
+			len(page.Keys) > 0 && size+len(key)+len(value) > scanMaxPageSize {
+			return false
+		}
+		visited++
+		if bytes.HasPrefix(key, prefix) && !chunk.ks.expired(value) {
+			page.Keys = append(page.Keys, key)
+			page.Values = append(page.Values, value)
+			size += len(key) + len(value)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	page.Next = protocol.ScanCursor{Revision: chunk.revision, Offset: next}
+	page.Done = next == uint64(chunk.pm.Used())
+	return page, nil
+}
@@ -0,0 +1,36 @@
+package core
+
+import "github.com/dv343/treeless/hashing"
+
+/*
+	Write notifications
+
+	A WriteListener is notified after each successful write of a local chunk (sets, deletions,
+	CAS, batches, read-modify-write operations and Paxos commits).
+	It gets the stored record of the written key after the write, the write may have been
+	discarded by the last writer wins policy, so the record could be older than the written one.
+*/
+
+//WriteListener gets notified of the writes made on a Core
+type WriteListener interface {
+	//Watched returns true if the writes of key should be notified, it should be fast
+	Watched(key []byte) bool
+	//Written is called after a write of a watched key with the chunk lock held, it must not block
+	//record is the stored record of the key (timestamp header + value), nil if the pair is deleted
+	Written(key, record []byte)
+}
+
+//SetWriteListener sets the listener of every write, it should be called before using the Core
+func (c *Core) SetWriteListener(l WriteListener) {
+	c.listener = l
+}
+
+//notifyWrite notifies a write of key to the listener and to the change feed waiters, chunk lock should be held
+func (c *Core) notifyWrite(chunk *metaChunk, key []byte) {
+	chunk.notifyChange()
+	if c.listener == nil || !c.listener.Watched(key) {
+		return
+	}
+	record, _ := chunk.pm.Get(uint32(hashing.FNV1a64(key)), key)
+	c.listener.Written(key, record)
+}
@@ -1,7 +1,9 @@
 package heartbeat
 
 import (
+	"errors"
 	"log"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,23 +15,62 @@ import (
 
 var heartbeatTimeout = time.Millisecond * 250
 var heartbeatSleep = time.Millisecond * 500
-var GossipNewsExpirationTime = time.Second * 10
 var timeoutRetries = 3
+var indirectProbes = 3
+var suspicionTimeout = time.Second * 3
+
+var errNoHelpers = errors.New("No servers available for indirect probing")
+
+//Phi-accrual failure detector defaults
+var phiSuspectThreshold = 3.0
+var phiDeadThreshold = 8.0
+var phiMinStdDev = time.Millisecond * 100
+var phiAcceptablePause = time.Second
+
+//Config contains the parameters of a heartbeater, it can't be changed once the heartbeater is started
+type Config struct {
+	Sleep          time.Duration
+	SleepOnFail    time.Duration
+	Timeout        time.Duration
+	TimeoutRetries time.Duration //Consecutive timeouts needed to declare dead a server that never replied
+	//Phi-accrual failure detector parameters
+	PhiSuspectThreshold float64       //Servers with a phi above this are suspected, but they keep their chunks
+	PhiDeadThreshold    float64       //Servers with a phi above this are declared dead
+	PhiMinStdDev        time.Duration //Lower bound of the inter-arrival standard deviation
+	PhiAcceptablePause  time.Duration //Tolerated pause (GC, packet loss...) on top of the expected inter-arrival time
+	//Membership protocol parameters
+	IndirectProbes   int           //Number of servers asked to ping a server that didn't respond
+	SuspicionTimeout time.Duration //Time a suspected server has to refute the suspicion before being declared dead
+}
+
+//DefaultConfig returns the default heartbeater parameters
+func DefaultConfig() Config {
+	return Config{
+		Sleep:               heartbeatSleep,
+		Timeout:             heartbeatTimeout,
+		TimeoutRetries:      time.Duration(timeoutRetries),
+		PhiSuspectThreshold: phiSuspectThreshold,
+		PhiDeadThreshold:    phiDeadThreshold,
+		PhiMinStdDev:        phiMinStdDev,
+		PhiAcceptablePause:  phiAcceptablePause,
+		IndirectProbes:      indirectProbes,
+		SuspicionTimeout:    suspicionTimeout,
+	}
+}
 
 //Heartbeater is used to discover changes in the DB topology by using a ping-pong protocol
-//Exported fields are used to configure various parameters
+//The exported fields of Config are read-only, they are set by Start
 type Heartbeater struct {
-	Sleep                time.Duration
-	SleepOnFail          time.Duration
-	Timeout              time.Duration
-	TimeoutRetries       time.Duration
-	stop                 int32
-	timeouts             map[string]int
-	sg                   *servergroup.ServerGroup
-	core                 *core.Core
-	recentlyAddedServers map[string]time.Time
-	recentlyDeadServers  map[string]time.Time
-	newsMutex            sync.Mutex
+	Config
+	stop        int32
+	sg          *servergroup.ServerGroup
+	core        *core.Core
+	mutex       sync.Mutex //Protects all the following fields
+	timeouts    map[string]int
+	detectors   map[string]*PhiDetector
+	incarnation uint32 //Local incarnation number
+	members     map[string]*member
+	updates     map[string]*gossipUpdate //Updates pending to be disseminated
 }
 
 //Stop requesting and listening to heartbeats
@@ -37,103 +78,200 @@ func (h *Heartbeater) Stop() {
 	atomic.StoreInt32(&h.stop, 1)
 }
 
-func (h *Heartbeater) GossipAdded(addr string) {
-	h.cleanNews()
-	h.newsMutex.Lock()
-	h.recentlyAddedServers[addr] = time.Now()
-	h.newsMutex.Unlock()
-}
-
-func (h *Heartbeater) GossipDead(addr string) {
-	h.cleanNews()
-	h.newsMutex.Lock()
-	h.recentlyDeadServers[addr] = time.Now()
-	h.newsMutex.Unlock()
+func (h *Heartbeater) heartbeatRequest(target string) protocol.HeartbeatRequest {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.sg.LocalhostIPPort == "" {
+		//Clients aren't group members, their membership updates would be ignored
+		return protocol.HeartbeatRequest{}
+	}
+	return protocol.HeartbeatRequest{Origin: h.sg.LocalhostIPPort, Updates: h.piggyback(target)}
 }
 
-func (h *Heartbeater) cleanNews() {
-	t := time.Now()
-	h.newsMutex.Lock()
-	for k, v := range h.recentlyAddedServers {
-		if v.Add(GossipNewsExpirationTime).Before(t) {
-			delete(h.recentlyAddedServers, k)
-		}
-	}
-	for k, v := range h.recentlyDeadServers {
-		if v.Add(GossipNewsExpirationTime).Before(t) {
-			delete(h.recentlyDeadServers, k)
-		}
-	}
-	h.newsMutex.Unlock()
+//trusted returns true if the membership updates and indirect pings of a request should be accepted,
+//only group members are allowed to change the membership view of other members
+//Origin is only checked on node requests (see com.SetHeartbeatNodeKey), clients could forge it
+func (h *Heartbeater) trusted(request protocol.HeartbeatRequest, node bool) bool {
+	return node && request.Origin != "" && h.sg.IsServerOnGroup(request.Origin)
 }
 
 func (h *Heartbeater) request(addr string) (ok bool) {
 	if addr == h.sg.LocalhostIPPort {
 		return true
 	}
-	aa, err := com.UDPRequest(addr, heartbeatTimeout)
+	aa, err := com.UDPRequest(addr, h.heartbeatRequest(addr), h.Timeout)
+	probed := false //True if the indirect probing failed
+	if err != nil && h.sg.IsServerOnGroup(addr) {
+		h.mutex.Lock()
+		_, known := h.detectors[addr]
+		h.mutex.Unlock()
+		if known {
+			//The problem could be on our side (asymmetric link), ask other servers
+			aa, err = h.indirectRequest(addr)
+			probed = err != nil && err != errNoHelpers
+		}
+	}
 	if err != nil {
-		if h.sg.IsServerOnGroup(addr) {
-			h.timeouts[addr] = h.timeouts[addr] + 1
-			if h.timeouts[addr] >= 3 {
+		if !h.sg.IsServerOnGroup(addr) {
+			h.mutex.Lock()
+			delete(h.timeouts, addr)
+			h.mutex.Unlock()
+			return false
+		}
+		h.mutex.Lock()
+		h.timeouts[addr] = h.timeouts[addr] + 1
+		d, ok := h.detectors[addr]
+		if !ok {
+			//No heartbeat was ever received from this server, fall back to consecutive timeouts
+			retry := time.Duration(h.timeouts[addr]) < h.TimeoutRetries
+			if !retry {
 				delete(h.timeouts, addr)
-				//Server is dead
-				h.sg.DeadServer(addr)
-				h.GossipDead(addr)
-			} else {
+				h.setStatus(addr, protocol.MemberDead)
+			}
+			h.mutex.Unlock()
+			if retry {
+				time.Sleep(h.SleepOnFail)
 				return h.request(addr)
 			}
-		} else {
-			delete(h.timeouts, addr)
+			return false
 		}
+		if !h.isDead(addr) {
+			phi := d.Phi(time.Now(), h.PhiMinStdDev, h.PhiAcceptablePause)
+			if phi >= h.PhiDeadThreshold {
+				delete(h.timeouts, addr)
+				h.setStatus(addr, protocol.MemberDead)
+			} else if probed || phi >= h.PhiSuspectThreshold {
+				//Nobody could reach the server, it has SuspicionTimeout to refute the suspicion
+				h.setStatus(addr, protocol.MemberSuspect)
+			}
+		}
+		h.mutex.Unlock()
 		return false
 	}
 	//Process
-	delete(h.timeouts, addr)
 	if !h.sg.IsServerOnGroup(addr) {
 		h.sg.AddServerToGroup(addr)
-		h.GossipAdded(addr)
+	}
+	h.mutex.Lock()
+	delete(h.timeouts, addr)
+	h.detector(addr).Heartbeat(time.Now())
+	h.acked(addr, aa.Incarnation)
+	h.mutex.Unlock()
+	if h.sg.IsNewerConfig(aa.Epoch, aa.ConfigHash) {
+		h.adoptConfiguration(addr)
 	}
 	h.sg.SetServerChunks(addr, aa.KnownChunks)
-	//Gossip
-	if err == nil {
-		for _, new := range aa.RecentlyAddedServers {
-			if !h.sg.IsServerOnGroup(new) {
-				//Mismatch detected, request more info
-				log.Println("Gossip (add)", addr, new, h.request(new))
-			}
+	h.applyUpdates(aa.Updates)
+	return true
+}
+
+//adoptConfiguration requests the server group configuration to addr, it will be adopted if it is newer than the local one
+func (h *Heartbeater) adoptConfiguration(addr string) {
+	s := h.sg.GetServer(addr)
+	if s == nil {
+		return
+	}
+	serialization := s.GetAccessInfo()
+	if serialization == nil {
+		return
+	}
+	adopted, err := h.sg.AdoptConfiguration(serialization)
+	if err != nil {
+		log.Println("Configuration from", addr, "rejected:", err)
+	} else if adopted {
+		log.Println("Configuration adopted from", addr, "epoch:", h.sg.Epoch())
+	}
+}
+
+//indirectRequest asks up to IndirectProbes random servers to ping addr on our behalf
+//It returns the first response
+func (h *Heartbeater) indirectRequest(addr string) (*protocol.AmAlive, error) {
+	var helpers []string
+	h.mutex.Lock()
+	for _, s := range h.sg.Servers() {
+		if s.Phy != addr && s.Phy != h.sg.LocalhostIPPort && !h.isDead(s.Phy) {
+			helpers = append(helpers, s.Phy)
 		}
-		for _, new := range aa.RecentlyDeadServers {
-			if h.sg.IsServerOnGroup(new) {
-				//Mismatch detected, request more info
-				log.Println("Gossip (dead)", addr, new, h.request(new))
+	}
+	h.mutex.Unlock()
+	for i := range helpers {
+		j := rand.Intn(i + 1)
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	}
+	if len(helpers) > h.IndirectProbes {
+		helpers = helpers[:h.IndirectProbes]
+	}
+	if len(helpers) == 0 {
+		return nil, errNoHelpers
+	}
+	responses := make(chan *protocol.AmAlive, len(helpers))
+	for _, helper := range helpers {
+		request := h.heartbeatRequest(helper)
+		request.Target = addr
+		go func(helper string, request protocol.HeartbeatRequest) {
+			//The helper needs a full timeout to ping the target
+			aa, err := com.UDPRequest(helper, request, 2*h.Timeout)
+			if err != nil {
+				aa = nil
 			}
+			responses <- aa
+		}(helper, request)
+	}
+	for range helpers {
+		if aa := <-responses; aa != nil {
+			return aa, nil
 		}
 	}
-	return true
+	return nil, errors.New("Indirect probing failed")
+}
+
+//detector returns the failure detector associated with addr, creating it if needed, h.mutex should be held
+func (h *Heartbeater) detector(addr string) *PhiDetector {
+	d, ok := h.detectors[addr]
+	if !ok {
+		//Each server is requested once per round
+		n := h.sg.NumServers()
+		if n < 1 {
+			n = 1
+		}
+		d = NewPhiDetector(h.Sleep * time.Duration(n))
+		h.detectors[addr] = d
+	}
+	return d
 }
 
 //Start a new heartbeater in the background and introduce the changes into sg
+//The default configuration is used if config is nil
 //It blocks until the first heartbeat of each server is served
-func Start(sg *servergroup.ServerGroup) *Heartbeater {
+func Start(sg *servergroup.ServerGroup, config *Config) *Heartbeater {
 	h := new(Heartbeater)
+	if config != nil {
+		h.Config = *config
+	} else {
+		h.Config = DefaultConfig()
+	}
 	h.timeouts = make(map[string]int)
-	h.recentlyAddedServers = make(map[string]time.Time)
-	h.recentlyDeadServers = make(map[string]time.Time)
+	h.detectors = make(map[string]*PhiDetector)
+	h.members = make(map[string]*member)
+	h.updates = make(map[string]*gossipUpdate)
 	h.sg = sg
 	for _, s := range sg.Servers() {
 		h.request(s.Phy)
 	}
 	go func() {
-		ticker := time.NewTicker(heartbeatSleep)
+		ticker := time.NewTicker(h.Sleep)
 		defer ticker.Stop()
 		for atomic.LoadInt32(&h.stop) == 0 {
 			queryList := sg.Servers()
 			if len(queryList) == 0 {
 				log.Println("Heartbeat querylist empty")
 			}
-			for _, qs := range queryList {
-				h.request(qs.Phy)
+			//Randomized round-robin, each server is requested once per round
+			for _, i := range rand.Perm(len(queryList)) {
+				h.request(queryList[i].Phy)
+				h.mutex.Lock()
+				h.checkSuspects()
+				h.mutex.Unlock()
 				<-ticker.C
 			}
 		}
@@ -142,22 +280,31 @@ func Start(sg *servergroup.ServerGroup) *Heartbeater {
 }
 
 //ListenReply starts listening and repling to UDP heartbeat requests
-func (h *Heartbeater) ListenReply(c *core.Core) func() protocol.AmAlive {
+func (h *Heartbeater) ListenReply(c *core.Core) com.UDPCallback {
 	h.core = c
-	return func() (r protocol.AmAlive) {
-		h.cleanNews()
-		r.KnownChunks = c.PresentChunksList()
-		h.cleanNews()
-		h.newsMutex.Lock()
-		r.RecentlyAddedServers = make([]string, 0, len(h.recentlyAddedServers))
-		for k := range h.recentlyAddedServers {
-			r.RecentlyAddedServers = append(r.RecentlyAddedServers, k)
+	return func(request protocol.HeartbeatRequest, node bool) (r protocol.AmAlive, ok bool) {
+		trusted := h.trusted(request, node)
+		if trusted {
+			h.applyUpdates(request.Updates)
 		}
-		r.RecentlyDeadServers = make([]string, 0, len(h.recentlyDeadServers))
-		for k := range h.recentlyDeadServers {
-			r.RecentlyDeadServers = append(r.RecentlyDeadServers, k)
+		if request.Target != "" {
+			//Indirect ping, relay the target response
+			//Only group members can be pinged on behalf of other group members, the server can't be used as a reflector
+			if !trusted || !h.sg.IsServerOnGroup(request.Target) || request.Target == h.sg.LocalhostIPPort {
+				return r, false
+			}
+			aa, err := com.UDPRequest(request.Target, h.heartbeatRequest(request.Target), h.Timeout)
+			if err != nil {
+				return r, false
+			}
+			return *aa, true
 		}
-		h.newsMutex.Unlock()
-		return r
+		r.KnownChunks = c.PresentChunksList()
+		h.mutex.Lock()
+		r.Incarnation = h.incarnation
+		r.Epoch, r.ConfigHash = h.sg.ConfigVersion()
+		r.Updates = h.piggyback("")
+		h.mutex.Unlock()
+		return r, true
 	}
 }
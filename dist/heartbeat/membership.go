@@ -0,0 +1,189 @@
+package heartbeat
+
+import (
+	"log"
+	"math"
+	"sort"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+/*
+	SWIM-like membership dissemination
+
+	Membership changes (alive, suspect and dead) are piggybacked on heartbeat requests and responses.
+	Each update is retransmitted a number of times proportional to log(number of servers),
+	so every member receives it with high probability.
+
+	Each member has an incarnation number that only the member itself can increment.
+	A member that learns that it is suspected (or declared dead) refutes it by disseminating
+	an alive update with a higher incarnation number.
+*/
+
+//retransmitMult controls the number of times an update is piggybacked: retransmitMult*log2(servers+1)
+var retransmitMult = 3
+
+//maxPiggybackedUpdates limits the number of updates sent on each heartbeat
+var maxPiggybackedUpdates = 16
+
+type member struct {
+	incarnation uint32
+	status      protocol.MemberStatus
+	suspectTime time.Time //Time of the transition to the suspect status
+}
+
+type gossipUpdate struct {
+	protocol.MemberUpdate
+	transmissions int
+}
+
+//overrides returns true if the update u contains newer information than the stored member m
+func overrides(u protocol.MemberUpdate, m *member) bool {
+	switch u.Status {
+	case protocol.MemberAlive:
+		return u.Incarnation > m.incarnation
+	case protocol.MemberSuspect:
+		return u.Incarnation > m.incarnation ||
+			(u.Incarnation == m.incarnation && m.status == protocol.MemberAlive)
+	case protocol.MemberDead:
+		return u.Incarnation > m.incarnation ||
+			(u.Incarnation == m.incarnation && m.status != protocol.MemberDead)
+	}
+	return false
+}
+
+//GossipAdded disseminates the addition of a new server
+func (h *Heartbeater) GossipAdded(addr string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	m, ok := h.members[addr]
+	if !ok {
+		m = new(member)
+		h.members[addr] = m
+	}
+	h.gossip(protocol.MemberUpdate{Addr: addr, Status: protocol.MemberAlive, Incarnation: m.incarnation})
+}
+
+//applyUpdates merges received membership updates into the local view
+func (h *Heartbeater) applyUpdates(updates []protocol.MemberUpdate) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, u := range updates {
+		h.apply(u)
+	}
+}
+
+//apply merges a membership update, h.mutex should be held
+func (h *Heartbeater) apply(u protocol.MemberUpdate) {
+	if u.Addr == h.sg.LocalhostIPPort {
+		if u.Status != protocol.MemberAlive && u.Incarnation >= h.incarnation {
+			//Refute the suspicion
+			h.incarnation = u.Incarnation + 1
+			log.Println("Refuting suspicion, new incarnation:", h.incarnation)
+			h.gossip(protocol.MemberUpdate{Addr: u.Addr, Status: protocol.MemberAlive, Incarnation: h.incarnation})
+		}
+		return
+	}
+	if !h.sg.IsServerOnGroup(u.Addr) {
+		//Servers are only added by newer configurations (see configuration epochs),
+		//gossip about unknown servers is stale
+		return
+	}
+	m, ok := h.members[u.Addr]
+	if !ok {
+		m = new(member)
+		h.members[u.Addr] = m
+	} else if !overrides(u, m) {
+		return
+	}
+	if u.Status == protocol.MemberSuspect && m.status != protocol.MemberSuspect {
+		m.suspectTime = time.Now()
+	}
+	m.incarnation = u.Incarnation
+	m.status = u.Status
+	switch u.Status {
+	case protocol.MemberAlive:
+		h.sg.ServerAlive(u.Addr)
+	case protocol.MemberSuspect:
+		h.sg.SuspectServer(u.Addr)
+	case protocol.MemberDead:
+		delete(h.detectors, u.Addr)
+		h.sg.DeadServer(u.Addr)
+	}
+	h.gossip(u)
+}
+
+//setStatus changes the status of a member as a result of a local decision, h.mutex should be held
+func (h *Heartbeater) setStatus(addr string, status protocol.MemberStatus) {
+	m, ok := h.members[addr]
+	if !ok {
+		m = new(member)
+		h.members[addr] = m
+	}
+	h.apply(protocol.MemberUpdate{Addr: addr, Status: status, Incarnation: m.incarnation})
+}
+
+//acked registers a direct response of a member, h.mutex should be held
+func (h *Heartbeater) acked(addr string, incarnation uint32) {
+	m, ok := h.members[addr]
+	if !ok || incarnation > m.incarnation {
+		h.apply(protocol.MemberUpdate{Addr: addr, Status: protocol.MemberAlive, Incarnation: incarnation})
+		return
+	}
+	//The member will refute the suspicion when it receives our view, meanwhile trust the response
+	m.status = protocol.MemberAlive
+}
+
+//checkSuspects declares dead the members suspected for a long time, h.mutex should be held
+func (h *Heartbeater) checkSuspects() {
+	now := time.Now()
+	for addr, m := range h.members {
+		if m.status == protocol.MemberSuspect && now.Sub(m.suspectTime) > h.SuspicionTimeout {
+			h.setStatus(addr, protocol.MemberDead)
+		}
+	}
+}
+
+//isDead returns true if the member is known to be dead, h.mutex should be held
+func (h *Heartbeater) isDead(addr string) bool {
+	m, ok := h.members[addr]
+	return ok && m.status == protocol.MemberDead
+}
+
+//gossip queues an update for dissemination, h.mutex should be held
+func (h *Heartbeater) gossip(u protocol.MemberUpdate) {
+	h.updates[u.Addr] = &gossipUpdate{MemberUpdate: u}
+}
+
+//piggyback returns the updates to send on the next heartbeat to target, h.mutex should be held
+//The updates with less transmissions are selected first
+func (h *Heartbeater) piggyback(target string) []protocol.MemberUpdate {
+	list := make([]*gossipUpdate, 0, len(h.updates))
+	for _, u := range h.updates {
+		list = append(list, u)
+	}
+	sort.Sort(byTransmissions(list))
+	maxTransmissions := retransmitMult * int(math.Ceil(math.Log2(float64(h.sg.NumServers()+1))))
+	var updates []protocol.MemberUpdate
+	//Let the target know our view of it, it will refute it if needed
+	if m, ok := h.members[target]; ok && m.status != protocol.MemberAlive {
+		updates = append(updates, protocol.MemberUpdate{Addr: target, Status: m.status, Incarnation: m.incarnation})
+	}
+	for _, u := range list {
+		if len(updates) >= maxPiggybackedUpdates {
+			break
+		}
+		updates = append(updates, u.MemberUpdate)
+		u.transmissions++
+		if u.transmissions >= maxTransmissions {
+			delete(h.updates, u.Addr)
+		}
+	}
+	return updates
+}
+
+type byTransmissions []*gossipUpdate
+
+func (l byTransmissions) Len() int           { return len(l) }
+func (l byTransmissions) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byTransmissions) Less(i, j int) bool { return l[i].transmissions < l[j].transmissions }
@@ -0,0 +1,82 @@
+package heartbeat
+
+import (
+	"math"
+	"time"
+)
+
+/*
+	Phi-accrual failure detector
+
+	Instead of a boolean alive/dead answer the detector outputs a suspicion level (phi)
+	that grows continuously with the time elapsed since the last heartbeat.
+	The inter-arrival times of each peer are sampled on a sliding window and modeled as
+	a normal distribution, phi = -log10(P(next heartbeat arrives later than now)).
+
+	A phi of 1 means a 10% chance of being wrong when the peer is declared failed,
+	a phi of 2 a 1% chance, a phi of 3 a 0.1% chance, and so on.
+*/
+
+const phiWindowSize = 100
+
+//PhiDetector estimates the suspicion level of a peer from the arrival times of its heartbeats
+type PhiDetector struct {
+	intervals     [phiWindowSize]float64 //Sampled inter-arrival times in seconds, used as a ring buffer
+	index, n      int                    //Next write position and number of valid samples
+	sum, sqSum    float64                //Running sums of the samples
+	lastHeartbeat time.Time
+}
+
+//NewPhiDetector returns a detector bootstrapped with an estimation of the interval between heartbeats,
+//avoiding false positives before enough samples have been taken
+func NewPhiDetector(firstEstimate time.Duration) *PhiDetector {
+	d := new(PhiDetector)
+	mean := firstEstimate.Seconds()
+	stdDev := mean / 4
+	d.add(mean - stdDev)
+	d.add(mean + stdDev)
+	return d
+}
+
+func (d *PhiDetector) add(interval float64) {
+	if d.n == phiWindowSize {
+		old := d.intervals[d.index]
+		d.sum -= old
+		d.sqSum -= old * old
+	} else {
+		d.n++
+	}
+	d.intervals[d.index] = interval
+	d.sum += interval
+	d.sqSum += interval * interval
+	d.index = (d.index + 1) % phiWindowSize
+}
+
+//Heartbeat registers a heartbeat arrival
+func (d *PhiDetector) Heartbeat(t time.Time) {
+	if !d.lastHeartbeat.IsZero() {
+		d.add(t.Sub(d.lastHeartbeat).Seconds())
+	}
+	d.lastHeartbeat = t
+}
+
+//Phi returns the suspicion level at time t
+//minStdDev prevents a too sensitive detector when heartbeats arrive very regularly
+//acceptablePause is added to the mean, it should absorb GC pauses and transient network hiccups
+func (d *PhiDetector) Phi(t time.Time, minStdDev, acceptablePause time.Duration) float64 {
+	if d.lastHeartbeat.IsZero() {
+		return 0
+	}
+	mean := d.sum / float64(d.n)
+	variance := d.sqSum/float64(d.n) - mean*mean
+	stdDev := math.Max(math.Sqrt(math.Max(variance, 0)), minStdDev.Seconds())
+	mean += acceptablePause.Seconds()
+
+	//Logistic approximation of the normal cumulative distribution function
+	y := (t.Sub(d.lastHeartbeat).Seconds() - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
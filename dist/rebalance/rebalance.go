@@ -39,20 +39,24 @@ func StartRebalance(sg *servergroup.ServerGroup, lh *core.Core, ShouldStop func(
 	go func() { //LoadRebalancer
 		for !ShouldStop() {
 			known := float64(lh.PresentChunks())
-			total := float64(sg.NumChunks()) * float64(sg.Redundancy())
+			//Each keyspace has its own redundancy
+			total := 0.0
+			for i := 0; i < sg.TotalChunks(); i++ {
+				total += float64(sg.ChunkRedundancy(i))
+			}
 			avg := total / float64(sg.NumServers())
 			//LR-Duplicate
-			for i := 0; i < sg.NumChunks(); i++ {
-				if sg.NumHolders(i) < sg.Redundancy() && !lh.IsPresent(i) {
-					log.Println("Duplicate to mantain redundancy. Reason:", i, sg.NumHolders(i), sg.Redundancy())
+			for i := 0; i < sg.TotalChunks(); i++ {
+				if sg.NumHolders(i) < sg.ChunkRedundancy(i) && !lh.IsPresent(i) {
+					log.Println("Duplicate to mantain redundancy. Reason:", i, sg.NumHolders(i), sg.ChunkRedundancy(i))
 					duplicate(i)
 				}
 			}
 			if known+1 < avg { //REB-Duplicate
 				//Local server has less work than it should
 				//Try to download a random chunk
-				c := int(rand.Int31n(int32(sg.NumChunks())))
-				if !lh.IsPresent(c) && sg.NumHolders(c) <= sg.Redundancy() {
+				c := int(rand.Int31n(int32(sg.TotalChunks())))
+				if !lh.IsPresent(c) && sg.NumHolders(c) <= sg.ChunkRedundancy(c) {
 					log.Println("Duplicate to rebalance. Reason:", known, avg)
 					duplicate(c)
 				}
@@ -60,7 +64,7 @@ func StartRebalance(sg *servergroup.ServerGroup, lh *core.Core, ShouldStop func(
 				//Local server has more work than it should
 				//Locate a chunk with more redundancy than the required redundancy and *not* protected
 				for _, c := range lh.PresentChunksList() {
-					if lh.IsPresent(c.ID) && sg.NumHolders(c.ID) > sg.Redundancy() {
+					if lh.IsPresent(c.ID) && sg.NumHolders(c.ID) > sg.ChunkRedundancy(c.ID) {
 						log.Println("Release to rebalance.", c.ID, sg.NumHolders(c.ID), " Reason:", known, avg)
 						release(c.ID)
 						break
@@ -127,16 +131,12 @@ func duplicator(sg *servergroup.ServerGroup, lh *core.Core,
 		}
 
 		lh.ChunkSetPresent(cid)
-		if length == 0 {
-			log.Println("Duplication completed: 0 sized", s.Phy, cid)
-
-		} else {
-			go func() {
-				//Heartbeat must be propagated before transfer initialization
-				time.Sleep(duplicationWaitTime)
-				duplicateChannel <- cid
-			}()
-		}
+		//Empty chunks are transferred too, pairs could be written before the heartbeat propagates the new holder
+		go func() {
+			//Heartbeat must be propagated before transfer initialization
+			time.Sleep(duplicationWaitTime)
+			duplicateChannel <- cid
+		}()
 	}
 
 	go func() {
@@ -36,7 +36,7 @@ func StartRepairSystem(sg *servergroup.ServerGroup, lh *core.Core, ShouldStop fu
 		m := make(map[int]int)
 		for !ShouldStop() {
 			sg.SetServerChunks(sg.LocalhostIPPort, lh.PresentChunksList())
-			for cid := 0; cid < sg.NumChunks(); cid++ {
+			for cid := 0; cid < sg.TotalChunks(); cid++ {
 				if !lh.IsPresent(cid) {
 					continue
 				}
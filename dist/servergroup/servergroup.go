@@ -11,14 +11,19 @@ import (
 	"time"
 	"github.com/dv343/treeless/com"
 	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/hashing"
 )
 
 //Hide virtuals
 
 type serializableServerGroup struct {
-	NumChunks  int //Number of DB chunks
-	Redundancy int //DB target redundancy
+	NumChunks  int  //Number of DB chunks
+	Redundancy int  //DB target redundancy
+	Ordered    bool //Chunks maintain an ordered index
+	Keyspaces  []protocol.Keyspace
+	Epoch      uint64 //Configuration epoch
 	Servers    map[string]*VirtualServer
+	Origin     string `json:",omitempty"` //Address of the server that marshalled the configuration
 }
 
 //ServerGroup provides an access to a DB server group
@@ -26,12 +31,26 @@ type ServerGroup struct {
 	mutex           sync.RWMutex //All ServerGroup read/writes are mutex-protected
 	LocalhostIPPort string       //Read-only from external packages
 	//Database configuration
-	numChunks  int //Number of DB chunks
-	redundancy int //DB target redundancy
+	numChunks  int                 //Number of DB chunks
+	redundancy int                 //DB target redundancy
+	ordered    bool                //Chunks maintain an ordered index, needed by range queries
+	keyspaces  []protocol.Keyspace //Named keyspaces, sorted by their first chunk ID
+	epoch      uint64              //Configuration epoch, incremented on each intentional server list change
+	hash       uint64              //Configuration hash, it breaks the ties between configurations with the same epoch
+	//keyspaceListener is called after adopting a configuration with new keyspaces
+	keyspaceListener func(k protocol.Keyspace)
+	//epochListener is called after each epoch change
+	epochListener func(epoch uint64)
 	//External status
 	servers map[string]*VirtualServer //Set of all DB servers
 	chunks  []VirtualChunk            //Array of all DB chunks
 	noDelay bool
+	origin  string         //Address of the server that sent the configuration, see Origin
+	local   *VirtualServer //Server preferred by GetChunkHolders, see SetLocalServer
+	//Address and dial address of the local server, they are kept to restore it if it is removed and added again
+	localAddr     string
+	localDialAddr string
+	token   []byte         //Token of the connections to the servers, see AssocWithToken
 }
 
 /*
@@ -65,8 +84,18 @@ func CreateServerGroup(numChunks int, redundancy int, LocalhostIPPort string) *S
 }
 
 func Assoc(addr string, LocalhostIPPort string) (*ServerGroup, error) {
+	return AssocWithToken(addr, LocalhostIPPort, "")
+}
+
+//AssocWithToken is like Assoc, but the connections to the servers are authenticated with token
+//instead of the token set by com.SetToken, "" uses the com.SetToken token
+func AssocWithToken(addr string, LocalhostIPPort string, token string) (*ServerGroup, error) {
+	var t []byte
+	if token != "" {
+		t = []byte(token)
+	}
 	//Connect to the provided address
-	c, err := com.CreateConnection(addr, func() {})
+	c, err := com.CreateConnectionWithToken(addr, t, func() {})
 	if err != nil {
 		return nil, err
 	}
@@ -80,6 +109,10 @@ func Assoc(addr string, LocalhostIPPort string) (*ServerGroup, error) {
 		return nil, err
 	}
 	sg.LocalhostIPPort = LocalhostIPPort
+	sg.token = t
+	for _, s := range sg.servers {
+		s.token = t
+	}
 	return sg, nil
 }
 
@@ -97,7 +130,13 @@ func UnmarhalServerGroup(serialization []byte) (*ServerGroup, error) {
 	for i := 0; i < sg.numChunks; i++ {
 		sg.chunks[i].id = i
 	}
-
+	keyspaces := sg.keyspaces
+	sg.keyspaces = nil
+	for _, k := range keyspaces {
+		if err := sg.addKeyspace(k); err != nil {
+			return nil, err
+		}
+	}
 	return sg, nil
 }
 
@@ -116,6 +155,8 @@ func (sg *ServerGroup) String() string {
 		dead := ""
 		if s.dead {
 			dead = "DEAD "
+		} else if s.suspect {
+			dead = "SUSPECT "
 		}
 		str += "\t Address: " + s.Phy +
 			"\n\t\t" + dead + "Known chunks: " + fmt.Sprint(s.heldChunks) + " Last heartbeat: " + (t.Sub(s.lastHeartbeat)).String() + "\n"
@@ -146,11 +187,7 @@ func (sg *ServerGroup) String() string {
 func (sg *ServerGroup) Marshal() ([]byte, error) {
 	sg.mutex.Lock()
 	defer sg.mutex.Unlock()
-	ssg := new(serializableServerGroup)
-	ssg.NumChunks = sg.numChunks
-	ssg.Redundancy = sg.redundancy
-	ssg.Servers = sg.servers
-	return json.Marshal(ssg)
+	return json.Marshal(sg.serializable())
 }
 
 func (sg *ServerGroup) unmarshal(b []byte) error {
@@ -161,14 +198,162 @@ func (sg *ServerGroup) unmarshal(b []byte) error {
 	}
 	sg.numChunks = ssg.NumChunks
 	sg.redundancy = ssg.Redundancy
+	sg.ordered = ssg.Ordered
+	sg.keyspaces = ssg.Keyspaces
+	sg.epoch = ssg.Epoch
 	sg.servers = ssg.Servers
+	sg.origin = ssg.Origin
+	sg.hash = ssg.hash()
 	return nil
 }
 
+/*
+	Configuration epochs
+
+	Each intentional change of the server list increments the configuration epoch,
+	servers adopt the configurations with a newer epoch (see AdoptConfiguration).
+	Concurrent changes made on different servers produce different configurations with the same epoch,
+	the configuration with the greatest hash wins, so every server converges to the same configuration.
+	The losing change is lost, it should be retried.
+*/
+
+//hash returns the configuration hash, it depends on the server addresses and the DB configuration
+func (ssg *serializableServerGroup) hash() uint64 {
+	addrs := make([]string, 0, len(ssg.Servers))
+	for addr := range ssg.Servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	b, err := json.Marshal(struct {
+		Servers    []string
+		NumChunks  int
+		Redundancy int
+		Ordered    bool
+		Keyspaces  []protocol.Keyspace
+	}{addrs, ssg.NumChunks, ssg.Redundancy, ssg.Ordered, ssg.Keyspaces})
+	if err != nil {
+		panic(err)
+	}
+	return hashing.FNV1a64(b)
+}
+
+//serializable returns the serializable configuration, sg.mutex should be held
+func (sg *ServerGroup) serializable() *serializableServerGroup {
+	ssg := new(serializableServerGroup)
+	ssg.NumChunks = sg.numChunks
+	ssg.Redundancy = sg.redundancy
+	ssg.Ordered = sg.ordered
+	ssg.Keyspaces = sg.keyspaces
+	ssg.Epoch = sg.epoch
+	ssg.Servers = sg.servers
+	ssg.Origin = sg.LocalhostIPPort
+	return ssg
+}
+
+//AdoptConfiguration replaces the server list with the one stored in serialization if its epoch is newer
+//than the local one, or if it has the same epoch and a greater hash (a concurrent change).
+//Stale configurations are rejected. It returns true if the configuration was adopted.
+func (sg *ServerGroup) AdoptConfiguration(serialization []byte) (bool, error) {
+	ssg := new(serializableServerGroup)
+	err := json.Unmarshal(serialization, ssg)
+	if err != nil {
+		return false, err
+	}
+	hash := ssg.hash()
+	sg.mutex.Lock()
+	if ssg.Epoch < sg.epoch || ssg.Epoch == sg.epoch && hash <= sg.hash {
+		sg.mutex.Unlock()
+		return false, nil
+	}
+	if ssg.Epoch == sg.epoch {
+		log.Println("Concurrent configuration change on epoch", ssg.Epoch, "the local configuration is replaced")
+	}
+	if ssg.NumChunks != sg.numChunks {
+		sg.mutex.Unlock()
+		return false, errors.New("Configuration mismatch: different number of chunks")
+	}
+	//Keyspaces are never removed, new keyspaces follow the known ones
+	for i, k := range sg.keyspaces {
+		if i >= len(ssg.Keyspaces) || ssg.Keyspaces[i].Name != k.Name || ssg.Keyspaces[i].FirstChunk != k.FirstChunk {
+			sg.mutex.Unlock()
+			return false, errors.New("Configuration mismatch: different keyspaces")
+		}
+	}
+	var added []protocol.Keyspace
+	for _, k := range ssg.Keyspaces[len(sg.keyspaces):] {
+		if err := sg.addKeyspace(k); err != nil {
+			sg.mutex.Unlock()
+			return false, err
+		}
+		added = append(added, k)
+		log.Println("Keyspace", k.Name, "added, configuration epoch", ssg.Epoch)
+	}
+	var removed []*VirtualServer
+	for addr, s := range sg.servers {
+		if _, ok := ssg.Servers[addr]; !ok {
+			if addr == sg.LocalhostIPPort {
+				log.Println("Localhost is not present on the configuration epoch", ssg.Epoch)
+				continue
+			}
+			sg.removeServer(s)
+			removed = append(removed, s)
+			log.Println("Server", addr, "removed, configuration epoch", ssg.Epoch)
+		}
+	}
+	for addr := range ssg.Servers {
+		if _, ok := sg.servers[addr]; !ok {
+			sg.newServer(addr)
+			log.Println("Server", addr, "added, configuration epoch", ssg.Epoch)
+		}
+	}
+	sg.redundancy = ssg.Redundancy
+	sg.ordered = ssg.Ordered
+	sg.epoch = ssg.Epoch
+	//The local server could have been kept, the adopted hash avoids adopting the same configuration again
+	sg.hash = hash
+	listener := sg.keyspaceListener
+	epochListener := sg.epochListener
+	sg.mutex.Unlock()
+	for _, s := range removed {
+		s.freeConn()
+	}
+	if listener != nil {
+		for _, k := range added {
+			listener(k)
+		}
+	}
+	if epochListener != nil {
+		epochListener(ssg.Epoch)
+	}
+	return true, nil
+}
+
 /*
 	ServerGroup getters
 */
 
+//Epoch returns the configuration epoch
+func (sg *ServerGroup) Epoch() uint64 {
+	sg.mutex.RLock()
+	e := sg.epoch
+	sg.mutex.RUnlock()
+	return e
+}
+
+//ConfigVersion returns the configuration epoch and hash
+func (sg *ServerGroup) ConfigVersion() (epoch, hash uint64) {
+	sg.mutex.RLock()
+	epoch, hash = sg.epoch, sg.hash
+	sg.mutex.RUnlock()
+	return epoch, hash
+}
+
+//IsNewerConfig returns true if the configuration version (epoch, hash) is newer than the local one
+func (sg *ServerGroup) IsNewerConfig(epoch, hash uint64) bool {
+	e, h := sg.ConfigVersion()
+	return epoch > e || epoch == e && hash > h
+}
+
 func (sg *ServerGroup) NumChunks() int {
 	return sg.numChunks
 }
@@ -180,6 +365,73 @@ func (sg *ServerGroup) Redundancy() int {
 	return r
 }
 
+//Ordered returns true if the chunks maintain an ordered index
+func (sg *ServerGroup) Ordered() bool {
+	return sg.ordered
+}
+
+//SetOrdered sets the ordered index configuration, it should be called before sharing the server group
+func (sg *ServerGroup) SetOrdered(ordered bool) {
+	sg.ordered = ordered
+}
+
+//TotalChunks returns the number of chunks of every keyspace
+func (sg *ServerGroup) TotalChunks() int {
+	sg.mutex.RLock()
+	n := len(sg.chunks)
+	sg.mutex.RUnlock()
+	return n
+}
+
+//Keyspace returns the settings of a keyspace, name "" returns the settings of the default keyspace
+func (sg *ServerGroup) Keyspace(name string) (protocol.Keyspace, bool) {
+	sg.mutex.RLock()
+	defer sg.mutex.RUnlock()
+	if name == "" {
+		return protocol.Keyspace{NumChunks: sg.numChunks, Redundancy: sg.redundancy, Ordered: sg.ordered}, true
+	}
+	for _, k := range sg.keyspaces {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return protocol.Keyspace{}, false
+}
+
+//Keyspaces returns the settings of every named keyspace
+func (sg *ServerGroup) Keyspaces() []protocol.Keyspace {
+	sg.mutex.RLock()
+	l := make([]protocol.Keyspace, len(sg.keyspaces))
+	copy(l, sg.keyspaces)
+	sg.mutex.RUnlock()
+	return l
+}
+
+//ChunkID returns the ID of the chunk that stores key, keys of named keyspaces are qualified (see hashing.KeyspaceKey)
+func (sg *ServerGroup) ChunkID(key []byte) (int, error) {
+	name, k := hashing.SplitKeyspace(key)
+	if name == "" {
+		return hashing.GetChunkID(k, sg.NumChunks()), nil
+	}
+	ks, ok := sg.Keyspace(name)
+	if !ok {
+		return 0, errors.New("Unknown keyspace " + name)
+	}
+	return ks.ChunkID(k), nil
+}
+
+//ChunkRedundancy returns the target redundancy of a chunk, which depends on its keyspace
+func (sg *ServerGroup) ChunkRedundancy(chunkID int) int {
+	sg.mutex.RLock()
+	defer sg.mutex.RUnlock()
+	for _, k := range sg.keyspaces {
+		if chunkID >= k.FirstChunk && chunkID < k.FirstChunk+k.NumChunks {
+			return k.Redundancy
+		}
+	}
+	return sg.redundancy
+}
+
 func (sg *ServerGroup) NumServers() int {
 	sg.mutex.RLock()
 	r := len(sg.servers)
@@ -189,6 +441,10 @@ func (sg *ServerGroup) NumServers() int {
 
 func (sg *ServerGroup) NumHolders(chunkID int) int {
 	sg.mutex.RLock()
+	if chunkID >= len(sg.chunks) {
+		sg.mutex.RUnlock()
+		return 0
+	}
 	num := len(sg.chunks[chunkID].holders)
 	sg.mutex.RUnlock()
 	return num
@@ -204,18 +460,108 @@ func (sg *ServerGroup) Servers() []*VirtualServer {
 	return l
 }
 
+//GetChunkHolders returns the holders of a chunk, the local server (see SetLocalServer) is the first one if it is a holder
 func (sg *ServerGroup) GetChunkHolders(chunkID int) (holders [8]*VirtualServer) {
 	sg.mutex.RLock()
 	c := sg.chunks[chunkID]
 	i := 0
 	for _, h := range c.holders {
 		holders[i] = h
+		if h == sg.local {
+			holders[0], holders[i] = holders[i], holders[0]
+		}
 		i++
 	}
 	sg.mutex.RUnlock()
 	return holders
 }
 
+//KeyMasters returns the holders of the chunk of key sorted by their master rank, highest first
+//The key master is the holder with the highest hash(key+address) rank, every node with the same
+//server group view will choose the same master, key should be qualified (see ChunkID)
+func (sg *ServerGroup) KeyMasters(key []byte) []*VirtualServer {
+	chunkID, err := sg.ChunkID(key)
+	if err != nil {
+		return nil
+	}
+	var servers []*VirtualServer
+	var rank []uint64
+	for _, s := range sg.GetChunkHolders(chunkID) {
+		if s != nil {
+			//Calc rank as hash(key+serverIpPort)
+			b := make([]byte, len(s.Phy)+len(key))
+			copy(b, key)
+			copy(b[len(key):], s.Phy)
+			servers = append(servers, s)
+			rank = append(rank, hashing.FNV1a64(b))
+		}
+	}
+	sort.Sort(byRank{servers, rank})
+	return servers
+}
+
+type byRank struct {
+	servers []*VirtualServer
+	rank    []uint64
+}
+
+func (r byRank) Len() int           { return len(r.servers) }
+func (r byRank) Less(i, j int) bool { return r.rank[i] > r.rank[j] }
+func (r byRank) Swap(i, j int) {
+	r.servers[i], r.servers[j] = r.servers[j], r.servers[i]
+	r.rank[i], r.rank[j] = r.rank[j], r.rank[i]
+}
+
+//Origin returns the address of the server that sent the configuration (see Assoc), "" if it is unknown
+func (sg *ServerGroup) Origin() string {
+	sg.mutex.RLock()
+	defer sg.mutex.RUnlock()
+	return sg.origin
+}
+
+//SetLocalServer sets the server located at addr as the local server, its connections will use dialAddr
+//(e.g. a Unix domain socket address, see com.SetUnixSocket) and it will be the preferred holder of its chunks
+func (sg *ServerGroup) SetLocalServer(addr, dialAddr string) error {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+	s, ok := sg.servers[addr]
+	if !ok {
+		return errors.New("Unknown server " + addr)
+	}
+	s.m.Lock()
+	s.dialAddr = dialAddr
+	s.m.Unlock()
+	//Connections to the old address are closed
+	s.freeConn()
+	sg.local = s
+	sg.localAddr = addr
+	sg.localDialAddr = dialAddr
+	return nil
+}
+
+//newServer adds a server located at addr to the group and returns it, sg.mutex should be held
+//The local server (see SetLocalServer) keeps its dial address if it is added again after being removed
+func (sg *ServerGroup) newServer(addr string) *VirtualServer {
+	s := new(VirtualServer)
+	s.Phy = addr
+	s.noDelay = sg.noDelay
+	s.token = sg.token
+	if addr == sg.localAddr {
+		s.dialAddr = sg.localDialAddr
+		sg.local = s
+	}
+	sg.servers[addr] = s
+	return s
+}
+
+//GetServer returns the server located at addr or nil if it is unknown
+func (sg *ServerGroup) GetServer(addr string) *VirtualServer {
+	sg.mutex.RLock()
+	s := sg.servers[addr]
+	sg.mutex.RUnlock()
+	return s
+}
+
 func (sg *ServerGroup) GetAnyHolder(chunkID int) *VirtualServer {
 	sg.mutex.RLock()
 	if len(sg.chunks[chunkID].holders) < 1 {
@@ -262,6 +608,7 @@ func (sg *ServerGroup) SetServerChunks(addr string, cids []protocol.AmAliveChunk
 		return
 	}
 	s.dead = false
+	s.suspect = false
 	for _, c := range s.heldChunks {
 		i := 0
 		for ; i < len(cids); i++ {
@@ -269,13 +616,17 @@ func (sg *ServerGroup) SetServerChunks(addr string, cids []protocol.AmAliveChunk
 				break
 			}
 		}
-		if i == len(cids) {
+		if i == len(cids) && c.ID < len(sg.chunks) {
 			//Forgotten chunk
 			sg.chunks[c.ID].removeHolder(s)
 		}
 	}
 
 	for i := 0; i < len(cids); i++ {
+		if cids[i].ID >= len(sg.chunks) {
+			//Chunk of a keyspace that isn't known yet
+			continue
+		}
 		if !sg.chunks[cids[i].ID].hasHolder(s) {
 			//Added chunk
 			sg.chunks[cids[i].ID].addHolder(s)
@@ -294,9 +645,33 @@ func (sg *ServerGroup) ServerAlive(addr string) {
 		return
 	}
 	s.dead = false
+	s.suspect = false
 	s.lastHeartbeat = time.Now()
 }
 
+//SuspectServer marks a server as suspected of being dead, a suspected server keeps its chunks
+func (sg *ServerGroup) SuspectServer(addr string) {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+	s, ok := sg.servers[addr]
+	if !ok || s.dead {
+		return
+	}
+	if !s.suspect {
+		log.Println("Server is suspected:", addr)
+		s.suspect = true
+	}
+}
+
+//IsSuspected returns true if the server is suspected of being dead
+func (sg *ServerGroup) IsSuspected(addr string) bool {
+	sg.mutex.RLock()
+	s, ok := sg.servers[addr]
+	suspect := ok && s.suspect
+	sg.mutex.RUnlock()
+	return suspect
+}
+
 func (sg *ServerGroup) IsServerOnGroup(addr string) bool {
 	sg.mutex.RLock()
 	_, ok := sg.servers[addr]
@@ -310,10 +685,7 @@ func (sg *ServerGroup) AddServerToGroup(addr string) (*VirtualServer, error) {
 	defer sg.mutex.Unlock()
 	s, ok := sg.servers[addr]
 	if !ok {
-		s = new(VirtualServer)
-		sg.servers[addr] = s
-		s.Phy = addr
-		s.noDelay = sg.noDelay
+		s = sg.newServer(addr)
 		log.Println("Server", addr, "added")
 		return s, nil
 	}
@@ -327,15 +699,103 @@ func (sg *ServerGroup) RemoveServer(addr string) error {
 		sg.mutex.Unlock()
 		return errors.New("Server not known")
 	}
-	delete(sg.servers, addr)
+	sg.removeServer(s)
+	sg.mutex.Unlock()
+	s.freeConn()
+	return nil
+}
+
+//removeServer deletes s from the server list and from the chunk holders, sg.mutex should be held
+func (sg *ServerGroup) removeServer(s *VirtualServer) {
+	delete(sg.servers, s.Phy)
+	if sg.local == s {
+		sg.local = nil
+	}
 	for _, c := range s.heldChunks {
 		sg.chunks[c.ID].removeHolder(s)
 	}
-	sg.mutex.Unlock()
-	s.freeConn()
+}
+
+//AddKeyspace adds a named keyspace, its chunk IDs are assigned if k.FirstChunk is 0
+//It returns the keyspace settings with the assigned chunk IDs
+func (sg *ServerGroup) AddKeyspace(k protocol.Keyspace) (protocol.Keyspace, error) {
+	sg.mutex.Lock()
+	defer sg.mutex.Unlock()
+	if k.FirstChunk == 0 {
+		k.FirstChunk = len(sg.chunks)
+	}
+	//Every chunk of the server group should fit in a heartbeat response
+	if len(sg.chunks)+k.NumChunks > protocol.MaxHeartbeatChunks {
+		return k, fmt.Errorf("Keyspace %s has too many chunks, a server group can't have more than %d chunks", k.Name, protocol.MaxHeartbeatChunks)
+	}
+	return k, sg.addKeyspace(k)
+}
+
+//addKeyspace adds a keyspace and its chunks, sg mutex should be held
+func (sg *ServerGroup) addKeyspace(k protocol.Keyspace) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+	for _, k2 := range sg.keyspaces {
+		if k2.Name == k.Name {
+			return errors.New("Keyspace " + k.Name + " already exists")
+		}
+	}
+	if k.FirstChunk != len(sg.chunks) {
+		return errors.New("Keyspace " + k.Name + " chunk IDs mismatch")
+	}
+	for i := 0; i < k.NumChunks; i++ {
+		sg.chunks = append(sg.chunks, VirtualChunk{id: k.FirstChunk + i})
+	}
+	//Servers could have reported chunks of the keyspace before it was known
+	for _, s := range sg.servers {
+		for _, c := range s.heldChunks {
+			if c.ID >= k.FirstChunk && c.ID < len(sg.chunks) && !sg.chunks[c.ID].hasHolder(s) {
+				sg.chunks[c.ID].addHolder(s)
+			}
+		}
+	}
+	sg.keyspaces = append(sg.keyspaces, k)
 	return nil
 }
 
+//SetKeyspaceListener sets a function that will be called for each keyspace added by an adopted configuration
+func (sg *ServerGroup) SetKeyspaceListener(f func(k protocol.Keyspace)) {
+	sg.mutex.Lock()
+	sg.keyspaceListener = f
+	sg.mutex.Unlock()
+}
+
+//IncEpoch increments the configuration epoch, it should be called after each intentional server list change
+func (sg *ServerGroup) IncEpoch() uint64 {
+	sg.mutex.Lock()
+	sg.epoch++
+	e := sg.epoch
+	sg.hash = sg.serializable().hash()
+	listener := sg.epochListener
+	sg.mutex.Unlock()
+	if listener != nil {
+		listener(e)
+	}
+	return e
+}
+
+//SetEpoch sets the configuration epoch of a restored server, it should be called before sharing the server group
+//The configuration hash is reset, configurations of the same epoch will be adopted
+func (sg *ServerGroup) SetEpoch(epoch uint64) {
+	sg.mutex.Lock()
+	sg.epoch = epoch
+	sg.hash = 0
+	sg.mutex.Unlock()
+}
+
+//SetEpochListener sets a function that will be called after each epoch change, it can be used to persist the epoch
+func (sg *ServerGroup) SetEpochListener(f func(epoch uint64)) {
+	sg.mutex.Lock()
+	sg.epochListener = f
+	sg.mutex.Unlock()
+}
+
 func (sg *ServerGroup) DeadServer(addr string) error {
 	sg.mutex.Lock()
 	s, ok := sg.servers[addr]
@@ -347,6 +807,7 @@ func (sg *ServerGroup) DeadServer(addr string) error {
 		log.Println("Server is dead:", addr)
 		s.dead = true
 	}
+	s.suspect = false
 	for _, c := range s.heldChunks {
 		sg.chunks[c.ID].removeHolder(s)
 	}
@@ -1,6 +1,9 @@
 package servergroup
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"sync"
 	"time"
 	"github.com/dv343/treeless/com"
@@ -12,8 +15,11 @@ type VirtualServer struct {
 	Phy           string    //Physical address. READ-ONLY by external packages!!!
 	lastHeartbeat time.Time //Last time a heartbeat was listened
 	dead          bool
+	suspect       bool //Suspected to be dead by the failure detector, but still a chunk holder
 	heldChunks    []protocol.AmAliveChunk //List of all chunks that this server holds
 	conn          *com.Conn               //TCP connection, it may not exists
+	dialAddr      string                  //Address used by new connections, Phy if it is empty
+	token         []byte                  //Token of new connections, nil uses the token set by com.SetToken
 	noDelay       bool
 	m             sync.RWMutex
 }
@@ -33,7 +39,11 @@ func (s *VirtualServer) needConnection() (err error) {
 		s.m.Lock()
 		if s.conn == nil {
 			//log.Println("Creatting conn to", s.Phy)
-			s.conn, err = com.CreateConnection(s.Phy, func() {
+			addr := s.Phy
+			if s.dialAddr != "" {
+				addr = s.dialAddr
+			}
+			s.conn, err = com.CreateConnectionWithToken(addr, s.token, func() {
 				//log.Println("Free connection", s.Phy)
 				s.freeConn()
 			})
@@ -52,6 +62,28 @@ func (s *VirtualServer) needConnection() (err error) {
 	}
 	return nil
 }
+//needFeature is like needConnection, but it fails if the server doesn't support the feature
+//(see protocol.OpHello), the lock is only held if it succeeds
+func (s *VirtualServer) needFeature(f protocol.Features) error {
+	if err := s.needConnection(); err != nil {
+		return err
+	}
+	if !s.conn.Supports(f) {
+		s.m.RUnlock()
+		return errors.New("Operation not supported by server " + s.Phy + ", protocol version " + fmt.Sprint(s.conn.Version()))
+	}
+	return nil
+}
+
+//Supports returns true if the server supports the feature, it returns an error if the server is unreachable
+func (s *VirtualServer) Supports(f protocol.Features) (bool, error) {
+	if err := s.needConnection(); err != nil {
+		return false, err
+	}
+	ok := s.conn.Supports(f)
+	s.m.RUnlock()
+	return ok, nil
+}
 func (s *VirtualServer) freeConn() {
 	//Close connetion now
 	s.m.Lock()
@@ -103,6 +135,96 @@ func (s *VirtualServer) CAS(key, value []byte, timeout time.Duration) (com.CASOp
 	return r, nil
 }
 
+//SetIfAbsent sets a new key/value pair only if the pair doesn't exists
+func (s *VirtualServer) SetIfAbsent(key, value []byte, timeout time.Duration) (com.SetOperation, error) {
+	if err := s.needFeature(protocol.FeatureAtomic); err != nil {
+		return com.SetOperation{}, err
+	}
+	r := s.conn.SetIfAbsent(key, value, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
+//SetIfTimestamp sets a key/value pair only if the stored timestamp matches the expected one
+func (s *VirtualServer) SetIfTimestamp(key, value []byte, timeout time.Duration) (com.SetOperation, error) {
+	if err := s.needFeature(protocol.FeatureAtomic); err != nil {
+		return com.SetOperation{}, err
+	}
+	r := s.conn.SetIfTimestamp(key, value, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
+//Batch sends a serialized batch of operations
+func (s *VirtualServer) Batch(batch []byte, timeout time.Duration) (com.SetOperation, error) {
+	if err := s.needFeature(protocol.FeatureBatch); err != nil {
+		return com.SetOperation{}, err
+	}
+	r := s.conn.Batch(batch, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
+//Incr adds delta to the int64 value of key
+func (s *VirtualServer) Incr(key []byte, delta int64, timeout time.Duration) (com.IncrOperation, error) {
+	if err := s.needFeature(protocol.FeatureAtomic); err != nil {
+		return com.IncrOperation{}, err
+	}
+	r := s.conn.Incr(key, delta, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
+//Append appends value to the value of key
+func (s *VirtualServer) Append(key, value []byte, timeout time.Duration) (com.AppendOperation, error) {
+	if err := s.needFeature(protocol.FeatureAtomic); err != nil {
+		return com.AppendOperation{}, err
+	}
+	r := s.conn.Append(key, value, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
+//Scan requests a page of pairs of a chunk
+func (s *VirtualServer) Scan(chunkID int, request *protocol.ScanRequest, timeout time.Duration) (com.ScanOperation, error) {
+	if err := s.needFeature(protocol.FeatureScan); err != nil {
+		return com.ScanOperation{}, err
+	}
+	r := s.conn.Scan(chunkID, request, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
+//Range requests the pairs of a chunk in a key range
+func (s *VirtualServer) Range(chunkID int, request *protocol.RangeRequest, timeout time.Duration) (com.RangeOperation, error) {
+	if err := s.needFeature(protocol.FeatureScan); err != nil {
+		return com.RangeOperation{}, err
+	}
+	r := s.conn.Range(chunkID, request, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
+//Subscribe requests the changes of a chunk
+func (s *VirtualServer) Subscribe(chunkID int, request *protocol.SubscribeRequest, timeout time.Duration) (com.SubscribeOperation, error) {
+	if err := s.needFeature(protocol.FeatureFeed); err != nil {
+		return com.SubscribeOperation{}, err
+	}
+	r := s.conn.Subscribe(chunkID, request, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
+//Paxos sends a Paxos request (see package com)
+func (s *VirtualServer) Paxos(op protocol.Operation, key, value []byte, timeout time.Duration) (com.PaxosOperation, error) {
+	if err := s.needFeature(protocol.FeaturePaxos); err != nil {
+		return com.PaxosOperation{}, err
+	}
+	r := s.conn.Paxos(op, key, value, timeout)
+	s.m.RUnlock()
+	return r, nil
+}
+
 func (s *VirtualServer) Transfer(addr string, chunkID int) error {
 	if err := s.needConnection(); err != nil {
 		return nil
@@ -132,6 +254,57 @@ func (s *VirtualServer) AddServerToGroup(addr string) error {
 	return cerr
 }
 
+//ForgetNode request to remove a server from the server group
+func (s *VirtualServer) ForgetNode(addr string) error {
+	if err := s.needConnection(); err != nil {
+		return err
+	}
+	cerr := s.conn.ForgetNode(addr)
+	s.m.RUnlock()
+	return cerr
+}
+
+//CreateKeyspace request to create a named keyspace
+func (s *VirtualServer) CreateKeyspace(k *protocol.Keyspace) error {
+	f := protocol.FeatureKeyspaces
+	if k.TTL != 0 {
+		f |= protocol.FeatureTTL
+	}
+	if err := s.needFeature(f); err != nil {
+		return err
+	}
+	cerr := s.conn.CreateKeyspace(k)
+	s.m.RUnlock()
+	return cerr
+}
+
+//Watch asks the server to notify the writes of a key or a key prefix (see package com)
+func (s *VirtualServer) Watch(id uint32, key []byte, prefix bool, handler func(key, record []byte, overflow bool)) error {
+	if err := s.needFeature(protocol.FeatureWatch); err != nil {
+		return err
+	}
+	cerr := s.conn.Watch(id, key, prefix, handler)
+	s.m.RUnlock()
+	return cerr
+}
+
+//Unwatch cancels a watch
+func (s *VirtualServer) Unwatch(id uint32) error {
+	if err := s.needConnection(); err != nil {
+		return err
+	}
+	cerr := s.conn.Unwatch(id)
+	s.m.RUnlock()
+	return cerr
+}
+
+//Watching returns true if the watch is active on the current connection to the server
+func (s *VirtualServer) Watching(id uint32) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.conn != nil && s.conn.Watching(id)
+}
+
 func (s *VirtualServer) Protect(chunkID int) (ok bool) {
 	if err := s.needConnection(); err != nil {
 		return false
@@ -141,13 +314,16 @@ func (s *VirtualServer) Protect(chunkID int) (ok bool) {
 	return cerr == nil
 }
 
-//GetChunkInfo request chunk info
+//GetChunkInfo request chunk info, it returns math.MaxUint64 if the chunk size is unknown
 func (s *VirtualServer) GetChunkInfo(chunkID int) (size uint64) {
 	if err := s.needConnection(); err != nil {
-		return 0
+		return math.MaxUint64
 	}
-	v, _ := s.conn.GetChunkInfo(chunkID)
+	v, err := s.conn.GetChunkInfo(chunkID)
 	s.m.RUnlock()
+	if err != nil {
+		return math.MaxUint64
+	}
 	return v
 }
 
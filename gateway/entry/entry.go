@@ -0,0 +1,50 @@
+/*
+Package entry defines the format of the values stored by the resp and memcache gateways,
+pairs written through one of them can be read through the other.
+The rest gateway stores values as they are, they are shared with the Go clients instead.
+
+Stored values have a 12 byte header followed by the value:
+	8 bytes:			expiration time in Unix nanoseconds, 0 means no expiration
+	4 bytes:			flags, set by memcached clients, 0 for Redis clients
+Expired pairs are hidden until they are overwritten or deleted, expiration is checked with the gateway clock.
+Pairs written by other clients (without the header) aren't visible through the gateways.
+*/
+package entry
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+//HeaderSize is the number of bytes stored before the value
+const HeaderSize = 12
+
+//Entry is a pair value written by a gateway
+type Entry struct {
+	Value      []byte
+	Flags      uint32
+	Expiration int64 //Unix time in nanoseconds, 0 means no expiration
+}
+
+//Encode returns the stored value of an entry
+func Encode(value []byte, flags uint32, expiration int64) []byte {
+	stored := make([]byte, HeaderSize+len(value))
+	binary.LittleEndian.PutUint64(stored, uint64(expiration))
+	binary.LittleEndian.PutUint32(stored[8:], flags)
+	copy(stored[HeaderSize:], value)
+	return stored
+}
+
+//Decode returns the entry of a stored value, ok is false if the entry is expired or if it wasn't written by a gateway
+func Decode(stored []byte, now time.Time) (e Entry, ok bool) {
+	if len(stored) < HeaderSize {
+		return e, false
+	}
+	e.Expiration = int64(binary.LittleEndian.Uint64(stored))
+	if e.Expiration != 0 && now.UnixNano() >= e.Expiration {
+		return e, false
+	}
+	e.Flags = binary.LittleEndian.Uint32(stored[8:])
+	e.Value = stored[HeaderSize:]
+	return e, true
+}
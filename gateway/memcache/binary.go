@@ -0,0 +1,345 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/gateway/entry"
+)
+
+//Magic bytes of the binary protocol
+const (
+	magicRequest  = 0x80
+	magicResponse = 0x81
+)
+
+const binaryHeaderSize = 24
+
+//Binary protocol opcodes
+const (
+	opGet       = 0x00
+	opSet       = 0x01
+	opAdd       = 0x02
+	opReplace   = 0x03
+	opDelete    = 0x04
+	opIncrement = 0x05
+	opDecrement = 0x06
+	opQuit      = 0x07
+	opGetQ      = 0x09
+	opNoop      = 0x0a
+	opVersion   = 0x0b
+	opGetK      = 0x0c
+	opGetKQ     = 0x0d
+	opSetQ      = 0x11
+	opAddQ      = 0x12
+	opReplaceQ  = 0x13
+	opDeleteQ   = 0x14
+	opIncrQ     = 0x15
+	opDecrQ     = 0x16
+	opQuitQ     = 0x17
+	opSASLList  = 0x20
+	opSASLAuth  = 0x21
+)
+
+//Binary protocol response status
+const (
+	binOK             = 0x00
+	binKeyNotFound    = 0x01
+	binKeyExists      = 0x02
+	binValueTooLarge  = 0x03
+	binInvalidArgs    = 0x04
+	binNotStored      = 0x05
+	binNonNumeric     = 0x06
+	binAuthError      = 0x20
+	binUnknownCommand = 0x81
+	binInternalError  = 0x84
+)
+
+var binStatusMessages = map[uint16]string{
+	binKeyNotFound:    "Not found",
+	binKeyExists:      "Data exists for key.",
+	binValueTooLarge:  "Too large.",
+	binInvalidArgs:    "Invalid arguments",
+	binNotStored:      "Not stored.",
+	binNonNumeric:     "Non-numeric server-side value for incr or decr",
+	binAuthError:      "Auth failure.",
+	binUnknownCommand: "Unknown command",
+}
+
+//binaryRequest is a request of the binary protocol
+type binaryRequest struct {
+	opcode byte
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+//quiet returns true if successful responses of the request are omitted
+func (req *binaryRequest) quiet() bool {
+	switch req.opcode {
+	case opGetQ, opGetKQ, opSetQ, opAddQ, opReplaceQ, opDeleteQ, opIncrQ, opDecrQ, opQuitQ:
+		return true
+	}
+	return false
+}
+
+//serveBinary runs the binary protocol requests of a connection, responses are flushed when there are no pipelined requests
+func (s *Server) serveBinary(r *bufio.Reader, w *bufio.Writer) {
+	authenticated := s.auth == nil
+	for {
+		req, err := readBinaryRequest(r, authenticated)
+		if err != nil {
+			return
+		}
+		var quit bool
+		switch {
+		case req.opcode == opSASLList || req.opcode == opSASLAuth:
+			authenticated = s.runSASL(w, req) || authenticated
+		case !authenticated && req.opcode != opQuit && req.opcode != opQuitQ:
+			writeStatus(w, req, binAuthError)
+		default:
+			quit = s.runBinary(w, req)
+		}
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+//readBinaryRequest reads a request, the connection should be closed if it returns an error
+//Requests of connections that aren't authenticated can only carry a key, extras and SASL data
+func readBinaryRequest(r *bufio.Reader, authenticated bool) (*binaryRequest, error) {
+	var h [binaryHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	keyLen := int(binary.BigEndian.Uint16(h[2:]))
+	extrasLen := int(h[4])
+	bodyLen := int64(binary.BigEndian.Uint32(h[8:]))
+	maxBodyLen := int64(maxKeyLength + 255 + maxSASLDataLength)
+	if authenticated {
+		maxBodyLen = int64(protocol.MaxValueSize) + maxKeyLength + 255
+	}
+	if h[0] != magicRequest || int64(keyLen+extrasLen) > bodyLen || bodyLen > maxBodyLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	//The body grows as the data arrives, declared lengths don't allocate memory by themselves
+	var body bytes.Buffer
+	if _, err := io.CopyN(&body, r, bodyLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	b := body.Bytes()
+	return &binaryRequest{
+		opcode: h[1],
+		opaque: binary.BigEndian.Uint32(h[12:]),
+		cas:    binary.BigEndian.Uint64(h[16:]),
+		extras: b[:extrasLen],
+		key:    b[extrasLen : extrasLen+keyLen],
+		value:  b[extrasLen+keyLen:],
+	}, nil
+}
+
+//writeResponse writes a response of req
+func writeResponse(w *bufio.Writer, req *binaryRequest, status uint16, cas uint64, extras, key, value []byte) {
+	var h [binaryHeaderSize]byte
+	h[0] = magicResponse
+	h[1] = req.opcode
+	binary.BigEndian.PutUint16(h[2:], uint16(len(key)))
+	h[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(h[6:], status)
+	binary.BigEndian.PutUint32(h[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(h[12:], req.opaque)
+	binary.BigEndian.PutUint64(h[16:], cas)
+	w.Write(h[:])
+	w.Write(extras)
+	w.Write(key)
+	w.Write(value)
+}
+
+//writeStatus writes a response without extras, errors have a message as value
+//Successful responses of quiet requests are omitted
+func writeStatus(w *bufio.Writer, req *binaryRequest, status uint16) {
+	if status == binOK && req.quiet() {
+		return
+	}
+	writeResponse(w, req, status, 0, nil, nil, []byte(binStatusMessages[status]))
+}
+
+func writeInternalError(w *bufio.Writer, req *binaryRequest, err error) {
+	writeResponse(w, req, binInternalError, 0, nil, nil, []byte(err.Error()))
+}
+
+//binStatus returns the binary protocol status of an operation status
+func binStatus(st status) uint16 {
+	switch st {
+	case statusOK:
+		return binOK
+	case statusNotFound:
+		return binKeyNotFound
+	case statusExists:
+		return binKeyExists
+	case statusNonNumeric:
+		return binNonNumeric
+	}
+	return binNotStored
+}
+
+//runBinary runs a request, it returns true if the connection should be closed
+func (s *Server) runBinary(w *bufio.Writer, req *binaryRequest) (quit bool) {
+	switch req.opcode {
+	case opGet, opGetQ, opGetK, opGetKQ:
+		binGet(s, w, req)
+	case opSet, opSetQ, opAdd, opAddQ, opReplace, opReplaceQ:
+		binStore(s, w, req)
+	case opDelete, opDeleteQ:
+		binDelete(s, w, req)
+	case opIncrement, opIncrQ, opDecrement, opDecrQ:
+		binIncr(s, w, req)
+	case opNoop:
+		writeStatus(w, req, binOK)
+	case opVersion:
+		writeResponse(w, req, binOK, 0, nil, nil, []byte("treeless"))
+	case opQuit, opQuitQ:
+		writeStatus(w, req, binOK)
+		return true
+	default:
+		writeStatus(w, req, binUnknownCommand)
+	}
+	return false
+}
+
+//runSASL runs the SASL requests, only the PLAIN mechanism is supported, the password is the token
+//It returns true if the connection was authenticated
+func (s *Server) runSASL(w *bufio.Writer, req *binaryRequest) bool {
+	if s.auth == nil {
+		writeStatus(w, req, binUnknownCommand)
+		return false
+	}
+	if req.opcode == opSASLList {
+		writeResponse(w, req, binOK, 0, nil, nil, []byte("PLAIN"))
+		return false
+	}
+	//PLAIN messages store the authorization identity, the user and the password separated by zeros
+	fields := bytes.Split(req.value, []byte{0})
+	if string(req.key) != "PLAIN" || len(fields) != 3 || s.auth(fields[2]) != nil {
+		writeStatus(w, req, binAuthError)
+		return false
+	}
+	writeResponse(w, req, binOK, 0, nil, nil, []byte("Authenticated"))
+	return true
+}
+
+func binGet(s *Server, w *bufio.Writer, req *binaryRequest) {
+	if len(req.extras) != 0 || len(req.value) != 0 || !validKey(req.key) {
+		writeStatus(w, req, binInvalidArgs)
+		return
+	}
+	withKey := req.opcode == opGetK || req.opcode == opGetKQ
+	it, found, _, _, err := s.get(req.key)
+	if err != nil {
+		writeInternalError(w, req, err)
+		return
+	}
+	var key []byte
+	if withKey {
+		key = req.key
+	}
+	if !found {
+		//Misses of quiet gets are omitted
+		if !req.quiet() {
+			writeResponse(w, req, binKeyNotFound, 0, nil, key, []byte(binStatusMessages[binKeyNotFound]))
+		}
+		return
+	}
+	var extras [4]byte
+	binary.BigEndian.PutUint32(extras[:], it.flags)
+	writeResponse(w, req, binOK, it.cas, extras[:], key, it.value)
+}
+
+//binStore runs set, add and replace, set and replace requests with a cas unique are run as a cas
+func binStore(s *Server, w *bufio.Writer, req *binaryRequest) {
+	if len(req.extras) != 8 || !validKey(req.key) {
+		writeStatus(w, req, binInvalidArgs)
+		return
+	}
+	if len(req.value) > protocol.MaxValueSize-entry.HeaderSize {
+		writeStatus(w, req, binValueTooLarge)
+		return
+	}
+	var mode storeMode
+	switch req.opcode {
+	case opSet, opSetQ:
+		mode = modeSet
+	case opAdd, opAddQ:
+		mode = modeAdd
+	default:
+		mode = modeReplace
+	}
+	if req.cas != 0 && mode != modeAdd {
+		mode = modeCAS
+	}
+	flags := binary.BigEndian.Uint32(req.extras)
+	exptime := int64(int32(binary.BigEndian.Uint32(req.extras[4:])))
+	st, newCAS, err := s.store(mode, req.key, req.value, flags, expiration(exptime, time.Now()), req.cas)
+	if err != nil {
+		writeInternalError(w, req, err)
+		return
+	}
+	if st != statusOK || req.quiet() {
+		writeStatus(w, req, binStatus(st))
+		return
+	}
+	writeResponse(w, req, binOK, newCAS, nil, nil, nil)
+}
+
+func binDelete(s *Server, w *bufio.Writer, req *binaryRequest) {
+	if len(req.extras) != 0 || len(req.value) != 0 || !validKey(req.key) {
+		writeStatus(w, req, binInvalidArgs)
+		return
+	}
+	st, err := s.delete(req.key, req.cas)
+	if err != nil {
+		writeInternalError(w, req, err)
+		return
+	}
+	writeStatus(w, req, binStatus(st))
+}
+
+//binIncr runs increments and decrements, non-existent pairs are created with the initial value
+//unless the expiration is 0xffffffff
+func binIncr(s *Server, w *bufio.Writer, req *binaryRequest) {
+	if len(req.extras) != 20 || len(req.value) != 0 || !validKey(req.key) {
+		writeStatus(w, req, binInvalidArgs)
+		return
+	}
+	delta := binary.BigEndian.Uint64(req.extras)
+	initial := binary.BigEndian.Uint64(req.extras[8:])
+	exptime := binary.BigEndian.Uint32(req.extras[16:])
+	decr := req.opcode == opDecrement || req.opcode == opDecrQ
+	create := exptime != 0xffffffff
+	n, st, err := s.incr(req.key, delta, decr, create, initial, expiration(int64(exptime), time.Now()))
+	if err != nil {
+		writeInternalError(w, req, err)
+		return
+	}
+	if st != statusOK || req.quiet() {
+		writeStatus(w, req, binStatus(st))
+		return
+	}
+	var value [8]byte
+	binary.BigEndian.PutUint64(value[:], n)
+	writeResponse(w, req, binOK, 0, nil, nil, value[:])
+}
@@ -0,0 +1,362 @@
+/*
+Package memcache provides a memcached compatible front-end of a treeless server group.
+
+Both memcached protocols are supported, the protocol of each connection is detected with its first byte:
+	Text protocol: get, gets, set, add, replace, cas, delete, incr, decr, version and quit
+	Binary protocol: the same operations (including their quiet variants), noop, version and quit
+
+Operations are mapped onto a client.DBClient, cas uniques are the timestamps of the stored pairs (last write wins
+timestamps), gets+cas runs a client.DBClient.CAS of the pair with the timestamp and the value read by gets.
+Add, replace, cas, incr and decr use CAS too: they need a majority of the chunk holders and they race with concurrent
+sets of the same key.
+
+Values are stored with the format shared by the gateways (see package entry), it keeps the memcached flags.
+Deletes with a cas unique (binary protocol) use CAS too, they write an empty value, which is hidden like
+a missing pair.
+
+If the gateway is started with an authentication function, connections should authenticate with SASL PLAIN
+(the password is the token) before running any operation. SASL is only supported by the binary protocol,
+text protocol connections are closed.
+*/
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/dv343/treeless/client"
+	"github.com/dv343/treeless/gateway/entry"
+)
+
+//Maximum key length, as in memcached
+const maxKeyLength = 250
+
+//Maximum length of the text protocol command lines
+const maxLineLength = 64 * 1024
+
+//Maximum length of the SASL data (the value of SASL requests), it bounds the requests of connections that aren't authenticated
+const maxSASLDataLength = 4096
+
+//Number of CAS tries of incr and decr before giving up
+const incrRetries = 16
+
+//Relative expiration times (in seconds) can't be longer than 30 days, longer times are Unix times
+const maxRelativeExpiration = 60 * 60 * 24 * 30
+
+var errUnreachable = errors.New("Servers unreachable")
+
+//Server accepts memcached connections and runs their operations with a DB client
+type Server struct {
+	c        *client.DBClient
+	listener net.Listener
+	auth     func(token []byte) error
+	conns    map[net.Conn]bool //Open connections, they are closed by Stop
+	stopped  int32
+	mutex    sync.Mutex
+}
+
+//Start starts a memcached server listening on addr (ip:port), operations are run with c
+//If auth is not nil connections should authenticate with a token accepted by auth
+func Start(addr string, c *client.DBClient, auth func(token []byte) error) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{c: c, listener: l, auth: auth, conns: make(map[net.Conn]bool)}
+	go s.accept()
+	return s, nil
+}
+
+//Addr returns the listening address
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+//Stop stops the server, its connections are closed
+//The DB client is not closed
+func (s *Server) Stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+	s.listener.Close()
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			for c := range s.conns {
+				c.Close()
+			}
+			s.conns = nil
+			s.mutex.Unlock()
+			if atomic.LoadInt32(&s.stopped) == 0 {
+				log.Println("Memcached listener error:", err)
+			}
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		go s.serve(conn)
+	}
+}
+
+//serve detects the protocol of a connection and runs its operations until it is closed
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+	}()
+	r := bufio.NewReaderSize(conn, maxLineLength)
+	w := bufio.NewWriter(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == magicRequest {
+		s.serveBinary(r, w)
+	} else {
+		s.serveText(r, w)
+	}
+}
+
+/*
+	Items
+*/
+
+//item is a pair written by the gateway
+type item struct {
+	value      []byte
+	flags      uint32
+	expiration int64 //Unix time in nanoseconds, 0 means no expiration
+	cas        uint64
+}
+
+//decode returns the item of a stored pair, ok is false if the pair is expired or if it wasn't written by a gateway
+func decode(stored []byte, t time.Time, now time.Time) (it item, ok bool) {
+	e, ok := entry.Decode(stored, now)
+	return item{value: e.Value, flags: e.Flags, expiration: e.Expiration, cas: uint64(t.UnixNano())}, ok
+}
+
+//expiration converts a memcached expiration time to a Unix time in nanoseconds
+//0 means no expiration, times up to 30 days are relative, longer times are Unix times, negative times are expired
+func expiration(exptime int64, now time.Time) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return now.UnixNano()
+	case exptime <= maxRelativeExpiration:
+		return now.Add(time.Duration(exptime) * time.Second).UnixNano()
+	default:
+		return time.Unix(exptime, 0).UnixNano()
+	}
+}
+
+//validKey returns true if key can be used by memcached clients
+func validKey(key []byte) bool {
+	if len(key) == 0 || len(key) > maxKeyLength {
+		return false
+	}
+	for _, b := range key {
+		if b <= ' ' || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Operations
+*/
+
+//status is the result of an operation
+type status int
+
+const (
+	statusOK status = iota
+	statusNotFound
+	statusExists
+	statusNotStored
+	statusNonNumeric
+)
+
+//storeMode is the kind of a storage operation
+type storeMode int
+
+const (
+	modeSet storeMode = iota
+	modeAdd
+	modeReplace
+	modeCAS
+)
+
+//get returns the item of a key (found is false if the pair doesn't exist or if it is expired),
+//its stored value and its timestamp
+func (s *Server) get(key []byte) (it item, found bool, stored []byte, t time.Time, err error) {
+	stored, t, read := s.c.Get(key)
+	if !read {
+		return it, false, nil, t, errUnreachable
+	}
+	if stored == nil {
+		return it, false, nil, t, nil
+	}
+	it, found = decode(stored, t, time.Now())
+	return it, found, stored, t, nil
+}
+
+//cas runs a CAS of the pair read by get, a failed CAS returns an error if the pair wasn't modified by someone else
+//casUnique is the cas unique of the written pair
+func (s *Server) cas(key, value []byte, stored []byte, t time.Time) (written bool, casUnique uint64, err error) {
+	if stored == nil {
+		//CAS on a non-existent pair
+		t = time.Unix(0, 0)
+	}
+	newTime, written, err := s.c.CASWithTime(key, value, t, stored)
+	if written {
+		return true, uint64(newTime.UnixNano()), nil
+	}
+	_, _, current, t2, err2 := s.get(key)
+	if err2 != nil {
+		return false, 0, err2
+	}
+	if t2.Equal(t) || current == nil && stored == nil {
+		//The pair wasn't modified, the CAS failed for other reasons
+		if err == nil {
+			err = errUnreachable
+		}
+		return false, 0, err
+	}
+	return false, 0, nil
+}
+
+//store runs set, add, replace and cas, casUnique is only used by modeCAS
+//newCAS is the cas unique of the written pair
+func (s *Server) store(mode storeMode, key, value []byte, flags uint32, exp int64, casUnique uint64) (st status, newCAS uint64, err error) {
+	newValue := entry.Encode(value, flags, exp)
+	if mode == modeSet {
+		t, written, err := s.c.SetWithTime(key, newValue)
+		if !written {
+			if err == nil {
+				err = errUnreachable
+			}
+			return statusNotStored, 0, err
+		}
+		return statusOK, uint64(t.UnixNano()), nil
+	}
+	it, found, stored, t, err := s.get(key)
+	if err != nil {
+		return statusNotStored, 0, err
+	}
+	switch mode {
+	case modeAdd:
+		if found {
+			return statusNotStored, 0, nil
+		}
+	case modeReplace:
+		if !found {
+			return statusNotStored, 0, nil
+		}
+	case modeCAS:
+		if !found {
+			return statusNotFound, 0, nil
+		}
+		if it.cas != casUnique {
+			return statusExists, 0, nil
+		}
+	}
+	written, newCAS, err := s.cas(key, newValue, stored, t)
+	if err != nil {
+		return statusNotStored, 0, err
+	}
+	if !written {
+		if mode == modeCAS {
+			return statusExists, 0, nil
+		}
+		return statusNotStored, 0, nil
+	}
+	return statusOK, newCAS, nil
+}
+
+//delete deletes a pair, if casUnique is not 0 the pair is only deleted if its cas unique matches
+//Conditional deletes write an empty value with a CAS, the pair can't be modified between the check and the delete
+func (s *Server) delete(key []byte, casUnique uint64) (status, error) {
+	it, found, stored, t, err := s.get(key)
+	if err != nil {
+		return statusNotFound, err
+	}
+	if stored == nil {
+		return statusNotFound, nil
+	}
+	if !found {
+		//Expired pairs are deleted too
+		if err := s.c.Del(key); err != nil {
+			return statusNotFound, err
+		}
+		return statusNotFound, nil
+	}
+	if casUnique == 0 {
+		if err := s.c.Del(key); err != nil {
+			return statusNotFound, err
+		}
+		return statusOK, nil
+	}
+	if it.cas != casUnique {
+		return statusExists, nil
+	}
+	written, _, err := s.cas(key, nil, stored, t)
+	if err != nil {
+		return statusNotFound, err
+	}
+	if !written {
+		return statusExists, nil
+	}
+	return statusOK, nil
+}
+
+//incr adds delta to (or subtracts delta from) a decimal value, increments wrap around at 64 bits and decrements stop at 0
+//The flags and the expiration of the pair are kept
+//If create is true non-existent pairs are created with the initial value and the expiration exp
+func (s *Server) incr(key []byte, delta uint64, decr bool, create bool, initial uint64, exp int64) (uint64, status, error) {
+	for i := 0; i < incrRetries; i++ {
+		it, found, stored, t, err := s.get(key)
+		if err != nil {
+			return 0, statusNotFound, err
+		}
+		var n uint64
+		switch {
+		case !found && !create:
+			return 0, statusNotFound, nil
+		case !found:
+			n = initial
+			it.expiration = exp
+		default:
+			n, err = strconv.ParseUint(string(it.value), 10, 64)
+			if err != nil {
+				return 0, statusNonNumeric, nil
+			}
+			if !decr {
+				n += delta
+			} else if n > delta {
+				n -= delta
+			} else {
+				n = 0
+			}
+		}
+		written, _, err := s.cas(key, entry.Encode(strconv.AppendUint(nil, n, 10), it.flags, it.expiration), stored, t)
+		if err != nil {
+			return 0, statusNotStored, err
+		}
+		if written {
+			return n, statusOK, nil
+		}
+	}
+	return 0, statusNotStored, errors.New("Too many concurrent writes")
+}
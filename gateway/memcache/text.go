@@ -0,0 +1,246 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/gateway/entry"
+)
+
+//serveText runs the text protocol commands of a connection, replies are flushed when there are no pipelined commands
+func (s *Server) serveText(r *bufio.Reader, w *bufio.Writer) {
+	if s.auth != nil {
+		w.WriteString("CLIENT_ERROR authentication required, use the binary protocol with SASL\r\n")
+		w.Flush()
+		return
+	}
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		args := bytes.Fields(line)
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else {
+			//args point to the reader buffer, they are copied before reading the data block
+			for i := range args {
+				args[i] = append([]byte(nil), args[i]...)
+			}
+			if quit := s.runText(r, w, args); quit {
+				w.Flush()
+				return
+			}
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+//runText runs a command, it returns true if the connection should be closed
+func (s *Server) runText(r *bufio.Reader, w *bufio.Writer, args [][]byte) (quit bool) {
+	switch string(args[0]) {
+	case "get":
+		return textGet(s, w, args, false)
+	case "gets":
+		return textGet(s, w, args, true)
+	case "set":
+		return textStore(s, r, w, args, modeSet)
+	case "add":
+		return textStore(s, r, w, args, modeAdd)
+	case "replace":
+		return textStore(s, r, w, args, modeReplace)
+	case "cas":
+		return textStore(s, r, w, args, modeCAS)
+	case "delete":
+		return textDelete(s, w, args)
+	case "incr":
+		return textIncr(s, w, args, false)
+	case "decr":
+		return textIncr(s, w, args, true)
+	case "version":
+		w.WriteString("VERSION treeless\r\n")
+		return false
+	case "quit":
+		return true
+	}
+	w.WriteString("ERROR\r\n")
+	return false
+}
+
+//noreply returns true if the optional argument at position i is "noreply"
+func noreply(args [][]byte, i int) bool {
+	return len(args) > i && string(args[i]) == "noreply"
+}
+
+//reply writes a reply, unless noreply is set
+func reply(w *bufio.Writer, noreply bool, s string) {
+	if !noreply {
+		w.WriteString(s + "\r\n")
+	}
+}
+
+func serverError(w *bufio.Writer, err error) {
+	w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+}
+
+func textGet(s *Server, w *bufio.Writer, args [][]byte, withCAS bool) bool {
+	if len(args) < 2 {
+		w.WriteString("ERROR\r\n")
+		return false
+	}
+	for _, key := range args[1:] {
+		if !validKey(key) {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+	}
+	for _, key := range args[1:] {
+		it, found, _, _, err := s.get(key)
+		if err != nil {
+			serverError(w, err)
+			return false
+		}
+		if !found {
+			continue
+		}
+		w.WriteString("VALUE ")
+		w.Write(key)
+		w.WriteString(" " + strconv.FormatUint(uint64(it.flags), 10) + " " + strconv.Itoa(len(it.value)))
+		if withCAS {
+			w.WriteString(" " + strconv.FormatUint(it.cas, 10))
+		}
+		w.WriteString("\r\n")
+		w.Write(it.value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+	return false
+}
+
+//textStore runs set, add, replace and cas: <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func textStore(s *Server, r *bufio.Reader, w *bufio.Writer, args [][]byte, mode storeMode) bool {
+	n := 5
+	if mode == modeCAS {
+		n = 6
+	}
+	if len(args) != n && !(len(args) == n+1 && noreply(args, n)) {
+		w.WriteString("ERROR\r\n")
+		return false
+	}
+	key := args[1]
+	flags, err1 := strconv.ParseUint(string(args[2]), 10, 32)
+	exptime, err2 := strconv.ParseInt(string(args[3]), 10, 64)
+	size, err3 := strconv.Atoi(string(args[4]))
+	var casUnique uint64
+	var err4 error
+	if mode == modeCAS {
+		casUnique, err4 = strconv.ParseUint(string(args[5]), 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 || !validKey(key) {
+		//The data block can't be skipped, the connection is closed
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+	if size > protocol.MaxValueSize-entry.HeaderSize {
+		//Swallow the data block
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)+2); err != nil {
+			return true
+		}
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return false
+	}
+	//The data block grows as it arrives, declared sizes don't allocate memory by themselves
+	var block bytes.Buffer
+	if _, err := io.CopyN(&block, r, int64(size)+2); err != nil {
+		return true
+	}
+	data := block.Bytes()
+	if data[size] != '\r' || data[size+1] != '\n' {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return true
+	}
+	st, _, err := s.store(mode, key, data[:size], uint32(flags), expiration(exptime, time.Now()), casUnique)
+	if err != nil {
+		serverError(w, err)
+		return false
+	}
+	quiet := noreply(args, n)
+	switch st {
+	case statusOK:
+		reply(w, quiet, "STORED")
+	case statusExists:
+		reply(w, quiet, "EXISTS")
+	case statusNotFound:
+		reply(w, quiet, "NOT_FOUND")
+	default:
+		reply(w, quiet, "NOT_STORED")
+	}
+	return false
+}
+
+//textDelete runs delete <key> [noreply]
+func textDelete(s *Server, w *bufio.Writer, args [][]byte) bool {
+	if len(args) != 2 && !(len(args) == 3 && noreply(args, 2)) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	if !validKey(args[1]) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	st, err := s.delete(args[1], 0)
+	if err != nil {
+		serverError(w, err)
+		return false
+	}
+	if st == statusOK {
+		reply(w, noreply(args, 2), "DELETED")
+	} else {
+		reply(w, noreply(args, 2), "NOT_FOUND")
+	}
+	return false
+}
+
+//textIncr runs incr and decr: <command> <key> <value> [noreply]
+func textIncr(s *Server, w *bufio.Writer, args [][]byte, decr bool) bool {
+	if len(args) != 3 && !(len(args) == 4 && noreply(args, 3)) {
+		w.WriteString("ERROR\r\n")
+		return false
+	}
+	if !validKey(args[1]) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	delta, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return false
+	}
+	n, st, err := s.incr(args[1], delta, decr, false, 0, 0)
+	if err != nil {
+		serverError(w, err)
+		return false
+	}
+	quiet := noreply(args, 3)
+	switch st {
+	case statusOK:
+		reply(w, quiet, strconv.FormatUint(n, 10))
+	case statusNonNumeric:
+		reply(w, quiet, "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	default:
+		reply(w, quiet, "NOT_FOUND")
+	}
+	return false
+}
@@ -0,0 +1,487 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/dv343/treeless/client"
+	"github.com/dv343/treeless/gateway/entry"
+)
+
+//Number of CAS tries of INCRBY before giving up
+const incrRetries = 16
+
+//Default COUNT of SCAN
+const defaultScanCount = 10
+
+var errUnreachable = errors.New("Servers unreachable")
+
+//command runs a command, args[0] is the command name
+//It returns true if the connection should be closed after the reply
+type command func(s *Server, w *bufio.Writer, args [][]byte) (quit bool)
+
+type commandSpec struct {
+	arity int //Number of arguments (including the name), -N means at least N
+	run   command
+}
+
+var commands map[string]commandSpec
+
+func init() {
+	commands = map[string]commandSpec{
+		"get":     {2, cmdGet},
+		"set":     {-3, cmdSet},
+		"del":     {-2, cmdDel},
+		"exists":  {-2, cmdExists},
+		"mget":    {-2, cmdMGet},
+		"mset":    {-3, cmdMSet},
+		"incrby":  {3, cmdIncr},
+		"incr":    {2, cmdIncr},
+		"decrby":  {3, cmdIncr},
+		"decr":    {2, cmdIncr},
+		"scan":    {-2, cmdScan},
+		"ping":    {-1, cmdPing},
+		"echo":    {2, cmdEcho},
+		"select":  {2, cmdSelect},
+		"quit":    {1, cmdQuit},
+		"command": {-1, cmdCommand},
+		"client":  {-2, cmdClient},
+	}
+}
+
+//run runs a command and writes its reply
+func (s *Server) run(w *bufio.Writer, args [][]byte) (quit bool) {
+	name := strings.ToLower(string(args[0]))
+	spec, ok := commands[name]
+	if !ok {
+		writeError(w, "ERR unknown command '"+string(args[0])+"'")
+		return false
+	}
+	if spec.arity > 0 && len(args) != spec.arity || spec.arity < 0 && len(args) < -spec.arity {
+		writeError(w, "ERR wrong number of arguments for '"+name+"' command")
+		return false
+	}
+	return spec.run(s, w, args)
+}
+
+//get returns the value of a pair (nil if the pair doesn't exist or if it is expired), its stored value and its timestamp
+func (s *Server) get(key []byte) (value, stored []byte, t time.Time, err error) {
+	stored, t, read := s.c.Get(key)
+	if !read {
+		return nil, nil, t, errUnreachable
+	}
+	e, _ := entry.Decode(stored, time.Now())
+	return e.Value, stored, t, nil
+}
+
+func (s *Server) set(key, value []byte, expiration int64) error {
+	written, err := s.c.Set(key, entry.Encode(value, 0, expiration))
+	if !written {
+		if err == nil {
+			err = errUnreachable
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+	Commands
+*/
+
+func cmdGet(s *Server, w *bufio.Writer, args [][]byte) bool {
+	value, _, _, err := s.get(args[1])
+	if err != nil {
+		writeError(w, "ERR "+err.Error())
+		return false
+	}
+	writeBulk(w, value)
+	return false
+}
+
+func cmdSet(s *Server, w *bufio.Writer, args [][]byte) bool {
+	var expiration int64
+	for i := 3; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		if (option != "ex" && option != "px") || i+1 == len(args) || expiration != 0 {
+			writeError(w, "ERR syntax error")
+			return false
+		}
+		i++
+		unit := int64(time.Millisecond)
+		if option == "ex" {
+			unit = int64(time.Second)
+		}
+		//The expiration time (now + n units) should fit in an int64
+		now := time.Now().UnixNano()
+		n, err := strconv.ParseInt(string(args[i]), 10, 64)
+		if err != nil || n <= 0 || n > (math.MaxInt64-now)/unit {
+			writeError(w, "ERR invalid expire time in 'set' command")
+			return false
+		}
+		expiration = now + n*unit
+	}
+	if err := s.set(args[1], args[2], expiration); err != nil {
+		writeError(w, "ERR "+err.Error())
+		return false
+	}
+	writeSimple(w, "OK")
+	return false
+}
+
+func cmdDel(s *Server, w *bufio.Writer, args [][]byte) bool {
+	n := int64(0)
+	for _, key := range args[1:] {
+		value, stored, _, err := s.get(key)
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return false
+		}
+		if stored == nil {
+			continue
+		}
+		if value != nil {
+			n++
+		}
+		//Expired pairs are deleted too
+		if err := s.c.Del(key); err != nil {
+			writeError(w, "ERR "+err.Error())
+			return false
+		}
+	}
+	writeInt(w, n)
+	return false
+}
+
+func cmdExists(s *Server, w *bufio.Writer, args [][]byte) bool {
+	n := int64(0)
+	for _, key := range args[1:] {
+		value, _, _, err := s.get(key)
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return false
+		}
+		if value != nil {
+			n++
+		}
+	}
+	writeInt(w, n)
+	return false
+}
+
+func cmdMGet(s *Server, w *bufio.Writer, args [][]byte) bool {
+	values := make([][]byte, len(args)-1)
+	for i, key := range args[1:] {
+		value, _, _, err := s.get(key)
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return false
+		}
+		values[i] = value
+	}
+	writeArray(w, len(values))
+	for _, v := range values {
+		writeBulk(w, v)
+	}
+	return false
+}
+
+func cmdMSet(s *Server, w *bufio.Writer, args [][]byte) bool {
+	if len(args)%2 != 1 {
+		writeError(w, "ERR wrong number of arguments for 'mset' command")
+		return false
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := s.set(args[i], args[i+1], 0); err != nil {
+			writeError(w, "ERR "+err.Error())
+			return false
+		}
+	}
+	writeSimple(w, "OK")
+	return false
+}
+
+//cmdIncr runs INCRBY, INCR, DECRBY and DECR, the expiration and the flags of the pair are kept
+func cmdIncr(s *Server, w *bufio.Writer, args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		delta, err = strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || name == "decrby" && delta == math.MinInt64 {
+			writeError(w, "ERR value is not an integer or out of range")
+			return false
+		}
+	}
+	if name == "decr" || name == "decrby" {
+		delta = -delta
+	}
+	key := args[1]
+	for i := 0; i < incrRetries; i++ {
+		value, stored, t, err := s.get(key)
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return false
+		}
+		n := int64(0)
+		var e entry.Entry
+		if value != nil {
+			n, err = strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				writeError(w, "ERR value is not an integer or out of range")
+				return false
+			}
+			e, _ = entry.Decode(stored, time.Now())
+		}
+		if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+			writeError(w, "ERR increment or decrement would overflow")
+			return false
+		}
+		n += delta
+		if stored == nil {
+			//CAS on a non-existent pair
+			t = time.Unix(0, 0)
+		}
+		written, _ := s.c.CAS(key, entry.Encode(strconv.AppendInt(nil, n, 10), e.Flags, e.Expiration), t, stored)
+		if written {
+			writeInt(w, n)
+			return false
+		}
+	}
+	writeError(w, "ERR "+name+" failed: too many concurrent writes")
+	return false
+}
+
+//SCAN cursors pack a client.ScanPosition in 64 bits, see scanCursor
+const (
+	cursorOffsetBits   = 32 //Store offsets are 32 bit numbers
+	cursorRevisionBits = 13
+	cursorHolderBits   = 3
+	cursorChunkBits    = 16
+)
+
+//scanCursor returns the SCAN cursor of a position, 0 is the start (and the end) of the scan
+//Revisions are truncated, cursors of truncated revisions are unknown to the holder,
+//it restarts their chunk scan (see core/scan.go)
+func scanCursor(p client.ScanPosition) uint64 {
+	return uint64(p.Chunk)<<(cursorOffsetBits+cursorRevisionBits+cursorHolderBits) |
+		uint64(p.Holder)<<(cursorOffsetBits+cursorRevisionBits) |
+		uint64(p.Cursor.Revision)&(1<<cursorRevisionBits-1)<<cursorOffsetBits |
+		p.Cursor.Offset&(1<<cursorOffsetBits-1)
+}
+
+//scanPosition returns the position of a SCAN cursor
+func scanPosition(cursor uint64) client.ScanPosition {
+	var p client.ScanPosition
+	p.Cursor.Offset = cursor & (1<<cursorOffsetBits - 1)
+	cursor >>= cursorOffsetBits
+	p.Cursor.Revision = int64(cursor & (1<<cursorRevisionBits - 1))
+	cursor >>= cursorRevisionBits
+	p.Holder = int(cursor & (1<<cursorHolderBits - 1))
+	p.Chunk = int(cursor >> cursorHolderBits)
+	return p
+}
+
+//cmdScan runs SCAN, each call reads up to COUNT pairs, MATCH and TYPE are applied to them
+func cmdScan(s *Server, w *bufio.Writer, args [][]byte) bool {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		writeError(w, "ERR invalid cursor")
+		return false
+	}
+	var pattern []byte
+	count := defaultScanCount
+	stringType := true //Every pair is a string
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			writeError(w, "ERR syntax error")
+			return false
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				writeError(w, "ERR syntax error")
+				return false
+			}
+		case "type":
+			stringType = strings.EqualFold(string(args[i+1]), "string")
+		default:
+			writeError(w, "ERR syntax error")
+			return false
+		}
+	}
+	numChunks, err := s.c.NumChunks()
+	if err != nil {
+		writeError(w, "ERR "+err.Error())
+		return false
+	}
+	if numChunks > 1<<cursorChunkBits {
+		writeError(w, "ERR SCAN is not supported on keyspaces of more than "+strconv.Itoa(1<<cursorChunkBits)+" chunks")
+		return false
+	}
+	var keys [][]byte
+	next := uint64(0)
+	if stringType {
+		now := time.Now()
+		position, done, err := s.c.ScanPage(scanPosition(cursor), literalPrefix(pattern), count, func(key, value []byte, lastTime time.Time) {
+			if _, ok := entry.Decode(value, now); ok && (pattern == nil || match(pattern, key)) {
+				keys = append(keys, key)
+			}
+		})
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return false
+		}
+		if !done {
+			next = scanCursor(position)
+		}
+	}
+	writeArray(w, 2)
+	writeBulk(w, []byte(strconv.FormatUint(next, 10)))
+	writeArray(w, len(keys))
+	for _, key := range keys {
+		writeBulk(w, key)
+	}
+	return false
+}
+
+func cmdPing(s *Server, w *bufio.Writer, args [][]byte) bool {
+	if len(args) > 1 {
+		writeBulk(w, args[1])
+	} else {
+		writeSimple(w, "PONG")
+	}
+	return false
+}
+
+func cmdEcho(s *Server, w *bufio.Writer, args [][]byte) bool {
+	writeBulk(w, args[1])
+	return false
+}
+
+//cmdSelect only accepts the database 0, there is only one database
+func cmdSelect(s *Server, w *bufio.Writer, args [][]byte) bool {
+	if string(args[1]) != "0" {
+		writeError(w, "ERR DB index is out of range")
+	} else {
+		writeSimple(w, "OK")
+	}
+	return false
+}
+
+func cmdQuit(s *Server, w *bufio.Writer, args [][]byte) bool {
+	writeSimple(w, "OK")
+	return true
+}
+
+//cmdCommand returns an empty list, clients use it to discover the commands
+func cmdCommand(s *Server, w *bufio.Writer, args [][]byte) bool {
+	writeArray(w, 0)
+	return false
+}
+
+//cmdClient accepts the connection settings sent by client libraries (CLIENT SETNAME...), they are ignored
+func cmdClient(s *Server, w *bufio.Writer, args [][]byte) bool {
+	writeSimple(w, "OK")
+	return false
+}
+
+/*
+	Glob-style patterns of SCAN MATCH
+*/
+
+//literalPrefix returns the prefix of pattern without special characters, every matching key starts with it
+func literalPrefix(pattern []byte) []byte {
+	i := bytes.IndexAny(pattern, `*?[\`)
+	if i < 0 {
+		return pattern
+	}
+	return pattern[:i]
+}
+
+//match returns true if s matches the pattern, patterns support *, ?, [abc], [^abc], [a-z] and \ escapes
+func match(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var ok bool
+			ok, pattern = matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			s = s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+//matchClass matches c with a character class (pattern starts after '['), it returns the pattern after the class
+func matchClass(pattern []byte, c byte) (bool, []byte) {
+	negated := len(pattern) > 0 && pattern[0] == '^'
+	if negated {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		pattern = pattern[1:]
+		hi := lo
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' {
+			hi = pattern[1]
+			pattern = pattern[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(pattern) > 0 {
+		//Skip ']'
+		pattern = pattern[1:]
+	}
+	return matched != negated, pattern
+}
@@ -0,0 +1,302 @@
+/*
+Package resp provides a Redis compatible (RESP) front-end of a treeless server group.
+
+Redis clients (redis-cli and the Redis client libraries) can use the server group as a replicated cache,
+commands are mapped onto the operations of a client.DBClient:
+	GET, SET (with the EX and PX options), DEL, MGET, MSET, INCRBY, INCR, DECRBY, DECR, EXISTS and
+	SCAN (with the MATCH, COUNT and TYPE options)
+	PING, ECHO, SELECT 0, QUIT, COMMAND and CLIENT are accepted to keep client libraries happy
+
+Values are stored with the format shared by the gateways, see package entry.
+
+If the gateway is started with an authenticator, connections should send AUTH [username] password before
+other commands, password is a token of the server group (see server.Authenticate), username is ignored.
+Until then commands are limited to a few short arguments.
+
+Differences with Redis:
+	MSET is not atomic, each pair is written on its own
+	INCRBY and its variants use CAS (see client.DBClient.CAS), they need a majority of the chunk holders
+	and they race with concurrent SETs of the same key
+	SCAN reads up to COUNT pairs on each call, cursors are positions on the chunk holders (see client.ScanPage),
+	keys can be returned more than once if a holder fails or if a chunk is defragmented
+*/
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"github.com/dv343/treeless/client"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+//Maximum length of inline commands and of the header lines of a request
+const maxLineLength = 64 * 1024
+
+//Maximum number of arguments of a command
+const maxArguments = 1024 * 1024
+
+//Maximum number of arguments of the commands of connections that aren't authenticated (AUTH username password)
+const maxUnauthenticatedArguments = 3
+
+//Server accepts RESP connections and runs their commands with a DB client
+type Server struct {
+	c        *client.DBClient
+	auth     func(token []byte) error //Authenticator, nil disables the authentication
+	listener net.Listener
+	conns    map[net.Conn]bool //Open connections, they are closed by Stop
+	stopped  int32
+	mutex    sync.Mutex
+}
+
+//protocolError is returned by readCommand if a request is malformed, the connection should be closed
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+//Start starts a RESP server listening on addr (ip:port), commands are run with c
+//If auth is not nil connections are authenticated with it (see AUTH), it returns an error if the token is invalid
+func Start(addr string, c *client.DBClient, auth func(token []byte) error) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{c: c, auth: auth, listener: l, conns: make(map[net.Conn]bool)}
+	go s.accept()
+	return s, nil
+}
+
+//Addr returns the listening address
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+//Stop stops the server, its connections are closed
+//The DB client is not closed
+func (s *Server) Stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+	s.listener.Close()
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			for c := range s.conns {
+				c.Close()
+			}
+			s.conns = nil
+			s.mutex.Unlock()
+			if atomic.LoadInt32(&s.stopped) == 0 {
+				log.Println("RESP listener error:", err)
+			}
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		go s.serve(conn)
+	}
+}
+
+//serve runs the commands of a connection until it is closed, replies are flushed when there are no pipelined commands
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+	}()
+	r := bufio.NewReaderSize(conn, maxLineLength)
+	w := bufio.NewWriter(conn)
+	authenticated := s.auth == nil
+	for {
+		args, err := readCommand(r, authenticated)
+		if err != nil {
+			if e, ok := err.(protocolError); ok {
+				writeError(w, "ERR "+e.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		var quit bool
+		switch name := strings.ToLower(string(args[0])); {
+		case name == "auth":
+			authenticated = s.authenticate(w, args) || authenticated
+		case !authenticated && name != "quit":
+			writeError(w, "NOAUTH Authentication required.")
+		default:
+			quit = s.run(w, args)
+		}
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+//authenticate runs an AUTH command, it returns true if the connection was authenticated
+func (s *Server) authenticate(w *bufio.Writer, args [][]byte) bool {
+	if len(args) != 2 && len(args) != 3 {
+		writeError(w, "ERR wrong number of arguments for 'auth' command")
+		return false
+	}
+	if s.auth == nil {
+		writeError(w, "ERR AUTH called without any password configured for the default user")
+		return false
+	}
+	if err := s.auth(args[len(args)-1]); err != nil {
+		writeError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+	writeSimple(w, "OK")
+	return true
+}
+
+/*
+	Requests
+*/
+
+//readCommand reads a request: an array of bulk strings or an inline command (arguments separated by spaces)
+//Commands of connections that aren't authenticated are limited to a few arguments of maxLineLength bytes in total
+func readCommand(r *bufio.Reader, authenticated bool) ([][]byte, error) {
+	argumentsLimit, sizeLimit := maxArguments, maxCommandSize()
+	if !authenticated {
+		argumentsLimit, sizeLimit = maxUnauthenticatedArguments, maxLineLength
+	}
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return splitInline(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > argumentsLimit {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	//Buffers grow as the data arrives, declared lengths don't allocate memory by themselves
+	var args [][]byte
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$'")
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > protocol.MaxValueSize {
+			return nil, protocolError("invalid bulk length")
+		}
+		if total += size; total > sizeLimit {
+			return nil, protocolError("too big request")
+		}
+		var arg bytes.Buffer
+		if _, err := io.CopyN(&arg, r, int64(size)); err != nil {
+			return nil, err
+		}
+		var crlf [2]byte
+		if _, err := io.ReadFull(r, crlf[:]); err != nil {
+			return nil, err
+		}
+		if crlf[0] != '\r' || crlf[1] != '\n' {
+			return nil, protocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, arg.Bytes())
+	}
+	return args, nil
+}
+
+//maxCommandSize returns the maximum total length of the arguments of a command, a SET of the largest pair fits
+func maxCommandSize() int {
+	return protocol.MaxValueSize + protocol.MaxKeySize + maxLineLength
+}
+
+//readLine returns a line without its terminator (CRLF or LF)
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("too big request line")
+	} else if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	l := make([]byte, len(line))
+	copy(l, line)
+	return l, nil
+}
+
+//splitInline returns the space separated arguments of an inline command
+func splitInline(line []byte) [][]byte {
+	var args [][]byte
+	start := -1
+	for i, b := range line {
+		if b == ' ' || b == '\t' {
+			if start >= 0 {
+				args = append(args, line[start:i])
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		args = append(args, line[start:])
+	}
+	return args
+}
+
+/*
+	Replies
+*/
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+//writeBulk writes a bulk string, nil is written as a null bulk string
+func writeBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func writeArray(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
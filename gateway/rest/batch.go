@@ -0,0 +1,195 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/dv343/treeless/client"
+)
+
+//Default limit of scan pages
+const defaultScanLimit = 100
+
+//Maximum limit of scan pages, greater limits are reduced to it
+const maxScanLimit = 1000
+
+//Pair is the JSON document of a pair, Value is nil if the pair doesn't exist
+type Pair struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	ETag  string `json:"etag,omitempty"`
+}
+
+//BatchGetRequest is the request of /batch/get
+type BatchGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+//BatchWriteRequest is the request of /batch/write, sets are applied before deletes
+//Atomic batches are applied with client.DBClient.WriteBatch, every key should belong to the same chunk
+type BatchWriteRequest struct {
+	Set    []Pair   `json:"set"`
+	Del    []string `json:"del"`
+	Atomic bool     `json:"atomic"`
+}
+
+//ScanPage is the response of /scan, Cursor is the cursor of the next page, it is empty after the last page
+type ScanPage struct {
+	Pairs  []Pair `json:"pairs"`
+	Cursor string `json:"cursor"`
+}
+
+//readJSON decodes the body of a POST request, it writes an error and returns false if it fails
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONSize)).Decode(v); err != nil {
+		http.Error(w, "Invalid JSON document: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleBatchGet(w http.ResponseWriter, r *http.Request) {
+	var req BatchGetRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	pairs := make([]Pair, len(req.Keys))
+	for i, key := range req.Keys {
+		value, t, err := s.get([]byte(key))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		pairs[i] = Pair{Key: key, Value: value}
+		if value != nil {
+			pairs[i].ETag = etag(t)
+		}
+	}
+	writeJSON(w, pairs)
+}
+
+func (s *Server) handleBatchWrite(w http.ResponseWriter, r *http.Request) {
+	var req BatchWriteRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if len(req.Set)+len(req.Del) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if req.Atomic {
+		var b client.Batch
+		for _, p := range req.Set {
+			b.Set([]byte(p.Key), p.Value)
+		}
+		for _, key := range req.Del {
+			b.Del([]byte(key))
+		}
+		written, err := s.c.WriteBatch(&b)
+		if !written {
+			if err == nil {
+				err = errUnreachable
+			}
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for _, p := range req.Set {
+		written, err := s.c.Set([]byte(p.Key), p.Value)
+		if !written {
+			if err == nil {
+				err = errUnreachable
+			}
+			writeError(w, err)
+			return
+		}
+	}
+	for _, key := range req.Del {
+		if err := s.c.Del([]byte(key)); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//scanCursor returns the cursor of a scan position: chunk.holder.revision.offset
+func scanCursor(p client.ScanPosition) string {
+	return strconv.Itoa(p.Chunk) + "." + strconv.Itoa(p.Holder) + "." +
+		strconv.FormatInt(p.Cursor.Revision, 10) + "." + strconv.FormatUint(p.Cursor.Offset, 10)
+}
+
+//scanPosition returns the scan position of a cursor, ok is false if the cursor is invalid
+func scanPosition(cursor string) (p client.ScanPosition, ok bool) {
+	fields := strings.Split(cursor, ".")
+	if len(fields) != 4 {
+		return p, false
+	}
+	var err [4]error
+	p.Chunk, err[0] = strconv.Atoi(fields[0])
+	p.Holder, err[1] = strconv.Atoi(fields[1])
+	p.Cursor.Revision, err[2] = strconv.ParseInt(fields[2], 10, 64)
+	p.Cursor.Offset, err[3] = strconv.ParseUint(fields[3], 10, 64)
+	for _, e := range err {
+		if e != nil {
+			return p, false
+		}
+	}
+	return p, p.Chunk >= 0 && p.Holder >= 0
+}
+
+//handleScan serves /scan, each page reads up to limit pairs
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	prefix := []byte(q.Get("prefix"))
+	var position client.ScanPosition
+	limit := defaultScanLimit
+	var err error
+	if c := q.Get("cursor"); c != "" {
+		var ok bool
+		if position, ok = scanPosition(c); !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxScanLimit {
+			limit = maxScanLimit
+		}
+	}
+	page := ScanPage{Pairs: []Pair{}}
+	next, done, err := s.c.ScanPage(position, prefix, limit, func(key, value []byte, lastTime time.Time) {
+		page.Pairs = append(page.Pairs, Pair{Key: string(key), Value: value, ETag: etag(lastTime)})
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !done {
+		page.Cursor = scanCursor(next)
+	}
+	writeJSON(w, page)
+}
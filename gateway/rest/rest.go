@@ -0,0 +1,277 @@
+/*
+Package rest provides an HTTP/JSON front-end of a treeless server group.
+
+Endpoints:
+	GET /kv/{key}		Returns the value of the pair (raw bytes) and its timestamp as ETag
+	PUT /kv/{key}		Sets the pair, the request body is the value
+	DELETE /kv/{key}	Deletes the pair
+	POST /batch/get		Gets many pairs: {"keys": [...]}
+	POST /batch/write	Sets and deletes many pairs: {"set": [{"key": ..., "value": ...}], "del": [...], "atomic": false}
+	GET /scan		Scans the pairs: ?prefix=...&cursor=...&limit=...
+
+Keys are the unescaped URL paths after /kv/, they aren't cleaned (keys can contain //, ./ and ../), values are raw bytes in /kv requests and base64 strings in JSON documents.
+Values are stored as they are, pairs can be accessed by every client.
+
+Conditional requests use the pair timestamp as ETag, successful PUTs return the ETag of the new value:
+	GET with If-None-Match returns 304 Not Modified if the pair wasn't modified
+	PUT with If-Match runs a client.DBClient.CAS with the timestamp, it fails with 412 Precondition Failed if the pair was modified
+	PUT with If-None-Match: * only creates the pair (CAS on a non-existent pair)
+	DELETE with If-Match or If-None-Match fails with 400 Bad Request, a CAS can't write a deleted pair
+CAS needs a majority of the chunk holders and it races with concurrent writes of the same key that don't use If-Match.
+
+Atomic batch writes use client.DBClient.WriteBatch, every key should belong to the same chunk.
+Each scan page reads up to limit pairs (at most 1000), cursors are positions on the chunk holders (see client.ScanPage),
+pairs can be returned more than once if a holder fails or if a chunk is defragmented.
+
+If the server has an authentication function, requests should send a token accepted by it
+in an "Authorization: Bearer <token>" header, other requests fail with 401 Unauthorized.
+*/
+package rest
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/dv343/treeless/client"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+//Maximum size of JSON request bodies
+const maxJSONSize = 64 * 1024 * 1024
+
+var errUnreachable = errors.New("Servers unreachable")
+
+//Server serves HTTP requests with a DB client
+type Server struct {
+	c        *client.DBClient
+	listener net.Listener
+	http     *http.Server
+	mux      *http.ServeMux
+	auth     func(token []byte) error
+}
+
+//NewServer returns a server that runs the requests with c, it can be used as an http.Handler
+//If auth is not nil requests should send a bearer token accepted by auth
+func NewServer(c *client.DBClient, auth func(token []byte) error) *Server {
+	s := &Server{c: c, mux: http.NewServeMux(), auth: auth}
+	s.mux.HandleFunc("/kv/", s.handleKV)
+	s.mux.HandleFunc("/batch/get", s.handleBatchGet)
+	s.mux.HandleFunc("/batch/write", s.handleBatchWrite)
+	s.mux.HandleFunc("/scan", s.handleScan)
+	return s
+}
+
+//Start starts an HTTP server listening on addr ([ip]:port), requests are run with c
+//If auth is not nil requests should send a bearer token accepted by auth
+func Start(addr string, c *client.DBClient, auth func(token []byte) error) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := NewServer(c, auth)
+	s.listener = l
+	s.http = &http.Server{Handler: s}
+	go func() {
+		if err := s.http.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Println("HTTP listener error:", err)
+		}
+	}()
+	return s, nil
+}
+
+//Addr returns the listening address
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+//Stop stops the server, its connections are closed
+//The DB client is not closed
+func (s *Server) Stop() {
+	s.http.Close()
+}
+
+//ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.auth != nil {
+		h := r.Header.Get("Authorization")
+		if !strings.HasPrefix(h, "Bearer ") || s.auth([]byte(strings.TrimPrefix(h, "Bearer "))) != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	//The mux cleans the paths, /kv/ requests are served without it to keep their keys
+	if strings.HasPrefix(r.URL.EscapedPath(), "/kv/") {
+		s.handleKV(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+/*
+	ETags
+*/
+
+//etag returns the ETag of a pair timestamp
+func etag(t time.Time) string {
+	return `"` + strconv.FormatInt(t.UnixNano(), 10) + `"`
+}
+
+//matchETag returns true if the header (a list of ETags or *) matches the pair, exists is false if the pair doesn't exist
+//Weak ETags (W/"...") don't match if strong is true (If-Match uses the strong comparison, RFC 7232)
+func matchETag(header string, t time.Time, exists, strong bool) bool {
+	if !exists {
+		return false
+	}
+	tag := etag(t)
+	for _, h := range strings.Split(header, ",") {
+		h = strings.TrimSpace(h)
+		if !strong {
+			h = strings.TrimPrefix(h, "W/")
+		}
+		if h == "*" || h == tag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Pairs
+*/
+
+//handleKV serves /kv/{key}
+func (s *Server) handleKV(w http.ResponseWriter, r *http.Request) {
+	k, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/kv/"))
+	key := []byte(k)
+	if err != nil || len(key) == 0 || len(key) > protocol.MaxKeySize {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		s.getPair(w, r, key)
+	case "PUT":
+		s.putPair(w, r, key)
+	case "DELETE":
+		s.deletePair(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//get returns the value of a pair and its timestamp, value is nil if the pair doesn't exist
+func (s *Server) get(key []byte) (value []byte, t time.Time, err error) {
+	value, t, read := s.c.Get(key)
+	if !read {
+		return nil, t, errUnreachable
+	}
+	return value, t, nil
+}
+
+//writeError writes a DB error
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if err == errUnreachable {
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func (s *Server) getPair(w http.ResponseWriter, r *http.Request, key []byte) {
+	value, t, err := s.get(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if value == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", etag(t))
+	if h := r.Header.Get("If-None-Match"); h != "" && matchETag(h, t, true, false) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	if r.Method == "GET" {
+		w.Write(value)
+	}
+}
+
+func (s *Server) putPair(w http.ResponseWriter, r *http.Request, key []byte) {
+	value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(protocol.MaxValueSize)))
+	if err != nil {
+		http.Error(w, "Value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		t, written, err := s.c.SetWithTime(key, value)
+		if !written {
+			if err == nil {
+				err = errUnreachable
+			}
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("ETag", etag(t))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if ifNoneMatch != "" && ifNoneMatch != "*" {
+		http.Error(w, "Only If-None-Match: * is supported", http.StatusBadRequest)
+		return
+	}
+	old, t, err := s.get(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	exists := old != nil
+	if ifMatch != "" && !matchETag(ifMatch, t, exists, true) || ifNoneMatch == "*" && exists {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	if !exists {
+		//CAS on a non-existent pair
+		t = time.Unix(0, 0)
+	}
+	newTime, written, err := s.c.CASWithTime(key, value, t, old)
+	if !written {
+		//Check if the pair was modified by someone else
+		_, t2, err2 := s.get(key)
+		if err2 == nil && !t2.Equal(t) && !(t2.IsZero() && !exists) {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		if err == nil {
+			err = errUnreachable
+		}
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(newTime))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deletePair(w http.ResponseWriter, r *http.Request, key []byte) {
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		http.Error(w, "Conditional deletes are not supported", http.StatusBadRequest)
+		return
+	}
+	if err := s.c.Del(key); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
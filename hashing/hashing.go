@@ -1,5 +1,7 @@
 package hashing
 
+import "bytes"
+
 const (
 	offset64 = 14695981039346656037
 	prime64  = 1099511628211
@@ -20,3 +22,91 @@ func GetChunkID(b []byte, numChunks int) int {
 	h := FNV1a64(b)
 	return int((h >> 32) % uint64(numChunks))
 }
+
+//GetTaggedChunkID returns the associated chunkID of a key b, if the key has a hash tag only the tag is used
+//It should only be used by keyspaces with hash tags enabled, it would move existing keys containing braces
+func GetTaggedChunkID(b []byte, numChunks int) int {
+	return GetChunkID(HashTag(b), numChunks)
+}
+
+//HashTag returns the part of the key used to select its chunk in keyspaces with hash tags enabled
+//Keys containing a non-empty substring between the first '{' and the next '}' use that substring,
+//so "{user1}name" and "{user1}email" belong to the same chunk
+//Other keys are returned unmodified
+func HashTag(key []byte) []byte {
+	start := bytes.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := bytes.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+//ColocatedKey returns a key with the hash tag tag, every key with the same tag belongs to the same chunk
+//of a keyspace with hash tags enabled
+func ColocatedKey(tag, key []byte) []byte {
+	k := make([]byte, 0, len(tag)+len(key)+2)
+	k = append(k, '{')
+	k = append(k, tag...)
+	k = append(k, '}')
+	return append(k, key...)
+}
+
+//keyspacePrefix marks the keys of named keyspaces, keys of the default keyspace shouldn't start with it
+const keyspacePrefix = "\xfe\xff"
+
+//MaxKeyspaceNameLen is the maximum length of a keyspace name
+const MaxKeyspaceNameLen = 64
+
+//ValidKeyspaceName returns true if name can be used as a keyspace name
+//Names are composed by 1 to MaxKeyspaceNameLen letters, digits, '_' or '-'
+func ValidKeyspaceName(name string) bool {
+	if len(name) == 0 || len(name) > MaxKeyspaceNameLen {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+//KeyspaceKey returns the stored key of key on the keyspace name, name "" is the default keyspace
+//Stored keys are composed by the keyspace prefix, the name length (1 byte), the name and the key
+func KeyspaceKey(name string, key []byte) []byte {
+	if name == "" {
+		return key
+	}
+	k := make([]byte, 0, len(keyspacePrefix)+1+len(name)+len(key))
+	k = append(k, keyspacePrefix...)
+	k = append(k, byte(len(name)))
+	k = append(k, name...)
+	return append(k, key...)
+}
+
+//HasKeyspacePrefix returns true if key starts with the keyspace prefix
+//Keys of the default keyspace can't start with it, they would be confused with keys of named keyspaces
+func HasKeyspacePrefix(key []byte) bool {
+	return len(key) >= len(keyspacePrefix) && string(key[:len(keyspacePrefix)]) == keyspacePrefix
+}
+
+//KeyspacesKey is a reserved key, the key master of its chunk assigns the chunk IDs of new keyspaces
+//It is never stored
+var KeyspacesKey = []byte(keyspacePrefix + "\x00keyspaces")
+
+//SplitKeyspace returns the keyspace name and the key of a stored key, see KeyspaceKey
+func SplitKeyspace(storedKey []byte) (name string, key []byte) {
+	n := len(keyspacePrefix)
+	if len(storedKey) <= n || string(storedKey[:n]) != keyspacePrefix {
+		return "", storedKey
+	}
+	l := int(storedKey[n])
+	if len(storedKey) < n+1+l || !ValidKeyspaceName(string(storedKey[n+1:n+1+l])) {
+		return "", storedKey
+	}
+	return string(storedKey[n+1 : n+1+l]), storedKey[n+1+l:]
+}
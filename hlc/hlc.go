@@ -0,0 +1,71 @@
+/*
+Package hlc provides hybrid logical clock timestamps.
+
+A hybrid logical clock timestamp fits in the same 8 bytes as a Unix nanoseconds timestamp:
+the 48 most significant bits store the physical time and the 16 least significant bits
+store a logical counter. Timestamps can be interpreted as Unix nanoseconds with an error
+of a few microseconds.
+
+Timestamps generated by a process are strictly increasing and they are always greater than
+any timestamp received by the process (see Update), so causally related events are ordered
+even if the wall clocks of the processes are skewed.
+*/
+package hlc
+
+import (
+	"sync"
+	"time"
+)
+
+const logicalBits = 16
+const logicalMask = 1<<logicalBits - 1
+
+var clock struct {
+	last uint64
+	sync.Mutex
+}
+
+//physical returns the wall clock, its logical part is rounded up so timestamps never precede the wall clock
+func physical() uint64 {
+	return (uint64(time.Now().UnixNano()) | logicalMask) + 1
+}
+
+//Now returns a new timestamp, it should be called on local or send events
+func Now() uint64 {
+	pt := physical()
+	clock.Lock()
+	if pt > clock.last {
+		clock.last = pt
+	} else {
+		clock.last++
+	}
+	ts := clock.last
+	clock.Unlock()
+	return ts
+}
+
+//Update advances the clock after receiving a remote timestamp and returns a new timestamp
+func Update(remote uint64) uint64 {
+	pt := physical()
+	clock.Lock()
+	if pt > clock.last && pt > remote {
+		clock.last = pt
+	} else if remote > clock.last {
+		clock.last = remote + 1
+	} else {
+		clock.last++
+	}
+	ts := clock.last
+	clock.Unlock()
+	return ts
+}
+
+//Physical returns the current wall clock as a timestamp without advancing the clock
+func Physical() uint64 {
+	return physical()
+}
+
+//Time converts a timestamp to a time.Time
+func Time(ts uint64) time.Time {
+	return time.Unix(0, int64(ts))
+}
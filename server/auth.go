@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"os"
+	"strings"
+	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+/*
+	Authentication
+
+	Authentication is enabled when at least one token is known, each token grants a role
+	(see protocol.Role). Server group nodes authenticate their connections to other nodes
+	with the cluster secret (or with the first cluster token of the tokens file if there is no secret),
+	so it should be the same on every node.
+	Gateways (see package gateway) authenticate their users with the same tokens, see Authenticate.
+*/
+
+var tokens = make(map[string]protocol.Role)
+
+var nodeToken string //Token of the connections to other nodes, see SetClusterSecret
+
+//AddToken allows connections authenticated with token to use the operations of role
+//It should be called before creating the server
+func AddToken(token string, role protocol.Role) {
+	tokens[token] = role
+}
+
+//LoadTokens adds the tokens stored in a file, one "<role> <token>" pair per line
+//Empty lines and lines starting with # are ignored
+func LoadTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return errors.New("Bad token line, expected \"<role> <token>\": " + line)
+		}
+		role, err := protocol.ParseRole(fields[0])
+		if err != nil {
+			return err
+		}
+		AddToken(fields[1], role)
+		if role == protocol.RoleCluster && nodeToken == "" {
+			nodeToken = fields[1]
+			com.SetToken(nodeToken)
+		}
+	}
+	return scanner.Err()
+}
+
+//SetClusterSecret sets the secret shared by the server group nodes, it enables the authentication
+//Connections authenticated with the secret get the cluster role, and connections to other nodes use it
+func SetClusterSecret(secret string) {
+	AddToken(secret, protocol.RoleCluster)
+	nodeToken = secret
+	com.SetToken(secret)
+}
+
+//AuthenticationEnabled returns true if connections should be authenticated
+func AuthenticationEnabled() bool {
+	return len(tokens) > 0
+}
+
+//NodeToken returns the token of the connections to other nodes, "" if there is none
+func NodeToken() string {
+	return nodeToken
+}
+
+//RoleToken returns a token that grants role, "" if there is none
+func RoleToken(role protocol.Role) string {
+	for t, r := range tokens {
+		if r == role {
+			return t
+		}
+	}
+	return ""
+}
+
+//Authenticate returns the role of a token
+func Authenticate(token []byte) (protocol.Role, error) {
+	role := protocol.RoleNone
+	//Every token is compared to avoid leaking timing information
+	for t, r := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+			role = r
+		}
+	}
+	if role == protocol.RoleNone {
+		return role, errors.New("Authentication failed")
+	}
+	return role, nil
+}
+
+//authorize returns an error if the peer can't send the message
+func authorize(message protocol.Message, peer *com.Peer) error {
+	if len(tokens) == 0 || message.Type == protocol.OpHello || message.Type == protocol.OpAuth || peer.Role().Allows(message.Type) {
+		return nil
+	}
+	if peer.Role() == protocol.RoleNone {
+		return errors.New("Unauthorized: authentication required")
+	}
+	return errors.New("Unauthorized: operation not allowed to role " + peer.Role().String())
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/binary"
+	"time"
+	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/hlc"
+)
+
+//waitChanges responds an OpSubscribe request when the chunk has changes after the request cursor or when
+//the request wait time expires, see protocol.SubscribeRequest
+//It runs on its own goroutine, requests of the same connection are served meanwhile
+func (s *DBServer) waitChanges(peer *com.Peer, id uint32, chunkID int, request *protocol.SubscribeRequest) {
+	timeout := time.NewTimer(request.Wait)
+	defer timeout.Stop()
+	page := &protocol.ChangePage{Next: request.Cursor}
+	var err error
+	for waiting := true; waiting; {
+		var changed <-chan struct{}
+		changed, err = s.core.ChangesWritten(chunkID, request.Cursor)
+		if err != nil {
+			break
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			waiting = false
+		case <-peer.Closed():
+			return
+		}
+		page, err = s.core.Changes(chunkID, request.Cursor, request.Limit)
+		waiting = waiting && err == nil && len(page.Keys) == 0
+	}
+	response := protocol.Message{Type: protocol.OpResponse, ID: id}
+	if err == nil {
+		response.Value = page.Marshal()
+	} else {
+		response.Type = protocol.OpErr
+		response.Value = []byte(err.Error())
+	}
+	//Let the client advance its clock
+	response.Key = make([]byte, 8)
+	binary.LittleEndian.PutUint64(response.Key, hlc.Now())
+	peer.Push(response)
+}
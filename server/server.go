@@ -2,8 +2,10 @@ package server
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 	"github.com/dv343/treeless/com"
@@ -13,15 +15,29 @@ import (
 	"github.com/dv343/treeless/dist/rebalance"
 	"github.com/dv343/treeless/dist/repair"
 	"github.com/dv343/treeless/dist/servergroup"
+	"github.com/dv343/treeless/hashing"
+	"github.com/dv343/treeless/hlc"
+	"github.com/dv343/treeless/vclock"
 )
 
+//MaxClockSkew is the maximum time a write timestamp can be ahead of the server clock, writes with
+//timestamps further in the future will be rejected
+var MaxClockSkew = time.Second
+
+//CompressValues enables the compression of the values stored by this server, values are flagged one by one
+//so it can be changed between restarts, network compression is set with com.SetCompression
+var CompressValues = false
+
 //DBServer manages a Treeless node server
 type DBServer struct {
 	core    *core.Core
 	server  *com.Server
 	sg      *servergroup.ServerGroup
 	hb      *heartbeat.Heartbeater
+	watches *watchRegistry
 	stopped uint32
+	//keyspaceMutex serializes keyspace creations, see createKeyspace
+	keyspaceMutex sync.Mutex
 }
 
 //Create creates a new DB server group
@@ -31,10 +47,22 @@ type DBServer struct {
 //openDB should be true if you want to open an already stored DB, set it to false if you want to create a new DB, overwriting previous DB if it exists
 //numChunks is the number of chunks to use in the new server group
 //redundancy is the level of redundancy to use in the new server group, 1 means that only one server will have each chunk/partition
-func Create(localIP string, localPort int, localDBpath string, localChunkSize uint64, openDB bool, numChunks, redundancy int) *DBServer {
+//ordered enables the ordered index (needed by range queries) of the default keyspace, it is stored in the server group
+//configuration so associated servers use it too, it should not change when the DB is opened again
+//Named keyspaces have their own setting (see protocol.Keyspace)
+//hbConfig sets the heartbeat and failure detector parameters, nil uses heartbeat.DefaultConfig()
+func Create(localIP string, localPort int, localDBpath string, localChunkSize uint64, openDB bool, numChunks, redundancy int, ordered bool, hbConfig *heartbeat.Config) *DBServer {
 	s := new(DBServer)
 	//Core
 	s.core = core.New(localDBpath, localChunkSize, numChunks)
+	s.watches = newWatchRegistry()
+	s.core.SetWriteListener(s.watches)
+	if ordered {
+		s.core.EnableOrderedIndex()
+	}
+	if CompressValues {
+		s.core.EnableCompression()
+	}
 	if openDB {
 		s.core.Open()
 	} else {
@@ -44,14 +72,25 @@ func Create(localIP string, localPort int, localDBpath string, localChunkSize ui
 	}
 	//Servergroup
 	s.sg = servergroup.CreateServerGroup(numChunks, redundancy, localIP+":"+fmt.Sprint(localPort))
+	s.sg.SetOrdered(ordered)
+	for _, k := range s.core.Keyspaces() {
+		if _, err := s.sg.AddKeyspace(k); err != nil {
+			panic(err)
+		}
+	}
+	s.sg.SetKeyspaceListener(s.addKeyspace)
+	if openDB {
+		s.sg.SetEpoch(s.core.StoredEpoch())
+	}
+	s.sg.SetEpochListener(s.storeEpoch)
 	s.sg.AddServerToGroup(localIP + ":" + fmt.Sprint(localPort))
-	list := make([]protocol.AmAliveChunk, numChunks)
-	for i := 0; i < numChunks; i++ {
+	list := make([]protocol.AmAliveChunk, s.sg.TotalChunks())
+	for i := range list {
 		list[i].ID = i
 	}
 	s.sg.SetServerChunks(localIP+":"+fmt.Sprint(localPort), list)
 	//Heartbeat
-	s.hb = heartbeat.Start(s.sg)
+	s.hb = heartbeat.Start(s.sg, hbConfig)
 	//Rebalance
 	rebalance.StartRebalance(s.sg, s.core, s.isStopped)
 	//Repair
@@ -68,7 +107,8 @@ func Create(localIP string, localPort int, localDBpath string, localChunkSize ui
 //localChunkSize sets the server chunk size in bytes
 //openDB should be true if you want to open an already stored DB, set it to false if you want to create a new DB, overwriting previous DB if it exists
 //assocAddr is the ip:port address of one of the server groups nodes, it will be used at initialization time to associate this server
-func Assoc(localIP string, localPort int, localDBpath string, localChunkSize uint64, openDB bool, assocAddr string) *DBServer {
+//hbConfig sets the heartbeat and failure detector parameters, nil uses heartbeat.DefaultConfig()
+func Assoc(localIP string, localPort int, localDBpath string, localChunkSize uint64, openDB bool, assocAddr string, hbConfig *heartbeat.Config) *DBServer {
 	s := new(DBServer)
 	//Associate to an existing DB group
 	var err error
@@ -80,9 +120,23 @@ func Assoc(localIP string, localPort int, localDBpath string, localChunkSize uin
 	numChunks := s.sg.NumChunks()
 	//Launch core
 	s.core = core.New(localDBpath, localChunkSize, numChunks)
+	s.watches = newWatchRegistry()
+	s.core.SetWriteListener(s.watches)
+	if s.sg.Ordered() {
+		s.core.EnableOrderedIndex()
+	}
+	if CompressValues {
+		s.core.EnableCompression()
+	}
+	for _, k := range s.sg.Keyspaces() {
+		s.addKeyspace(k)
+	}
+	s.sg.SetKeyspaceListener(s.addKeyspace)
+	s.sg.SetEpochListener(s.storeEpoch)
 	if openDB {
 		s.core.Open()
 	}
+	s.storeEpoch(s.sg.Epoch())
 	//Add this server to the server group
 	addedAtLeastOnce := false
 	for _, s2 := range s.sg.Servers() {
@@ -98,7 +152,7 @@ func Assoc(localIP string, localPort int, localDBpath string, localChunkSize uin
 	}
 	s.sg.AddServerToGroup(localIP + ":" + fmt.Sprint(localPort))
 	//Heartbeat
-	s.hb = heartbeat.Start(s.sg)
+	s.hb = heartbeat.Start(s.sg, hbConfig)
 	//Rebalance
 	rebalance.StartRebalance(s.sg, s.core, s.isStopped)
 	//Repair
@@ -115,6 +169,7 @@ func (s *DBServer) Stop() {
 	atomic.StoreUint32(&s.stopped, 1)
 	s.hb.Stop()
 	s.server.Stop()
+	s.watches.Stop()
 	s.sg.Stop()
 	s.core.Close()
 	log.Println("Server closed")
@@ -124,20 +179,51 @@ func (s *DBServer) isStopped() bool {
 	return atomic.LoadUint32(&s.stopped) > 0
 }
 
-func (s *DBServer) processMessage(message protocol.Message) (response protocol.Message) {
+func (s *DBServer) processMessage(message protocol.Message, peer *com.Peer) (response protocol.Message) {
 	//fmt.Println("Server", "message received", string(message.Key), string(message.Value), message.Type)
 	response.Type = 0
 	if s.isStopped() {
 		return response
 	}
 	response.ID = message.ID
+	if err := authorize(message, peer); err != nil {
+		response.Type = protocol.OpErr
+		response.Value = []byte(err.Error())
+		return response
+	}
 	switch message.Type {
+	case protocol.OpHello:
+		var local *protocol.Hello
+		hello, err := protocol.HelloUnMarshal(message.Value)
+		if err == nil {
+			local, err = peer.Hello(hello)
+		}
+		if err == nil {
+			response.Type = protocol.OpResponse
+			response.Value = local.Marshal()
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpAuth:
+		role, err := Authenticate(message.Value)
+		if err == nil {
+			peer.SetRole(role)
+			response.Type = protocol.OpOK
+		} else {
+			log.Println("Connection authentication failed")
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
 	case protocol.OpGet:
 		value, _ := s.core.Get(message.Key)
 		response.Type = protocol.OpResponse
 		response.Value = value
 	case protocol.OpSet:
-		err := s.core.Set(message.Key, message.Value)
+		err := checkTimestamp(message.Value)
+		if err == nil {
+			err = s.core.Set(message.Key, message.Value)
+		}
 		if err == nil {
 			response.Type = protocol.OpOK
 		} else {
@@ -145,17 +231,208 @@ func (s *DBServer) processMessage(message protocol.Message) (response protocol.M
 			response.Value = []byte(err.Error())
 		}
 	case protocol.OpAsyncSet:
-		s.core.Set(message.Key, message.Value)
+		//Async sets don't have a response, rejected writes are only logged
+		err := checkTimestamp(message.Value)
+		if err == nil {
+			err = s.core.Set(message.Key, message.Value)
+		}
+		if err != nil {
+			log.Println("Async set rejected:", err)
+		}
 	case protocol.OpCAS:
-		err := s.core.CAS(message.Key, message.Value, s.sg.IsSynched)
+		var err error
+		if len(message.Value) < 24 {
+			err = errors.New("Error: CAS value len < 24")
+		} else {
+			err = checkTimestamp(message.Value[16:24])
+		}
+		if err == nil {
+			err = s.core.CAS(message.Key, message.Value, s.sg.IsSynched)
+		}
 		if err == nil {
 			response.Type = protocol.OpOK
 		} else {
 			response.Type = protocol.OpErr
 			response.Value = []byte(err.Error())
 		}
+	case protocol.OpPaxosPrepare:
+		ballot, err := protocol.BallotUnMarshal(message.Value)
+		var promise *protocol.PaxosPromise
+		if err == nil {
+			//Skewed ballots would extend the ballot lease of the acceptor too far, see core/paxos.go
+			err = checkTimestamp(message.Value)
+		}
+		if err == nil {
+			var proposal uint64
+			if len(message.Value) >= protocol.BallotSize+8 {
+				proposal = binary.LittleEndian.Uint64(message.Value[protocol.BallotSize:])
+			}
+			promise, err = s.core.PaxosPrepare(message.Key, ballot, proposal)
+		}
+		if err == nil {
+			response.Type = protocol.OpResponse
+			response.Value = promise.Marshal()
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpPaxosPropose, protocol.OpPaxosCommit:
+		ballot, err := protocol.BallotUnMarshal(message.Value)
+		if err == nil {
+			err = checkTimestamp(message.Value[protocol.BallotSize:])
+		}
+		if err == nil {
+			if message.Type == protocol.OpPaxosPropose {
+				err = s.core.PaxosPropose(message.Key, ballot, message.Value[protocol.BallotSize:])
+			} else {
+				err = s.core.PaxosCommit(message.Key, ballot, message.Value[protocol.BallotSize:])
+			}
+		}
+		if err == nil {
+			response.Type = protocol.OpOK
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpSetIfAbsent, protocol.OpSetIfTimestamp:
+		record := message.Value
+		if message.Type == protocol.OpSetIfTimestamp && len(record) >= 8 {
+			record = record[8:]
+		}
+		err := checkTimestamp(record)
+		if err == nil {
+			if message.Type == protocol.OpSetIfAbsent {
+				err = s.core.SetIfAbsent(message.Key, message.Value)
+			} else {
+				err = s.core.SetIfTimestamp(message.Key, message.Value)
+			}
+		}
+		if err == nil {
+			err = s.replicate(message.Key, record)
+		}
+		if err == nil {
+			response.Type = protocol.OpOK
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpBatch:
+		batch, err := protocol.BatchUnMarshal(message.Value)
+		for i := 0; err == nil && i < len(batch); i++ {
+			err = checkTimestamp(batch[i].Value)
+		}
+		if err == nil {
+			err = s.core.Batch(batch)
+		}
+		if err == nil {
+			response.Type = protocol.OpOK
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpScan:
+		var page *protocol.ScanPage
+		request, err := protocol.ScanRequestUnMarshal(message.Value)
+		if err == nil && len(message.Key) != 4 {
+			err = errors.New("Error: Scan key len != 4")
+		}
+		if err == nil {
+			chunkID := int(binary.LittleEndian.Uint32(message.Key))
+			page, err = s.core.Scan(chunkID, request.Cursor, request.Prefix, request.Limit)
+		}
+		if err == nil {
+			response.Type = protocol.OpResponse
+			response.Value = page.Marshal()
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpRange:
+		var result *protocol.RangeResult
+		request, err := protocol.RangeRequestUnMarshal(message.Value)
+		if err == nil && len(message.Key) != 4 {
+			err = errors.New("Error: Range key len != 4")
+		}
+		if err == nil {
+			chunkID := int(binary.LittleEndian.Uint32(message.Key))
+			result, err = s.core.Range(chunkID, request.Start, request.End, request.Limit)
+		}
+		if err == nil {
+			response.Type = protocol.OpResponse
+			response.Value = result.Marshal()
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpSubscribe:
+		var page *protocol.ChangePage
+		request, err := protocol.SubscribeRequestUnMarshal(message.Value)
+		if err == nil && len(message.Key) != 4 {
+			err = errors.New("Error: Subscribe key len != 4")
+		}
+		if err == nil {
+			chunkID := int(binary.LittleEndian.Uint32(message.Key))
+			page, err = s.core.Changes(chunkID, request.Cursor, request.Limit)
+			if err == nil && len(page.Keys) == 0 && request.Wait > 0 {
+				//The response is sent when new changes are written
+				go s.waitChanges(peer, message.ID, chunkID, request)
+				return response
+			}
+		}
+		if err == nil {
+			response.Type = protocol.OpResponse
+			response.Value = page.Marshal()
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpWatch:
+		request, err := protocol.WatchRequestUnMarshal(message.Value)
+		if err == nil {
+			s.watches.add(peer, request.ID, message.Key, request.Prefix)
+			response.Type = protocol.OpOK
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpUnwatch:
+		if len(message.Value) == 4 {
+			s.watches.remove(peer, binary.LittleEndian.Uint32(message.Value))
+			response.Type = protocol.OpOK
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte("Error: Unwatch value len != 4")
+		}
+	case protocol.OpIncr, protocol.OpAppend:
+		var value []byte
+		var err error
+		if message.Type == protocol.OpAppend {
+			value, err = s.core.Append(message.Key, message.Value)
+		} else if len(message.Value) != 8 {
+			err = errors.New("Error: Incr value len != 8")
+		} else {
+			value, err = s.core.Incr(message.Key, int64(binary.LittleEndian.Uint64(message.Value)))
+		}
+		if err == nil {
+			//Replicas use last writer wins, so replication order doesn't matter
+			err = s.replicate(message.Key, value)
+		}
+		if err == nil {
+			if message.Type == protocol.OpIncr {
+				response.Type = protocol.OpResponse
+				response.Value = value[8:]
+			} else {
+				response.Type = protocol.OpOK
+			}
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
 	case protocol.OpDel:
-		err := s.core.Delete(message.Key, message.Value)
+		err := checkTimestamp(message.Value)
+		if err == nil {
+			err = s.core.Delete(message.Key, message.Value)
+		}
 		if err == nil {
 			response.Type = protocol.OpOK
 		} else {
@@ -163,29 +440,39 @@ func (s *DBServer) processMessage(message protocol.Message) (response protocol.M
 			response.Value = []byte(err.Error())
 		}
 	case protocol.OpTransfer:
+		if len(message.Key) != 4 {
+			response.Type = protocol.OpErr
+			response.Value = []byte("Error: Transfer key len != 4")
+			break
+		}
 		chunkID := int(binary.LittleEndian.Uint32(message.Key))
 		//New goroutine will put every key value pair into destination, it will manage the OpTransferOK response
 		go func() {
 			addr := string(message.Value)
 			c, err := com.CreateConnection(addr, func() {})
-			defer c.Close()
 			if err != nil {
+				//The connection handshake (TLS, hello or authentication) could fail, c is nil
 				log.Println("Transfer failed, error:", err)
-			} else {
-				log.Println("Transfer operation initiated, chunkID:", chunkID)
-				i := 0
-				s.core.Iterate(chunkID, func(key, value []byte) bool {
-					if i%100 == 0 {
-						ch := c.Set(key, value, time.Millisecond*500)
-						err = ch.Wait()
-					} else {
-						c.Set(key, value, 0) //AsyncSet
-					}
-					i++
-					return true
-				})
-				log.Println("Transfer operation completed", chunkID, "pairs:", i)
+				return
+			}
+			defer c.Close()
+			log.Println("Transfer operation initiated, chunkID:", chunkID)
+			i := 0
+			s.core.Iterate(chunkID, func(key, value []byte) bool {
+				if i%100 == 0 {
+					ch := c.Set(key, value, time.Millisecond*500)
+					err = ch.Wait()
+				} else {
+					c.Set(key, value, 0) //AsyncSet
+				}
+				i++
+				return true
+			})
+			//Asynchronous sets are buffered, the connection is closed only after the destination has applied them
+			if _, err := c.GetChunkInfo(chunkID); err != nil {
+				log.Println("Transfer flush failed, error:", err)
 			}
+			log.Println("Transfer operation completed", chunkID, "pairs:", i)
 		}()
 		response.Type = protocol.OpOK
 	case protocol.OpGetConf:
@@ -197,18 +484,49 @@ func (s *DBServer) processMessage(message protocol.Message) (response protocol.M
 		response.Value = b
 	case protocol.OpAddServerToGroup:
 		addr := string(message.Key)
-		s.sg.AddServerToGroup(addr)
+		_, err := s.sg.AddServerToGroup(addr)
+		if err == nil {
+			s.sg.IncEpoch()
+		}
 		s.hb.GossipAdded(addr)
 		response.Type = protocol.OpOK
+	case protocol.OpForgetNode:
+		addr := string(message.Key)
+		err := s.sg.RemoveServer(addr)
+		if err == nil {
+			s.sg.IncEpoch()
+			response.Type = protocol.OpOK
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
+	case protocol.OpCreateKeyspace:
+		err := s.createKeyspace(message.Value)
+		if err == nil {
+			response.Type = protocol.OpOK
+		} else {
+			response.Type = protocol.OpErr
+			response.Value = []byte(err.Error())
+		}
 	case protocol.OpGetChunkInfo:
+		if len(message.Key) != 4 {
+			response.Type = protocol.OpErr
+			response.Value = []byte("Error: GetChunkInfo key len != 4")
+			break
+		}
 		chunkID := int(binary.LittleEndian.Uint32(message.Key))
 		response.Type = protocol.OpResponse
 		response.Value = make([]byte, 8)
 		length := s.core.LengthOfChunk(chunkID)
 		binary.LittleEndian.PutUint64(response.Value, length)
 	case protocol.OpProtect:
+		if len(message.Key) != 4 {
+			response.Type = protocol.OpErr
+			response.Value = []byte("Error: Protect key len != 4")
+			break
+		}
 		chunkID := binary.LittleEndian.Uint32(message.Key)
-		if s.sg.NumHolders(int(chunkID)) > s.sg.Redundancy() {
+		if s.sg.NumHolders(int(chunkID)) > s.sg.ChunkRedundancy(int(chunkID)) {
 			err := s.core.ChunkSetProtected(int(chunkID))
 			if err == nil {
 				response.Type = protocol.OpOK
@@ -228,5 +546,105 @@ func (s *DBServer) processMessage(message protocol.Message) (response protocol.M
 		response.Value = []byte("Operation not supported")
 		log.Println("Operation not supported", message.Type)
 	}
+	if response.Type == protocol.OpOK || response.Type == protocol.OpErr || response.Type == protocol.OpResponse {
+		//Let the client advance its clock
+		response.Key = make([]byte, 8)
+		binary.LittleEndian.PutUint64(response.Key, hlc.Now())
+	}
 	return response
 }
+
+//replicationTimeout is the maximum time the key master waits for the replicas of a record
+const replicationTimeout = 500 * time.Millisecond
+
+//replicate sends a locally written record to the other holders of its chunk
+//It waits until one of them stores the record, so it survives a key master failure
+//Holders that can't be reached are skipped, it returns nil if there are no reachable holders
+func (s *DBServer) replicate(key, value []byte) error {
+	chunkID, err := s.sg.ChunkID(key)
+	if err != nil {
+		return err
+	}
+	servers := s.sg.GetChunkHolders(chunkID)
+	var ops []com.SetOperation
+	for _, vs := range servers {
+		if vs != nil && vs.Phy != s.sg.LocalhostIPPort {
+			op, err := vs.Set(key, value, replicationTimeout)
+			if err == nil {
+				ops = append(ops, op)
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	//Every operation should be waited to return its channel
+	acks := 0
+	for i := range ops {
+		if err = ops[i].Wait(); err == nil {
+			acks++
+		}
+	}
+	if acks == 0 {
+		return errors.New("Replication failed: the write was applied by the key master only, error: " + err.Error())
+	}
+	return nil
+}
+
+//createKeyspace creates a named keyspace, this server will hold its chunks until they are rebalanced
+//Only the key master of hashing.KeyspacesKey creates keyspaces, so chunk IDs are assigned in order by a single server
+//A new master could reuse chunk IDs if it didn't receive the configuration of the last keyspaces created by the old one
+func (s *DBServer) createKeyspace(msg []byte) error {
+	k, err := protocol.KeyspaceUnMarshal(msg)
+	if err != nil {
+		return err
+	}
+	//Chunk IDs are assigned by a single server, the key master of hashing.KeyspacesKey
+	if masters := s.sg.KeyMasters(hashing.KeyspacesKey); len(masters) == 0 || masters[0].Phy != s.sg.LocalhostIPPort {
+		return errors.New(protocol.ErrNotKeyspacesMaster)
+	}
+	s.keyspaceMutex.Lock()
+	defer s.keyspaceMutex.Unlock()
+	k.FirstChunk = 0
+	*k, err = s.sg.AddKeyspace(*k)
+	if err != nil {
+		return err
+	}
+	if err := s.core.AddKeyspace(*k); err != nil {
+		return err
+	}
+	for i := k.FirstChunk; i < k.FirstChunk+k.NumChunks; i++ {
+		s.core.ChunkSetPresent(i)
+	}
+	s.sg.SetServerChunks(s.sg.LocalhostIPPort, s.core.PresentChunksList())
+	s.sg.IncEpoch()
+	return nil
+}
+
+//addKeyspace adds a keyspace of the server group configuration to the core
+func (s *DBServer) addKeyspace(k protocol.Keyspace) {
+	if err := s.core.AddKeyspace(k); err != nil {
+		log.Println("Keyspace", k.Name, "couldn't be added:", err)
+	}
+}
+
+//storeEpoch persists the configuration epoch, see core.StoreEpoch
+func (s *DBServer) storeEpoch(epoch uint64) {
+	if err := s.core.StoreEpoch(epoch); err != nil {
+		log.Println("Configuration epoch couldn't be stored:", err)
+	}
+}
+
+//checkTimestamp rejects write timestamps too far ahead of the local clock
+//Accepted timestamps advance the local clock
+func checkTimestamp(timestamp []byte) error {
+	if len(timestamp) < 8 {
+		return errors.New("Error: message value len < 8")
+	}
+	t := vclock.Timestamp(timestamp)
+	if t > hlc.Physical()+uint64(MaxClockSkew) {
+		return errors.New("Timestamp too far ahead of the server clock")
+	}
+	hlc.Update(t)
+	return nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+//Number of events waiting to be pushed, watches that can't queue an event are removed (see protocol.OpWatchOverflow)
+const watchQueueSize = 4096
+
+//watchRegistry stores the watches of the connected clients, it notifies them the writes of the watched keys
+//Watches are indexed by key and by prefix, a write looks up each prefix length in use
+//It implements core.WriteListener
+type watchRegistry struct {
+	peers      map[*com.Peer]map[uint32]*watch
+	keys       map[string]map[*watch]bool //Watches of each key
+	prefixes   map[string]map[*watch]bool //Watches of each prefix
+	prefixLens map[int]int                //Number of watched prefixes of each length
+	count      int32                      //Number of watches, it avoids locking when nothing is watched
+	events     chan watchEvent
+	stop       chan struct{}
+	mutex      sync.RWMutex
+}
+
+type watch struct {
+	peer     *com.Peer
+	id       uint32
+	key      []byte
+	prefix   bool
+	overflow int32 //1 if an event was dropped, the watch is being removed
+}
+
+type watchEvent struct {
+	w           *watch
+	key, record []byte
+}
+
+func newWatchRegistry() *watchRegistry {
+	r := new(watchRegistry)
+	r.peers = make(map[*com.Peer]map[uint32]*watch)
+	r.keys = make(map[string]map[*watch]bool)
+	r.prefixes = make(map[string]map[*watch]bool)
+	r.prefixLens = make(map[int]int)
+	r.events = make(chan watchEvent, watchQueueSize)
+	r.stop = make(chan struct{})
+	go r.push()
+	return r
+}
+
+//add registers a watch of a peer, watches are removed when the peer connection is closed
+func (r *watchRegistry) add(peer *com.Peer, id uint32, key []byte, prefix bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	watches, ok := r.peers[peer]
+	if !ok {
+		watches = make(map[uint32]*watch)
+		r.peers[peer] = watches
+		go func() {
+			select {
+			case <-peer.Closed():
+				r.removePeer(peer)
+			case <-r.stop:
+			}
+		}()
+	}
+	if old, ok := watches[id]; ok {
+		r.unindex(old)
+	} else {
+		atomic.AddInt32(&r.count, 1)
+	}
+	w := &watch{peer: peer, id: id, key: append([]byte(nil), key...), prefix: prefix}
+	watches[id] = w
+	r.index(w)
+}
+
+//index adds a watch to the key or prefix index, the mutex should be held
+func (r *watchRegistry) index(w *watch) {
+	index := r.keys
+	if w.prefix {
+		index = r.prefixes
+		r.prefixLens[len(w.key)]++
+	}
+	if index[string(w.key)] == nil {
+		index[string(w.key)] = make(map[*watch]bool)
+	}
+	index[string(w.key)][w] = true
+}
+
+//unindex removes a watch from the key or prefix index, the mutex should be held
+func (r *watchRegistry) unindex(w *watch) {
+	index := r.keys
+	if w.prefix {
+		index = r.prefixes
+		if r.prefixLens[len(w.key)]--; r.prefixLens[len(w.key)] == 0 {
+			delete(r.prefixLens, len(w.key))
+		}
+	}
+	delete(index[string(w.key)], w)
+	if len(index[string(w.key)]) == 0 {
+		delete(index, string(w.key))
+	}
+}
+
+//remove unregisters a watch of a peer
+func (r *watchRegistry) remove(peer *com.Peer, id uint32) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if w, ok := r.peers[peer][id]; ok {
+		r.unindex(w)
+		delete(r.peers[peer], id)
+		atomic.AddInt32(&r.count, -1)
+	}
+}
+
+//removePeer unregisters every watch of a peer
+func (r *watchRegistry) removePeer(peer *com.Peer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, w := range r.peers[peer] {
+		r.unindex(w)
+	}
+	atomic.AddInt32(&r.count, -int32(len(r.peers[peer])))
+	delete(r.peers, peer)
+}
+
+//matching calls f for each watch that covers key, the mutex should be held
+func (r *watchRegistry) matching(key []byte, f func(w *watch)) {
+	for w := range r.keys[string(key)] {
+		f(w)
+	}
+	for l := range r.prefixLens {
+		if l <= len(key) {
+			for w := range r.prefixes[string(key[:l])] {
+				f(w)
+			}
+		}
+	}
+}
+
+//Watched returns true if any watch covers key
+func (r *watchRegistry) Watched(key []byte) bool {
+	if atomic.LoadInt32(&r.count) == 0 {
+		return false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.keys[string(key)]) > 0 {
+		return true
+	}
+	for l := range r.prefixLens {
+		if l <= len(key) && len(r.prefixes[string(key[:l])]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//Written queues an event for each watch that covers key
+//Watches whose events can't be queued are removed, their peers get an OpWatchOverflow message
+func (r *watchRegistry) Written(key, record []byte) {
+	key = append([]byte(nil), key...)
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	r.matching(key, func(w *watch) {
+		if atomic.LoadInt32(&w.overflow) == 1 {
+			return
+		}
+		select {
+		case r.events <- watchEvent{w: w, key: key, record: record}:
+		default:
+			if atomic.CompareAndSwapInt32(&w.overflow, 0, 1) {
+				log.Println("Watch event dropped, queue full, removing the watch", w.id)
+				//Written is called with the chunk lock held, it can't wait for the registry mutex
+				go r.overflow(w)
+			}
+		}
+	})
+}
+
+//overflow removes a watch that lost events and notifies its peer
+func (r *watchRegistry) overflow(w *watch) {
+	r.mutex.Lock()
+	if r.peers[w.peer][w.id] == w {
+		r.unindex(w)
+		delete(r.peers[w.peer], w.id)
+		atomic.AddInt32(&r.count, -1)
+	}
+	r.mutex.Unlock()
+	w.peer.Push(protocol.Message{Type: protocol.OpWatchOverflow, ID: w.id})
+}
+
+//push sends the queued events to their peers until the registry is stopped
+func (r *watchRegistry) push() {
+	for {
+		select {
+		case e := <-r.events:
+			if atomic.LoadInt32(&e.w.overflow) == 0 {
+				e.w.peer.Push(protocol.Message{Type: protocol.OpWatchEvent, ID: e.w.id, Key: e.key, Value: e.record})
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+//Stop stops pushing events
+func (r *watchRegistry) Stop() {
+	close(r.stop)
+}
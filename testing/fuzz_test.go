@@ -0,0 +1,76 @@
+package test
+
+import (
+	"bytes"
+	"testing"
+	"github.com/dv343/treeless/com/protocol"
+)
+
+//marshalMessage returns the serialization of m
+func marshalMessage(m protocol.Message) []byte {
+	size, _ := m.Marshal(nil)
+	b := make([]byte, size)
+	m.Marshal(b)
+	return b
+}
+
+//Unmarshal should reject malformed messages without panicking, accepted messages should be serialized back
+func FuzzUnmarshal(f *testing.F) {
+	f.Add(marshalMessage(protocol.Message{Type: protocol.OpGet, ID: 1, Key: []byte("key")}))
+	f.Add(marshalMessage(protocol.Message{Type: protocol.OpSet, ID: 2, Key: []byte("key"), Value: []byte("12345678value")}))
+	f.Add(marshalMessage(protocol.Message{Type: protocol.OpSetNoDelay}))
+	f.Add([]byte{})
+	f.Add([]byte{13, 0, 0, 0, 0, 0, 0, 0, 255, 255, 255, 255, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := protocol.Unmarshal(data)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(marshalMessage(m), data) {
+			t.Fatal("Marshal mismatch")
+		}
+	})
+}
+
+//AmAliveUnMarshal should reject malformed heartbeats without panicking
+func FuzzAmAliveUnMarshal(f *testing.F) {
+	aa := protocol.AmAlive{
+		KnownChunks: []protocol.AmAliveChunk{{ID: 1, Checksum: 42}, {ID: 7, Checksum: 3}},
+		Incarnation: 2,
+		Epoch:       5,
+		ConfigHash:  77,
+		Updates:     []protocol.MemberUpdate{{Addr: "127.0.0.1:10000", Status: protocol.MemberSuspect, Incarnation: 1}},
+	}
+	for _, seed := range []protocol.AmAlive{aa, {}} {
+		b, err := seed.Marshal()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{255, 255, 0, 0})
+	f.Add([]byte{protocol.HeartbeatVersion, 255, 255, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		aa, err := protocol.AmAliveUnMarshal(data)
+		if err != nil || len(data) > protocol.MaxHeartbeatSize {
+			return
+		}
+		b, err := aa.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		aa2, err := protocol.AmAliveUnMarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(aa2.KnownChunks) != len(aa.KnownChunks) || aa2.Incarnation != aa.Incarnation || aa2.Epoch != aa.Epoch || aa2.ConfigHash != aa.ConfigHash {
+			t.Fatal("Marshal mismatch")
+		}
+		for i := range aa.KnownChunks {
+			if aa2.KnownChunks[i] != aa.KnownChunks[i] {
+				t.Fatal("Marshal mismatch")
+			}
+		}
+	})
+}
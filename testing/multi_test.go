@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"os/exec"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 	"github.com/dv343/treeless/client"
+	"github.com/dv343/treeless/client/lock"
+	"github.com/dv343/treeless/com/protocol"
 	"github.com/dv343/treeless/hashing"
 	"github.com/dv343/treeless/tlfmt"
 )
@@ -58,6 +62,224 @@ func TestMultiBasicRebalance(t *testing.T) {
 	}
 }
 
+func TestMultiKeyspaces(t *testing.T) {
+	addr1 := cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	waitForServer(addr1)
+	c, err := client.Connect(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cluster[1].assoc(addr1, ultraverbose, false)
+	defer cluster[1].kill()
+	time.Sleep(time.Second * 2)
+
+	//The keyspace redundancy overrides the server group redundancy
+	err = c.CreateKeyspace(protocol.Keyspace{Name: "replicated", NumChunks: 4, Redundancy: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := c.Keyspace("replicated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := ks.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Wait for rebalance
+	time.Sleep(time.Second * 8)
+	fmt.Println("Server 1 shut down")
+	cluster[0].kill()
+	time.Sleep(time.Millisecond * 100)
+	for i := 0; i < 100; i++ {
+		v, _, _ := ks.Get([]byte(fmt.Sprint("key", i)))
+		if string(v) != fmt.Sprint(i) {
+			t.Fatal("Keyspace pair lost:", i, string(v))
+		}
+	}
+}
+
+func TestMultiFeed(t *testing.T) {
+	addr1 := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	waitForServer(addr1)
+	c, err := client.Connect(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cluster[1].assoc(addr1, ultraverbose, false)
+	defer cluster[1].kill()
+	defer cluster[0].kill()
+	//Wait for rebalance
+	time.Sleep(time.Second * 8)
+
+	f, err := c.Subscribe(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 50
+	for i := 0; i < n; i++ {
+		c.Set([]byte(fmt.Sprint("feed", i)), []byte(fmt.Sprint(i)))
+	}
+	c.Del([]byte("feed0"))
+	//Both replicas report every change, each one should be returned once
+	seen := make(map[string]int)
+	deletions := 0
+	timer := time.AfterFunc(time.Second*3, f.Close)
+	defer timer.Stop()
+	for {
+		ch, err := f.Next()
+		if err != nil {
+			break
+		}
+		if ch.Deleted {
+			deletions++
+		} else {
+			seen[string(ch.Key)]++
+		}
+	}
+	if len(seen) != n || deletions != 1 {
+		t.Fatal("Feed mismatch:", len(seen), "keys", deletions, "deletions")
+	}
+	for k, times := range seen {
+		if times != 1 {
+			t.Fatal("Duplicated change:", k, times)
+		}
+	}
+}
+
+func TestMultiWatch(t *testing.T) {
+	addr1 := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	waitForServer(addr1)
+	c, err := client.Connect(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	w, err := c.Watch([]byte("watched"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	//The new server is watched once the client knows it
+	cluster[1].assoc(addr1, ultraverbose, false)
+	defer cluster[1].kill()
+	//Wait for rebalance
+	time.Sleep(time.Second * 8)
+	fmt.Println("Server 1 shut down")
+	cluster[0].kill()
+	time.Sleep(time.Second * 2)
+	c.Set([]byte("watched"), []byte("after failover"))
+	ch := nextEvents(t, w, 1, time.Second*5)[0]
+	if string(ch.Key) != "watched" || string(ch.Value) != "after failover" {
+		t.Fatal("Watch mismatch:", string(ch.Key), string(ch.Value))
+	}
+}
+
+func TestMultiTLS(t *testing.T) {
+	disable := enableTestTLS(t)
+	defer disable()
+	addr1 := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	c, err := client.Connect(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Set([]byte("tls"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	//The chunk is transferred over TLS
+	cluster[1].assoc(addr1, ultraverbose, false)
+	defer cluster[1].kill()
+	//Wait for rebalance
+	time.Sleep(time.Second * 8)
+	fmt.Println("Server 1 shut down")
+	cluster[0].kill()
+	time.Sleep(time.Millisecond * 100)
+	if v, _, _ := c.Get([]byte("tls")); string(v) != "secret" {
+		t.Fatal("Pair lost:", string(v))
+	}
+}
+
+func TestMultiCompression(t *testing.T) {
+	disable := enableTestCompression()
+	defer disable()
+	addr1 := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	c, err := client.Connect(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	value := compressibleValue(0, 256*1024)
+	if _, err := c.Set([]byte("json"), value); err != nil {
+		t.Fatal(err)
+	}
+	//The chunk is transferred with compression
+	cluster[1].assoc(addr1, ultraverbose, false)
+	defer cluster[1].kill()
+	//Wait for rebalance
+	time.Sleep(time.Second * 8)
+	fmt.Println("Server 1 shut down")
+	cluster[0].kill()
+	time.Sleep(time.Millisecond * 100)
+	if v, _, _ := c.Get([]byte("json")); !bytes.Equal(v, value) {
+		t.Fatal("Pair lost:", len(v))
+	}
+}
+
+func TestMultiAuth(t *testing.T) {
+	disable := enableTestAuth(t, "cluster-secret", "client-token")
+	defer disable()
+	addr1 := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	c, err := client.Connect(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Set([]byte("auth"), []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	//Nodes authenticate their connections with the cluster secret
+	cluster[1].assoc(addr1, ultraverbose, false)
+	defer cluster[1].kill()
+	//Wait for rebalance
+	time.Sleep(time.Second * 8)
+	fmt.Println("Server 1 shut down")
+	cluster[0].kill()
+	time.Sleep(time.Millisecond * 100)
+	if v, _, _ := c.Get([]byte("auth")); string(v) != "ok" {
+		t.Fatal("Pair lost:", string(v))
+	}
+}
+
+func TestMultiHeartbeatAuth(t *testing.T) {
+	disable := enableTestHeartbeatKey("heartbeat-key")
+	defer disable()
+	addr1 := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	c, err := client.Connect(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Set([]byte("heartbeat"), []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	//Membership and rebalance work with signed heartbeats
+	cluster[1].assoc(addr1, ultraverbose, false)
+	defer cluster[1].kill()
+	//Wait for rebalance
+	time.Sleep(time.Second * 8)
+	fmt.Println("Server 1 shut down")
+	cluster[0].kill()
+	time.Sleep(time.Millisecond * 100)
+	if v, _, _ := c.Get([]byte("heartbeat")); string(v) != "ok" {
+		t.Fatal("Pair lost:", string(v))
+	}
+}
+
 func TestMultiHotRebalance(t *testing.T) {
 	var stop2 func()
 	//Server set-up
@@ -269,15 +491,24 @@ func TestMultiCAS(t *testing.T) {
 	inc := func(c *client.DBClient, key []byte) {
 		written := false
 		for !written {
-			oldv, t, _ := c.Get(key)
-			//fmt.Println(oldv, t)
+			oldv, lastTime, read := c.Get(key)
+			if !read {
+				//Timeout, retry
+				time.Sleep(time.Microsecond * time.Duration(rand.Intn(2000)))
+				continue
+			}
+			if len(oldv) < 4 {
+				t.Error("Invalid value read:", oldv)
+				return
+			}
+			//fmt.Println(oldv, lastTime)
 			x := binary.LittleEndian.Uint32(oldv)
 			//fmt.Println(x)
 			x++
 			value := make([]byte, 8)
 			binary.LittleEndian.PutUint32(value, uint32(x))
 			binary.LittleEndian.PutUint32(value[4:8], uint32(rand.Int63()))
-			written, _ = c.CAS(key, value, t, oldv)
+			written, _ = c.CAS(key, value, lastTime, oldv)
 			atomic.AddUint64(&tries, 1)
 			if !written {
 				time.Sleep(time.Microsecond * time.Duration(rand.Intn(2000)))
@@ -329,6 +560,468 @@ func TestMultiCAS(t *testing.T) {
 	}
 }
 
+//Test that CAS is linearizable under network partitions: each successful CAS should increment
+//a different value and no CAS should succeed without a majority of the chunk holders
+func TestMultiLinearizableCAS(t *testing.T) {
+	if !cluster[0].testCapability(capDisconnect) {
+		t.Skip("Cluster doesn't support disconnections")
+	}
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	cluster[1].assoc(addr, ultraverbose, false)
+	defer cluster[1].kill()
+	time.Sleep(time.Second * 8)
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetNoDelay()
+	defer c.Close()
+
+	key := []byte("counter")
+	value := make([]byte, 4)
+	written, errs := c.CAS(key, value, time.Unix(0, 0), nil)
+	if !written {
+		t.Fatal("Initial CAS failed", errs)
+	}
+
+	var m sync.Mutex
+	writtenValues := make(map[uint32]bool)
+	var partitioned, partitionedWrites int32
+	var stop int32
+	clients := 8
+	var w sync.WaitGroup
+	w.Add(clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			defer w.Done()
+			c, err := client.Connect(cluster[1].addr())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.SetNoDelay()
+			defer c.Close()
+			for atomic.LoadInt32(&stop) == 0 {
+				oldv, ts, read := c.Get(key)
+				if !read || len(oldv) < 4 {
+					time.Sleep(time.Millisecond * 10)
+					continue
+				}
+				x := binary.LittleEndian.Uint32(oldv) + 1
+				newv := make([]byte, 4)
+				binary.LittleEndian.PutUint32(newv, x)
+				written, _ := c.CAS(key, newv, ts, oldv)
+				if written {
+					if atomic.LoadInt32(&partitioned) == 1 {
+						atomic.AddInt32(&partitionedWrites, 1)
+					}
+					m.Lock()
+					if writtenValues[x] {
+						m.Unlock()
+						t.Error("Two CAS operations succeeded with the same old value", x-1)
+						return
+					}
+					writtenValues[x] = true
+					m.Unlock()
+				} else {
+					time.Sleep(time.Microsecond * time.Duration(rand.Intn(2000)))
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Second * 3)
+	fmt.Println("Disconnect A")
+	cluster[0].disconnect()
+	//Wait for in-flight operations
+	time.Sleep(time.Second)
+	atomic.StoreInt32(&partitioned, 1)
+	time.Sleep(time.Second * 5)
+	atomic.StoreInt32(&partitioned, 0)
+	fmt.Println("Reconnect A")
+	cluster[0].reconnect()
+	time.Sleep(time.Second * 8)
+	atomic.StoreInt32(&stop, 1)
+	w.Wait()
+
+	if partitionedWrites > 0 {
+		t.Fatal("CAS operations succeeded without a majority:", partitionedWrites)
+	}
+	v, _, _ := c.Get(key)
+	if len(v) < 4 {
+		t.Fatal("Get failed", v)
+	}
+	x := binary.LittleEndian.Uint32(v)
+	m.Lock()
+	defer m.Unlock()
+	if len(writtenValues) == 0 {
+		t.Fatal("No CAS operation succeeded")
+	}
+	//Every successful CAS should be visible, x can be higher due to CAS operations with unknown results
+	if int(x) < len(writtenValues) {
+		t.Fatal("Lost CAS operations:", x, "<", len(writtenValues))
+	}
+	for y := range writtenValues {
+		if y > x {
+			t.Fatal("Successful CAS not visible:", y, ">", x)
+		}
+	}
+}
+
+func TestMultiIncrAppend(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	for i := 1; i < len(cluster); i++ {
+		cluster[i].assoc(addr, ultraverbose, false)
+		defer cluster[i].kill()
+	}
+	time.Sleep(time.Second * 8)
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	counter := []byte("counter")
+	appended := []byte("appended")
+	ops := 100
+	clients := 20
+	var w sync.WaitGroup
+	w.Add(clients)
+	var failed uint64
+	for i := 0; i < clients; i++ {
+		go func() {
+			defer w.Done()
+			c, err := client.Connect(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.SetNoDelay()
+			defer c.Close()
+			for i := 0; i < ops; i++ {
+				if _, err := c.Incr(counter, 2); err != nil {
+					atomic.AddUint64(&failed, 1)
+				}
+				if _, err := c.Append(appended, []byte{'x'}); err != nil {
+					atomic.AddUint64(&failed, 1)
+				}
+			}
+		}()
+	}
+	w.Wait()
+	if failed > 0 {
+		t.Fatal("Failed operations:", failed)
+	}
+	x, err := c.Incr(counter, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != int64(2*ops*clients-1) {
+		t.Fatal("Incr mismatch:", x, "!=", 2*ops*clients-1)
+	}
+	//Incr and Append wait for the replicas, every holder should have the values
+	v, _, _ := c.Get(counter)
+	if len(v) != 8 || int64(binary.LittleEndian.Uint64(v)) != x {
+		t.Fatal("Get mismatch:", v, x)
+	}
+	v, _, _ = c.Get(appended)
+	if len(v) != ops*clients {
+		t.Fatal("Append length mismatch:", len(v), "!=", ops*clients)
+	}
+	//Incr on a non-int64 value should fail
+	if _, err := c.Incr(appended, 1); err == nil {
+		t.Fatal("Incr on a non-int64 value succeeded")
+	}
+}
+
+func TestMultiConditionalSet(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	for i := 1; i < len(cluster); i++ {
+		cluster[i].assoc(addr, ultraverbose, false)
+		defer cluster[i].kill()
+	}
+	time.Sleep(time.Second * 8)
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	//SetIfAbsent
+	if written, err := c.SetIfAbsent([]byte("insert"), []byte("first")); !written {
+		t.Fatal("SetIfAbsent failed", err)
+	}
+	if written, _ := c.SetIfAbsent([]byte("insert"), []byte("second")); written {
+		t.Fatal("SetIfAbsent overwrote an existing pair")
+	}
+	v, ts, _ := c.Get([]byte("insert"))
+	if string(v) != "first" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+	//SetIfTimestamp
+	if written, err := c.SetIfTimestamp([]byte("insert"), []byte("third"), ts); !written {
+		t.Fatal("SetIfTimestamp failed", err)
+	}
+	if written, _ := c.SetIfTimestamp([]byte("insert"), []byte("fourth"), ts); written {
+		t.Fatal("SetIfTimestamp succeeded with an old timestamp")
+	}
+	v, _, _ = c.Get([]byte("insert"))
+	if string(v) != "third" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+	//The zero time matches a non-existent pair, like time.Unix(0, 0)
+	if written, err := c.SetIfTimestamp([]byte("zero"), []byte("first"), time.Time{}); !written {
+		t.Fatal("SetIfTimestamp with the zero time failed", err)
+	}
+	if written, _ := c.SetIfTimestamp([]byte("zero"), []byte("second"), time.Time{}); written {
+		t.Fatal("SetIfTimestamp with the zero time overwrote an existing pair")
+	}
+	if written, _ := c.SetIfTimestamp([]byte("zero"), []byte("second"), time.Unix(-1, 0)); written {
+		t.Fatal("SetIfTimestamp accepted a timestamp out of range")
+	}
+
+	//Optimistic concurrency
+	key := []byte("counter")
+	ops := 50
+	clients := 20
+	var w sync.WaitGroup
+	w.Add(clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			defer w.Done()
+			c, err := client.Connect(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.SetNoDelay()
+			defer c.Close()
+			for i := 0; i < ops; i++ {
+				for {
+					v, ts, read := c.Get(key)
+					if !read {
+						continue
+					}
+					x := uint32(0)
+					if v == nil {
+						ts = time.Unix(0, 0)
+					} else {
+						x = binary.LittleEndian.Uint32(v)
+					}
+					value := make([]byte, 4)
+					binary.LittleEndian.PutUint32(value, x+1)
+					if written, _ := c.SetIfTimestamp(key, value, ts); written {
+						break
+					}
+					time.Sleep(time.Microsecond * time.Duration(rand.Intn(2000)))
+				}
+			}
+		}()
+	}
+	w.Wait()
+	time.Sleep(time.Second)
+	v, _, _ = c.Get(key)
+	if len(v) != 4 || int(binary.LittleEndian.Uint32(v)) != ops*clients {
+		t.Fatal("Optimistic concurrency failed:", v, ops*clients)
+	}
+}
+
+func TestMultiLock(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	for i := 1; i < len(cluster); i++ {
+		cluster[i].assoc(addr, ultraverbose, false)
+		defer cluster[i].kill()
+	}
+	time.Sleep(time.Second * 8)
+
+	key := []byte("lock")
+	ops := 10
+	clients := 8
+	var inside int32
+	var lastToken uint64
+	var w sync.WaitGroup
+	w.Add(clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			defer w.Done()
+			c, err := client.Connect(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.SetNoDelay()
+			defer c.Close()
+			l := lock.New(c)
+			for i := 0; i < ops; i++ {
+				lease, err := l.Lock(key, time.Second*2)
+				if err != nil {
+					t.Error("Lock failed:", err)
+					return
+				}
+				if atomic.AddInt32(&inside, 1) != 1 {
+					t.Error("Mutual exclusion violated")
+				}
+				//Fencing tokens should be increasing
+				if lease.Token() <= atomic.LoadUint64(&lastToken) {
+					t.Error("Fencing token not increasing:", lease.Token(), lastToken)
+				}
+				atomic.StoreUint64(&lastToken, lease.Token())
+				//The token is the timestamp of the write that acquired the lease
+				if _, lt, _ := c.Get(key); uint64(lt.UnixNano()) != lease.Token() {
+					t.Error("Fencing token isn't the lock timestamp:", lease.Token(), lt.UnixNano())
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&inside, -1)
+				if err := lease.Unlock(); err != nil {
+					t.Error("Unlock failed:", err)
+				}
+			}
+		}()
+	}
+	w.Wait()
+}
+
+func TestMultiLockExpiry(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	for i := 1; i < len(cluster); i++ {
+		cluster[i].assoc(addr, ultraverbose, false)
+		defer cluster[i].kill()
+	}
+	time.Sleep(time.Second * 8)
+	c1, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	l1 := lock.New(c1)
+	l2 := lock.New(c2)
+	key := []byte("lock")
+	ttl := time.Second
+
+	//Renewed leases shouldn't expire
+	lease, err := l1.Lock(key, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * ttl)
+	if _, err := l2.TryLock(key, ttl); err != lock.ErrLocked {
+		t.Fatal("Renewed lease expired", err)
+	}
+	if err := lease.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lease2, err := l2.TryLock(key, ttl)
+	if err != nil {
+		t.Fatal("Released lock not acquired", err)
+	}
+	if lease2.Token() <= lease.Token() {
+		t.Fatal("Fencing token not increasing")
+	}
+	lease2.Unlock()
+
+	//Paused holder: the lease isn't renewed, it should expire after the TTL
+	paused := lock.New(c1)
+	paused.AutoRenew = false
+	lease, err = paused.Lock(key, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l2.TryLock(key, ttl); err != lock.ErrLocked {
+		t.Fatal("Lock acquired twice", err)
+	}
+	//Lock gives up after the timeout
+	impatient := lock.New(c2)
+	impatient.Timeout = ttl / 4
+	if _, err := impatient.Lock(key, ttl); err != lock.ErrTimeout {
+		t.Fatal("Lock didn't time out", err)
+	}
+	t1 := time.Now()
+	lease2, err = l2.Lock(key, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Sub(t1) > 2*ttl {
+		t.Fatal("Expired lease not acquired in time:", time.Now().Sub(t1))
+	}
+	if lease2.Token() <= lease.Token() {
+		t.Fatal("Fencing token not increasing")
+	}
+	//The old holder should notice the lost lease
+	if err := lease.Refresh(); err != lock.ErrNotHeld {
+		t.Fatal("Expired lease refreshed", err)
+	}
+	select {
+	case <-lease.Lost():
+	default:
+		t.Fatal("Lost channel not closed")
+	}
+	if err := lease.Unlock(); err != lock.ErrNotHeld {
+		t.Fatal("Expired lease unlocked", err)
+	}
+	if err := lease2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Holder crash: a holder process with automatic renewals is killed
+	holder := exec.Command(os.Args[0], "-test.run=^$")
+	holder.Env = append(os.Environ(), "TREELESS_LOCK_HOLDER="+addr)
+	out, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var token uint64
+	if _, err := fmt.Fscan(out, &token); err != nil {
+		holder.Process.Kill()
+		t.Fatal("Lock holder process failed", err)
+	}
+	//The lease is renewed while the holder is alive
+	time.Sleep(3 * ttl)
+	if _, err := l2.TryLock(key, ttl); err != lock.ErrLocked {
+		holder.Process.Kill()
+		t.Fatal("Lease of a live holder expired", err)
+	}
+	holder.Process.Kill()
+	holder.Wait()
+	t1 = time.Now()
+	lease2, err = l2.Lock(key, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Sub(t1) > 2*ttl {
+		t.Fatal("Lease of a crashed holder not acquired in time:", time.Now().Sub(t1))
+	}
+	if lease2.Token() <= token {
+		t.Fatal("Fencing token not increasing")
+	}
+	lease2.Unlock()
+}
+
+//lockHolder acquires the lock used by TestMultiLockExpiry and holds it until the process is killed
+func lockHolder(addr string) {
+	c, err := client.Connect(addr)
+	if err != nil {
+		os.Exit(1)
+	}
+	lease, err := lock.New(c).Lock([]byte("lock"), time.Second)
+	if err != nil {
+		os.Exit(1)
+	}
+	fmt.Println(lease.Token())
+	select {}
+}
+
 func TestMultiReadRepair(t *testing.T) {
 	if !cluster[0].testCapability(capDisconnect) {
 		t.Skip("Cluster doesn't support disconnections")
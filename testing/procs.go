@@ -19,6 +19,9 @@ var ramonly = false
 
 var localIP = "127.0.0.1"
 
+//serverArgs are additional arguments of every server process
+var serverArgs []string
+
 func procStartCluster(numServers int) []testServer {
 	dbTestFolder := ""
 	if exists("/mnt/dbs/") && !ramonly {
@@ -79,9 +82,11 @@ func (ps *procServer) create(numChunks, redundancy int, verbose bool, open bool)
 	} else {
 		ps.kill()
 	}
-	ps.cmd = exec.Command("./treeless", "-create", "-port",
-		fmt.Sprint(10000+ps.id), "-dbpath", ps.dbpath, "-localip", localIP,
-		"-redundancy", fmt.Sprint(redundancy), "-procs", "1", "-chunks", fmt.Sprint(numChunks), openstr)
+	args := []string{"-create", "-port",
+		fmt.Sprint(10000 + ps.id), "-dbpath", ps.dbpath, "-localip", localIP,
+		"-redundancy", fmt.Sprint(redundancy), "-procs", "1", "-chunks", fmt.Sprint(numChunks)}
+	args = append(args, serverArgs...)
+	ps.cmd = exec.Command("./treeless", append(args, openstr)...)
 	if verbose {
 		ps.cmd.Stdout = os.Stdout
 		ps.cmd.Stderr = os.Stderr
@@ -105,8 +110,10 @@ func (ps *procServer) assoc(addr string, verbose bool, open bool) string {
 	} else {
 		os.RemoveAll(ps.dbpath)
 	}
-	ps.cmd = exec.Command("./treeless", "-assoc", addr, "-port",
-		fmt.Sprint(10000+ps.id), "-dbpath", ps.dbpath, "-localip", localIP, openstr)
+	args := []string{"-assoc", addr, "-port",
+		fmt.Sprint(10000 + ps.id), "-dbpath", ps.dbpath, "-localip", localIP}
+	args = append(args, serverArgs...)
+	ps.cmd = exec.Command("./treeless", append(args, openstr)...)
 	if verbose {
 		ps.cmd.Stdout = os.Stdout
 		ps.cmd.Stderr = os.Stderr
@@ -1,20 +1,38 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 	"github.com/dv343/treeless/client"
+	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/buffconn"
+	"github.com/dv343/treeless/com/protocol"
+	"github.com/dv343/treeless/dist/heartbeat"
+	"github.com/dv343/treeless/dist/servergroup"
+	"github.com/dv343/treeless/hashing"
 	"github.com/dv343/treeless/tlfmt"
 )
 
@@ -25,6 +43,10 @@ var cluster []testServer
 var ultraverbose = false
 
 func TestMain(m *testing.M) {
+	if addr := os.Getenv("TREELESS_LOCK_HOLDER"); addr != "" {
+		//Lock holder process of TestMultiLockExpiry
+		lockHolder(addr)
+	}
 	//debug.SetTraceback("all")
 	cmd := exec.Command("killall", "treeless")
 	cmd.Run()
@@ -590,6 +612,2226 @@ func TestSingleClock(t *testing.T) {
 	fmt.Println("Max time difference: ", maxDiff, "\nAverage time difference:", avgDiff)
 }
 
+//TestSingleClockSkew tests that writes with timestamps far ahead of the server clock are rejected
+func TestSingleClockSkew(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	waitForServer(addr)
+	conn, err := com.CreateConnection(addr, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	value := make([]byte, 8+5)
+	copy(value[8:], "mundo")
+	binary.LittleEndian.PutUint64(value, uint64(time.Now().Add(time.Hour).UnixNano()))
+	op := conn.Set([]byte("hola"), value, time.Second)
+	if op.Wait() == nil {
+		t.Fatal("Write with a skewed timestamp accepted")
+	}
+	//Async writes are dropped too
+	conn.Set([]byte("adios"), value, 0)
+	get := conn.Get([]byte("adios"), time.Second)
+	if r := get.Wait(); r.Err != nil || len(r.Value) != 0 {
+		t.Fatal("Async write with a skewed timestamp accepted:", r.Value, r.Err)
+	}
+
+	//A skewed client can't win against later writes
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetNoDelay()
+	_, err = c.Set([]byte("hola"), []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _, _ := c.Get([]byte("hola"))
+	if string(v) != "world" {
+		t.Fatal("Get failed, returned string: ", string(v))
+	}
+}
+
+//Test that a restarted acceptor doesn't break the Paxos promises it forgot
+func TestSinglePaxosRestart(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	defer cluster[0].kill()
+	waitForServer(addr)
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetNoDelay()
+	written, errs := c.CAS([]byte("hola"), []byte("mundo"), time.Unix(0, 0), nil)
+	if !written {
+		t.Fatal("CAS failed", errs)
+	}
+	c.Close()
+
+	conn, err := com.CreateConnection(addr, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare := func(ballotTime time.Time) error {
+		ballot := protocol.Ballot{Time: uint64(ballotTime.UnixNano()), Proposer: 1}
+		op := conn.Paxos(protocol.OpPaxosPrepare, []byte("hola"), ballot.Marshal(), time.Second)
+		return op.Wait().Err
+	}
+	//Ballots too far ahead of the server clock are rejected
+	if prepare(time.Now().Add(time.Hour)) == nil {
+		t.Fatal("Skewed ballot accepted")
+	}
+	//Promise a ballot ahead of the clock, the acceptor forgets it after the restart
+	promised := time.Now().Add(time.Millisecond * 900)
+	if err := prepare(promised); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	cluster[0].close()
+	addr = cluster[0].create(testingNumChunks, 1, ultraverbose, true)
+	conn, err = com.CreateConnection(addr, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if prepare(promised.Add(-time.Millisecond)) == nil {
+		t.Fatal("Restarted acceptor accepted a ballot lower than a forgotten promise")
+	}
+
+	//CAS works again after the ballot lease of the previous execution
+	c, err = client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetNoDelay()
+	time.Sleep(promised.Add(time.Second * 2).Sub(time.Now()))
+	v, ts, _ := c.Get([]byte("hola"))
+	if string(v) != "mundo" {
+		t.Fatal("Get failed, returned string: ", string(v))
+	}
+	written, errs = c.CAS([]byte("hola"), []byte("world"), ts, v)
+	if !written {
+		t.Fatal("CAS after restart failed", errs)
+	}
+}
+
+func TestSingleSiblings(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.CreateKeyspace(protocol.Keyspace{Name: "carts", NumChunks: 4, Redundancy: 1, Conflicts: protocol.ConflictSiblings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The default keyspace is last-writer-wins
+	if _, err := c.SetWithContext([]byte("hola"), []byte("mundo"), nil); err == nil {
+		t.Fatal("Multi-value pair written on the default keyspace")
+	}
+	c1, err := c.Keyspace("carts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2c.Close()
+	c2, err := c2c.Keyspace("carts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Concurrent writes should be kept as siblings
+	_, err = c1.SetWithContext([]byte("hola"), []byte("mundo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c2.SetWithContext([]byte("hola"), []byte("world"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, context, _ := c1.GetSiblings([]byte("hola"))
+	if len(values) != 2 {
+		t.Fatal("Siblings not kept, returned values: ", len(values))
+	}
+	//Get should return the newest sibling
+	v, _, _ := c1.Get([]byte("hola"))
+	if string(v) != "world" {
+		t.Fatal("Get failed, returned string: ", string(v))
+	}
+
+	//A write with the causal context should resolve the conflict
+	_, err = c2.SetWithContext([]byte("hola"), []byte("mundo world"), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _, _ = c1.GetSiblings([]byte("hola"))
+	if len(values) != 1 || string(values[0]) != "mundo world" {
+		t.Fatal("Siblings not resolved, returned values: ", values)
+	}
+
+	//A plain Set replaces every sibling
+	c1.SetWithContext([]byte("adios"), []byte("mundo"), nil)
+	c2.SetWithContext([]byte("adios"), []byte("world"), nil)
+	if values, _, _ := c1.GetSiblings([]byte("adios")); len(values) != 2 {
+		t.Fatal("Siblings not kept, returned values: ", len(values))
+	}
+	if _, err := c1.Set([]byte("adios"), []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	values, context, _ = c2.GetSiblings([]byte("adios"))
+	if len(values) != 1 || string(values[0]) != "bye" {
+		t.Fatal("Set didn't replace the siblings, returned values: ", values)
+	}
+	if v, _, _ := c2.Get([]byte("adios")); string(v) != "bye" {
+		t.Fatal("Get failed, returned string: ", string(v))
+	}
+	//Later writes with a context replace the plain value
+	c2.SetWithContext([]byte("adios"), []byte("ciao"), context)
+	if values, _, _ := c1.GetSiblings([]byte("adios")); len(values) != 1 || string(values[0]) != "ciao" {
+		t.Fatal("Plain value not replaced, returned values: ", values)
+	}
+}
+
+//hashTagged creates a keyspace with hash tags enabled and returns a client of it
+func hashTagged(t *testing.T, c *client.DBClient, name string) *client.DBClient {
+	err := c.CreateKeyspace(protocol.Keyspace{Name: name, NumChunks: testingNumChunks, Redundancy: 1, HashTags: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := c.Keyspace(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSingleBatch(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = hashTagged(t, c, "users")
+	name := hashing.ColocatedKey([]byte("user1"), []byte("name"))
+	email := hashing.ColocatedKey([]byte("user1"), []byte("email"))
+	old := hashing.ColocatedKey([]byte("user1"), []byte("old"))
+	c.Set(old, []byte("old value"))
+
+	var b client.Batch
+	b.Set(name, []byte("John"))
+	b.Set(email, []byte("john@example.com"))
+	b.Del(old)
+	b.Set(name, []byte("Jane"))
+	if written, err := c.WriteBatch(&b); !written {
+		t.Fatal("Batch failed", err)
+	}
+	check := func() {
+		if v, _, _ := c.Get(name); string(v) != "Jane" {
+			t.Fatal("Get mismatch:", string(v))
+		}
+		if v, _, _ := c.Get(email); string(v) != "john@example.com" {
+			t.Fatal("Get mismatch:", string(v))
+		}
+		if v, _, _ := c.Get(old); v != nil {
+			t.Fatal("Deleted pair present:", string(v))
+		}
+	}
+	check()
+
+	//Keys of different chunks can't be used in the same batch
+	b = client.Batch{}
+	for i := 0; i < 2*testingNumChunks; i++ {
+		b.Set([]byte(fmt.Sprint("key", i)), []byte("value"))
+	}
+	if written, _ := c.WriteBatch(&b); written {
+		t.Fatal("Batch with keys of different chunks written")
+	}
+
+	//Batches should be restored after a restart
+	c.Close()
+	cluster[0].close()
+	addr = cluster[0].create(testingNumChunks, 2, ultraverbose, true)
+	c, err = client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c, err = c.Keyspace("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	//The default keyspace ignores hash tags, keys with braces keep their chunk
+	b = client.Batch{}
+	for i := 0; i < 2*testingNumChunks; i++ {
+		b.Set(hashing.ColocatedKey([]byte("user1"), []byte(fmt.Sprint("key", i))), []byte("value"))
+	}
+	c, err = client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if written, _ := c.WriteBatch(&b); written {
+		t.Fatal("Hash tags used by the default keyspace")
+	}
+}
+
+func TestSingleScan(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c = hashTagged(t, c, "scans")
+
+	//Scanned keys share the same chunk, the chunk will be defragmented during the scan
+	n := 1000
+	for i := 0; i < n; i++ {
+		c.Set(hashing.ColocatedKey([]byte("scan"), []byte(fmt.Sprint(i))), []byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < 100; i++ {
+		c.Set([]byte(fmt.Sprint("other", i)), []byte("other"))
+	}
+
+	all := make(map[string]bool)
+	err = c.Scan(nil, func(key, value []byte, lastTime time.Time) bool {
+		all[string(key)] = true
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != n+100 {
+		t.Fatal("Scan mismatch:", len(all), "keys returned")
+	}
+
+	prefix := hashing.ColocatedKey([]byte("scan"), nil)
+	seen := make(map[string]int)
+	calls := 0
+	err = c.Scan(prefix, func(key, value []byte, lastTime time.Time) bool {
+		calls++
+		if calls == 300 {
+			big := hashing.ColocatedKey([]byte("scan"), []byte("big"))
+			c.Set(big, make([]byte, 1024*1024*16))
+			c.Del(big)
+			time.Sleep(time.Second)
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			t.Fatal("Prefix mismatch:", string(key))
+		}
+		if string(key[len(prefix):]) != string(value) {
+			t.Fatal("Value mismatch:", string(key), string(value))
+		}
+		seen[string(key)]++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != n {
+		t.Fatal("Scan after defrag mismatch:", len(seen), "keys returned")
+	}
+	//The cursor is remapped after the defrag, only some pairs should be returned again
+	if calls-n >= 64 {
+		t.Fatal("Too many pairs returned again:", calls-n)
+	}
+
+	calls = 0
+	c.Scan(nil, func(key, value []byte, lastTime time.Time) bool {
+		calls++
+		return calls < 10
+	})
+	if calls != 10 {
+		t.Fatal("Scan didn't stop:", calls)
+	}
+
+	//Pages stop at the limit and resume at the returned position
+	paged := make(map[string]bool)
+	var position client.ScanPosition
+	for done := false; !done; {
+		calls = 0
+		position, done, err = c.ScanPage(position, nil, 7, func(key, value []byte, lastTime time.Time) {
+			calls++
+			paged[string(key)] = true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls > 7 || !done && calls != 7 {
+			t.Fatal("Scan page size mismatch:", calls)
+		}
+	}
+	if len(paged) != n+100 {
+		t.Fatal("Paginated scan mismatch:", len(paged), "keys returned")
+	}
+}
+
+func TestSingleRange(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The ordered index is a keyspace setting
+	err = c.CreateKeyspace(protocol.Keyspace{Name: "events", NumChunks: testingNumChunks, Redundancy: 1, Ordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = c.Keyspace("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 200
+	for i := 0; i < n; i++ {
+		c.Set([]byte(fmt.Sprintf("user42:event:%04d", i)), []byte(fmt.Sprint(i)))
+		c.Set([]byte(fmt.Sprintf("user43:event:%04d", i)), []byte("other"))
+	}
+	for i := 0; i < n; i += 10 {
+		c.Del([]byte(fmt.Sprintf("user42:event:%04d", i)))
+	}
+
+	check := func() {
+		keys, values, err := c.Range([]byte("user42:event:0050"), []byte("user42:event:0100"), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 45 {
+			t.Fatal("Range mismatch:", len(keys), "pairs returned")
+		}
+		for i := range keys {
+			if i > 0 && bytes.Compare(keys[i-1], keys[i]) >= 0 {
+				t.Fatal("Range not ordered:", string(keys[i-1]), string(keys[i]))
+			}
+			var id int
+			fmt.Sscanf(string(keys[i]), "user42:event:%04d", &id)
+			if id%10 == 0 || string(values[i]) != fmt.Sprint(id) {
+				t.Fatal("Range pair mismatch:", string(keys[i]), string(values[i]))
+			}
+		}
+		//Page through every pair of user42
+		start := []byte("user42:")
+		total := 0
+		for {
+			keys, _, err := c.Range(start, []byte("user42;"), 17)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += len(keys)
+			if len(keys) < 17 {
+				break
+			}
+			start = append(keys[len(keys)-1], 0)
+		}
+		if total != n-n/10 {
+			t.Fatal("Paged range mismatch:", total, "pairs returned")
+		}
+	}
+	check()
+
+	//The ordered index should be rebuilt after a restart
+	c.Close()
+	cluster[0].close()
+	addr = cluster[0].create(testingNumChunks, 2, ultraverbose, true)
+	c, err = client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c, err = c.Keyspace("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestSingleKeyspaces(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.CreateKeyspace(protocol.Keyspace{Name: "events", NumChunks: 8, Redundancy: 1, Ordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.CreateKeyspace(protocol.Keyspace{Name: "sessions", NumChunks: 4, Redundancy: 1, TTL: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CreateKeyspace(protocol.Keyspace{Name: "events", NumChunks: 8, Redundancy: 1}) == nil {
+		t.Fatal("Duplicated keyspace created")
+	}
+	if c.CreateKeyspace(protocol.Keyspace{Name: "bad name", NumChunks: 8, Redundancy: 1}) == nil {
+		t.Fatal("Invalid keyspace created")
+	}
+	if _, err := c.Keyspace("unknown"); err == nil {
+		t.Fatal("Unknown keyspace handle returned")
+	}
+	events, err := c.Keyspace("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := c.Keyspace("sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Keyspaces are isolated
+	c.Set([]byte("k"), []byte("default"))
+	events.Set([]byte("k"), []byte("events"))
+	for i := 0; i < 50; i++ {
+		events.Set([]byte(fmt.Sprintf("event:%04d", i)), []byte(fmt.Sprint(i)))
+	}
+	check := func() {
+		if v, _, _ := c.Get([]byte("k")); string(v) != "default" {
+			t.Fatal("Default keyspace mismatch:", string(v))
+		}
+		if v, _, _ := events.Get([]byte("k")); string(v) != "events" {
+			t.Fatal("Keyspace mismatch:", string(v))
+		}
+		if v, _, _ := sessions.Get([]byte("k")); v != nil {
+			t.Fatal("Keyspace not isolated:", string(v))
+		}
+		keys, values, err := events.Range([]byte("event:0010"), []byte("event:0020"), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 10 || string(keys[0]) != "event:0010" || string(values[9]) != "19" {
+			t.Fatal("Keyspace range mismatch:", len(keys))
+		}
+		n := 0
+		err = events.Scan([]byte("event:"), func(key, value []byte, lastTime time.Time) bool {
+			n++
+			return true
+		})
+		if err != nil || n != 50 {
+			t.Fatal("Keyspace scan mismatch:", n, err)
+		}
+		c.Scan(nil, func(key, value []byte, lastTime time.Time) bool {
+			if string(key) != "k" {
+				t.Fatal("Default keyspace scan returned a key of another keyspace:", key)
+			}
+			return true
+		})
+	}
+	check()
+	//Keys of the default keyspace can't look like keys of named keyspaces
+	if _, err := c.Set(hashing.KeyspaceKey("events", []byte("k")), []byte("default")); err == nil {
+		t.Fatal("Default keyspace key with the keyspace prefix written")
+	}
+	if v, _, _ := events.Get([]byte("k")); string(v) != "events" {
+		t.Fatal("Keyspace pair overwritten through the default keyspace:", string(v))
+	}
+	if _, _, err := c.Range(nil, nil, 10); err == nil {
+		t.Fatal("Range on a keyspace without ordered index")
+	}
+	if _, err := events.SetWithContext([]byte("k"), []byte("v"), nil); err == nil {
+		t.Fatal("SetWithContext on a last-writer-wins keyspace")
+	}
+
+	//TTL
+	sessions.Set([]byte("session"), []byte("data"))
+	if v, _, _ := sessions.Get([]byte("session")); string(v) != "data" {
+		t.Fatal("TTL keyspace mismatch:", string(v))
+	}
+	time.Sleep(time.Millisecond * 1500)
+	if v, _, _ := sessions.Get([]byte("session")); v != nil {
+		t.Fatal("Expired pair returned:", string(v))
+	}
+
+	//Keyspaces should be restored after a restart
+	c.Close()
+	cluster[0].close()
+	addr = cluster[0].create(testingNumChunks, 2, ultraverbose, true)
+	c, err = client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	events, err = c.Keyspace("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err = c.Keyspace("sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestSingleLargeKeyspace(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//Heartbeat responses list every chunk of the server, server groups can't have more than MaxHeartbeatChunks chunks
+	if c.CreateKeyspace(protocol.Keyspace{Name: "huge", NumChunks: protocol.MaxHeartbeatChunks + 1, Redundancy: 1}) == nil {
+		t.Fatal("Keyspace with too many chunks created")
+	}
+	large := protocol.MaxHeartbeatChunks - testingNumChunks
+	if err := c.CreateKeyspace(protocol.Keyspace{Name: "large", NumChunks: large, Redundancy: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if c.CreateKeyspace(protocol.Keyspace{Name: "overflow", NumChunks: 1, Redundancy: 1}) == nil {
+		t.Fatal("Keyspace over the chunk limit of the server group created")
+	}
+	//The server holds every chunk and it still answers heartbeats
+	time.Sleep(time.Millisecond * 500)
+	aa, err := com.UDPRequest(addr, protocol.HeartbeatRequest{}, time.Millisecond*300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aa.KnownChunks) != protocol.MaxHeartbeatChunks {
+		t.Fatal("Heartbeat chunks mismatch:", len(aa.KnownChunks))
+	}
+	ks, err := c.Keyspace("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := ks.Get([]byte("k")); string(v) != "v" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+	if _, err := (&protocol.AmAlive{KnownChunks: make([]protocol.AmAliveChunk, protocol.MaxHeartbeatChunks+1)}).Marshal(); err == nil {
+		t.Fatal("Heartbeat response with too many chunks serialized")
+	}
+}
+
+//nextChanges reads n changes of a feed, it fails if they aren't received in time
+func nextChanges(t *testing.T, f *client.Feed, n int, timeout time.Duration) []client.Change {
+	timer := time.AfterFunc(timeout, f.Close)
+	defer timer.Stop()
+	var changes []client.Change
+	for len(changes) < n {
+		ch, err := f.Next()
+		if err != nil {
+			t.Fatal("Feed error:", err, "changes received:", len(changes))
+		}
+		changes = append(changes, ch)
+	}
+	return changes
+}
+
+func TestSingleFeed(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.Subscribe(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 100
+	for i := 0; i < n; i++ {
+		c.Set([]byte(fmt.Sprint("feed", i)), []byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < n; i += 10 {
+		c.Del([]byte(fmt.Sprint("feed", i)))
+	}
+	//Changes of a key are ordered
+	set := make(map[string]bool)
+	for _, ch := range nextChanges(t, f, n+n/10, time.Second*10) {
+		key := string(ch.Key)
+		if ch.Deleted {
+			if !set[key] {
+				t.Fatal("Deletion reported before the set:", key)
+			}
+			delete(set, key)
+			continue
+		}
+		var i int
+		fmt.Sscan(key[len("feed"):], &i)
+		if string(ch.Value) != fmt.Sprint(i) || ch.Time.IsZero() {
+			t.Fatal("Change mismatch:", key, string(ch.Value), ch.Time)
+		}
+		set[key] = true
+	}
+	if len(set) != n-n/10 {
+		t.Fatal("Feed mismatch:", len(set), "pairs")
+	}
+	position := f.Position()
+	f.Close()
+
+	//A Feed resumed from a position only reports the following changes
+	c.Set([]byte("feed-resumed"), []byte("new"))
+	f, err = c.Subscribe(position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ch := nextChanges(t, f, 1, time.Second*5)[0]
+	if string(ch.Key) != "feed-resumed" || string(ch.Value) != "new" {
+		t.Fatal("Resumed feed mismatch:", string(ch.Key), string(ch.Value))
+	}
+
+	//Positions that can't be resumed are reported
+	expired := f.Position()
+	expired[client.FeedSource{ChunkID: 0, Server: addr}] = protocol.ScanCursor{Revision: 1000, Offset: 8}
+	ef, err := c.Subscribe(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer := time.AfterFunc(time.Second*5, ef.Close)
+	_, err = ef.Next()
+	timer.Stop()
+	if err == nil || !strings.Contains(err.Error(), protocol.ErrInvalidCursor) {
+		t.Fatal("Expired feed position resumed, error:", err)
+	}
+
+	//Feeds of a keyspace only report its changes
+	err = c.CreateKeyspace(protocol.Keyspace{Name: "feed", NumChunks: 4, Redundancy: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := c.Keyspace("feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kf, err := ks.Subscribe(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kf.Close()
+	ks.Set([]byte("k"), []byte("v"))
+	ch = nextChanges(t, kf, 1, time.Second*5)[0]
+	if string(ch.Key) != "k" || string(ch.Value) != "v" {
+		t.Fatal("Keyspace feed mismatch:", string(ch.Key), string(ch.Value))
+	}
+}
+
+func nextEvents(t *testing.T, w *client.Watch, n int, timeout time.Duration) []client.Change {
+	var changes []client.Change
+	deadline := time.After(timeout)
+	for len(changes) < n {
+		select {
+		case ch, ok := <-w.Events():
+			if !ok {
+				t.Fatal("Watch closed, changes received:", len(changes))
+			}
+			changes = append(changes, ch)
+		case <-deadline:
+			t.Fatal("Watch timeout, changes received:", len(changes))
+		}
+	}
+	return changes
+}
+
+func TestSingleWatch(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	w, err := c.Watch([]byte("watched"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set([]byte("other"), []byte("x"))
+	//Discarded writes (deletions of missing pairs) aren't reported
+	c.Del([]byte("watched"))
+	c.Set([]byte("watched"), []byte("v1"))
+	c.Del([]byte("watched"))
+	changes := nextEvents(t, w, 2, time.Second*5)
+	if string(changes[0].Key) != "watched" || string(changes[0].Value) != "v1" || changes[0].Time.IsZero() {
+		t.Fatal("Watch set mismatch:", string(changes[0].Key), string(changes[0].Value))
+	}
+	if string(changes[1].Key) != "watched" || !changes[1].Deleted {
+		t.Fatal("Watch deletion mismatch:", string(changes[1].Key), changes[1].Deleted)
+	}
+	w.Close()
+	for range w.Events() {
+	}
+
+	//Prefix watches of a keyspace only report its changes
+	err = c.CreateKeyspace(protocol.Keyspace{Name: "watch", NumChunks: 4, Redundancy: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := c.Keyspace("watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := c.WatchPrefix([]byte("p/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+	kw, err := ks.WatchPrefix(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kw.Close()
+	ks.Set([]byte("p/ks"), []byte("ks"))
+	c.Set([]byte("q/1"), []byte("x"))
+	c.Set([]byte("p/1"), []byte("1"))
+	c.Incr([]byte("p/2"), 5)
+	changes = nextEvents(t, pw, 2, time.Second*5)
+	for _, ch := range changes {
+		if string(ch.Key) != "p/1" && string(ch.Key) != "p/2" {
+			t.Fatal("Prefix watch mismatch:", string(ch.Key))
+		}
+	}
+	ch := nextEvents(t, kw, 1, time.Second*5)[0]
+	if string(ch.Key) != "p/ks" || string(ch.Value) != "ks" {
+		t.Fatal("Keyspace watch mismatch:", string(ch.Key), string(ch.Value))
+	}
+	select {
+	case ch := <-kw.Events():
+		t.Fatal("Unexpected keyspace change:", string(ch.Key))
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	//Watches that drop notifications are closed
+	fw, err := c.WatchPrefix([]byte("flood/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				c.Set([]byte(fmt.Sprint("flood/", g, "/", i)), []byte("x"))
+			}
+		}(g)
+	}
+	wg.Wait()
+	deadline := time.Now().Add(time.Second * 10)
+	for fw.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if fw.Err() != client.ErrWatchOverflow {
+		t.Fatal("Flooded watch not closed, error:", fw.Err())
+	}
+	for range fw.Events() {
+	}
+}
+
+//enableTestTLS starts the following servers with mutual TLS, it returns a function that disables it
+func enableTestTLS(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "treeless-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key, ca, err := writeTestCerts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := com.LoadTLS(cert, key, ca, true); err != nil {
+		t.Fatal(err)
+	}
+	serverArgs = []string{"-tlscert", cert, "-tlskey", key, "-tlsca", ca, "-tlsmutual"}
+	return func() {
+		serverArgs = nil
+		com.SetTLS(nil, nil)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSingleTLS(t *testing.T) {
+	disable := enableTestTLS(t)
+	defer disable()
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Set([]byte("tls"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := c.Get([]byte("tls")); string(v) != "secret" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+
+	//Plain TCP clients and clients without certificate are rejected
+	com.SetTLS(nil, nil)
+	if c2, err := client.Connect(addr); err == nil {
+		c2.Close()
+		t.Fatal("Plain TCP client accepted")
+	}
+	com.SetTLS(nil, &tls.Config{InsecureSkipVerify: true})
+	if c2, err := client.Connect(addr); err == nil {
+		c2.Close()
+		t.Fatal("Client without certificate accepted")
+	}
+}
+
+//enableTestAuth starts the following servers with authentication, it returns a function that disables it
+//Connections of the test use clientToken
+func enableTestAuth(t *testing.T, clusterSecret, clientToken string) func() {
+	f, err := ioutil.TempFile("", "treeless-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, "# Test tokens")
+	fmt.Fprintln(f, "client", clientToken)
+	f.Close()
+	serverArgs = []string{"-clustersecret", clusterSecret, "-tokens", f.Name()}
+	com.SetToken(clientToken)
+	return func() {
+		serverArgs = nil
+		com.SetToken("")
+		os.Remove(f.Name())
+	}
+}
+
+func TestSingleAuth(t *testing.T) {
+	disable := enableTestAuth(t, "cluster-secret", "client-token")
+	defer disable()
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Set([]byte("auth"), []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := c.Get([]byte("auth")); string(v) != "ok" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+	//Client tokens can't use administration operations
+	if err := c.CreateKeyspace(protocol.Keyspace{Name: "auth", NumChunks: 4, Redundancy: 1}); err == nil {
+		t.Fatal("Keyspace created with a client token")
+	}
+
+	//Connections without a valid token are rejected
+	for _, token := range []string{"", "wrong-token"} {
+		com.SetToken(token)
+		if c2, err := client.Connect(addr); err == nil {
+			c2.Close()
+			t.Fatal("Connection accepted with token", token)
+		}
+	}
+
+	//The cluster secret grants every operation
+	com.SetToken("cluster-secret")
+	admin, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if err := admin.CreateKeyspace(protocol.Keyspace{Name: "auth", NumChunks: 4, Redundancy: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Transfers to servers that reject the connection fail without stopping the server
+	conn, err := com.CreateConnection(addr, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Transfer(localIP+":1", 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	if v, _, read := admin.Get([]byte("auth")); !read || string(v) != "ok" {
+		t.Fatal("Server stopped after a failed transfer:", string(v))
+	}
+}
+
+//enableTestHeartbeatKey starts the following servers with signed heartbeats, it returns a function that disables them
+//The node key is only known by the servers
+func enableTestHeartbeatKey(key string) func() {
+	serverArgs = []string{"-heartbeatkey", key, "-heartbeatnodekey", key + "-node"}
+	com.SetHeartbeatKey(key)
+	return func() {
+		serverArgs = nil
+		com.SetHeartbeatKey("")
+	}
+}
+
+//udpExchange sends a raw heartbeat packet and returns true if a response is received
+func udpExchange(t *testing.T, addr string, packet []byte) bool {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Millisecond * 300))
+	conn.Write(packet)
+	_, err = conn.Read(make([]byte, 2*protocol.MaxHeartbeatSize))
+	return err == nil
+}
+
+//TestSingleHeartbeatConfig tests servers and clients with custom failure detector parameters
+func TestSingleHeartbeatConfig(t *testing.T) {
+	serverArgs = []string{"-phisuspect", "2", "-phidead", "12", "-phipause", "2s"}
+	defer func() {
+		serverArgs = nil
+	}()
+	addr := cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	defer cluster[0].kill()
+	waitForServer(addr)
+
+	config := heartbeat.DefaultConfig()
+	config.PhiDeadThreshold = 12
+	config.PhiAcceptablePause = time.Second * 2
+	c, err := client.ConnectWithConfig(addr, "", &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := c.Get([]byte("k")); string(v) != "v" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+}
+
+//TestSingleMembershipGossip tests that only group members can change the membership view and be pinged indirectly
+func TestSingleMembershipGossip(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	waitForServer(addr)
+
+	//Packets of other versions are dropped
+	packet := (&protocol.HeartbeatRequest{}).Marshal()
+	if !udpExchange(t, addr, packet) {
+		t.Fatal("Heartbeat not answered")
+	}
+	packet[0] = protocol.HeartbeatVersion + 1
+	if udpExchange(t, addr, packet) {
+		t.Fatal("Heartbeat of an unknown version answered")
+	}
+	response, err := (&protocol.AmAlive{}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response[0] = protocol.HeartbeatVersion + 1
+	if _, err := protocol.AmAliveUnMarshal(response); err == nil {
+		t.Fatal("Response of an unknown version accepted")
+	}
+
+	//Verdicts of clients and unknown servers are ignored, the server doesn't need to refute them
+	dead := []protocol.MemberUpdate{{Addr: addr, Status: protocol.MemberDead}}
+	for _, origin := range []string{"", "127.0.0.1:1"} {
+		aa, err := com.UDPRequest(addr, protocol.HeartbeatRequest{Origin: origin, Updates: dead}, time.Millisecond*300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aa.Incarnation != 0 {
+			t.Fatal("Verdict accepted from", origin)
+		}
+	}
+	//Verdicts of group members are applied
+	aa, err := com.UDPRequest(addr, protocol.HeartbeatRequest{Origin: addr, Updates: dead}, time.Millisecond*300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aa.Incarnation != 1 {
+		t.Fatal("Verdict of a group member not refuted, incarnation:", aa.Incarnation)
+	}
+
+	//Indirect pings to addresses outside the group aren't relayed
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	_, err = com.UDPRequest(addr, protocol.HeartbeatRequest{Target: target.LocalAddr().String(), Origin: addr}, time.Millisecond*300)
+	if err == nil {
+		t.Fatal("Indirect ping to a non-member answered")
+	}
+	target.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if n, _, err := target.ReadFrom(make([]byte, protocol.MaxHeartbeatSize)); err == nil {
+		t.Fatal("Indirect ping relayed to a non-member,", n, "bytes")
+	}
+}
+
+//serverAddrs returns the sorted server addresses of sg
+func serverAddrs(sg *servergroup.ServerGroup) []string {
+	var addrs []string
+	for _, s := range sg.Servers() {
+		addrs = append(addrs, s.Phy)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+//TestSingleConcurrentConfigurations tests that concurrent configuration changes converge and that the epoch is persisted
+func TestSingleConcurrentConfigurations(t *testing.T) {
+	a := servergroup.CreateServerGroup(testingNumChunks, 1, "127.0.0.1:1")
+	a.AddServerToGroup("127.0.0.1:1")
+	a.AddServerToGroup("127.0.0.1:2")
+	serialization, err := a.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := servergroup.UnmarhalServerGroup(serialization)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.LocalhostIPPort = "127.0.0.1:2"
+	//Both servers change the configuration at the same time, both changes get epoch 1
+	a.AddServerToGroup("127.0.0.1:3")
+	a.IncEpoch()
+	b.RemoveServer("127.0.0.1:1")
+	b.IncEpoch()
+	confA, _ := a.Marshal()
+	confB, _ := b.Marshal()
+	adoptedA, err := a.AdoptConfiguration(confB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adoptedB, err := b.AdoptConfiguration(confA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adoptedA == adoptedB {
+		t.Fatal("Exactly one configuration should be adopted, adopted by a:", adoptedA, "adopted by b:", adoptedB)
+	}
+	epochA, hashA := a.ConfigVersion()
+	epochB, hashB := b.ConfigVersion()
+	if epochA != 1 || epochA != epochB || hashA != hashB {
+		t.Fatal("Configurations didn't converge:", epochA, hashA, epochB, hashB)
+	}
+	if fmt.Sprint(serverAddrs(a)) != fmt.Sprint(serverAddrs(b)) {
+		t.Fatal("Server lists didn't converge:", serverAddrs(a), serverAddrs(b))
+	}
+	//The same configuration isn't adopted again
+	confA, _ = a.Marshal()
+	confB, _ = b.Marshal()
+	if adopted, _ := a.AdoptConfiguration(confB); adopted {
+		t.Fatal("Configuration adopted twice")
+	}
+	if adopted, _ := b.AdoptConfiguration(confA); adopted {
+		t.Fatal("Configuration adopted twice")
+	}
+
+	//Reopened servers keep their epoch
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	waitForServer(addr)
+	conn, err := com.CreateConnection(addr, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.AddServerToGroup("127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ForgetNode("127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	cluster[0].close()
+	addr = cluster[0].create(testingNumChunks, 2, ultraverbose, true)
+	defer cluster[0].kill()
+	waitForServer(addr)
+	aa, err := com.UDPRequest(addr, protocol.HeartbeatRequest{}, time.Millisecond*300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aa.Epoch != 2 {
+		t.Fatal("Epoch not restored:", aa.Epoch)
+	}
+}
+
+//TestSinglePhiDetector checks the suspicion levels of the phi-accrual failure detector for known arrival patterns
+func TestSinglePhiDetector(t *testing.T) {
+	const epsilon = 1e-6
+	minStdDev := time.Millisecond * 100
+	start := time.Unix(1000, 0)
+
+	d := heartbeat.NewPhiDetector(time.Second)
+	if phi := d.Phi(start, minStdDev, 0); phi != 0 {
+		t.Fatal("Phi before the first heartbeat:", phi)
+	}
+	//Regular arrivals, one second apart
+	last := start
+	for i := 0; i < 10; i++ {
+		last = start.Add(time.Duration(i) * time.Second)
+		d.Heartbeat(last)
+	}
+	//Half of the arrivals are expected to be later than the mean: phi = -log10(0.5)
+	if phi := d.Phi(last.Add(time.Second), minStdDev, 0); math.Abs(phi-math.Log10(2)) > 0.01 {
+		t.Fatal("Phi at the mean inter-arrival time:", phi)
+	}
+	//Phi grows with the time elapsed since the last heartbeat
+	prev := -1.0
+	for elapsed := time.Duration(0); elapsed <= 3*time.Second; elapsed += 100 * time.Millisecond {
+		phi := d.Phi(last.Add(elapsed), minStdDev, 0)
+		if phi < prev {
+			t.Fatal("Phi decreased, elapsed:", elapsed, "phi:", phi, "previous phi:", prev)
+		}
+		prev = phi
+	}
+	if phi := d.Phi(last.Add(100*time.Millisecond), minStdDev, 0); phi > 0.01 {
+		t.Fatal("Phi too high right after a heartbeat:", phi)
+	}
+	if phi := d.Phi(last.Add(3*time.Second), minStdDev, 0); phi < 8 {
+		t.Fatal("Phi too low after missing two heartbeats:", phi)
+	}
+	//The acceptable pause delays the suspicion
+	if phi := d.Phi(last.Add(2*time.Second), minStdDev, time.Second); math.Abs(phi-math.Log10(2)) > 0.01 {
+		t.Fatal("Phi with an acceptable pause:", phi)
+	}
+
+	//Irregular arrivals make the detector less sensitive
+	irregular := heartbeat.NewPhiDetector(time.Second)
+	last = start
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			last = last.Add(500 * time.Millisecond)
+		} else {
+			last = last.Add(1500 * time.Millisecond)
+		}
+		irregular.Heartbeat(last)
+	}
+	if a, b := irregular.Phi(last.Add(2*time.Second), minStdDev, 0), d.Phi(start.Add(11*time.Second), minStdDev, 0); a >= b {
+		t.Fatal("Irregular arrivals are not less suspicious, irregular:", a, "regular:", b)
+	}
+
+	//Old samples leave the window, the bootstrap estimate is forgotten
+	d = heartbeat.NewPhiDetector(time.Second)
+	last = start
+	for i := 0; i < 200; i++ {
+		last = last.Add(2 * time.Second)
+		d.Heartbeat(last)
+	}
+	if phi := d.Phi(last.Add(2*time.Second), minStdDev, 0); math.Abs(phi-math.Log10(2)) > epsilon {
+		t.Fatal("Phi after the window was refilled:", phi)
+	}
+}
+
+func TestSingleHeartbeatAuth(t *testing.T) {
+	disable := enableTestHeartbeatKey("heartbeat-key")
+	defer disable()
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := com.UDPRequest(addr, protocol.HeartbeatRequest{}, time.Millisecond*300); err != nil {
+		t.Fatal(err)
+	}
+
+	//Unsigned requests and requests signed with another key are dropped
+	for _, key := range []string{"", "wrong-key"} {
+		com.SetHeartbeatKey(key)
+		if _, err := com.UDPRequest(addr, protocol.HeartbeatRequest{}, time.Millisecond*300); err == nil {
+			t.Fatal("Heartbeat answered, key:", key)
+		}
+	}
+	com.SetHeartbeatKey("heartbeat-key")
+
+	//Replayed and old requests are dropped
+	request := (&protocol.HeartbeatRequest{}).Marshal()
+	packet := protocol.SignHeartbeatRequest([]byte("heartbeat-key"), request, 42, time.Now().UnixNano())
+	if !udpExchange(t, addr, packet) {
+		t.Fatal("Signed heartbeat not answered")
+	}
+	if udpExchange(t, addr, packet) {
+		t.Fatal("Replayed heartbeat answered")
+	}
+	old := protocol.SignHeartbeatRequest([]byte("heartbeat-key"), request, 43, time.Now().Add(-time.Minute).UnixNano())
+	if udpExchange(t, addr, old) {
+		t.Fatal("Old heartbeat answered")
+	}
+
+	//Clients can't forge the verdicts of group members, only requests signed with the node key are trusted
+	dead := []protocol.MemberUpdate{{Addr: addr, Status: protocol.MemberDead}}
+	aa, err := com.UDPRequest(addr, protocol.HeartbeatRequest{Origin: addr, Updates: dead}, time.Millisecond*300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aa.Incarnation != 0 {
+		t.Fatal("Verdict accepted from a client with a forged origin")
+	}
+	com.SetHeartbeatNodeKey("heartbeat-key-node")
+	defer com.SetHeartbeatNodeKey("")
+	aa, err = com.UDPRequest(addr, protocol.HeartbeatRequest{Origin: addr, Updates: dead}, time.Millisecond*300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aa.Incarnation != 1 {
+		t.Fatal("Verdict of a group member not refuted, incarnation:", aa.Incarnation)
+	}
+}
+
+func TestSingleHandshake(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	conn, err := com.CreateConnection(addr, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Version() != protocol.ProtocolVersion || !conn.Supports(protocol.SupportedFeatures&^protocol.FeatureCompression) {
+		t.Fatal("Handshake mismatch:", conn.Version())
+	}
+	//Compression is used only if both sides enable it
+	if conn.Supports(protocol.FeatureCompression) {
+		t.Fatal("Compression negotiated without enabling it")
+	}
+
+	//Connections without OpHello use protocol version 0
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bconn := buffconn.New(raw)
+	defer bconn.Close()
+	bconn.Write(protocol.Message{Type: protocol.OpSetNoDelay})
+	bconn.Write(protocol.Message{Type: protocol.OpGet, ID: 1, Key: []byte("handshake")})
+	if m, err := bconn.Read(); err != nil || m.Type != protocol.OpSetNoDelay {
+		t.Fatal("Version 0 connection failed:", err, m.Type)
+	}
+	if m, err := bconn.Read(); err != nil || m.Type != protocol.OpResponse || m.ID != 1 {
+		t.Fatal("Version 0 connection failed:", err, m.Type)
+	}
+	//Hellos of unsupported versions are rejected
+	old := protocol.Hello{Version: protocol.MinProtocolVersion - 1}
+	bconn.Write(protocol.Message{Type: protocol.OpHello, ID: 2, Value: old.Marshal()})
+	if m, err := bconn.Read(); err != nil || m.Type != protocol.OpErr {
+		t.Fatal("Old hello accepted:", err, m.Type)
+	}
+
+	//New clients don't use new features with version 0 servers
+	legacy := com.Start(localIP, 10100, func(m protocol.Message, peer *com.Peer) (response protocol.Message) {
+		response.ID = m.ID
+		response.Type = protocol.OpErr
+		response.Value = []byte("Operation not supported")
+		return response
+	}, func(protocol.HeartbeatRequest, bool) (protocol.AmAlive, bool) {
+		return protocol.AmAlive{}, false
+	})
+	defer legacy.Stop()
+	lconn, err := com.CreateConnection(localIP+":10100", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lconn.Close()
+	if lconn.Version() != 0 || lconn.Supports(protocol.FeatureBatch) || lconn.Supports(protocol.FeaturePaxos) || lconn.Supports(protocol.FeatureAtomic) {
+		t.Fatal("Version 0 server features:", lconn.Version())
+	}
+}
+
+//enableTestCompression starts the following servers with network and value compression,
+//it returns a function that disables it
+func enableTestCompression() func() {
+	serverArgs = []string{"-compress", "-compressvalues"}
+	com.SetCompression(true)
+	return func() {
+		serverArgs = nil
+		com.SetCompression(false)
+	}
+}
+
+//compressibleValue returns a JSON-like value of about size bytes
+func compressibleValue(i, size int) []byte {
+	var b bytes.Buffer
+	for j := 0; b.Len() < size; j++ {
+		fmt.Fprintf(&b, `{"id":%d,"item":%d,"name":"treeless","tags":["kv","db"]},`, i, j)
+	}
+	return b.Bytes()
+}
+
+func TestSingleCompression(t *testing.T) {
+	disable := enableTestCompression()
+	defer disable()
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	conn, err := com.CreateConnection(addr, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.Supports(protocol.FeatureCompression) {
+		t.Fatal("Compression not negotiated")
+	}
+
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	n := 16
+	size := 64 * 1024
+	for i := 0; i < n; i++ {
+		if _, err := c.Set([]byte(fmt.Sprint("json", i)), compressibleValue(i, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Small values aren't compressed
+	if _, err := c.Set([]byte("small"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if v, _, _ := c.Get([]byte(fmt.Sprint("json", i))); !bytes.Equal(v, compressibleValue(i, size)) {
+			t.Fatal("Get mismatch:", i, len(v))
+		}
+	}
+	if v, _, _ := c.Get([]byte("small")); string(v) != "value" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+	//Values are compressed at rest
+	used := uint64(0)
+	for i := 0; i < testingNumChunks; i++ {
+		u, err := conn.GetChunkInfo(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		used += u
+	}
+	if used > uint64(n*size/4) {
+		t.Fatal("Values weren't compressed, used bytes:", used)
+	}
+	//Scans return decompressed values
+	found := 0
+	err = c.Scan([]byte("json"), func(key, value []byte, lastTime time.Time) bool {
+		var i int
+		fmt.Sscan(string(key[len("json"):]), &i)
+		if !bytes.Equal(value, compressibleValue(i, size)) {
+			t.Error("Scan mismatch:", string(key))
+		}
+		found++
+		return true
+	})
+	if err != nil || found != n {
+		t.Fatal("Scan failed:", err, found)
+	}
+
+	//Clients without compression are still accepted
+	com.SetCompression(false)
+	c2, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if v, _, _ := c2.Get([]byte("json0")); !bytes.Equal(v, compressibleValue(0, size)) {
+		t.Fatal("Get mismatch:", len(v))
+	}
+}
+
+//rawExchange sends raw bytes to a server, it returns the response or an error if the connection was closed
+func rawExchange(t *testing.T, addr string, frame []byte) (protocol.Message, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bconn := buffconn.New(conn)
+	defer bconn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	bconn.Write(protocol.Message{Type: protocol.OpSetNoDelay})
+	if _, err := bconn.Read(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(frame)
+	return bconn.Read()
+}
+
+func TestSingleMalformedMessages(t *testing.T) {
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	frame := func(size, keySize uint32, op protocol.Operation, body []byte) []byte {
+		b := make([]byte, 13, 13+len(body))
+		binary.LittleEndian.PutUint32(b[0:], size)
+		binary.LittleEndian.PutUint32(b[4:], 1)
+		binary.LittleEndian.PutUint32(b[8:], keySize)
+		b[12] = byte(op)
+		return append(b, body...)
+	}
+	//Huge sizes aren't allocated, the connection is closed
+	if _, err := rawExchange(t, addr, frame(0xFFFFFFF0, 0, protocol.OpGet, nil)); err == nil {
+		t.Fatal("Huge message accepted")
+	}
+	if _, err := rawExchange(t, addr, frame(5, 0, protocol.OpGet, nil)); err == nil {
+		t.Fatal("Short message accepted")
+	}
+	//Keys out of the message bounds
+	if _, err := rawExchange(t, addr, frame(16, 100, protocol.OpGet, []byte("key"))); err == nil {
+		t.Fatal("Key out of bounds accepted")
+	}
+	//Invalid operation arguments are rejected without closing the connection
+	for _, op := range []protocol.Operation{protocol.OpGetChunkInfo, protocol.OpProtect, protocol.OpTransfer} {
+		if m, err := rawExchange(t, addr, frame(13, 0, op, nil)); err != nil || m.Type != protocol.OpErr {
+			t.Fatal("Invalid arguments accepted:", op, m.Type, err)
+		}
+	}
+
+	//Clients don't send messages exceeding the limits
+	if _, err := c.Set(make([]byte, protocol.MaxKeySize+1), []byte("value")); err == nil {
+		t.Fatal("Long key sent")
+	}
+	//The server is still alive
+	if _, err := c.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := c.Get([]byte("k")); string(v) != "v" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+}
+
+//TestSingleAppendLimit tests that Append can't grow a value beyond the maximum value size of the server
+func TestSingleAppendLimit(t *testing.T) {
+	serverArgs = []string{"-maxvaluesize", "1024"}
+	defer func() {
+		serverArgs = nil
+	}()
+	addr := cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	defer cluster[0].kill()
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	data := make([]byte, 600)
+	if _, err := c.Append([]byte("big"), data); err != nil {
+		t.Fatal(err)
+	}
+	if written, err := c.Append([]byte("big"), data); written || err == nil {
+		t.Fatal("Append exceeded the maximum value size")
+	}
+	if v, _, _ := c.Get([]byte("big")); len(v) != len(data) {
+		t.Fatal("Get length mismatch:", len(v))
+	}
+}
+
+//respConn is a minimal RESP client
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRESP(t *testing.T, addr string) *respConn {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return &respConn{conn, bufio.NewReader(conn)}
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatal("RESP listener unreachable:", addr)
+	return nil
+}
+
+//do sends a command and returns its reply: a string (simple strings), an error, an int64,
+//a []byte (bulk strings, nil if null) or an []interface{} (arrays)
+func (c *respConn) do(t *testing.T, args ...string) interface{} {
+	req := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		req += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+	return c.doRaw(t, req)
+}
+
+//doRaw sends a raw request and returns its reply
+func (c *respConn) doRaw(t *testing.T, req string) interface{} {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	return c.reply(t)
+}
+
+func (c *respConn) reply(t *testing.T) interface{} {
+	line, err := c.r.ReadString('\n')
+	if err != nil || len(line) < 3 {
+		t.Fatal("Invalid reply:", line, err)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body
+	case '-':
+		return errors.New(body)
+	case ':':
+		n, _ := strconv.ParseInt(body, 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(body)
+		if n < 0 {
+			return []byte(nil)
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			t.Fatal(err)
+		}
+		return b[:n]
+	case '*':
+		n, _ := strconv.Atoi(body)
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i] = c.reply(t)
+		}
+		return a
+	}
+	t.Fatal("Invalid reply:", line)
+	return nil
+}
+
+func TestSingleRESP(t *testing.T) {
+	serverArgs = []string{"-resp-port", "10300"}
+	defer func() {
+		serverArgs = nil
+	}()
+	//Redundancy 1, INCRBY uses CAS, it needs a majority of the target redundancy
+	cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	defer cluster[0].kill()
+	c := dialRESP(t, localIP+":10300")
+	defer c.conn.Close()
+
+	expect := func(r interface{}, expected interface{}) {
+		if fmt.Sprintf("%q", r) != fmt.Sprintf("%q", expected) {
+			t.Fatalf("Reply mismatch: %q, expected %q", r, expected)
+		}
+	}
+	expect(c.do(t, "PING"), "PONG")
+	expect(c.do(t, "SET", "k1", "v1"), "OK")
+	expect(c.do(t, "GET", "k1"), []byte("v1"))
+	expect(c.do(t, "GET", "missing"), []byte(nil))
+	expect(c.do(t, "SET", "empty", ""), "OK")
+	expect(c.do(t, "GET", "empty"), []byte(""))
+	expect(c.do(t, "EXISTS", "k1", "empty", "missing"), int64(2))
+	expect(c.do(t, "DEL", "k1", "missing"), int64(1))
+	expect(c.do(t, "GET", "k1"), []byte(nil))
+
+	expect(c.do(t, "MSET", "a", "1", "b", "2"), "OK")
+	expect(c.do(t, "MGET", "a", "missing", "b"), []interface{}{[]byte("1"), []byte(nil), []byte("2")})
+
+	expect(c.do(t, "INCRBY", "a", "10"), int64(11))
+	expect(c.do(t, "INCR", "counter"), int64(1))
+	expect(c.do(t, "DECRBY", "counter", "5"), int64(-4))
+	if _, ok := c.do(t, "INCR", "empty").(error); !ok {
+		t.Fatal("INCR of a non-integer accepted")
+	}
+
+	//Expiration
+	expect(c.do(t, "SET", "ttl", "v", "PX", "500"), "OK")
+	expect(c.do(t, "INCR", "ttl2"), int64(1))
+	expect(c.do(t, "SET", "ttl2", "5", "EX", "1"), "OK")
+	expect(c.do(t, "INCR", "ttl2"), int64(6))
+	expect(c.do(t, "GET", "ttl"), []byte("v"))
+	time.Sleep(1200 * time.Millisecond)
+	expect(c.do(t, "GET", "ttl"), []byte(nil))
+	expect(c.do(t, "GET", "ttl2"), []byte(nil))
+	expect(c.do(t, "EXISTS", "ttl"), int64(0))
+	expect(c.do(t, "DEL", "ttl"), int64(0))
+
+	//SCAN iterates every chunk, each call reads up to COUNT pairs
+	n := 50
+	for i := 0; i < n; i++ {
+		expect(c.do(t, "SET", fmt.Sprint("scan:", i), "v"), "OK")
+	}
+	found := make(map[string]bool)
+	cursor := "0"
+	for {
+		r, ok := c.do(t, "SCAN", cursor, "MATCH", "scan:*", "COUNT", "5").([]interface{})
+		if !ok || len(r) != 2 {
+			t.Fatal("Invalid SCAN reply:", r)
+		}
+		if len(r[1].([]interface{})) > 5 {
+			t.Fatal("SCAN returned more keys than COUNT:", len(r[1].([]interface{})))
+		}
+		for _, k := range r[1].([]interface{}) {
+			found[string(k.([]byte))] = true
+		}
+		cursor = string(r[0].([]byte))
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(found) != n {
+		t.Fatal("SCAN mismatch:", len(found))
+	}
+	for k := range found {
+		if !strings.HasPrefix(k, "scan:") {
+			t.Fatal("SCAN returned a non-matching key:", k)
+		}
+	}
+
+	//Errors keep the connection open
+	if _, ok := c.do(t, "FOO").(error); !ok {
+		t.Fatal("Unknown command accepted")
+	}
+	if _, ok := c.do(t, "GET").(error); !ok {
+		t.Fatal("Wrong number of arguments accepted")
+	}
+	if _, ok := c.do(t, "SET", "k", "v", "EX", "0").(error); !ok {
+		t.Fatal("Invalid expire time accepted")
+	}
+	//Expiration times that overflow are rejected
+	for _, option := range [][]string{{"EX", "9223372036"}, {"PX", "9223372036854775"}, {"PX", "9223372036854775807"}} {
+		if _, ok := c.do(t, "SET", "k", "v", option[0], option[1]).(error); !ok {
+			t.Fatal("Overflowing expire time accepted:", option)
+		}
+	}
+	expect(c.do(t, "SET", "long", "v", "EX", "3153600000"), "OK")
+	expect(c.do(t, "GET", "long"), []byte("v"))
+	//Inline commands and pipelining
+	expect(c.doRaw(t, "SET inline value\r\nGET inline\r\n"), "OK")
+	expect(c.reply(t), []byte("value"))
+	expect(c.do(t, "QUIT"), "OK")
+}
+
+//memcacheExchange sends a raw request to a memcached listener and reads n reply lines
+func memcacheExchange(t *testing.T, conn net.Conn, r *bufio.Reader, req string, n int) string {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	reply := ""
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal("Reply error:", reply, err)
+		}
+		reply += line
+	}
+	return reply
+}
+
+//memcacheRequest returns a binary protocol request
+func memcacheRequest(opcode byte, cas uint64, extras, key, value []byte) []byte {
+	h := make([]byte, 24)
+	h[0] = 0x80
+	h[1] = opcode
+	binary.BigEndian.PutUint16(h[2:], uint16(len(key)))
+	h[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(h[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(h[12:], 0xCAFE)
+	binary.BigEndian.PutUint64(h[16:], cas)
+	return append(append(append(h, extras...), key...), value...)
+}
+
+//memcacheBinary sends a binary protocol request and returns the response status, cas, extras and value
+func memcacheBinary(t *testing.T, conn net.Conn, r *bufio.Reader, opcode byte, cas uint64, extras, key, value []byte) (uint16, uint64, []byte, []byte) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(memcacheRequest(opcode, cas, extras, key, value)); err != nil {
+		t.Fatal(err)
+	}
+	h := make([]byte, 24)
+	if _, err := io.ReadFull(r, h); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != 0x81 || h[1] != opcode || binary.BigEndian.Uint32(h[12:]) != 0xCAFE {
+		t.Fatal("Invalid response header:", h)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(h[8:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	extrasLen := int(h[4])
+	keyLen := int(binary.BigEndian.Uint16(h[2:]))
+	return binary.BigEndian.Uint16(h[6:]), binary.BigEndian.Uint64(h[16:]), body[:extrasLen], body[extrasLen+keyLen:]
+}
+
+func TestSingleMemcache(t *testing.T) {
+	serverArgs = []string{"-memcache-port", "10301"}
+	defer func() {
+		serverArgs = nil
+	}()
+	//Redundancy 1, cas, add, replace, incr and decr need a majority of the target redundancy
+	cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	defer cluster[0].kill()
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", localIP+":10301"); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	expect := func(req string, lines int, expected string) {
+		if reply := memcacheExchange(t, conn, r, req, lines); reply != expected {
+			t.Fatalf("Reply mismatch: %q, expected %q", reply, expected)
+		}
+	}
+
+	//Text protocol
+	expect("set k1 42 0 2\r\nv1\r\n", 1, "STORED\r\n")
+	expect("get k1 missing\r\n", 3, "VALUE k1 42 2\r\nv1\r\nEND\r\n")
+	expect("add k1 0 0 1\r\nx\r\n", 1, "NOT_STORED\r\n")
+	expect("add k2 0 0 1\r\nx\r\n", 1, "STORED\r\n")
+	expect("replace missing 0 0 1\r\nx\r\n", 1, "NOT_STORED\r\n")
+	expect("replace k2 7 0 1\r\ny\r\n", 1, "STORED\r\n")
+	expect("get k2\r\n", 3, "VALUE k2 7 1\r\ny\r\nEND\r\n")
+
+	//gets+cas
+	reply := memcacheExchange(t, conn, r, "gets k1\r\n", 3)
+	var key string
+	var flags, size int
+	var unique uint64
+	if _, err := fmt.Sscanf(reply, "VALUE %s %d %d %d", &key, &flags, &size, &unique); err != nil || unique == 0 {
+		t.Fatal("Invalid gets reply:", reply, err)
+	}
+	expect(fmt.Sprintf("cas k1 0 0 2 %d\r\nv2\r\n", unique+1), 1, "EXISTS\r\n")
+	expect(fmt.Sprintf("cas k1 0 0 2 %d\r\nv2\r\n", unique), 1, "STORED\r\n")
+	expect(fmt.Sprintf("cas k1 0 0 2 %d\r\nv3\r\n", unique), 1, "EXISTS\r\n")
+	expect("cas missing 0 0 2 1\r\nv3\r\n", 1, "NOT_FOUND\r\n")
+	expect("get k1\r\n", 3, "VALUE k1 0 2\r\nv2\r\nEND\r\n")
+
+	expect("delete k1\r\n", 1, "DELETED\r\n")
+	expect("delete k1\r\n", 1, "NOT_FOUND\r\n")
+	expect("get k1\r\n", 1, "END\r\n")
+
+	expect("incr counter 1\r\n", 1, "NOT_FOUND\r\n")
+	expect("set counter 0 0 2\r\n10\r\n", 1, "STORED\r\n")
+	expect("incr counter 5\r\n", 1, "15\r\n")
+	expect("decr counter 20\r\n", 1, "0\r\n")
+	expect("incr k2 1\r\n", 1, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+
+	//Expiration, noreply and pipelining
+	expect("set ttl 0 1 1 noreply\r\nv\r\nset expired 0 -1 1\r\nv\r\nget ttl expired\r\n", 4, "STORED\r\nVALUE ttl 0 1\r\nv\r\nEND\r\n")
+	time.Sleep(1200 * time.Millisecond)
+	expect("get ttl\r\n", 1, "END\r\n")
+	expect("add ttl 0 0 1\r\nw\r\n", 1, "STORED\r\n")
+	expect("foo\r\n", 1, "ERROR\r\n")
+	expect("version\r\n", 1, "VERSION treeless\r\n")
+
+	//Binary protocol
+	bconn, err := net.Dial("tcp", localIP+":10301")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bconn.Close()
+	br := bufio.NewReader(bconn)
+	setExtras := []byte{0, 0, 0, 9, 0, 0, 0, 0}
+	if st, _, _, _ := memcacheBinary(t, bconn, br, 0x01, 0, setExtras, []byte("b1"), []byte("bv1")); st != 0 {
+		t.Fatal("Binary set failed:", st)
+	}
+	st, cas, extras, value := memcacheBinary(t, bconn, br, 0x00, 0, nil, []byte("b1"), nil)
+	if st != 0 || cas == 0 || binary.BigEndian.Uint32(extras) != 9 || string(value) != "bv1" {
+		t.Fatal("Binary get mismatch:", st, cas, extras, string(value))
+	}
+	if st, _, _, _ := memcacheBinary(t, bconn, br, 0x00, 0, nil, []byte("missing"), nil); st != 1 {
+		t.Fatal("Binary get of a missing key:", st)
+	}
+	//Set with a cas unique
+	if st, _, _, _ := memcacheBinary(t, bconn, br, 0x01, cas+1, setExtras, []byte("b1"), []byte("bv2")); st != 2 {
+		t.Fatal("Binary cas with a wrong unique:", st)
+	}
+	//Storage responses return the new cas unique
+	st, cas, _, _ = memcacheBinary(t, bconn, br, 0x01, cas, setExtras, []byte("b1"), []byte("bv2"))
+	if st != 0 || cas == 0 {
+		t.Fatal("Binary cas failed:", st, cas)
+	}
+	if st, getCAS, _, _ := memcacheBinary(t, bconn, br, 0x00, 0, nil, []byte("b1"), nil); st != 0 || getCAS != cas {
+		t.Fatal("Binary cas unique mismatch:", st, getCAS, cas)
+	}
+	//The text protocol sees the same pairs
+	expect("get b1\r\n", 3, "VALUE b1 9 3\r\nbv2\r\nEND\r\n")
+	//Increment with an initial value
+	incrExtras := make([]byte, 20)
+	binary.BigEndian.PutUint64(incrExtras, 3)
+	binary.BigEndian.PutUint64(incrExtras[8:], 100)
+	for _, expected := range []uint64{100, 103} {
+		st, _, _, value := memcacheBinary(t, bconn, br, 0x05, 0, incrExtras, []byte("bcounter"), nil)
+		if st != 0 || len(value) != 8 || binary.BigEndian.Uint64(value) != expected {
+			t.Fatal("Binary increment mismatch:", st, value, expected)
+		}
+	}
+	//Delete with a cas unique
+	if st, _, _, _ := memcacheBinary(t, bconn, br, 0x04, cas+1, nil, []byte("b1"), nil); st != 2 {
+		t.Fatal("Binary delete with a wrong unique:", st)
+	}
+	if st, _, _, _ := memcacheBinary(t, bconn, br, 0x04, cas, nil, []byte("b1"), nil); st != 0 {
+		t.Fatal("Binary delete failed:", st)
+	}
+	if st, _, _, _ := memcacheBinary(t, bconn, br, 0x00, 0, nil, []byte("b1"), nil); st != 1 {
+		t.Fatal("Binary get of a deleted key:", st)
+	}
+	//Quiet requests (SetQ, GetQ of a missing key) don't reply, the first reply is the noop one
+	bconn.Write(memcacheRequest(0x11, 0, setExtras, []byte("bq"), []byte("quiet")))
+	bconn.Write(memcacheRequest(0x09, 0, nil, []byte("missing"), nil))
+	if st, _, _, _ := memcacheBinary(t, bconn, br, 0x0a, 0, nil, nil, nil); st != 0 {
+		t.Fatal("Binary noop failed:", st)
+	}
+	expect("get bq\r\n", 3, "VALUE bq 9 5\r\nquiet\r\nEND\r\n")
+	if st, _, _, _ := memcacheBinary(t, bconn, br, 0x33, 0, nil, nil, nil); st != 0x81 {
+		t.Fatal("Unknown binary command accepted:", st)
+	}
+}
+
+//httpDo runs an HTTP request and returns the response status, body and ETag
+func httpDo(t *testing.T, method, url string, body []byte, header ...string) (int, []byte, string) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, b, resp.Header.Get("ETag")
+}
+
+func TestSingleREST(t *testing.T) {
+	serverArgs = []string{"-http", localIP + ":10302"}
+	defer func() {
+		serverArgs = nil
+	}()
+	//Redundancy 1, conditional PUTs use CAS, it needs a majority of the target redundancy
+	addr := cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	defer cluster[0].kill()
+	base := "http://" + localIP + ":10302"
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", localIP+":10302"); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	if code, _, _ := httpDo(t, "PUT", base+"/kv/k1", []byte("v1")); code != http.StatusNoContent {
+		t.Fatal("PUT failed:", code)
+	}
+	code, body, tag := httpDo(t, "GET", base+"/kv/k1", nil)
+	if code != http.StatusOK || string(body) != "v1" || tag == "" {
+		t.Fatal("GET mismatch:", code, string(body), tag)
+	}
+	if code, _, _ := httpDo(t, "GET", base+"/kv/missing", nil); code != http.StatusNotFound {
+		t.Fatal("GET of a missing key:", code)
+	}
+	if code, _, _ := httpDo(t, "GET", base+"/kv/k1", nil, "If-None-Match", tag); code != http.StatusNotModified {
+		t.Fatal("GET If-None-Match:", code)
+	}
+	//The pairs are shared with the Go client
+	c, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v, _, _ := c.Get([]byte("k1")); string(v) != "v1" {
+		t.Fatal("Get mismatch:", string(v))
+	}
+
+	//Conditional PUTs
+	if code, _, _ := httpDo(t, "PUT", base+"/kv/k1", []byte("v2"), "If-Match", `"1"`); code != http.StatusPreconditionFailed {
+		t.Fatal("PUT with a wrong If-Match:", code)
+	}
+	//If-Match uses the strong comparison, weak ETags don't match
+	if code, _, _ := httpDo(t, "PUT", base+"/kv/k1", []byte("v2"), "If-Match", "W/"+tag); code != http.StatusPreconditionFailed {
+		t.Fatal("PUT with a weak If-Match:", code)
+	}
+	code, _, newTag := httpDo(t, "PUT", base+"/kv/k1", []byte("v2"), "If-Match", tag)
+	if code != http.StatusNoContent || newTag == "" || newTag == tag {
+		t.Fatal("PUT If-Match failed:", code, newTag)
+	}
+	//PUTs return the ETag of the new value
+	if _, _, getTag := httpDo(t, "GET", base+"/kv/k1", nil); getTag != newTag {
+		t.Fatal("ETag mismatch:", getTag, newTag)
+	}
+	if code, _, _ := httpDo(t, "PUT", base+"/kv/k1", []byte("v3"), "If-Match", tag); code != http.StatusPreconditionFailed {
+		t.Fatal("PUT with an old If-Match:", code)
+	}
+	if code, _, _ := httpDo(t, "PUT", base+"/kv/k1", []byte("v3"), "If-None-Match", "*"); code != http.StatusPreconditionFailed {
+		t.Fatal("PUT If-None-Match of an existing pair:", code)
+	}
+	if code, _, _ := httpDo(t, "PUT", base+"/kv/new", []byte("n"), "If-None-Match", "*"); code != http.StatusNoContent {
+		t.Fatal("PUT If-None-Match failed:", code)
+	}
+	if code, body, _ := httpDo(t, "GET", base+"/kv/k1", nil); code != http.StatusOK || string(body) != "v2" {
+		t.Fatal("GET mismatch:", code, string(body))
+	}
+
+	//Keys aren't cleaned
+	if code, _, _ := httpDo(t, "PUT", base+"/kv/a//b/./../c", []byte("dots")); code != http.StatusNoContent {
+		t.Fatal("PUT of a key with dots failed:", code)
+	}
+	if code, body, _ := httpDo(t, "GET", base+"/kv/a//b/./../c", nil); code != http.StatusOK || string(body) != "dots" {
+		t.Fatal("GET of a key with dots mismatch:", code, string(body))
+	}
+	if code, _, _ := httpDo(t, "GET", base+"/kv/a/c", nil); code != http.StatusNotFound {
+		t.Fatal("GET of the cleaned key:", code)
+	}
+	if code, body, _ := httpDo(t, "GET", base+"/kv/a%2F%2Fb%2F.%2F..%2Fc", nil); code != http.StatusOK || string(body) != "dots" {
+		t.Fatal("GET of an escaped key with dots mismatch:", code, string(body))
+	}
+	if code, _, _ := httpDo(t, "DELETE", base+"/kv/a//b/./../c", nil); code != http.StatusNoContent {
+		t.Fatal("DELETE of a key with dots failed:", code)
+	}
+
+	//DELETE
+	//A CAS can't write a deleted pair, conditional deletes are rejected
+	_, _, newTag = httpDo(t, "GET", base+"/kv/new", nil)
+	if code, _, _ := httpDo(t, "DELETE", base+"/kv/new", nil, "If-Match", newTag); code != http.StatusBadRequest {
+		t.Fatal("DELETE with If-Match:", code)
+	}
+	if code, _, _ := httpDo(t, "DELETE", base+"/kv/new", nil); code != http.StatusNoContent {
+		t.Fatal("DELETE failed:", code)
+	}
+	if code, _, _ := httpDo(t, "GET", base+"/kv/new", nil); code != http.StatusNotFound {
+		t.Fatal("GET of a deleted key:", code)
+	}
+
+	//Batches
+	code, _, _ = httpDo(t, "POST", base+"/batch/write",
+		[]byte(`{"set": [{"key": "b1", "value": "YQ=="}, {"key": "b2", "value": "Yg=="}], "del": ["k1"]}`))
+	if code != http.StatusNoContent {
+		t.Fatal("Batch write failed:", code)
+	}
+	code, body, _ = httpDo(t, "POST", base+"/batch/get", []byte(`{"keys": ["b1", "k1", "b2"]}`))
+	var pairs []struct {
+		Key   string
+		Value []byte
+		ETag  string
+	}
+	if err := json.Unmarshal(body, &pairs); code != http.StatusOK || err != nil || len(pairs) != 3 {
+		t.Fatal("Batch get failed:", code, string(body), err)
+	}
+	if string(pairs[0].Value) != "a" || pairs[0].ETag == "" || pairs[1].Value != nil || string(pairs[2].Value) != "b" {
+		t.Fatal("Batch get mismatch:", string(body))
+	}
+	//Atomic batches need colocated keys
+	code, _, _ = httpDo(t, "POST", base+"/batch/write", []byte(`{"set": [{"key": "{t}x1", "value": ""}, {"key": "{t}x2", "value": ""}], "atomic": true}`))
+	if code != http.StatusNoContent {
+		t.Fatal("Atomic batch write failed:", code)
+	}
+	if code, _, _ := httpDo(t, "POST", base+"/batch/get", []byte(`{"keys": `)); code != http.StatusBadRequest {
+		t.Fatal("Invalid JSON accepted:", code)
+	}
+
+	//Scan pages
+	n := 50
+	for i := 0; i < n; i++ {
+		c.Set([]byte(fmt.Sprint("scan:", i, ":v")), []byte(fmt.Sprint(i)))
+	}
+	found := make(map[string]string)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		code, body, _ := httpDo(t, "GET", base+"/scan?prefix=scan:&limit=5&cursor="+cursor, nil)
+		var page struct {
+			Pairs []struct {
+				Key   string
+				Value []byte
+			}
+			Cursor string
+		}
+		if err := json.Unmarshal(body, &page); code != http.StatusOK || err != nil || len(page.Pairs) > 5 || pages > n {
+			t.Fatal("Scan failed:", code, string(body), err)
+		}
+		for _, p := range page.Pairs {
+			found[p.Key] = string(p.Value)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		cursor = page.Cursor
+	}
+	if len(found) != n {
+		t.Fatal("Scan mismatch:", len(found))
+	}
+	for k, v := range found {
+		if k != "scan:"+v+":v" {
+			t.Fatal("Scan mismatch:", k, v)
+		}
+	}
+	//Page limits are bounded
+	for i := 0; i < 1001; i++ {
+		c.Set([]byte(fmt.Sprint("limit:", i)), []byte{})
+	}
+	code, body, _ = httpDo(t, "GET", base+"/scan?prefix=limit:&limit=1000000000", nil)
+	var page struct {
+		Pairs  []json.RawMessage
+		Cursor string
+	}
+	if err := json.Unmarshal(body, &page); code != http.StatusOK || err != nil || len(page.Pairs) != 1000 || page.Cursor == "" {
+		t.Fatal("Scan limit not bounded:", code, err, len(page.Pairs))
+	}
+}
+
+func TestSingleGatewayAuth(t *testing.T) {
+	disable := enableTestAuth(t, "cluster-secret", "client-token")
+	defer disable()
+	serverArgs = append(serverArgs, "-resp-port", "10300", "-memcache-port", "10301", "-http", localIP+":10302")
+	cluster[0].create(testingNumChunks, 1, ultraverbose, false)
+	defer cluster[0].kill()
+
+	//RESP
+	c := dialRESP(t, localIP+":10300")
+	defer c.conn.Close()
+	if r, ok := c.do(t, "GET", "k1").(error); !ok || !strings.HasPrefix(r.Error(), "NOAUTH") {
+		t.Fatal("Unauthenticated RESP command didn't fail:", r)
+	}
+	if _, ok := c.do(t, "AUTH", "bad-token").(error); !ok {
+		t.Fatal("AUTH with a bad token succeeded")
+	}
+	if r := c.do(t, "AUTH", "client-token"); r != "OK" {
+		t.Fatal("AUTH failed:", r)
+	}
+	if r := c.do(t, "SET", "k1", "v1"); r != "OK" {
+		t.Fatal("Authenticated SET failed:", r)
+	}
+	//Big commands are rejected before the authentication, the connection is closed
+	for _, req := range []string{"*4\r\n", "*2\r\n$3\r\nSET\r\n$1000000\r\n"} {
+		big := dialRESP(t, localIP+":10300")
+		r, ok := big.doRaw(t, req).(error)
+		big.conn.Close()
+		if !ok || !strings.Contains(r.Error(), "Protocol error") {
+			t.Fatal("Big unauthenticated command accepted:", r)
+		}
+	}
+
+	//memcached
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", localIP+":10301"); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if st, _, _, _ := memcacheBinary(t, conn, r, 0x00, 0, nil, []byte("k1"), nil); st != 0x20 {
+		t.Fatal("Unauthenticated get didn't fail:", st)
+	}
+	if st, _, _, _ := memcacheBinary(t, conn, r, 0x21, 0, nil, []byte("PLAIN"), []byte("\x00user\x00bad-token")); st != 0x20 {
+		t.Fatal("SASL with a bad token succeeded:", st)
+	}
+	if st, _, _, _ := memcacheBinary(t, conn, r, 0x21, 0, nil, []byte("PLAIN"), []byte("\x00user\x00client-token")); st != 0 {
+		t.Fatal("SASL failed:", st)
+	}
+	if st, _, _, _ := memcacheBinary(t, conn, r, 0x00, 0, nil, []byte("missing"), nil); st != 1 {
+		t.Fatal("Authenticated get failed:", st)
+	}
+	//Requests with a value are closed before the authentication, the header is enough to reject them
+	big, err := net.Dial("tcp", localIP+":10301")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer big.Close()
+	header := memcacheRequest(0x01, 0, make([]byte, 8), []byte("big"), nil)
+	binary.BigEndian.PutUint32(header[8:], 8+3+1024*1024)
+	big.Write(header[:24])
+	big.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := big.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Unauthenticated request with a big value accepted:", err)
+	}
+
+	//HTTP
+	base := "http://" + localIP + ":10302"
+	if code, _, _ := httpDo(t, "GET", base+"/kv/k1", nil); code != http.StatusUnauthorized {
+		t.Fatal("Unauthenticated GET didn't fail:", code)
+	}
+	if code, _, _ := httpDo(t, "GET", base+"/kv/k1", nil, "Authorization", "Bearer bad-token"); code != http.StatusUnauthorized {
+		t.Fatal("GET with a bad token didn't fail:", code)
+	}
+	if code, _, _ := httpDo(t, "PUT", base+"/kv/k2", []byte("v2"), "Authorization", "Bearer client-token"); code != http.StatusNoContent {
+		t.Fatal("Authenticated PUT failed:", code)
+	}
+}
+
+func TestSingleUnixSocket(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "treeless-test.sock")
+	serverArgs = []string{"-unixsocket", path}
+	defer func() {
+		serverArgs = nil
+	}()
+	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
+	defer cluster[0].kill()
+	if _, err := client.Connect(com.UnixScheme + path + ".missing"); err == nil {
+		t.Fatal("Connected to a missing socket")
+	}
+	c, err := client.Connect(com.UnixScheme + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//Pairs written through the socket are read over TCP
+	tcp, err := client.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	for i := 0; i < 100; i++ {
+		if _, err := c.Set([]byte(fmt.Sprint("unix", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if v, _, _ := tcp.Get([]byte(fmt.Sprint("unix", i))); string(v) != fmt.Sprint(i) {
+			t.Fatal("Get mismatch:", i, string(v))
+		}
+		if v, _, _ := c.Get([]byte(fmt.Sprint("unix", i))); string(v) != fmt.Sprint(i) {
+			t.Fatal("Get mismatch:", i, string(v))
+		}
+	}
+	found := 0
+	if err := c.Scan([]byte("unix"), func(key, value []byte, lastTime time.Time) bool {
+		found++
+		return true
+	}); err != nil || found != 100 {
+		t.Fatal("Scan failed:", err, found)
+	}
+	//Unix connections don't use TLS, TCP ones can't be created with an invalid configuration
+	com.SetTLS(nil, &tls.Config{ServerName: "invalid"})
+	defer com.SetTLS(nil, nil)
+	if _, err := client.Connect(addr); err == nil {
+		t.Fatal("TCP connection created")
+	}
+	c2, err := client.Connect(com.UnixScheme + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if v, _, _ := c2.Get([]byte("unix1")); string(v) != "1" {
+		t.Fatal("Get through the Unix socket failed:", string(v))
+	}
+	if _, err := c2.Set([]byte("unix1"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSingleDefrag(t *testing.T) {
 	addr := cluster[0].create(testingNumChunks, 2, ultraverbose, false)
 	c, err := client.Connect(addr)
@@ -2,10 +2,20 @@ package test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"net"
 	"time"
 	"github.com/dv343/treeless/client"
+	"github.com/dv343/treeless/hashing"
 )
 
 type capability int
@@ -56,6 +66,10 @@ func randKVOpGenerator(minKeySize, maxKeySize, maxValueSize, seed, mult, offset
 		binary.LittleEndian.PutUint32(base, uint32(r.Int31())*uint32(mult)+uint32(offset))
 		binary.LittleEndian.PutUint32(base2, uint32(r.Int31())*uint32(mult)+uint32(offset))
 		key := bytes.Repeat([]byte(base), opKeySize)[0:opKeySize]
+		if hashing.HasKeyspacePrefix(key) {
+			//The keyspace prefix is reserved
+			key[0] = 0
+		}
 		value := bytes.Repeat([]byte(base2), opValueSize)[0:opValueSize]
 		op = 0
 		if r.Float32() > 0.5 {
@@ -64,3 +78,58 @@ func randKVOpGenerator(minKeySize, maxKeySize, maxValueSize, seed, mult, offset
 		return op, key, value
 	}
 }
+
+//writeTestCerts writes a CA and a certificate signed by it for localIP, valid for servers and clients
+//It returns the file names of the certificate, its key and the CA
+func writeTestCerts(dir string) (certFile, keyFile, caFile string, err error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "treeless test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: localIP},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP(localIP)},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	certFile, keyFile, caFile = dir+"/cert.pem", dir+"/key.pem", dir+"/ca.pem"
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		caFile:   {Type: "CERTIFICATE", Bytes: caDER},
+	}
+	for name, block := range files {
+		if err = ioutil.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+			return
+		}
+	}
+	return
+}
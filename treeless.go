@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -11,9 +12,14 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"time"
+	"github.com/dv343/treeless/client"
 	"github.com/dv343/treeless/com"
+	"github.com/dv343/treeless/com/protocol"
 	"github.com/dv343/treeless/dist/heartbeat"
 	"github.com/dv343/treeless/dist/servergroup"
+	"github.com/dv343/treeless/gateway/memcache"
+	"github.com/dv343/treeless/gateway/resp"
+	"github.com/dv343/treeless/gateway/rest"
 	"github.com/dv343/treeless/server"
 )
 import (
@@ -56,8 +62,37 @@ func main() {
 	localIP := flag.String("localip", com.GetLocalIP(),
 		"Set the local IP, Treeless will use a non loopback IP if the flag is missing")
 	logToFile := flag.String("logtofile", "", "Set an output file for logging")
+	ordered := flag.Bool("ordered", false, "Maintain an ordered index on each chunk of the new DB server group, needed by range queries")
+	maxSkew := flag.Duration("maxskew", server.MaxClockSkew, "Reject writes with timestamps further ahead of the server clock")
+	tlsCert := flag.String("tlscert", "", "TLS certificate file (PEM), enables TLS on every TCP connection, use with -tlskey")
+	tlsKey := flag.String("tlskey", "", "TLS private key file (PEM)")
+	tlsCA := flag.String("tlsca", "", "CA bundle file (PEM) used to verify TLS certificates, the system CAs are used if the flag is missing")
+	tlsMutual := flag.Bool("tlsmutual", false, "Require and verify client TLS certificates, the -tlscert certificate is used as client certificate")
+	clusterSecret := flag.String("clustersecret", "", "Secret shared by the server group nodes, enables authentication, it grants the cluster role")
+	tokensFile := flag.String("tokens", "", "File of authentication tokens, one \"<role> <token>\" pair per line (roles: client, cluster), enables authentication")
+	heartbeatKey := flag.String("heartbeatkey", "", "Key used to sign heartbeats (HMAC), unsigned heartbeats are dropped, clients should use the same key")
+	heartbeatNodeKey := flag.String("heartbeatnodekey", "", "Key used to sign the heartbeats of the server group nodes, only they can change the membership view, clients shouldn't know it")
+	compress := flag.Bool("compress", false, "Compress TCP traffic (values, transfers...) on connections with peers that enable it too")
+	compressValues := flag.Bool("compressvalues", false, "Compress the values stored by this node, it saves memory and disk space")
+	maxKeySize := flag.Int("maxkeysize", protocol.MaxKeySize, "Maximum key length, connections sending longer keys are closed")
+	maxValueSize := flag.Int("maxvaluesize", protocol.MaxValueSize, "Maximum value length, connections sending longer values are closed")
+	unixSocket := flag.String("unixsocket", "", "Also accept connections on this Unix domain socket path, clients on the same host can connect to unix://<path>")
+	respPort := flag.Int("resp-port", 0, "Port of a Redis compatible (RESP) listener backed by the server group, 0 disables it")
+	memcachePort := flag.Int("memcache-port", 0, "Port of a memcached compatible listener (text and binary protocols) backed by the server group, 0 disables it")
+	httpAddr := flag.String("http", "", "Address ([ip]:port) of an HTTP/JSON REST listener backed by the server group, e.g. :8080")
+	hbDefaults := heartbeat.DefaultConfig()
+	phiSuspect := flag.Float64("phisuspect", hbDefaults.PhiSuspectThreshold, "Failure detector phi above which a server is suspected")
+	phiDead := flag.Float64("phidead", hbDefaults.PhiDeadThreshold, "Failure detector phi above which a server is declared dead")
+	phiPause := flag.Duration("phipause", hbDefaults.PhiAcceptablePause, "Pause (GC, packet loss...) tolerated by the failure detector on top of the expected heartbeat interval")
 	flag.Parse()
 
+	server.MaxClockSkew = *maxSkew
+	server.CompressValues = *compressValues
+	com.SetCompression(*compress)
+	com.SetUnixSocket(*unixSocket)
+	protocol.MaxKeySize = *maxKeySize
+	protocol.MaxValueSize = *maxValueSize
+
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.SetPrefix(*localIP + ":" + fmt.Sprint(*port) + " ")
 
@@ -90,6 +125,42 @@ func main() {
 		}()
 	}
 
+	if *tlsCert != "" || *tlsKey != "" {
+		if err := com.LoadTLS(*tlsCert, *tlsKey, *tlsCA, *tlsMutual); err != nil {
+			fmt.Println("TLS configuration error:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *heartbeatKey != "" && *heartbeatNodeKey == "" {
+		fmt.Println("Heartbeat key error: -heartbeatkey needs -heartbeatnodekey, clients know the heartbeat key and could forge the membership gossip")
+		os.Exit(1)
+	}
+	com.SetHeartbeatKey(*heartbeatKey)
+	com.SetHeartbeatNodeKey(*heartbeatNodeKey)
+	if *clusterSecret != "" {
+		server.SetClusterSecret(*clusterSecret)
+	}
+	if *tokensFile != "" {
+		if err := server.LoadTokens(*tokensFile); err != nil {
+			fmt.Println("Tokens file error:", err)
+			os.Exit(1)
+		}
+	}
+	if server.AuthenticationEnabled() && server.NodeToken() == "" {
+		fmt.Println("Authentication error: nodes need a cluster token, use -clustersecret or add a \"cluster <token>\" line to the tokens file")
+		os.Exit(1)
+	}
+
+	if *phiSuspect <= 0 || *phiDead < *phiSuspect || *phiPause < 0 {
+		fmt.Println("Failure detector error: -phisuspect should be positive, -phidead should not be lower than -phisuspect and -phipause should not be negative")
+		os.Exit(1)
+	}
+	hbConfig := hbDefaults
+	hbConfig.PhiSuspectThreshold = *phiSuspect
+	hbConfig.PhiDeadThreshold = *phiDead
+	hbConfig.PhiAcceptablePause = *phiPause
+
 	var s *server.DBServer
 	if *monitor != "" {
 		sg, err := servergroup.Assoc(*monitor, "")
@@ -98,7 +169,7 @@ func main() {
 			return
 		}
 		//Start heartbeat listener
-		hb := heartbeat.Start(sg)
+		hb := heartbeat.Start(sg, &hbConfig)
 		go func() {
 			for {
 				fmt.Println("\033[H\033[2J" + sg.String())
@@ -111,14 +182,62 @@ func main() {
 		hb.Stop()
 		return
 	} else if *create {
-		s = server.Create(*localIP, *port, *dbpath, uint64(*size), *open, *chunks, *redundancy)
+		//Heartbeat responses list every chunk of the server
+		if *chunks <= 0 || *chunks > protocol.MaxHeartbeatChunks {
+			fmt.Println("Chunks error: the number of chunks should be in the range [1, " + fmt.Sprint(protocol.MaxHeartbeatChunks) + "]")
+			os.Exit(1)
+		}
+		s = server.Create(*localIP, *port, *dbpath, uint64(*size), *open, *chunks, *redundancy, *ordered, &hbConfig)
 	} else if *assoc != "" {
-		s = server.Assoc(*localIP, *port, *dbpath, uint64(*size), *open, *assoc)
+		s = server.Assoc(*localIP, *port, *dbpath, uint64(*size), *open, *assoc, &hbConfig)
 	} else {
 		flag.Usage()
 		fmt.Println("No operations passed. Use one of these: -create, -assoc -monitor.")
 		os.Exit(1)
 	}
+	//Gateways use a client of the local node
+	var rc *client.DBClient
+	var rs *resp.Server
+	var ms *memcache.Server
+	var hs *rest.Server
+	if *respPort != 0 || *memcachePort != 0 || *httpAddr != "" {
+		addr := *localIP + ":" + fmt.Sprint(*port)
+		if *unixSocket != "" {
+			addr = com.UnixScheme + *unixSocket
+		}
+		//Gateway users authenticate with the server tokens, the gateway client gets the client role only
+		var auth func(token []byte) error
+		var token string
+		var err error
+		if server.AuthenticationEnabled() {
+			auth = func(t []byte) error {
+				_, err := server.Authenticate(t)
+				return err
+			}
+			token = server.RoleToken(protocol.RoleClient)
+			if token == "" {
+				err = errors.New("Authentication is enabled, gateways need a \"client <token>\" line in the tokens file")
+			}
+		}
+		if err == nil {
+			rc, err = client.ConnectWithConfig(addr, token, &hbConfig)
+		}
+		if err == nil && *respPort != 0 {
+			rs, err = resp.Start(*localIP+":"+fmt.Sprint(*respPort), rc, auth)
+		}
+		if err == nil && *memcachePort != 0 {
+			ms, err = memcache.Start(*localIP+":"+fmt.Sprint(*memcachePort), rc, auth)
+		}
+		if err == nil && *httpAddr != "" {
+			hs, err = rest.Start(*httpAddr, rc, auth)
+		}
+		if err != nil {
+			fmt.Println("Gateway error:", err)
+			s.Stop()
+			os.Exit(1)
+		}
+		log.Println("Gateways started, RESP port:", *respPort, "memcached port:", *memcachePort, "HTTP address:", *httpAddr)
+	}
 	//Wait for an interrupt signal
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -131,6 +250,18 @@ func main() {
 		fmt.Println("View the pprof graph with:")
 		fmt.Println("go tool pprof --png treeless cpu.prof > a.png")
 	}
+	if rs != nil {
+		rs.Stop()
+	}
+	if ms != nil {
+		ms.Stop()
+	}
+	if hs != nil {
+		hs.Stop()
+	}
+	if rc != nil {
+		rc.Close()
+	}
 	s.Stop()
 	log.Println("Server stopped")
 }
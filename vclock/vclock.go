@@ -0,0 +1,256 @@
+/*
+Package vclock provides version vectors and multi-value (sibling) records.
+
+Multi-value records are an alternative to the last writer wins policy, concurrent writes
+are not discarded, they are kept as siblings until a write that descends from all of them
+resolves the conflict. They are only stored on keyspaces with the siblings conflict policy.
+
+A multi-value record is a regular value with the MultiValueFlag set on its 8 byte timestamp header.
+The rest of the timestamp header stores the newest sibling timestamp.
+
+Binary structure of a multi-value record (after the header):
+	2 bytes:	number of siblings
+	Each sibling:
+		2 bytes:	number of version vector entries
+		16 bytes per entry:	actor ID (8 bytes) and counter (8 bytes)
+		8 bytes:	timestamp
+		4 bytes:	value length
+		N bytes:	value
+Siblings and version vector entries are sorted, replicas storing the same siblings store the same bytes.
+*/
+package vclock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+//MultiValueFlag is set on the timestamp header of multi-value records
+const MultiValueFlag = 1 << 63
+
+//VersionVector stores a counter for each actor that has modified a value
+type VersionVector map[uint64]uint64
+
+//Sibling is one of the concurrent versions of a value
+type Sibling struct {
+	Version   VersionVector
+	Timestamp uint64
+	Value     []byte
+}
+
+//Increment increments the counter of actor
+func (v VersionVector) Increment(actor uint64) {
+	v[actor]++
+}
+
+//Merge sets each counter of v to the maximum of v and o counters
+func (v VersionVector) Merge(o VersionVector) {
+	for actor, n := range o {
+		if n > v[actor] {
+			v[actor] = n
+		}
+	}
+}
+
+//Descends returns true if v has seen every event seen by o
+func (v VersionVector) Descends(o VersionVector) bool {
+	for actor, n := range o {
+		if v[actor] < n {
+			return false
+		}
+	}
+	return true
+}
+
+//Dominates returns true if v descends from o and v is not equal to o
+func (v VersionVector) Dominates(o VersionVector) bool {
+	return v.Descends(o) && !o.Descends(v)
+}
+
+//Marshal serializes v, entries are sorted by actor ID
+func (v VersionVector) Marshal() []byte {
+	actors := make([]uint64, 0, len(v))
+	for actor := range v {
+		actors = append(actors, actor)
+	}
+	sort.Sort(uint64Slice(actors))
+	b := make([]byte, 2+16*len(actors))
+	binary.LittleEndian.PutUint16(b, uint16(len(actors)))
+	for i, actor := range actors {
+		binary.LittleEndian.PutUint64(b[2+16*i:], actor)
+		binary.LittleEndian.PutUint64(b[2+16*i+8:], v[actor])
+	}
+	return b
+}
+
+//UnmarshalVersionVector unserializes b, returning the version vector and the number of bytes read
+func UnmarshalVersionVector(b []byte) (VersionVector, int, error) {
+	v := make(VersionVector)
+	if len(b) == 0 {
+		//Empty contexts are valid, they are used on first writes
+		return v, 0, nil
+	}
+	if len(b) < 2 {
+		return nil, 0, errors.New("Bad version vector formatting")
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	if len(b) < 2+16*n {
+		return nil, 0, errors.New("Bad version vector formatting")
+	}
+	for i := 0; i < n; i++ {
+		v[binary.LittleEndian.Uint64(b[2+16*i:])] = binary.LittleEndian.Uint64(b[2+16*i+8:])
+	}
+	return v, 2 + 16*n, nil
+}
+
+//IsMultiValue returns true if record is a multi-value record
+func IsMultiValue(record []byte) bool {
+	return len(record) >= 8 && binary.LittleEndian.Uint64(record)&MultiValueFlag != 0
+}
+
+//Timestamp returns the timestamp stored on a record header, it works with both regular and multi-value records
+func Timestamp(record []byte) uint64 {
+	return binary.LittleEndian.Uint64(record) &^ MultiValueFlag
+}
+
+//Marshal serializes siblings as a multi-value record
+func Marshal(siblings []Sibling) []byte {
+	sortSiblings(siblings)
+	var buf bytes.Buffer
+	header := make([]byte, 10)
+	var newest uint64
+	for _, s := range siblings {
+		if s.Timestamp > newest {
+			newest = s.Timestamp
+		}
+	}
+	binary.LittleEndian.PutUint64(header, newest|MultiValueFlag)
+	binary.LittleEndian.PutUint16(header[8:], uint16(len(siblings)))
+	buf.Write(header)
+	for _, s := range siblings {
+		buf.Write(s.Version.Marshal())
+		b := make([]byte, 12)
+		binary.LittleEndian.PutUint64(b, s.Timestamp)
+		binary.LittleEndian.PutUint32(b[8:], uint32(len(s.Value)))
+		buf.Write(b)
+		buf.Write(s.Value)
+	}
+	return buf.Bytes()
+}
+
+//Unmarshal unserializes a record into its siblings
+//Regular records are returned as one sibling with an empty version vector
+func Unmarshal(record []byte) ([]Sibling, error) {
+	if len(record) < 8 {
+		return nil, errors.New("Bad record formatting: record len < 8")
+	}
+	if !IsMultiValue(record) {
+		return []Sibling{{Version: make(VersionVector), Timestamp: Timestamp(record), Value: record[8:]}}, nil
+	}
+	if len(record) < 10 {
+		return nil, errors.New("Bad record formatting: missing number of siblings")
+	}
+	n := int(binary.LittleEndian.Uint16(record[8:]))
+	siblings := make([]Sibling, 0, n)
+	b := record[10:]
+	for i := 0; i < n; i++ {
+		var s Sibling
+		var read int
+		var err error
+		s.Version, read, err = UnmarshalVersionVector(b)
+		if err != nil || read == 0 {
+			return nil, errors.New("Bad record formatting: bad version vector")
+		}
+		b = b[read:]
+		if len(b) < 12 {
+			return nil, errors.New("Bad record formatting: truncated sibling")
+		}
+		s.Timestamp = binary.LittleEndian.Uint64(b)
+		l := int(binary.LittleEndian.Uint32(b[8:]))
+		if len(b) < 12+l {
+			return nil, errors.New("Bad record formatting: truncated sibling value")
+		}
+		s.Value = b[12 : 12+l]
+		b = b[12+l:]
+		siblings = append(siblings, s)
+	}
+	return siblings, nil
+}
+
+//Merge returns the union of a and b without the siblings dominated by other siblings
+//Siblings with equal version vectors are deduplicated, keeping the newest one
+func Merge(a, b []Sibling) []Sibling {
+	all := append(append([]Sibling{}, a...), b...)
+	var merged []Sibling
+	for i, s := range all {
+		obsolete := false
+		for j, o := range all {
+			if i == j {
+				continue
+			}
+			if o.Version.Dominates(s.Version) ||
+				(o.Version.Descends(s.Version) && s.Version.Descends(o.Version) &&
+					(o.Timestamp > s.Timestamp || (o.Timestamp == s.Timestamp && j < i))) {
+				obsolete = true
+				break
+			}
+		}
+		if !obsolete {
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
+
+//MergeRecords merges two records, regular or multi-value
+//Two multi-value records are merged into a multi-value record.
+//A regular record replaces the siblings of a multi-value record if it is newer than all of them,
+//otherwise it is discarded. The newest of two regular records is kept.
+//The result doesn't depend on the order of a and b.
+func MergeRecords(a, b []byte) ([]byte, error) {
+	if len(a) < 8 || len(b) < 8 {
+		return nil, errors.New("Bad record formatting: record len < 8")
+	}
+	if !IsMultiValue(a) || !IsMultiValue(b) {
+		ta, tb := Timestamp(a), Timestamp(b)
+		if ta > tb || ta == tb && (IsMultiValue(a) || !IsMultiValue(b) && bytes.Compare(a, b) >= 0) {
+			return a, nil
+		}
+		return b, nil
+	}
+	sa, err := Unmarshal(a)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(Merge(sa, sb)), nil
+}
+
+//Context returns the causal context of siblings, a version vector that descends from all of them
+func Context(siblings []Sibling) VersionVector {
+	v := make(VersionVector)
+	for _, s := range siblings {
+		v.Merge(s.Version)
+	}
+	return v
+}
+
+func sortSiblings(siblings []Sibling) {
+	sort.Slice(siblings, func(i, j int) bool {
+		if siblings[i].Timestamp != siblings[j].Timestamp {
+			return siblings[i].Timestamp < siblings[j].Timestamp
+		}
+		return bytes.Compare(siblings[i].Value, siblings[j].Value) < 0
+	})
+}
+
+type uint64Slice []uint64
+
+func (p uint64Slice) Len() int           { return len(p) }
+func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }